@@ -3,14 +3,19 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/enochcodes/orchestra/core/internal/handler"
 	"github.com/enochcodes/orchestra/core/internal/config"
 	"github.com/enochcodes/orchestra/core/internal/store"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
 	"github.com/hibiken/asynq"
 )
 
 func main() {
+	// Error messages quoted in log messages may carry secrets
+	log.SetOutput(redact.Writer(os.Stderr))
+
 	// Load configuration
 	cfg, err := config.Load()
 	if err != nil {
@@ -38,8 +43,14 @@ func main() {
 	defer asynqClient.Close()
 	log.Println("Asynq client initialized")
 
+	// Open the store compacted deployment logs are offloaded to, if any
+	logStore, err := cfg.LogArchiveStore()
+	if err != nil {
+		log.Fatalf("Failed to open log archive store: %v", err)
+	}
+
 	// Setup Fiber router
-	app := handler.SetupRouter(db, asynqClient, cfg.EncryptionKey, cfg.JWTSecret, cfg.SkipAuth)
+	app := handler.SetupRouter(db, asynqClient, logStore, cfg.EncryptionKey, cfg.JWTSecret, cfg.SkipAuth, cfg.ExecRecordTranscripts)
 
 	// Start server
 	addr := fmt.Sprintf(":%s", cfg.ServerPort)
@@ -2,14 +2,21 @@ package main
 
 import (
 	"log"
+	"os"
+	"time"
 
 	"github.com/enochcodes/orchestra/core/internal/config"
+	"github.com/enochcodes/orchestra/core/internal/deploylog"
 	"github.com/enochcodes/orchestra/core/internal/store"
 	tasks "github.com/enochcodes/orchestra/core/internal/engine"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
 	"github.com/hibiken/asynq"
 )
 
 func main() {
+	// Task output quoted in log messages may carry secrets
+	log.SetOutput(redact.Writer(os.Stderr))
+
 	cfg, err := config.Load()
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
@@ -21,12 +28,18 @@ func main() {
 	}
 	log.Println("Worker: Database connected")
 
+	redisOpt := asynq.RedisClientOpt{
+		Addr:     cfg.RedisAddr,
+		Password: cfg.RedisPassword,
+		DB:       cfg.RedisDB,
+	}
+
+	// Client for tasks that enqueue follow-up work
+	client := asynq.NewClient(redisOpt)
+	defer client.Close()
+
 	srv := asynq.NewServer(
-		asynq.RedisClientOpt{
-			Addr:     cfg.RedisAddr,
-			Password: cfg.RedisPassword,
-			DB:       cfg.RedisDB,
-		},
+		redisOpt,
 		asynq.Config{
 			Concurrency: 10,
 			Queues: map[string]int{
@@ -65,6 +78,8 @@ func main() {
 	appHandler := &tasks.AppTaskHandler{
 		DB:            db,
 		EncryptionKey: cfg.EncryptionKey,
+		AsynqClient:   client,
+		StorageClass:  cfg.K8sStorageClass,
 	}
 
 	// Nginx provisioning
@@ -77,9 +92,26 @@ func main() {
 	envHandler := &tasks.EnvTaskHandler{
 		DB:            db,
 		EncryptionKey: cfg.EncryptionKey,
+		AsynqClient:   client,
+	}
+
+	// Deployment log retention and compaction
+	logStore, err := cfg.LogArchiveStore()
+	if err != nil {
+		log.Fatalf("Failed to open log archive store: %v", err)
+	}
+	logHandler := &tasks.LogTaskHandler{
+		DB:    db,
+		Store: logStore,
+		Policy: deploylog.Policy{
+			CompactAfter:    time.Duration(cfg.LogCompactAfterDays) * 24 * time.Hour,
+			RetainFor:       time.Duration(cfg.LogRetentionDays) * 24 * time.Hour,
+			KeepDeployments: cfg.LogKeepDeployments,
+		},
 	}
 
 	mux := asynq.NewServeMux()
+	mux.Use(tasks.RedactErrors)
 
 	// SSH
 	mux.HandleFunc(tasks.TypePreflightCheck, sshHandler.HandlePreflightCheck)
@@ -98,15 +130,34 @@ func main() {
 
 	// Application
 	mux.HandleFunc(tasks.TypeDeployApplication, appHandler.HandleDeployAppTask)
+	mux.HandleFunc(tasks.TypeRestartApplication, appHandler.HandleRestartAppTask)
+	mux.HandleFunc(tasks.TypeRollbackDeployment, appHandler.HandleRollbackTask)
+	mux.HandleFunc(tasks.TypeTeardownApplication, appHandler.HandleTeardownAppTask)
+	mux.HandleFunc(tasks.TypeAppLifecycle, appHandler.HandleAppLifecycleTask)
+	mux.HandleFunc(tasks.TypeAppCommand, appHandler.HandleAppCommandTask)
 
 	// Nginx
 	mux.HandleFunc(tasks.TypeNginxProvision, nginxHandler.HandleNginxProvision)
 
 	// Environment
 	mux.HandleFunc(tasks.TypePushEnv, envHandler.HandlePushEnv)
+	mux.HandleFunc(tasks.TypeVerifyEnv, envHandler.HandleVerifyEnv)
+
+	// Logs
+	mux.HandleFunc(tasks.TypeCompactLogs, logHandler.HandleCompactLogs)
+
+	// Periodic tasks
+	scheduler := asynq.NewScheduler(redisOpt, nil)
+	if _, err := scheduler.Register("@hourly", tasks.NewCompactLogsTask(), asynq.Unique(time.Hour)); err != nil {
+		log.Fatalf("Failed to schedule log compaction: %v", err)
+	}
+	if err := scheduler.Start(); err != nil {
+		log.Fatalf("Failed to start scheduler: %v", err)
+	}
+	defer scheduler.Shutdown()
 
 	log.Println("Orchestra Worker starting...")
-	log.Println("  Tasks: preflight, k3s, swarm, manual, deploy, nginx, env")
+	log.Println("  Tasks: preflight, k3s, swarm, manual, deploy, restart, rollback, lifecycle, teardown, command, nginx, env, env verify, logs")
 	log.Println("  Queues: provisioning (6), deployment (3), default (1)")
 	if err := srv.Run(mux); err != nil {
 		log.Fatalf("Worker failed: %v", err)
@@ -0,0 +1,152 @@
+package deploylog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/objstore"
+	"gorm.io/gorm"
+)
+
+// Policy configures compaction and retention of deployment logs.
+type Policy struct {
+	CompactAfter    time.Duration // compact logs of deployments older than this; 0 disables compaction
+	RetainFor       time.Duration // delete logs of deployments older than this; 0 keeps them forever
+	KeepDeployments int           // newest deployments per application whose logs are never compacted or deleted
+	BatchSize       int           // deployments handled per run and phase
+}
+
+// Result counts what a Compact run did.
+type Result struct {
+	Compacted int
+	Purged    int
+}
+
+// Compact deletes logs past retention, then compacts the logs of older
+// finished deployments into archives, offloaded to store when it is not
+// nil. A deployment that fails is logged and left for the next run.
+func Compact(ctx context.Context, db *gorm.DB, store objstore.Store, p Policy) (Result, error) {
+	var res Result
+	if p.BatchSize <= 0 {
+		p.BatchSize = 100
+	}
+
+	if p.RetainFor > 0 {
+		var deps []model.Deployment
+		err := candidates(db, time.Now().Add(-p.RetainFor), p).
+			Where(`(log_lines > 0 OR COALESCE(logs, '') <> '' OR EXISTS
+				(SELECT 1 FROM deployment_log_archives a WHERE a.deployment_id = deployments.id))`).
+			Find(&deps).Error
+		if err != nil {
+			return res, fmt.Errorf("find expired logs: %w", err)
+		}
+		for i := range deps {
+			if err := purge(ctx, db, store, &deps[i]); err != nil {
+				log.Printf("Log retention: deployment %d: %v", deps[i].ID, err)
+				continue
+			}
+			res.Purged++
+		}
+	}
+
+	if p.CompactAfter > 0 {
+		var deps []model.Deployment
+		err := candidates(db, time.Now().Add(-p.CompactAfter), p).
+			Where("(log_lines > 0 OR COALESCE(logs, '') <> '')").
+			Where("NOT EXISTS (SELECT 1 FROM deployment_log_archives a WHERE a.deployment_id = deployments.id)").
+			Find(&deps).Error
+		if err != nil {
+			return res, fmt.Errorf("find logs to compact: %w", err)
+		}
+		for i := range deps {
+			if err := compact(ctx, db, store, &deps[i]); err != nil {
+				log.Printf("Log compaction: deployment %d: %v", deps[i].ID, err)
+				continue
+			}
+			res.Compacted++
+		}
+	}
+	return res, nil
+}
+
+// candidates selects finished deployments created before cutoff, excluding
+// each application's newest p.KeepDeployments.
+func candidates(db *gorm.DB, cutoff time.Time, p Policy) *gorm.DB {
+	return db.Model(&model.Deployment{}).
+		Select("id", "application_id", "log_lines", "logs", "created_at").
+		Where("status NOT IN ? AND created_at < ? AND logs_purged_at IS NULL", model.DeploymentStatusesActive, cutoff).
+		Where(`id NOT IN (SELECT id FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY application_id ORDER BY id DESC) AS rn
+			FROM deployments WHERE deleted_at IS NULL) ranked WHERE rn <= ?)`, p.KeepDeployments).
+		Order("id").Limit(p.BatchSize)
+}
+
+// compact packs a deployment's lines into an archive and deletes them.
+func compact(ctx context.Context, db *gorm.DB, store objstore.Store, dep *model.Deployment) error {
+	var lines []model.DeploymentLogLine
+	if err := db.Where("deployment_id = ?", dep.ID).Order("seq").Find(&lines).Error; err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		lines = legacyLines(dep)
+	}
+	data, err := encodeArchive(lines)
+	if err != nil {
+		return err
+	}
+
+	archive := model.DeploymentLogArchive{
+		DeploymentID:  dep.ID,
+		ApplicationID: dep.ApplicationID,
+		Lines:         len(lines),
+		SizeBytes:     int64(len(data)),
+	}
+	if store != nil {
+		archive.Location = fmt.Sprintf("deployments/%d/%d.jsonl.gz", dep.ApplicationID, dep.ID)
+		if err := store.Put(ctx, archive.Location, data); err != nil {
+			return fmt.Errorf("offload log: %w", err)
+		}
+	} else {
+		archive.Data = data
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&archive).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("deployment_id = ?", dep.ID).Delete(&model.DeploymentLogLine{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(dep).Update("logs", "").Error
+	})
+}
+
+// purge deletes a deployment's log wherever it is kept.
+func purge(ctx context.Context, db *gorm.DB, store objstore.Store, dep *model.Deployment) error {
+	var archive model.DeploymentLogArchive
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("deployment_id = ?", dep.ID).Delete(&model.DeploymentLogLine{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Select("id", "location").Where("deployment_id = ?", dep.ID).Limit(1).Find(&archive).Error; err != nil {
+			return err
+		}
+		if archive.ID != 0 {
+			if err := tx.Delete(&archive).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(dep).Updates(map[string]interface{}{"logs": "", "logs_purged_at": time.Now()}).Error
+	})
+	if err != nil {
+		return err
+	}
+	if archive.Location != "" && store != nil {
+		if err := store.Delete(ctx, archive.Location); err != nil {
+			log.Printf("Log retention: deployment %d: delete %s: %v", dep.ID, archive.Location, err)
+		}
+	}
+	return nil
+}
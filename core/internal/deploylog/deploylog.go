@@ -0,0 +1,107 @@
+// Package deploylog stores deployment logs as line records, reads them back
+// page by page, searches them, and compacts and expires old ones.
+//
+// A deployment's lines live in deployment_log_lines until compaction packs
+// them into a single DeploymentLogArchive, kept in the database or offloaded
+// to an object store. Deployments made before line records existed keep
+// their log as text in Deployment.Logs; readers handle all three.
+package deploylog
+
+import (
+	"strings"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
+	"gorm.io/gorm"
+)
+
+// Entry is a line to append to a deployment's log.
+type Entry struct {
+	Time   time.Time // defaults to now
+	Stream model.LogStream
+	Text   string
+}
+
+// System returns entries for text written by Orchestra itself, one per line.
+func System(text string) []Entry {
+	now := time.Now()
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	entries := make([]Entry, len(lines))
+	for i, line := range lines {
+		entries[i] = Entry{Time: now, Stream: model.LogStreamSystem, Text: line}
+	}
+	return entries
+}
+
+// LevelOf infers a line's level from the conventional prefixes used by
+// Orchestra and most build tools.
+func LevelOf(text string) model.LogLevel {
+	t := strings.ToUpper(strings.TrimSpace(text))
+	switch {
+	case strings.HasPrefix(t, "ERROR"), strings.HasPrefix(t, "FATAL"):
+		return model.LogLevelError
+	case strings.HasPrefix(t, "WARN"):
+		return model.LogLevelWarn
+	default:
+		return model.LogLevelInfo
+	}
+}
+
+// levelsAtLeast returns level and the levels more severe than it.
+func levelsAtLeast(level model.LogLevel) []model.LogLevel {
+	switch level {
+	case model.LogLevelError:
+		return []model.LogLevel{model.LogLevelError}
+	case model.LogLevelWarn:
+		return []model.LogLevel{model.LogLevelWarn, model.LogLevelError}
+	default:
+		return []model.LogLevel{model.LogLevelInfo, model.LogLevelWarn, model.LogLevelError}
+	}
+}
+
+// Append writes entries as the deployment's next lines, tagged with step
+// (empty when no step is running). Sequence numbers are taken from the
+// deployment's line counter in one statement, so concurrent writers never
+// collide.
+func Append(db *gorm.DB, dep *model.Deployment, step model.DeploymentStepName, entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var last int
+	if err := db.Raw("UPDATE deployments SET log_lines = log_lines + ? WHERE id = ? RETURNING log_lines",
+		len(entries), dep.ID).Scan(&last).Error; err != nil {
+		return err
+	}
+	first := last - len(entries) + 1
+	rows := make([]model.DeploymentLogLine, len(entries))
+	for i, e := range entries {
+		if e.Time.IsZero() {
+			e.Time = time.Now()
+		}
+		if e.Stream == "" {
+			e.Stream = model.LogStreamSystem
+		}
+		rows[i] = model.DeploymentLogLine{
+			DeploymentID:  dep.ID,
+			ApplicationID: dep.ApplicationID,
+			Seq:           first + i,
+			Step:          step,
+			Stream:        e.Stream,
+			Level:         LevelOf(e.Text),
+			Text:          redact.String(e.Text),
+			Time:          e.Time,
+		}
+	}
+	return db.Create(&rows).Error
+}
+
+// Text joins lines into log text, one line per row.
+func Text(lines []model.DeploymentLogLine) string {
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(l.Text)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
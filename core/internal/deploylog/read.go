@@ -0,0 +1,189 @@
+package deploylog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/objstore"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
+	"gorm.io/gorm"
+)
+
+// Query selects a page of a deployment's log.
+type Query struct {
+	After  int // return lines with Seq greater than this
+	Limit  int
+	Step   model.DeploymentStepName // optional
+	Level  model.LogLevel           // optional; this level and above
+	Stream model.LogStream          // optional
+}
+
+func (q Query) match(l model.DeploymentLogLine) bool {
+	if l.Seq <= q.After {
+		return false
+	}
+	if q.Step != "" && l.Step != q.Step {
+		return false
+	}
+	if q.Stream != "" && l.Stream != q.Stream {
+		return false
+	}
+	if q.Level != "" {
+		for _, lvl := range levelsAtLeast(q.Level) {
+			if l.Level == lvl {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Read returns the lines of a deployment's log selected by q, in order, and
+// whether more matching lines follow. It reads archived and legacy logs as
+// well as live line records; store may be nil if nothing was offloaded.
+func Read(ctx context.Context, db *gorm.DB, store objstore.Store, depID uint, q Query) ([]model.DeploymentLogLine, bool, error) {
+	if q.Limit <= 0 {
+		q.Limit = 1000
+	}
+
+	var archive model.DeploymentLogArchive
+	err := db.Where("deployment_id = ?", depID).Limit(1).Find(&archive).Error
+	if err != nil {
+		return nil, false, err
+	}
+	if archive.ID != 0 {
+		lines, err := readArchive(ctx, store, &archive)
+		if err != nil {
+			return nil, false, err
+		}
+		return filter(lines, q)
+	}
+
+	tx := db.Where("deployment_id = ? AND seq > ?", depID, q.After)
+	if q.Step != "" {
+		tx = tx.Where("step = ?", q.Step)
+	}
+	if q.Stream != "" {
+		tx = tx.Where("stream = ?", q.Stream)
+	}
+	if q.Level != "" {
+		tx = tx.Where("level IN ?", levelsAtLeast(q.Level))
+	}
+	var lines []model.DeploymentLogLine
+	if err := tx.Order("seq").Limit(q.Limit + 1).Find(&lines).Error; err != nil {
+		return nil, false, err
+	}
+	if len(lines) > 0 {
+		more := len(lines) > q.Limit
+		if more {
+			lines = lines[:q.Limit]
+		}
+		return lines, more, nil
+	}
+
+	var dep model.Deployment
+	if err := db.Select("id", "application_id", "log_lines", "logs", "created_at").First(&dep, depID).Error; err != nil {
+		return nil, false, err
+	}
+	if dep.LogLines > 0 || dep.Logs == "" {
+		return nil, false, nil
+	}
+	return filter(legacyLines(&dep), q)
+}
+
+func filter(lines []model.DeploymentLogLine, q Query) ([]model.DeploymentLogLine, bool, error) {
+	var page []model.DeploymentLogLine
+	for _, l := range lines {
+		if !q.match(l) {
+			continue
+		}
+		if len(page) == q.Limit {
+			return page, true, nil
+		}
+		page = append(page, l)
+	}
+	return page, false, nil
+}
+
+// legacyLines splits a deployment's text log into line records.
+func legacyLines(dep *model.Deployment) []model.DeploymentLogLine {
+	text := strings.TrimRight(dep.Logs, "\n")
+	if text == "" {
+		return nil
+	}
+	split := strings.Split(text, "\n")
+	lines := make([]model.DeploymentLogLine, len(split))
+	for i, t := range split {
+		lines[i] = model.DeploymentLogLine{
+			DeploymentID:  dep.ID,
+			ApplicationID: dep.ApplicationID,
+			Seq:           i + 1,
+			Stream:        model.LogStreamSystem,
+			Level:         LevelOf(t),
+			Text:          redact.String(t),
+			Time:          dep.CreatedAt,
+		}
+	}
+	return lines
+}
+
+// encodeArchive packs lines as gzipped JSON, one record per line.
+func encodeArchive(lines []model.DeploymentLogLine) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, l := range lines {
+		if err := enc.Encode(l); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func readArchive(ctx context.Context, store objstore.Store, archive *model.DeploymentLogArchive) ([]model.DeploymentLogLine, error) {
+	data := archive.Data
+	if archive.Location != "" {
+		if store == nil {
+			return nil, fmt.Errorf("log of deployment %d is offloaded to %s but no log archive store is configured",
+				archive.DeploymentID, archive.Location)
+		}
+		var err error
+		if data, err = store.Get(ctx, archive.Location); err != nil {
+			if errors.Is(err, objstore.ErrNotFound) {
+				return nil, fmt.Errorf("log archive %s is missing from the store", archive.Location)
+			}
+			return nil, fmt.Errorf("fetch log archive: %w", err)
+		}
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("read log archive: %w", err)
+	}
+	defer zr.Close()
+	lines := make([]model.DeploymentLogLine, 0, archive.Lines)
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var l model.DeploymentLogLine
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			return nil, fmt.Errorf("read log archive: %w", err)
+		}
+		lines = append(lines, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read log archive: %w", err)
+	}
+	return lines, nil
+}
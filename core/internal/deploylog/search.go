@@ -0,0 +1,42 @@
+package deploylog
+
+import (
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"gorm.io/gorm"
+)
+
+// Match is a log line found by Search, with the version of its deployment.
+type Match struct {
+	model.DeploymentLogLine
+	Version string `json:"version"`
+}
+
+// SearchQuery narrows a Search.
+type SearchQuery struct {
+	Text   string // words to find, all of which must appear in the line
+	Before uint64 // return lines with ID below this, for paging; 0 for the newest
+	Limit  int
+	Level  model.LogLevel // optional; this level and above
+}
+
+// Search finds lines across an application's deployments that contain every
+// word of q.Text, newest first. Compacted logs are not searched.
+func Search(db *gorm.DB, appID uint, q SearchQuery) ([]Match, error) {
+	if q.Limit <= 0 {
+		q.Limit = 50
+	}
+	tx := db.Table("deployment_log_lines AS l").
+		Select("l.*, d.version").
+		Joins("JOIN deployments d ON d.id = l.deployment_id").
+		Where("l.application_id = ?", appID).
+		Where("to_tsvector('simple', l.text) @@ plainto_tsquery('simple', ?)", q.Text)
+	if q.Before > 0 {
+		tx = tx.Where("l.id < ?", q.Before)
+	}
+	if q.Level != "" {
+		tx = tx.Where("l.level IN ?", levelsAtLeast(q.Level))
+	}
+	var matches []Match
+	err := tx.Order("l.id DESC").Limit(q.Limit).Scan(&matches).Error
+	return matches, err
+}
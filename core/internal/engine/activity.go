@@ -0,0 +1,23 @@
+package tasks
+
+import (
+	"log"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
+	"gorm.io/gorm"
+)
+
+// logActivity records an activity entry from a background task. Tasks have no
+// acting user; failures are logged rather than failing the task.
+func logActivity(db *gorm.DB, activityType model.ActivityType, message, entity string, entityID uint) {
+	activity := model.Activity{
+		Type:     activityType,
+		Message:  redact.String(message),
+		Entity:   entity,
+		EntityID: entityID,
+	}
+	if err := db.Create(&activity).Error; err != nil {
+		log.Printf("Failed to record activity %s: %v", activityType, err)
+	}
+}
@@ -0,0 +1,343 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
+	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+)
+
+const (
+	TypeAppCommand = "app:command"
+)
+
+// Release-phase hooks and one-off commands run once, with sh -c, in a
+// throwaway container of the application's image that has its environment:
+// a `docker run --rm` on the cluster manager, or a Kubernetes Job.
+
+const (
+	jobPollInterval  = 2 * time.Second
+	jobScheduleGrace = time.Minute // time a Job's pod may take to start on top of its deadline
+	jobTTLSeconds    = 3600        // finished Jobs left for inspection are deleted by Kubernetes after this
+	maxCommandOutput = 256 << 10   // bytes of a one-off command's output kept
+)
+
+// ErrNotDeployed is returned by EnqueueAppCommand for an application with
+// no live deployment whose image the command could run in.
+var ErrNotDeployed = errors.New("application has no live deployment to run the command in")
+
+// runOnce runs command in a throwaway container of image with env. Output
+// lines go to onLine as they arrive, or for a Kubernetes Job once it has
+// finished. It returns the command's exit code; err reports that it could
+// not be run or did not finish within timeout. purpose and runID name the
+// container; runID must be unique among the app's runs of that purpose.
+// The container mounts volumes, except on Swarm: it runs on the manager and
+// the volumes live on the node the service is pinned to.
+func runOnce(ctx context.Context, client *sshpkg.Client, app *model.Application, image string, env *resolvedEnv,
+	volumes []model.AppVolume, purpose, runID, command string, timeout time.Duration, onLine func(sshpkg.Stream, string)) (int, error) {
+
+	name := sanitizeName(app.Name)
+	// Names must stay valid Kubernetes object names: at most 63 characters.
+	runName := fmt.Sprintf("%.36s-%s-%s", name, purpose, runID)
+	if app.Cluster.Type == model.ClusterTypeK8s {
+		return runK8sJob(ctx, client, app, name, runName, image, env, volumes, command, timeout, onLine)
+	}
+	if app.Cluster.Type == model.ClusterTypeDockerSwarm {
+		volumes = nil
+	}
+
+	var envFile dockerEnv
+	if len(env.Vars) > 0 {
+		// Unlike the app's own .env, this file has secrets too: a plain
+		// container cannot mount Swarm secrets. It is removed afterwards.
+		path := appDirFor(*app) + "/.env." + runName
+		defer client.ExecuteCommand(sshpkg.Cmd("rm", "-f", path, path+".sh").String())
+		var err error
+		if envFile, err = writeDockerEnv(client, path, env.Vars); err != nil {
+			return -1, err
+		}
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := sshpkg.Cmd("docker", "run", "--rm", "--name", runName, "--label", "orchestra.run="+name).
+		Arg(dockerResourceArgs(app.Resources)...).
+		Arg(dockerVolumeArgs(app, volumes)...).
+		Arg(envFile.args...).
+		Arg(image, "sh", "-c", command)
+	result, err := client.WithContext(runCtx).ExecuteCommandFollow(envFile.command(cmd), onLine)
+	if err != nil {
+		// Aborting the docker CLI leaves the container running.
+		client.ExecuteCommand(sshpkg.Shellf("docker rm -f %s >/dev/null 2>&1", runName))
+		if ctx.Err() == nil && runCtx.Err() != nil {
+			return -1, fmt.Errorf("timed out after %s", timeout)
+		}
+		return -1, err
+	}
+	return result.ExitCode, nil
+}
+
+// runK8sJob runs command as a Kubernetes Job in the application's namespace
+// and waits for it to finish. The Job loads env from a Secret of its own,
+// <job>-env, so that it neither changes nor depends on the app's.
+func runK8sJob(ctx context.Context, client *sshpkg.Client, app *model.Application, name, job, image string, env *resolvedEnv,
+	volumes []model.AppVolume, command string, timeout time.Duration, onLine func(sshpkg.Stream, string)) (int, error) {
+
+	envYaml := ""
+	if len(env.Vars) > 0 {
+		defer client.ExecuteCommand(sshpkg.Shellf("kubectl delete secret -n %s %s --ignore-not-found >/dev/null 2>&1",
+			app.Namespace, job+"-env"))
+		if err := applyK8sEnvSecret(client, job, app.Namespace, env.Vars); err != nil {
+			return -1, err
+		}
+		envYaml = fmt.Sprintf("        envFrom:\n        - secretRef:\n            name: %s-env\n", job)
+	}
+	// JSON strings are valid YAML, and quote the command whatever it holds.
+	quotedImage, _ := json.Marshal(image)
+	quotedCommand, _ := json.Marshal(command)
+	manifest := fmt.Sprintf(`apiVersion: batch/v1
+kind: Job
+metadata:
+  name: %s
+  namespace: %s
+  labels:
+    orchestra.app: %s
+spec:
+  backoffLimit: 0
+  activeDeadlineSeconds: %d
+  ttlSecondsAfterFinished: %d
+  template:
+    metadata:
+      labels:
+        orchestra.app: %s
+    spec:
+      restartPolicy: Never
+      containers:
+      - name: run
+        image: %s
+        command: ["sh", "-c", %s]
+%s%s%s`,
+		job, app.Namespace, name, int(timeout.Seconds()), jobTTLSeconds, name, quotedImage, quotedCommand,
+		envYaml, k8sResourcesYaml(app.Resources), k8sJobVolumesYaml(app, volumes))
+
+	result, err := client.ExecuteCommandWithInput("kubectl apply -f - 2>&1", []byte(manifest))
+	if err := commandError(result, err); err != nil {
+		return -1, fmt.Errorf("creating job failed: %v: %s", err, commandOutput(result))
+	}
+	defer client.ExecuteCommand(sshpkg.Shellf("kubectl delete job -n %s %s --ignore-not-found --wait=false >/dev/null 2>&1",
+		app.Namespace, job))
+
+	// Wait for the Job to succeed or fail; Kubernetes enforces the deadline.
+	deadline := time.Now().Add(timeout + jobScheduleGrace)
+	for {
+		result, err := client.ExecuteCommand(sshpkg.Shellf("kubectl get job -n %s %s -o %s 2>&1",
+			app.Namespace, job, "jsonpath={.status.succeeded} {.status.failed}"))
+		if err := commandError(result, err); err != nil {
+			return -1, fmt.Errorf("kubectl get job: %v: %s", err, commandOutput(result))
+		}
+		if counts := strings.Fields(result.Stdout); len(counts) > 0 && counts[0] != "0" {
+			break
+		}
+		if time.Now().After(deadline) {
+			return -1, fmt.Errorf("job did not finish within %s", timeout+jobScheduleGrace)
+		}
+		select {
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		case <-time.After(jobPollInterval):
+		}
+	}
+
+	client.ExecuteCommandFollow(sshpkg.Shellf("kubectl logs -n %s %s --tail=-1", app.Namespace, "job/"+job), onLine)
+	result, err = client.ExecuteCommand(sshpkg.Shellf("kubectl get pods -n %s -l %s -o %s 2>&1", app.Namespace, "job-name="+job,
+		"jsonpath={.items[0].status.containerStatuses[0].state.terminated.exitCode}"))
+	if err := commandError(result, err); err != nil {
+		return -1, fmt.Errorf("kubectl get pods: %v: %s", err, commandOutput(result))
+	}
+	var code int
+	if _, err := fmt.Sscan(result.Stdout, &code); err != nil {
+		// No exit code: the pod never ran, or was killed at the deadline.
+		return -1, fmt.Errorf("job failed without running to completion (deadline %s)", timeout)
+	}
+	return code, nil
+}
+
+// runHook runs one of the application's release-phase hooks as step of the
+// deployment, streaming its output into the deployment log. A hook that
+// exits non-zero fails the deployment, which is not retried.
+func (h *AppTaskHandler) runHook(ctx context.Context, client *sshpkg.Client, dep *model.Deployment, app *model.Application,
+	image string, env *resolvedEnv, step model.DeploymentStepName, command string) error {
+
+	label := strings.ReplaceAll(string(step), "_", "-")
+	if strings.TrimSpace(command) == "" {
+		h.skipStep(dep, step, fmt.Sprintf("No %s hook configured.", label))
+		return nil
+	}
+	h.beginStep(dep, step)
+	h.appendLog(dep, fmt.Sprintf("Running %s hook: %s", label, command))
+	s := h.newLogStream(dep)
+	runID := fmt.Sprintf("%d-%d", dep.ID, dep.Attempt)
+	code, err := runOnce(ctx, client, app, image, env, h.volumesIn(app.ID, model.AppVolumeReady), label, runID, command, app.Hooks.Timeout(), func(stream sshpkg.Stream, line string) {
+		s.line(model.LogStream(stream), "  "+line)
+	})
+	s.close()
+	if err != nil {
+		h.failDeployment(dep, app, fmt.Sprintf("The %s hook could not run: %v", label, err))
+		return fmt.Errorf("%s hook: %w", label, err)
+	}
+	if code != 0 {
+		msg := fmt.Sprintf("The %s hook exited with status %d.", label, code)
+		if step == model.StepPostDeploy {
+			msg += " The new version is already running."
+		}
+		h.failDeployment(dep, app, msg)
+		return fmt.Errorf("%s hook exited with status %d: %w", label, code, asynq.SkipRetry)
+	}
+	h.appendLog(dep, fmt.Sprintf("The %s hook succeeded.", label))
+	return nil
+}
+
+type AppCommandPayload struct {
+	RunID uint `json:"run_id"`
+}
+
+// NewAppCommandTask runs a one-off command recorded by EnqueueAppCommand.
+// Commands are not retried: running a command twice is rarely harmless.
+func NewAppCommandTask(runID uint) (*asynq.Task, error) {
+	payload, err := json.Marshal(AppCommandPayload{RunID: runID})
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TypeAppCommand, payload, asynq.Queue("default"), asynq.MaxRetry(0)), nil
+}
+
+// EnqueueAppCommand records a one-off run of command in the image of the
+// application's live deployment and queues it. timeoutSeconds of 0 means
+// the default.
+func EnqueueAppCommand(db *gorm.DB, client *asynq.Client, app *model.Application, command string, timeoutSeconds int, userID *uint) (*model.AppCommandRun, error) {
+	switch app.Status {
+	case AppStatusDeleting, AppStatusTeardownFailed:
+		return nil, ErrAppDeleting
+	}
+	var live model.Deployment
+	if err := db.Where("application_id = ? AND status = ? AND image_tag <> ''", app.ID, model.DeploymentStatusLive).
+		Order("created_at DESC").First(&live).Error; err != nil {
+		return nil, ErrNotDeployed
+	}
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = model.DefaultHookTimeoutSeconds
+	}
+
+	run := &model.AppCommandRun{
+		ApplicationID:  app.ID,
+		UserID:         userID,
+		Command:        command,
+		Image:          live.ImageTag,
+		TimeoutSeconds: timeoutSeconds,
+		Status:         model.AppCommandQueued,
+	}
+	if err := db.Create(run).Error; err != nil {
+		return nil, fmt.Errorf("record command run: %w", err)
+	}
+	task, err := NewAppCommandTask(run.ID)
+	if err == nil {
+		_, err = client.Enqueue(task)
+	}
+	if err != nil {
+		db.Model(run).Updates(map[string]interface{}{"status": model.AppCommandFailed, "error": err.Error()})
+		return nil, fmt.Errorf("enqueue command: %w", err)
+	}
+	return run, nil
+}
+
+// HandleAppCommandTask runs a one-off command and records its output and
+// exit code on the run.
+func (h *AppTaskHandler) HandleAppCommandTask(ctx context.Context, t *asynq.Task) error {
+	var p AppCommandPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+	var run model.AppCommandRun
+	if err := h.DB.First(&run, p.RunID).Error; err != nil {
+		return fmt.Errorf("command run lookup failed: %v: %w", err, asynq.SkipRetry)
+	}
+	if run.Status != model.AppCommandQueued {
+		return nil
+	}
+	var app model.Application
+	if err := h.DB.Preload("Cluster").Preload("Cluster.ManagerServer").First(&app, run.ApplicationID).Error; err != nil {
+		h.finishCommandRun(&run, -1, "", false, fmt.Errorf("application not found"))
+		return nil
+	}
+
+	now := time.Now()
+	h.DB.Model(&run).Updates(map[string]interface{}{"status": model.AppCommandRunning, "started_at": now})
+	log.Printf("Running one-off command %d for app %s", run.ID, app.Name)
+
+	vars, err := h.appEnvVars(app)
+	var env *resolvedEnv
+	if err == nil {
+		env, err = resolveEnv(h.DB, h.EncryptionKey, app.ClusterID, vars)
+	}
+	if err != nil {
+		h.finishCommandRun(&run, -1, "", false, fmt.Errorf("resolving environment failed: %w", err))
+		return nil
+	}
+	defer redact.Track(env.secretValues()...)()
+
+	client, err := h.dial(app.Cluster.ManagerServer)
+	if err != nil {
+		h.finishCommandRun(&run, -1, "", false, err)
+		return nil
+	}
+	defer client.Close()
+	client = client.WithContext(ctx)
+
+	var mu sync.Mutex
+	var out strings.Builder
+	truncated := false
+	timeout := time.Duration(run.TimeoutSeconds) * time.Second
+	code, err := runOnce(ctx, client, &app, run.Image, env, h.volumesIn(app.ID, model.AppVolumeReady), "run", fmt.Sprint(run.ID), run.Command, timeout, func(_ sshpkg.Stream, line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if out.Len()+len(line)+1 > maxCommandOutput {
+			truncated = true
+			return
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	})
+	h.finishCommandRun(&run, code, out.String(), truncated, err)
+	return nil
+}
+
+// finishCommandRun records how a one-off command ended.
+func (h *AppTaskHandler) finishCommandRun(run *model.AppCommandRun, code int, output string, truncated bool, err error) {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"status":      model.AppCommandSucceeded,
+		"output":      redact.String(output),
+		"truncated":   truncated,
+		"finished_at": now,
+	}
+	if err != nil {
+		updates["status"] = model.AppCommandFailed
+		updates["error"] = redact.String(err.Error())
+	} else {
+		updates["exit_code"] = code
+		if code != 0 {
+			updates["status"] = model.AppCommandFailed
+		}
+	}
+	h.DB.Model(run).Updates(updates)
+}
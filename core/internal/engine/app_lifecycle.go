@@ -0,0 +1,392 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+)
+
+const TypeAppLifecycle = "app:lifecycle"
+
+// LifecycleAction changes a running application without deploying it.
+type LifecycleAction string
+
+const (
+	LifecycleStop  LifecycleAction = "stop"  // stop every instance, keeping them for start
+	LifecycleStart LifecycleAction = "start" // bring a stopped application back
+	LifecycleScale LifecycleAction = "scale" // change the number of instances
+)
+
+// Application statuses set by lifecycle actions.
+const (
+	AppStatusStopping = "stopping"
+	AppStatusStopped  = "stopped"
+	AppStatusStarting = "starting"
+	AppStatusScaling  = "scaling"
+)
+
+// ErrLifecycleBusy is returned when a lifecycle action is requested while a
+// deployment or another action is in progress.
+var ErrLifecycleBusy = errors.New("a deployment or another action is in progress for this application")
+
+// lifecycleStatus is the status an application has while action runs.
+var lifecycleStatus = map[LifecycleAction]string{
+	LifecycleStop:  AppStatusStopping,
+	LifecycleStart: AppStatusStarting,
+	LifecycleScale: AppStatusScaling,
+}
+
+// Activity returns the activity type recorded for the action.
+func (a LifecycleAction) Activity() model.ActivityType {
+	switch a {
+	case LifecycleStop:
+		return model.ActivityTypeAppStopped
+	case LifecycleStart:
+		return model.ActivityTypeAppStarted
+	default:
+		return model.ActivityTypeAppScaled
+	}
+}
+
+type AppLifecyclePayload struct {
+	AppID          uint            `json:"app_id"`
+	Action         LifecycleAction `json:"action"`
+	Replicas       int             `json:"replicas,omitempty"`        // scale only
+	PreviousStatus string          `json:"previous_status,omitempty"` // restored if the action fails
+}
+
+// NewAppLifecycleTask runs an action queued by EnqueueLifecycle.
+func NewAppLifecycleTask(p AppLifecyclePayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TypeAppLifecycle, payload, asynq.Queue("deployment"), asynq.MaxRetry(1)), nil
+}
+
+// EnqueueLifecycle moves the application to the action's in-progress status
+// and enqueues the task that performs it. The status is claimed in a single
+// statement, so it fails with ErrLifecycleBusy while a deployment is queued
+// or running or another action has not finished.
+func EnqueueLifecycle(db *gorm.DB, client *asynq.Client, app *model.Application, action LifecycleAction, replicas int) error {
+	status, ok := lifecycleStatus[action]
+	if !ok {
+		return fmt.Errorf("unknown lifecycle action %q", action)
+	}
+	switch app.Status {
+	case AppStatusDeleting, AppStatusTeardownFailed:
+		return ErrAppDeleting
+	}
+
+	active := db.Model(&model.Deployment{}).Select("1").
+		Where("application_id = ? AND status IN ?", app.ID, model.DeploymentStatusesActive)
+	res := db.Model(&model.Application{}).
+		Where("id = ? AND status NOT IN ?", app.ID, []string{
+			AppStatusStopping, AppStatusStarting, AppStatusScaling, AppStatusDeleting, AppStatusTeardownFailed,
+		}).
+		Where("NOT EXISTS (?)", active).
+		Update("status", status)
+	if res.Error != nil {
+		return fmt.Errorf("claim application: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return ErrLifecycleBusy
+	}
+
+	previous := app.Status
+	app.Status = status
+	task, err := NewAppLifecycleTask(AppLifecyclePayload{AppID: app.ID, Action: action, Replicas: replicas, PreviousStatus: previous})
+	if err == nil {
+		_, err = client.Enqueue(task)
+	}
+	if err != nil {
+		db.Model(app).Update("status", previous)
+		app.Status = previous
+		return fmt.Errorf("enqueue %s: %w", action, err)
+	}
+	return nil
+}
+
+// HandleAppLifecycleTask stops, starts or scales an application on its
+// cluster's runtime without rebuilding or redeploying it.
+func (h *AppTaskHandler) HandleAppLifecycleTask(ctx context.Context, t *asynq.Task) error {
+	var p AppLifecyclePayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+
+	var app model.Application
+	if err := h.DB.Preload("Cluster").Preload("Cluster.ManagerServer").First(&app, p.AppID).Error; err != nil {
+		return fmt.Errorf("app lookup failed: %v: %w", err, asynq.SkipRetry)
+	}
+	if app.Status != lifecycleStatus[p.Action] {
+		log.Printf("Application %d is %s; dropping %s", app.ID, app.Status, p.Action)
+		return nil
+	}
+
+	client, err := h.dial(app.Cluster.ManagerServer)
+	if err != nil {
+		return h.lifecycleFailed(ctx, &app, p, err)
+	}
+	defer client.Close()
+	client = client.WithContext(ctx)
+
+	switch p.Action {
+	case LifecycleStop:
+		err = h.stopApp(client, &app)
+	case LifecycleStart:
+		err = h.startApp(client, &app)
+	case LifecycleScale:
+		err = h.scaleApp(client, &app, p.Replicas)
+	}
+	if err != nil {
+		return h.lifecycleFailed(ctx, &app, p, err)
+	}
+
+	switch p.Action {
+	case LifecycleStop:
+		h.DB.Model(&app).Update("status", AppStatusStopped)
+		logActivity(h.DB, p.Action.Activity(), fmt.Sprintf("Application '%s' stopped", app.Name), "application", app.ID)
+	case LifecycleStart:
+		h.DB.Model(&app).Update("status", "running")
+		logActivity(h.DB, p.Action.Activity(),
+			fmt.Sprintf("Application '%s' started with %d replica(s)", app.Name, app.Replicas), "application", app.ID)
+	case LifecycleScale:
+		h.DB.Model(&app).Updates(map[string]interface{}{"status": "running", "replicas": p.Replicas})
+		logActivity(h.DB, p.Action.Activity(),
+			fmt.Sprintf("Application '%s' scaled from %d to %d replica(s)", app.Name, app.Replicas, p.Replicas), "application", app.ID)
+	}
+	log.Printf("Application %s: %s complete", app.Name, p.Action)
+	return nil
+}
+
+// lifecycleFailed restores the application's previous status once the
+// action will not be retried, and records the failure.
+func (h *AppTaskHandler) lifecycleFailed(ctx context.Context, app *model.Application, p AppLifecyclePayload, err error) error {
+	if willRetry(ctx, err) {
+		return err
+	}
+	status := p.PreviousStatus
+	if p.Action == LifecycleStop {
+		// Some instances may have stopped; the app is no longer fully serving.
+		status = "failed"
+	}
+	h.DB.Model(app).Update("status", status)
+	logActivity(h.DB, p.Action.Activity(),
+		fmt.Sprintf("Application '%s': %s failed: %v", app.Name, p.Action, err), "application", app.ID)
+	return err
+}
+
+// stopApp stops every instance of the application, leaving its service,
+// Deployment or containers in place for start.
+func (h *AppTaskHandler) stopApp(client *sshpkg.Client, app *model.Application) error {
+	name := sanitizeName(app.Name)
+	switch app.Cluster.Type {
+	case model.ClusterTypeK8s, model.ClusterTypeDockerSwarm:
+		return h.scaleApp(client, app, 0)
+	default:
+		cmd := sshpkg.Shellf("docker ps -q --filter %s | xargs -r docker stop 2>&1", "label=orchestra.app="+name)
+		result, err := client.ExecuteCommand(cmd)
+		if err := commandError(result, err); err != nil {
+			return fmt.Errorf("docker stop: %v: %s", err, commandOutput(result))
+		}
+		return nil
+	}
+}
+
+// startApp brings a stopped application back with its configured number of
+// replicas.
+func (h *AppTaskHandler) startApp(client *sshpkg.Client, app *model.Application) error {
+	switch app.Cluster.Type {
+	case model.ClusterTypeK8s, model.ClusterTypeDockerSwarm:
+	default:
+		label := "label=orchestra.app=" + sanitizeName(app.Name)
+		result, err := client.ExecuteCommand(sshpkg.Shellf("docker ps -aq --filter %s", label))
+		if err := commandError(result, err); err != nil {
+			return fmt.Errorf("docker ps: %v: %s", err, commandOutput(result))
+		}
+		if strings.TrimSpace(result.Stdout) == "" {
+			return fmt.Errorf("no containers left to start; redeploy the application: %w", asynq.SkipRetry)
+		}
+		result, err = client.ExecuteCommand(sshpkg.Shellf("docker ps -aq --filter %s | xargs docker start 2>&1", label))
+		if err := commandError(result, err); err != nil {
+			return fmt.Errorf("docker start: %v: %s", err, commandOutput(result))
+		}
+	}
+	return h.scaleApp(client, app, app.Replicas)
+}
+
+// scaleApp runs replicas instances of the application on its current
+// version and waits for them to come up. On a Docker host, replicas beyond
+// the first are extra containers; zero replicas is handled by stopApp.
+func (h *AppTaskHandler) scaleApp(client *sshpkg.Client, app *model.Application, replicas int) error {
+	name := sanitizeName(app.Name)
+	switch app.Cluster.Type {
+	case model.ClusterTypeK8s:
+		cmd := sshpkg.Shellf("kubectl scale %[1]s -n %[2]s --replicas=%[3]d 2>&1 && kubectl rollout status %[1]s -n %[2]s --timeout=300s 2>&1",
+			k8sWorkload(client, app), app.Namespace, replicas)
+		result, err := client.ExecuteCommand(cmd)
+		if err := commandError(result, err); err != nil {
+			return fmt.Errorf("kubectl scale: %v: %s", err, commandOutput(result))
+		}
+		return nil
+	case model.ClusterTypeDockerSwarm:
+		timeout, _ := time.ParseDuration(app.UpdatePolicy.WithDefaults().ConvergeTimeout)
+		result, err := client.ExecuteCommand(sshpkg.Shellf("timeout %d docker service scale %s 2>&1",
+			int(timeout.Seconds()), fmt.Sprintf("%s=%d", name, replicas)))
+		if err := commandError(result, err); err != nil {
+			return fmt.Errorf("docker service scale: %s", swarmCommandFailure(result))
+		}
+		return nil
+	default:
+		var live model.Deployment
+		if err := h.DB.Where("application_id = ? AND status = ? AND image_tag <> ''", app.ID, model.DeploymentStatusLive).
+			Order("created_at DESC").First(&live).Error; err != nil {
+			return fmt.Errorf("no live deployment to scale: %w", asynq.SkipRetry)
+		}
+		scaled := *app
+		scaled.Replicas = replicas
+		volumeArgs := dockerVolumeArgs(app, h.volumesIn(app.ID, model.AppVolumeReady))
+		if err := reconcileDockerReplicas(client, &scaled, live.ImageTag, existingDockerEnv(client, app), volumeArgs, false); err != nil {
+			return err
+		}
+		return h.routeDockerReplicas(client, &scaled)
+	}
+}
+
+// Extra containers run replicas 2..N of an application on a single Docker
+// host; replica 1 is the container named after the application (or its
+// active blue/green slot). Only one container can publish the application's
+// port, so extra replicas publish it on ephemeral loopback ports, and the
+// application's nginx sites balance requests over all of them.
+
+// dockerReplicaName names the container running replica i (i >= 2).
+func dockerReplicaName(name string, i int) string {
+	return fmt.Sprintf("%s-r%d", name, i)
+}
+
+// dockerUpstreamPorts returns the loopback ports nginx balances the
+// application over: primary, where its main container serves, followed by
+// the ports its extra replicas publish.
+func dockerUpstreamPorts(client *sshpkg.Client, app *model.Application, primary int) ([]int, error) {
+	ports := []int{primary}
+	name := sanitizeName(app.Name)
+	for i := 2; i <= app.Replicas; i++ {
+		port, err := containerHostPort(client, dockerReplicaName(name, i), app.Port)
+		if err != nil {
+			return nil, fmt.Errorf("port of replica %d: %w", i, err)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// routeDockerReplicas points the application's nginx sites at its main
+// container and every extra replica, after they were scaled or restarted
+// onto new ephemeral ports.
+func (h *AppTaskHandler) routeDockerReplicas(client *sshpkg.Client, app *model.Application) error {
+	if app.Port == 0 {
+		return nil
+	}
+	sites, err := h.appNginxSites(app)
+	if err != nil || len(sites) == 0 {
+		return err
+	}
+	primary := app.Port
+	name := sanitizeName(app.Name)
+	if active := activeSlotContainer(client, name); active != "" && active != name {
+		if primary, err = containerHostPort(client, active, app.Port); err != nil {
+			return fmt.Errorf("port of %s: %w", active, err)
+		}
+	}
+	ports, err := dockerUpstreamPorts(client, app, primary)
+	if err != nil {
+		return err
+	}
+	if _, err := h.routeNginxSites(client, sites, ports); err != nil {
+		return fmt.Errorf("route nginx: %w", err)
+	}
+	return nil
+}
+
+// reconcileDockerReplicas makes replicas 2..app.Replicas of the application
+// run image, started with env and runArgs such as its volumes, and removes
+// replicas beyond that. With recreate, existing extra replicas are replaced,
+// as after deploying a new version.
+func reconcileDockerReplicas(client *sshpkg.Client, app *model.Application, image string, env dockerEnv, runArgs []string, recreate bool) error {
+	name := sanitizeName(app.Name)
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker ps -a --filter %s --filter %s --format %s",
+		"label=orchestra.app="+name, "label=orchestra.replica", `{{.Label "orchestra.replica"}}`))
+	if err := commandError(result, err); err != nil {
+		return fmt.Errorf("list replicas: %v: %s", err, commandOutput(result))
+	}
+	existing := map[int]bool{}
+	for _, f := range strings.Fields(result.Stdout) {
+		if i, err := strconv.Atoi(f); err == nil {
+			existing[i] = true
+		}
+	}
+
+	for i := range existing {
+		if i > app.Replicas || recreate {
+			client.ExecuteCommand(sshpkg.Shellf("docker rm -f %s 2>/dev/null", dockerReplicaName(name, i)))
+			delete(existing, i)
+		}
+	}
+
+	check := app.HealthCheck.WithDefaults(app.Port)
+	for i := 2; i <= app.Replicas; i++ {
+		if existing[i] {
+			continue
+		}
+		cmd := sshpkg.Cmd("docker", "run", "-d", "--name", dockerReplicaName(name, i),
+			"--label", "orchestra.app="+name, "--label", "orchestra.replica="+strconv.Itoa(i),
+			"--restart", "unless-stopped").
+			Arg(dockerResourceArgs(app.Resources)...).
+			Arg(dockerHealthArgs(check)...).
+			Arg(env.args...).
+			Arg(runArgs...)
+		if app.Port > 0 {
+			cmd.Arg("-p", fmt.Sprintf("127.0.0.1::%d", app.Port))
+		}
+		cmd.Arg(image).Raw("2>&1")
+		result, err := client.ExecuteCommand(env.command(cmd))
+		if err := commandError(result, err); err != nil {
+			return fmt.Errorf("start replica %d: %v: %s", i, err, commandOutput(result))
+		}
+	}
+	if check.Enabled() {
+		for i := 2; i <= app.Replicas; i++ {
+			if err := waitDockerHealthy(client, dockerReplicaName(name, i), check); err != nil {
+				return fmt.Errorf("replica %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// existingDockerEnv loads the env file the last deployment wrote, if there
+// is one.
+func existingDockerEnv(client *sshpkg.Client, app *model.Application) dockerEnv {
+	path := appDirFor(*app) + "/.env"
+	result, err := client.ExecuteCommand(sshpkg.Shellf("test -f %s", path))
+	if commandError(result, err) != nil {
+		return dockerEnv{}
+	}
+	env := dockerEnv{args: []string{"--env-file", path}}
+	result, err = client.ExecuteCommand(sshpkg.Shellf("test -f %s", path+".sh"))
+	if commandError(result, err) == nil {
+		env.exports = path + ".sh"
+	}
+	return env
+}
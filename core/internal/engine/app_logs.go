@@ -0,0 +1,242 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
+	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
+)
+
+// ErrUnknownInstance is returned by StreamAppLogs and OpenAppTerminal when
+// the requested instance is not one of the application's.
+var ErrUnknownInstance = errors.New("no such instance of this application")
+
+// maxPodLogStreams bounds how many pods kubectl follows at once.
+const maxPodLogStreams = 20
+
+// LogOptions selects which of an application's container output to read.
+type LogOptions struct {
+	Instance string // only this pod, Swarm task slot or container; empty for all
+	Since    string // a duration such as 10m or an RFC 3339 time; empty for no bound
+	Tail     int    // lines per instance from the end of its log; negative for all
+	Follow   bool   // keep streaming new lines until ctx is done
+}
+
+// LogLine is one line an application instance wrote.
+type LogLine struct {
+	Instance string     `json:"instance"`
+	Stream   string     `json:"stream"` // stdout or stderr, where the runtime tells them apart
+	Time     *time.Time `json:"time,omitempty"`
+	Message  string     `json:"message"`
+}
+
+// StreamAppLogs reads the container output of app's instances through its
+// runtime and calls onLine with each line, credentials masked. Calls are
+// never concurrent. With opts.Follow it returns only once ctx is done or the
+// runtime stops the stream. app must have its Cluster and
+// Cluster.ManagerServer loaded.
+func StreamAppLogs(ctx context.Context, keyHex string, app *model.Application, opts LogOptions, onLine func(LogLine)) error {
+	manager := app.Cluster.ManagerServer
+	if manager.ID == 0 {
+		return fmt.Errorf("cluster has no manager server")
+	}
+	client, err := dialServer(manager, keyHex)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	client = client.WithContext(ctx)
+
+	emit := onLine
+	onLine = func(l LogLine) {
+		l.Message = redact.String(l.Message)
+		emit(l)
+	}
+
+	name := sanitizeName(app.Name)
+	switch app.Cluster.Type {
+	case model.ClusterTypeK8s:
+		err = k8sLogs(client, name, app.Namespace, opts, onLine)
+	case model.ClusterTypeDockerSwarm:
+		err = swarmLogs(client, name, opts, onLine)
+	default:
+		err = dockerLogs(client, name, opts, onLine)
+	}
+	if ctx.Err() != nil {
+		return nil // the caller stopped following
+	}
+	return err
+}
+
+// logTail renders LogOptions.Tail for docker's --tail.
+func (o LogOptions) logTail() string {
+	if o.Tail < 0 {
+		return "all"
+	}
+	return fmt.Sprint(o.Tail)
+}
+
+func k8sLogs(client *sshpkg.Client, name, namespace string, opts LogOptions, onLine func(LogLine)) error {
+	cmd := sshpkg.Cmd("kubectl", "logs", "-n", namespace)
+	if opts.Instance != "" {
+		// kubectl logs accepts any pod; make sure this one is the app's.
+		result, err := client.ExecuteCommand(sshpkg.Shellf("kubectl get pods -n %s -l %s -o name 2>&1", namespace, "app="+name))
+		if err := commandError(result, err); err != nil {
+			return fmt.Errorf("kubectl get pods: %v: %s", err, commandOutput(result))
+		}
+		if !containsLine(result.Stdout, "pod/"+opts.Instance) {
+			return ErrUnknownInstance
+		}
+		cmd.Arg("pod/" + opts.Instance)
+	} else {
+		cmd.Flag("-l", "app="+name).Flag("--max-log-requests", fmt.Sprint(maxPodLogStreams))
+	}
+	// With a selector kubectl defaults to the last 10 lines, so always say.
+	cmd.Arg("--prefix", "--timestamps").Flag("--tail", fmt.Sprint(max(opts.Tail, -1)))
+	if opts.Since != "" {
+		if _, err := time.Parse(time.RFC3339, opts.Since); err == nil {
+			cmd.Flag("--since-time", opts.Since)
+		} else {
+			cmd.Flag("--since", opts.Since)
+		}
+	}
+	if opts.Follow {
+		cmd.Arg("-f")
+	}
+
+	// Pod output all arrives on stdout; stderr is kubectl's own complaints.
+	var complaint string
+	result, err := client.ExecuteCommandFollow(cmd.String(), func(stream sshpkg.Stream, line string) {
+		if stream == sshpkg.Stderr {
+			complaint = line
+			return
+		}
+		// Lines look like "[pod/web-5d9c/web] 2024-05-01T10:00:00.000Z message".
+		l := LogLine{Stream: string(sshpkg.Stdout)}
+		if prefix, rest, ok := strings.Cut(line, "] "); ok && strings.HasPrefix(prefix, "[") {
+			parts := strings.Split(strings.TrimPrefix(prefix, "["), "/")
+			if len(parts) > 1 {
+				l.Instance = parts[1]
+			}
+			line = rest
+		}
+		l.Time, l.Message = splitLogTimestamp(line)
+		onLine(l)
+	})
+	if err := commandError(result, err); err != nil {
+		return fmt.Errorf("kubectl logs: %v: %s", err, complaint)
+	}
+	return nil
+}
+
+func swarmLogs(client *sshpkg.Client, name string, opts LogOptions, onLine func(LogLine)) error {
+	cmd := sshpkg.Cmd("docker", "service", "logs", "--timestamps").Flag("--tail", opts.logTail()).Flag("--since", opts.Since)
+	if opts.Follow {
+		cmd.Arg("-f")
+	}
+	cmd.Arg(name)
+
+	var complaint string
+	result, err := client.ExecuteCommandFollow(cmd.String(), func(stream sshpkg.Stream, line string) {
+		// Lines look like "web.1.k3j2h1@node-1    | 2024-05-01T10:00:00.000Z message".
+		source, msg, ok := strings.Cut(line, " | ")
+		if !ok {
+			complaint = line
+			return
+		}
+		l := LogLine{Instance: swarmSlot(strings.TrimSpace(source)), Stream: string(stream)}
+		if opts.Instance != "" && l.Instance != opts.Instance {
+			return
+		}
+		l.Time, l.Message = splitLogTimestamp(msg)
+		onLine(l)
+	})
+	if err := commandError(result, err); err != nil {
+		return fmt.Errorf("docker service logs: %v: %s", err, complaint)
+	}
+	return nil
+}
+
+// swarmSlot turns a log context such as "web.1.k3j2h1@node-1" into the
+// task slot name "web.1" that InspectRuntime reports.
+func swarmSlot(source string) string {
+	task, _, _ := strings.Cut(source, "@")
+	if i := strings.LastIndex(task, "."); i > 0 {
+		return task[:i]
+	}
+	return task
+}
+
+func dockerLogs(client *sshpkg.Client, name string, opts LogOptions, onLine func(LogLine)) error {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker ps -a --filter %s --format %s 2>&1",
+		"label=orchestra.app="+name, "{{.Names}}"))
+	if err := commandError(result, err); err != nil {
+		return fmt.Errorf("list containers: %v: %s", err, commandOutput(result))
+	}
+	containers := strings.Fields(result.Stdout)
+	if opts.Instance != "" {
+		if !containsLine(result.Stdout, opts.Instance) {
+			return ErrUnknownInstance
+		}
+		containers = []string{opts.Instance}
+	}
+
+	// docker logs reads one container, so follow each replica in its own
+	// session and merge the lines.
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make([]error, len(containers))
+	for i, container := range containers {
+		cmd := sshpkg.Cmd("docker", "logs", "--timestamps").Flag("--tail", opts.logTail()).Flag("--since", opts.Since)
+		if opts.Follow {
+			cmd.Arg("-f")
+		}
+		cmd.Arg(container)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := client.ExecuteCommandFollow(cmd.String(), func(stream sshpkg.Stream, line string) {
+				l := LogLine{Instance: container, Stream: string(stream)}
+				l.Time, l.Message = splitLogTimestamp(line)
+				mu.Lock()
+				defer mu.Unlock()
+				onLine(l)
+			})
+			if err := commandError(result, err); err != nil {
+				errs[i] = fmt.Errorf("docker logs %s: %w", container, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// splitLogTimestamp separates the RFC 3339 timestamp the runtimes put in
+// front of each line when asked for --timestamps.
+func splitLogTimestamp(line string) (*time.Time, string) {
+	stamp, msg, ok := strings.Cut(line, " ")
+	if !ok {
+		stamp, msg = line, ""
+	}
+	t, err := time.Parse(time.RFC3339Nano, stamp)
+	if err != nil {
+		return nil, line
+	}
+	return &t, msg
+}
+
+// containsLine reports whether out has a line equal to want.
+func containsLine(out, want string) bool {
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == want {
+			return true
+		}
+	}
+	return false
+}
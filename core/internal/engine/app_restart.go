@@ -0,0 +1,134 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
+	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
+	"github.com/hibiken/asynq"
+)
+
+const TypeRestartApplication = "app:restart"
+
+type RestartAppPayload struct {
+	AppID        uint   `json:"app_id"`
+	DeploymentID uint   `json:"deployment_id"` // the queued restart deployment to run
+	Reason       string `json:"reason"`        // recorded in the deployment log and activity
+}
+
+// NewRestartAppTask runs a restart queued by EnqueueRestart: the application
+// is restarted on its current image so it picks up changed environment
+// values, without rebuilding.
+func NewRestartAppTask(appID, deploymentID uint, reason string) (*asynq.Task, error) {
+	payload, err := json.Marshal(RestartAppPayload{AppID: appID, DeploymentID: deploymentID, Reason: reason})
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TypeRestartApplication, payload, asynq.Queue("deployment"), asynq.MaxRetry(1)), nil
+}
+
+// HandleRestartAppTask re-deploys the image of the app's latest live
+// deployment with freshly resolved environment variables. Kubernetes apps get
+// a rolling restart; Swarm services and Docker containers are recreated.
+func (h *AppTaskHandler) HandleRestartAppTask(ctx context.Context, t *asynq.Task) error {
+	var p RestartAppPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+	if p.DeploymentID == 0 {
+		// Enqueued before deployments were queued up front.
+		var app model.Application
+		if err := h.DB.First(&app, p.AppID).Error; err != nil {
+			return fmt.Errorf("app lookup failed: %v: %w", err, asynq.SkipRetry)
+		}
+		_, err := EnqueueRestart(h.DB, h.AsynqClient, &app, p.Reason)
+		return err
+	}
+	return h.runDeployment(ctx, t, p.DeploymentID, func(ctx context.Context, dep *model.Deployment, app *model.Application) error {
+		return h.restart(ctx, dep, app, p.Reason)
+	})
+}
+
+func (h *AppTaskHandler) restart(ctx context.Context, deployment *model.Deployment, app *model.Application, reason string) error {
+	// The image is chosen now rather than when the restart was queued, so a
+	// deploy that ran in between is restarted rather than undone.
+	var current model.Deployment
+	if err := h.DB.Where("application_id = ? AND status = ? AND image_tag <> ''", app.ID, model.DeploymentStatusLive).
+		Order("created_at DESC").First(&current).Error; err != nil {
+		h.failDeployment(deployment, app, "No live deployment to restart")
+		SettleAppStatus(h.DB, app.ID)
+		return nil
+	}
+
+	vars, varsErr := h.appEnvVars(*app)
+	deployment.ImageTag = current.ImageTag
+	deployment.Spec = specFor(*app, current.ImageTag, vars, h.mountedVolumes(app.ID))
+	h.DB.Model(deployment).Updates(map[string]interface{}{"image_tag": deployment.ImageTag, "spec": deployment.Spec})
+	h.setStatus(deployment, model.DeploymentStatusDeploying)
+	h.appendLog(deployment, fmt.Sprintf("Restarting %s on %s: %s", app.Name, current.ImageTag, reason))
+	h.DB.Model(app).Update("status", "deploying")
+
+	managerServer := app.Cluster.ManagerServer
+	sshKey, err := decrypt(managerServer.SSHKeyEncrypted, h.EncryptionKey)
+	if err != nil {
+		h.failDeployment(deployment, app, "Failed to decrypt manager SSH key")
+		return fmt.Errorf("decrypt SSH key: %w", err)
+	}
+	client, err := sshpkg.NewClient(managerServer.IP, managerServer.SSHPort, managerServer.SSHUser, sshKey, "")
+	if err != nil {
+		h.failDeployment(deployment, app, fmt.Sprintf("SSH to manager failed: %v", err))
+		return fmt.Errorf("SSH to manager: %w", err)
+	}
+	defer client.Close()
+	client = client.WithContext(ctx)
+
+	if varsErr != nil {
+		h.failDeployment(deployment, app, fmt.Sprintf("Loading environment failed: %v", varsErr))
+		return fmt.Errorf("app env: %w", varsErr)
+	}
+	env, err := resolveEnv(h.DB, h.EncryptionKey, app.ClusterID, vars)
+	if err != nil {
+		h.failDeployment(deployment, app, fmt.Sprintf("Resolving environment failed: %v", err))
+		return fmt.Errorf("resolve env: %v: %w", err, asynq.SkipRetry)
+	}
+	defer redact.Track(env.secretValues()...)()
+
+	h.beginStep(deployment, model.StepDeploy)
+	if err := h.deployRuntime(client, deployment, app, current.ImageTag, env); err != nil {
+		return h.deployFailed(client, deployment, app, err)
+	}
+
+	if app.Cluster.Type == model.ClusterTypeK8s {
+		if err := h.rolloutRestart(client, deployment, app); err != nil {
+			return err
+		}
+	}
+
+	h.setStatus(deployment, model.DeploymentStatusLive)
+	h.DB.Model(app).Update("status", "running")
+	h.appendLog(deployment, fmt.Sprintf("Deployment %s is live!", deployment.Version))
+	logActivity(h.DB, model.ActivityTypeAppRestarted,
+		fmt.Sprintf("Application '%s' restarted: %s", app.Name, reason), "application", app.ID)
+
+	log.Printf("Restart %s complete for app %s", deployment.Version, app.Name)
+	return nil
+}
+
+// rolloutRestart rolls a Kubernetes app's pods. Re-applying an unchanged
+// workload does not restart pods, and env values live in a Secret, so this
+// is needed whenever only the environment changed.
+func (h *AppTaskHandler) rolloutRestart(client *sshpkg.Client, dep *model.Deployment, app *model.Application) error {
+	cmd := sshpkg.Shellf("kubectl rollout restart %[1]s -n %[2]s 2>&1 && kubectl rollout status %[1]s -n %[2]s --timeout=300s 2>&1",
+		k8sWorkload(client, app), app.Namespace)
+	result, err := client.ExecuteCommand(cmd)
+	if err := commandError(result, err); err != nil {
+		h.failDeployment(dep, app, fmt.Sprintf("Rolling restart failed: %s", commandOutput(result)))
+		return fmt.Errorf("kubectl rollout restart: %w", err)
+	}
+	h.appendLog(dep, "Rolling restart complete.")
+	return nil
+}
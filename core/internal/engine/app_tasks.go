@@ -2,13 +2,19 @@ package tasks
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/enochcodes/orchestra/core/internal/buildpack"
+	"github.com/enochcodes/orchestra/core/internal/deploylog"
 	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
 	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
 	"github.com/hibiken/asynq"
 	"gorm.io/gorm"
@@ -19,16 +25,20 @@ const (
 )
 
 type DeployAppPayload struct {
-	AppID uint `json:"app_id"`
+	AppID        uint `json:"app_id"`
+	DeploymentID uint `json:"deployment_id"` // the queued deployment to run
 }
 
 type AppTaskHandler struct {
 	DB            *gorm.DB
 	EncryptionKey string
+	AsynqClient   *asynq.Client // queues automatic rollbacks; may be nil
+	StorageClass  string        // Kubernetes storage class of volumes that name none; empty uses the cluster default
 }
 
-func NewDeployAppTask(appID uint) (*asynq.Task, error) {
-	payload, err := json.Marshal(DeployAppPayload{AppID: appID})
+// NewDeployAppTask runs a deployment queued by EnqueueDeploy.
+func NewDeployAppTask(appID, deploymentID uint) (*asynq.Task, error) {
+	payload, err := json.Marshal(DeployAppPayload{AppID: appID, DeploymentID: deploymentID})
 	if err != nil {
 		return nil, err
 	}
@@ -40,164 +50,347 @@ func (h *AppTaskHandler) HandleDeployAppTask(ctx context.Context, t *asynq.Task)
 	if err := json.Unmarshal(t.Payload(), &p); err != nil {
 		return fmt.Errorf("unmarshal failed: %v: %w", err, asynq.SkipRetry)
 	}
-
-	log.Printf("Starting deployment for App ID: %d", p.AppID)
-
-	var app model.Application
-	if err := h.DB.Preload("Cluster").Preload("Cluster.ManagerServer").First(&app, p.AppID).Error; err != nil {
-		return fmt.Errorf("app lookup failed: %v", err)
+	if p.DeploymentID == 0 {
+		// Enqueued before deployments were queued up front.
+		var app model.Application
+		if err := h.DB.First(&app, p.AppID).Error; err != nil {
+			return fmt.Errorf("app lookup failed: %v: %w", err, asynq.SkipRetry)
+		}
+		_, err := EnqueueDeploy(h.DB, h.AsynqClient, &app)
+		return err
 	}
 
-	// Count existing deployments for versioning
-	var count int64
-	h.DB.Model(&model.Deployment{}).Where("application_id = ?", app.ID).Count(&count)
-	version := fmt.Sprintf("v%d", count+1)
+	log.Printf("Starting deployment %d for App ID: %d", p.DeploymentID, p.AppID)
+	return h.runDeployment(ctx, t, p.DeploymentID, h.deploy)
+}
 
-	// Create deployment record
-	deployment := model.Deployment{
-		ApplicationID: app.ID,
-		Version:       version,
-		Status:        model.DeploymentStatusBuilding,
-	}
-	if err := h.DB.Create(&deployment).Error; err != nil {
-		return fmt.Errorf("create deployment: %v", err)
+// deploy fetches, builds and runs the app's current configuration as
+// deployment.
+func (h *AppTaskHandler) deploy(ctx context.Context, deployment *model.Deployment, app *model.Application) error {
+	version := deployment.Version
+	imageName := fmt.Sprintf("orchestra/%s:%s", sanitizeName(app.Name), version)
+	if app.SourceType == model.DeploymentSourceDocker {
+		imageName = app.DockerImage
 	}
+	vars, varsErr := h.appEnvVars(*app)
 
-	h.DB.Model(&app).Update("status", "building")
+	if deployment.Spec.IsZero() { // retries keep the spec of the first attempt
+		deployment.Spec = specFor(*app, imageName, vars, h.mountedVolumes(app.ID))
+		h.DB.Model(deployment).Update("spec", deployment.Spec)
+	}
+	h.setStatus(deployment, model.DeploymentStatusBuilding)
+	h.DB.Model(app).Update("status", "building")
 
 	// Get SSH client to the manager server
 	managerServer := app.Cluster.ManagerServer
 	sshKey, err := decrypt(managerServer.SSHKeyEncrypted, h.EncryptionKey)
 	if err != nil {
-		h.failDeployment(&deployment, &app, "Failed to decrypt manager SSH key")
+		h.failDeployment(deployment, app, "Failed to decrypt manager SSH key")
 		return fmt.Errorf("decrypt SSH key: %w", err)
 	}
 
 	client, err := sshpkg.NewClient(managerServer.IP, managerServer.SSHPort, managerServer.SSHUser, sshKey, "")
 	if err != nil {
-		h.failDeployment(&deployment, &app, fmt.Sprintf("SSH to manager failed: %v", err))
+		h.failDeployment(deployment, app, fmt.Sprintf("SSH to manager failed: %v", err))
 		return fmt.Errorf("SSH to manager: %w", err)
 	}
 	defer client.Close()
+	client = client.WithContext(ctx)
 
-	appDir := fmt.Sprintf("/opt/orchestra/apps/%s", sanitizeName(app.Name))
-	imageName := fmt.Sprintf("orchestra/%s:%s", sanitizeName(app.Name), version)
+	// Resolve ${secret:NAME} references up front so a missing secret fails
+	// the deploy before any time is spent building.
+	if varsErr != nil {
+		h.failDeployment(deployment, app, fmt.Sprintf("Loading environment failed: %v", varsErr))
+		return fmt.Errorf("app env: %w", varsErr)
+	}
+	env, err := resolveEnv(h.DB, h.EncryptionKey, app.ClusterID, vars)
+	if err != nil {
+		h.failDeployment(deployment, app, fmt.Sprintf("Resolving environment failed: %v", err))
+		return fmt.Errorf("resolve env: %w", err)
+	}
+	defer redact.Track(env.secretValues()...)()
+
+	// A retry of a deployment whose image was already built goes straight
+	// to deploying it. Built image tags are unique to a deployment.
+	resumed := false
+	if deployment.Attempt > 1 && app.SourceType != model.DeploymentSourceDocker {
+		result, err := client.ExecuteCommand(sshpkg.Shellf("docker image inspect %s >/dev/null 2>&1", imageName))
+		if commandError(result, err) == nil {
+			h.appendLog(deployment, fmt.Sprintf("Image %s was built by an earlier attempt; skipping build.", imageName))
+			for _, step := range []model.DeploymentStepName{model.StepFetchSource, model.StepGenerateDockerfile, model.StepBuild} {
+				h.skipStep(deployment, step, "Image was built by an earlier attempt.")
+			}
+			resumed = true
+		}
+	}
+	if !resumed {
+		if err := h.fetchAndBuild(client, deployment, app, imageName); err != nil {
+			return err
+		}
+	}
+
+	h.skipStep(deployment, model.StepPush, "Images are built on the cluster manager; there is no registry to push to.")
+
+	// Migrations and the like run against the new image before it serves.
+	if err := h.runHook(ctx, client, deployment, app, imageName, env, model.StepPreDeploy, app.Hooks.PreDeploy); err != nil {
+		return err
+	}
+
+	// Step 4: Deploy based on cluster type
+	h.beginStep(deployment, model.StepDeploy)
+	h.setStatus(deployment, model.DeploymentStatusDeploying)
+	h.DB.Model(app).Update("status", "deploying")
+
+	if err := h.deployRuntime(client, deployment, app, imageName, env); err != nil {
+		return h.deployFailed(client, deployment, app, err)
+	}
+	if err := h.runHook(ctx, client, deployment, app, imageName, env, model.StepPostDeploy, app.Hooks.PostDeploy); err != nil {
+		return err
+	}
+
+	// Step 5: Mark as live
+	h.DB.Model(deployment).Where("status <> ?", model.DeploymentStatusCancelled).Updates(map[string]interface{}{
+		"status":    model.DeploymentStatusLive,
+		"image_tag": imageName,
+	})
+	h.DB.Model(app).Update("status", "running")
+	h.appendLog(deployment, fmt.Sprintf("Deployment %s is live!", version))
+
+	log.Printf("Deployment %s complete for app %s", version, app.Name)
+	return nil
+}
+
+// fetchAndBuild gets the app's source onto the manager and builds imageName
+// from it, or pulls the image for docker_image apps.
+func (h *AppTaskHandler) fetchAndBuild(client *sshpkg.Client, deployment *model.Deployment, app *model.Application, imageName string) error {
+	appDir := appDirFor(*app)
+
+	h.beginStep(deployment, model.StepFetchSource)
 
 	// Step 1: Prepare app directory
-	client.ExecuteCommand(fmt.Sprintf("mkdir -p %s", appDir))
+	client.ExecuteCommand(sshpkg.Cmd("mkdir", "-p", appDir).String())
 
 	// Step 2: Get source code based on source type
 	switch app.SourceType {
 	case model.DeploymentSourceGit:
-		h.appendLog(&deployment, fmt.Sprintf("Cloning %s (branch: %s)...", app.RepoURL, app.Branch))
-		cloneCmd := fmt.Sprintf("cd %s && rm -rf src && git clone --depth 1 --branch %s %s src 2>&1",
+		h.appendLog(deployment, fmt.Sprintf("Cloning %s (branch: %s)...", app.RepoURL, app.Branch))
+		cloneCmd := sshpkg.Shellf("cd %s && rm -rf src && git clone --depth 1 --branch %s -- %s src 2>&1",
 			appDir, app.Branch, app.RepoURL)
-		result, err := client.ExecuteCommand(cloneCmd)
-		if err != nil {
-			h.failDeployment(&deployment, &app, fmt.Sprintf("Git clone failed: %s", result.Stderr))
+		result, err := h.streamCommand(client, deployment, cloneCmd)
+		if err := commandError(result, err); err != nil {
+			h.failDeployment(deployment, app, fmt.Sprintf("Git clone failed: %s", commandOutput(result)))
 			return fmt.Errorf("git clone: %w", err)
 		}
-		h.appendLog(&deployment, "Clone complete.")
+		h.appendLog(deployment, "Clone complete.")
 
 	case model.DeploymentSourceDocker:
 		// Docker image: just pull and deploy directly
-		h.appendLog(&deployment, fmt.Sprintf("Pulling Docker image: %s", app.DockerImage))
-		imageName = app.DockerImage
-		pullCmd := fmt.Sprintf("docker pull %s 2>&1", app.DockerImage)
-		result, err := client.ExecuteCommand(pullCmd)
-		if err != nil {
-			h.failDeployment(&deployment, &app, fmt.Sprintf("Docker pull failed: %s", result.Stderr))
+		h.appendLog(deployment, fmt.Sprintf("Pulling Docker image: %s", app.DockerImage))
+		pullCmd := sshpkg.Shellf("docker pull -- %s 2>&1", app.DockerImage)
+		result, err := h.streamCommand(client, deployment, pullCmd)
+		if err := commandError(result, err); err != nil {
+			h.failDeployment(deployment, app, fmt.Sprintf("Docker pull failed: %s", commandOutput(result)))
 			return fmt.Errorf("docker pull: %w", err)
 		}
-		h.appendLog(&deployment, "Pull complete.")
+		h.appendLog(deployment, "Pull complete.")
 
 	case model.DeploymentSourceManual:
-		h.appendLog(&deployment, fmt.Sprintf("Using manual path: %s", app.ManualPath))
-		client.ExecuteCommand(fmt.Sprintf("cd %s && ln -sfn %s src", appDir, app.ManualPath))
+		h.appendLog(deployment, fmt.Sprintf("Using manual path: %s", app.ManualPath))
+		result, err := client.ExecuteCommand(sshpkg.Shellf("cd %s && ln -sfn -- %s src 2>&1", appDir, app.ManualPath))
+		if err := commandError(result, err); err != nil {
+			h.failDeployment(deployment, app, fmt.Sprintf("Linking manual path failed: %s", commandOutput(result)))
+			return fmt.Errorf("link manual path: %w", err)
+		}
 	}
 
 	// Step 3: Build (if not docker_image source)
-	if app.SourceType != model.DeploymentSourceDocker {
+	if app.SourceType == model.DeploymentSourceDocker {
+		h.skipStep(deployment, model.StepGenerateDockerfile, "Image is pulled, not built.")
+		h.skipStep(deployment, model.StepBuild, "Image is pulled, not built.")
+	} else {
 		srcDir := fmt.Sprintf("%s/src", appDir)
 
 		// Check if repo has Dockerfile
 		hasDockerfile := false
-		checkResult, _ := client.ExecuteCommand(fmt.Sprintf("test -f %s/Dockerfile && echo YES || echo NO", srcDir))
-		if strings.TrimSpace(checkResult.Stdout) == "YES" {
+		checkResult, err := client.ExecuteCommand(sshpkg.Shellf("test -f %s && echo YES || echo NO", srcDir+"/Dockerfile"))
+		if err == nil && strings.TrimSpace(checkResult.Stdout) == "YES" {
 			hasDockerfile = true
 		}
 
-		if !hasDockerfile && app.BuildType != "" && app.BuildType != "docker" {
+		if hasDockerfile {
+			h.skipStep(deployment, model.StepGenerateDockerfile, "Source has a Dockerfile.")
+		} else if app.BuildType != "" && app.BuildType != "docker" {
 			// Generate Dockerfile from buildpack
 			dockerfile := buildpack.GenerateDockerfile(app.BuildType, app.BuildCmd, app.StartCmd)
 			if dockerfile != "" {
-				h.appendLog(&deployment, "Generating Dockerfile from buildpack...")
-				escapedDF := strings.ReplaceAll(dockerfile, "'", "'\\''")
-				writeCmd := fmt.Sprintf("cat > %s/Dockerfile << 'ORCHESTRA_EOF'\n%s\nORCHESTRA_EOF", srcDir, escapedDF)
-				client.ExecuteCommand(writeCmd)
+				h.beginStep(deployment, model.StepGenerateDockerfile)
+				h.appendLog(deployment, "Generating Dockerfile from buildpack...")
+				if err := client.WriteFile(srcDir+"/Dockerfile", []byte(dockerfile+"\n"), 0644); err != nil {
+					h.failDeployment(deployment, app, fmt.Sprintf("Writing Dockerfile failed: %v", err))
+					return fmt.Errorf("write Dockerfile: %w", err)
+				}
 			}
 		}
 
-		h.appendLog(&deployment, "Building Docker image...")
-		h.DB.Model(&deployment).Update("status", model.DeploymentStatusBuilding)
-		buildCmd := fmt.Sprintf("cd %s && docker build -t %s . 2>&1", srcDir, imageName)
-		result, err := client.ExecuteCommand(buildCmd)
-		if err != nil {
-			h.failDeployment(&deployment, &app, fmt.Sprintf("Docker build failed: %s", result.Stderr))
+		h.beginStep(deployment, model.StepBuild)
+		h.appendLog(deployment, "Building Docker image...")
+		h.setStatus(deployment, model.DeploymentStatusBuilding)
+		buildCmd := sshpkg.Shellf("cd %s && docker build -t %s . 2>&1", srcDir, imageName)
+		result, err := h.streamCommand(client, deployment, buildCmd)
+		if err := commandError(result, err); err != nil {
+			h.failDeployment(deployment, app, fmt.Sprintf("Docker build failed: %s", commandOutput(result)))
 			return fmt.Errorf("docker build: %w", err)
 		}
-		h.appendLog(&deployment, "Build complete.")
+		h.appendLog(deployment, "Build complete.")
 	}
+	return nil
+}
 
-	// Step 4: Deploy based on cluster type
-	h.DB.Model(&deployment).Update("status", model.DeploymentStatusDeploying)
-	h.DB.Model(&app).Update("status", "deploying")
+// appEnvVars returns the production variables an application runs with, with
+// secret references unresolved: its shared Environment, if any, overlaid
+// with the app's own variables.
+func (h *AppTaskHandler) appEnvVars(app model.Application) (map[string]string, error) {
+	vars := map[string]string{}
+	if app.EnvironmentID != nil {
+		var shared model.Environment
+		if err := h.DB.First(&shared, *app.EnvironmentID).Error; err != nil {
+			return nil, fmt.Errorf("environment %d: %w", *app.EnvironmentID, err)
+		}
+		for k, v := range shared.Variables {
+			vars[k] = v
+		}
+	}
+	for k, v := range app.EnvVars.Production {
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+// specFor captures the full spec of a deployment of app.
+func specFor(app model.Application, image string, env map[string]string, volumes []model.AppVolume) model.DeploymentSpec {
+	spec := model.DeploymentSpec{
+		AppName:       app.Name,
+		SourceType:    app.SourceType,
+		RepoURL:       app.RepoURL,
+		Branch:        app.Branch,
+		DockerImage:   app.DockerImage,
+		ManualPath:    app.ManualPath,
+		BuildType:     app.BuildType,
+		BuildCmd:      app.BuildCmd,
+		StartCmd:      app.StartCmd,
+		ClusterType:   app.Cluster.Type,
+		Image:         image,
+		Namespace:     app.Namespace,
+		Replicas:      app.Replicas,
+		Port:          app.Port,
+		Domain:        app.Domain,
+		Strategy:      app.DeployStrategy,
+		EnvironmentID: app.EnvironmentID,
+		Env:           env,
+	}
+	if app.Cluster.Type == model.ClusterTypeDockerSwarm {
+		policy := app.UpdatePolicy.WithDefaults()
+		spec.UpdatePolicy = &policy
+	}
+	if app.HealthCheck.Enabled() {
+		check := app.HealthCheck.WithDefaults(app.Port)
+		spec.HealthCheck = &check
+	}
+	if app.Hooks.PreDeploy != "" || app.Hooks.PostDeploy != "" {
+		hooks := app.Hooks
+		spec.Hooks = &hooks
+	}
+	spec.Volumes = volumeMounts(volumes)
+	if !app.Resources.IsZero() {
+		resources := app.Resources
+		spec.Resources = &resources
+	}
+	return spec
+}
 
-	// Build env args
-	envArgs := h.buildEnvArgs(app)
+// applySpec returns a copy of app configured as spec describes.
+func applySpec(app model.Application, spec model.DeploymentSpec) model.Application {
+	app.Namespace = spec.Namespace
+	app.Replicas = spec.Replicas
+	app.Port = spec.Port
+	if spec.Strategy != "" {
+		app.DeployStrategy = spec.Strategy
+	}
+	if spec.UpdatePolicy != nil {
+		app.UpdatePolicy = *spec.UpdatePolicy
+	}
+	app.HealthCheck = model.HealthCheck{}
+	if spec.HealthCheck != nil {
+		app.HealthCheck = *spec.HealthCheck
+	}
+	app.Resources = model.Resources{}
+	if spec.Resources != nil {
+		app.Resources = *spec.Resources
+	}
+	return app
+}
+
+// deployFailed handles an error from deployRuntime. A deployment that failed
+// its health check is not retried, and is rolled back if the application
+// asks for it.
+func (h *AppTaskHandler) deployFailed(client *sshpkg.Client, dep *model.Deployment, app *model.Application, err error) error {
+	if !errors.Is(err, errUnhealthy) {
+		return err
+	}
+	if app.HealthCheck.RollbackOnFailure {
+		h.rollbackUnhealthy(client, dep, app)
+	}
+	return fmt.Errorf("%w: %w", err, asynq.SkipRetry)
+}
+
+// deployRuntime runs image for the app on its cluster's runtime, with its
+// volumes mounted. When the app has a health check, it returns only once the
+// new instances pass it, or an error wrapping errUnhealthy. Volumes marked
+// for deletion are removed once the new instances no longer mount them.
+func (h *AppTaskHandler) deployRuntime(client *sshpkg.Client, dep *model.Deployment, app *model.Application, image string, env *resolvedEnv) error {
 	containerName := sanitizeName(app.Name)
-	portMapping := ""
+	var ports []string
 	if app.Port > 0 {
-		portMapping = fmt.Sprintf("-p %d:%d", app.Port, app.Port)
+		ports = []string{"-p", fmt.Sprintf("%d:%d", app.Port, app.Port)}
+	}
+
+	if !app.HealthCheck.Enabled() {
+		h.skipStep(dep, model.StepHealthCheck, "No health check configured.")
 	}
 
+	vols, err := h.prepareVolumes(client, dep, app)
+	if err != nil {
+		return err
+	}
 	switch app.Cluster.Type {
 	case model.ClusterTypeK8s:
-		err = h.deployK8s(client, &deployment, &app, imageName, containerName, envArgs)
+		err = h.deployK8s(client, dep, app, image, containerName, env, vols)
 	case model.ClusterTypeDockerSwarm:
-		err = h.deploySwarm(client, &deployment, &app, imageName, containerName, envArgs, portMapping)
+		err = h.deploySwarm(client, dep, app, image, containerName, env, ports, vols)
 	case model.ClusterTypeManual:
-		err = h.deployDocker(client, &deployment, &app, imageName, containerName, envArgs, portMapping)
+		err = h.deployDocker(client, dep, app, image, containerName, env, ports, vols)
 	default:
-		err = h.deployDocker(client, &deployment, &app, imageName, containerName, envArgs, portMapping)
+		err = h.deployDocker(client, dep, app, image, containerName, env, ports, vols)
 	}
-
 	if err != nil {
 		return err
 	}
-
-	// Step 5: Mark as live
-	h.DB.Model(&deployment).Updates(map[string]interface{}{
-		"status":    model.DeploymentStatusLive,
-		"image_tag": imageName,
-	})
-	h.DB.Model(&app).Update("status", "running")
-	h.appendLog(&deployment, fmt.Sprintf("Deployment %s is live!", version))
-
-	log.Printf("Deployment %s complete for app %s", version, app.Name)
+	h.pruneVolumes(client, dep, app)
 	return nil
 }
 
-func (h *AppTaskHandler) deployK8s(client *sshpkg.Client, dep *model.Deployment, app *model.Application, image, name, envArgs string) error {
+func (h *AppTaskHandler) deployK8s(client *sshpkg.Client, dep *model.Deployment, app *model.Application, image, name string, env *resolvedEnv, vols *appVolumes) error {
 	h.appendLog(dep, "Deploying to Kubernetes...")
 
-	// Generate K8s manifest
+	// Variables are delivered through a Secret object and referenced with
+	// envFrom, so values never appear in the Deployment manifest.
 	envYaml := ""
-	if app.EnvVars.Production != nil {
-		envYaml = "        env:\n"
-		for k, v := range app.EnvVars.Production {
-			envYaml += fmt.Sprintf("        - name: %s\n          value: \"%s\"\n", k, v)
+	if len(env.Vars) > 0 {
+		if err := applyK8sEnvSecret(client, name, app.Namespace, env.Vars); err != nil {
+			h.failDeployment(dep, app, err.Error())
+			return err
 		}
+		envYaml = fmt.Sprintf("        envFrom:\n        - secretRef:\n            name: %s-env\n", name)
 	}
 
 	portYaml := ""
@@ -205,13 +398,24 @@ func (h *AppTaskHandler) deployK8s(client *sshpkg.Client, dep *model.Deployment,
 		portYaml = fmt.Sprintf("        ports:\n        - containerPort: %d", app.Port)
 	}
 
+	// With volumes the app runs as a StatefulSet, which needs the name of
+	// the Service that governs it and gives each replica its own claims.
+	kind, other, serviceYaml := "Deployment", "statefulset/"+name, ""
+	if len(vols.list) > 0 {
+		kind, other, serviceYaml = "StatefulSet", "deployment/"+name, fmt.Sprintf("  serviceName: %s\n", name)
+		if err := h.syncClaimTemplates(client, dep, app, vols.list); err != nil {
+			h.failDeployment(dep, app, fmt.Sprintf("Replacing the StatefulSet failed: %v", err))
+			return err
+		}
+	}
+
 	manifest := fmt.Sprintf(`apiVersion: apps/v1
-kind: Deployment
+kind: %s
 metadata:
   name: %s
   namespace: %s
 spec:
-  replicas: %d
+%s  replicas: %d
   selector:
     matchLabels:
       app: %s
@@ -223,7 +427,7 @@ spec:
       containers:
       - name: %s
         image: %s
-%s%s
+%s%s%s%s%s%s
 ---
 apiVersion: v1
 kind: Service
@@ -237,77 +441,330 @@ spec:
   - port: %d
     targetPort: %d
   type: ClusterIP`,
-		name, app.Namespace, app.Replicas, name, name, name, image,
-		envYaml, portYaml,
+		kind, name, app.Namespace, serviceYaml, app.Replicas, name, name, name, image,
+		envYaml, portYaml, k8sProbesYaml(app.HealthCheck.WithDefaults(app.Port)), k8sResourcesYaml(app.Resources),
+		k8sVolumeMountsYaml(vols.list), h.k8sClaimTemplatesYaml(app, vols.list),
 		name, app.Namespace, name,
 		app.Port, app.Port,
 	)
 
-	// Write and apply manifest
-	writeCmd := fmt.Sprintf("cat > /tmp/%s.yaml << 'ORCHESTRA_EOF'\n%s\nORCHESTRA_EOF", name, manifest)
-	client.ExecuteCommand(writeCmd)
-
-	result, err := client.ExecuteCommand(fmt.Sprintf("kubectl apply -f /tmp/%s.yaml 2>&1", name))
-	if err != nil {
-		h.failDeployment(dep, app, fmt.Sprintf("kubectl apply failed: %s", result.Stderr))
+	result, err := client.ExecuteCommandWithInput("kubectl apply -f - 2>&1", []byte(manifest))
+	if err := commandError(result, err); err != nil {
+		h.failDeployment(dep, app, fmt.Sprintf("kubectl apply failed: %s", commandOutput(result)))
 		return fmt.Errorf("kubectl apply: %w", err)
 	}
 	h.appendLog(dep, "Kubernetes deployment applied.")
+	// An app that gained or lost its volumes changed workload kind; the
+	// workload of the old kind is removed once the new one is applied.
+	result, err = client.ExecuteCommand(sshpkg.Shellf("kubectl delete %s -n %s --ignore-not-found 2>&1", other, app.Namespace))
+	if err := commandError(result, err); err != nil {
+		h.appendLog(dep, fmt.Sprintf("WARNING: removing %s failed: %s", other, commandOutput(result)))
+	} else if out := strings.TrimSpace(result.Stdout); out != "" {
+		h.appendLog(dep, out)
+	}
+	h.skipStep(dep, model.StepRouteTraffic, "The Kubernetes Service is applied with the Deployment.")
+
+	if app.HealthCheck.Enabled() {
+		check := app.HealthCheck.WithDefaults(app.Port)
+		h.beginStep(dep, model.StepHealthCheck)
+		h.appendLog(dep, fmt.Sprintf("Waiting up to %ds for pods to pass their %s health check...", check.DeadlineSeconds, check.Type))
+		if err := waitK8sReady(client, app, check); err != nil {
+			h.failDeployment(dep, app, err.Error())
+			return err
+		}
+		h.appendLog(dep, "All pods are healthy.")
+	}
 	return nil
 }
 
-func (h *AppTaskHandler) deploySwarm(client *sshpkg.Client, dep *model.Deployment, app *model.Application, image, name, envArgs, portMapping string) error {
+func (h *AppTaskHandler) deploySwarm(client *sshpkg.Client, dep *model.Deployment, app *model.Application, image, name string, env *resolvedEnv, ports []string, vols *appVolumes) error {
 	h.appendLog(dep, "Deploying to Docker Swarm...")
 
-	// Remove existing service
-	client.ExecuteCommand(fmt.Sprintf("docker service rm %s 2>/dev/null", name))
+	// Every variable is set on the service, as on plain Docker. Values that
+	// come from secrets are also stored as Swarm secrets mounted at
+	// /run/secrets/<KEY>, with <KEY>_FILE pointing at them, for images that
+	// read secrets from files.
+	serviceEnv := map[string]string{}
+	var secrets []swarmSecretRef
+	for _, k := range sortedKeys(env.Vars) {
+		v := env.Vars[k]
+		serviceEnv[k] = v
+		if !env.Secrets[k] {
+			continue
+		}
+		secretName := swarmSecretName(name, k, v)
+		createCmd := sshpkg.Shellf("docker secret inspect %s >/dev/null 2>&1 || docker secret create --label %s %s - 2>&1",
+			secretName, "orchestra.app="+name, secretName)
+		result, err := client.ExecuteCommandWithInput(createCmd, []byte(v))
+		if err := commandError(result, err); err != nil {
+			h.failDeployment(dep, app, fmt.Sprintf("Creating swarm secret for %s failed: %s", k, commandOutput(result)))
+			return fmt.Errorf("swarm secret create: %w", err)
+		}
+		secrets = append(secrets, swarmSecretRef{Name: secretName, Target: k})
+		serviceEnv[k+"_FILE"] = "/run/secrets/" + k
+	}
 
-	cmd := fmt.Sprintf("docker service create --name %s --replicas %d %s %s %s 2>&1",
-		name, app.Replicas, envArgs, portMapping, image)
-	result, err := client.ExecuteCommand(cmd)
-	if err != nil {
-		h.failDeployment(dep, app, fmt.Sprintf("Swarm deploy failed: %s", result.Stderr))
-		return fmt.Errorf("swarm deploy: %w", err)
+	policy := app.UpdatePolicy.WithDefaults()
+	timeout, _ := time.ParseDuration(policy.ConvergeTimeout)
+
+	if swarmServiceExists(client, name) {
+		if err := h.updateSwarmService(client, dep, app, image, name, serviceEnv, secrets, vols, policy, timeout); err != nil {
+			return err
+		}
+	} else {
+		envFile, err := h.writeEnvFile(client, dep, app, serviceEnv)
+		if err != nil {
+			return err
+		}
+		cmd := sshpkg.Cmd("timeout", strconv.Itoa(int(timeout.Seconds())), "docker", "service", "create", "--quiet",
+			"--name", name, "--label", "orchestra.app="+name, "--replicas", strconv.Itoa(app.Replicas))
+		cmd.Arg(swarmPolicyArgs(policy)...)
+		cmd.Arg(swarmResourceArgs(app.Resources)...)
+		cmd.Arg(swarmVolumeArgs(app, vols)...)
+		cmd.Arg(dockerHealthArgs(app.HealthCheck.WithDefaults(app.Port))...)
+		cmd.Arg(envFile.args...)
+		for _, sec := range secrets {
+			cmd.Arg("--secret", fmt.Sprintf("source=%s,target=%s", sec.Name, sec.Target))
+		}
+		cmd.Arg(ports...).Arg(image).Raw("2>&1")
+		result, err := client.ExecuteCommand(envFile.command(cmd))
+		if err := commandError(result, err); err != nil {
+			h.failDeployment(dep, app, fmt.Sprintf("Swarm deploy failed: %s", swarmCommandFailure(result)))
+			return fmt.Errorf("swarm deploy: %w", err)
+		}
+		h.appendLog(dep, "Swarm service created.")
 	}
-	h.appendLog(dep, "Swarm service created.")
+
+	if app.HealthCheck.Enabled() {
+		h.skipStep(dep, model.StepHealthCheck, "Swarm waited for tasks to pass their health check while the service converged.")
+	}
+	h.skipStep(dep, model.StepRouteTraffic, "Swarm's routing mesh publishes the service port.")
+	h.logSwarmTasks(client, dep, name)
+
+	var keep []string
+	for _, sec := range secrets {
+		keep = append(keep, sec.Name)
+	}
+	h.pruneSwarmSecrets(client, name, keep)
 	return nil
 }
 
-func (h *AppTaskHandler) deployDocker(client *sshpkg.Client, dep *model.Deployment, app *model.Application, image, name, envArgs, portMapping string) error {
-	h.appendLog(dep, "Deploying with Docker...")
+// pruneSwarmSecrets removes this app's Swarm secrets that are no longer
+// referenced. Docker refuses to remove secrets still in use, so errors are
+// ignored.
+func (h *AppTaskHandler) pruneSwarmSecrets(client *sshpkg.Client, name string, keep []string) {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker secret ls --filter %s --format %s",
+		"label=orchestra.app="+name, "{{.Name}}"))
+	if err != nil {
+		return
+	}
+	inUse := map[string]bool{}
+	for _, n := range keep {
+		inUse[n] = true
+	}
+	for _, n := range strings.Fields(result.Stdout) {
+		if !inUse[n] {
+			client.ExecuteCommand(sshpkg.Shellf("docker secret rm %s 2>/dev/null", n))
+		}
+	}
+}
 
-	// Stop existing container
-	client.ExecuteCommand(fmt.Sprintf("docker stop %s 2>/dev/null; docker rm %s 2>/dev/null", name, name))
+func (h *AppTaskHandler) deployDocker(client *sshpkg.Client, dep *model.Deployment, app *model.Application, image, name string, env *resolvedEnv, ports []string, vols *appVolumes) error {
+	if app.DeployStrategy == model.DeployStrategyBlueGreen {
+		return h.deployDockerBlueGreen(client, dep, app, image, name, env, ports, vols)
+	}
+	h.appendLog(dep, "Deploying with Docker...")
 
-	cmd := fmt.Sprintf("docker run -d --name %s --restart unless-stopped %s %s %s 2>&1",
-		name, envArgs, portMapping, image)
-	result, err := client.ExecuteCommand(cmd)
+	envFile, err := h.writeEnvFile(client, dep, app, env.Vars)
 	if err != nil {
-		h.failDeployment(dep, app, fmt.Sprintf("Docker run failed: %s", result.Stderr))
+		return err
+	}
+
+	// Stop existing container, including any left by a blue/green deploy
+	for _, c := range []string{name, name + "-" + slotBlue, name + "-" + slotGreen} {
+		client.ExecuteCommand(sshpkg.Shellf("docker stop %[1]s 2>/dev/null; docker rm %[1]s 2>/dev/null", c))
+	}
+
+	volumeArgs := dockerVolumeArgs(app, vols.list)
+	check := app.HealthCheck.WithDefaults(app.Port)
+	cmd := sshpkg.Cmd("docker", "run", "-d", "--name", name, "--label", "orchestra.app="+name, "--restart", "unless-stopped").
+		Arg(dockerResourceArgs(app.Resources)...).
+		Arg(dockerHealthArgs(check)...).
+		Arg(envFile.args...).
+		Arg(volumeArgs...).
+		Arg(ports...).
+		Arg(image).
+		Raw("2>&1")
+	result, err := client.ExecuteCommand(envFile.command(cmd))
+	if err := commandError(result, err); err != nil {
+		h.failDeployment(dep, app, fmt.Sprintf("Docker run failed: %s", commandOutput(result)))
 		return fmt.Errorf("docker run: %w", err)
 	}
 	h.appendLog(dep, "Docker container started.")
+
+	if check.Enabled() {
+		h.beginStep(dep, model.StepHealthCheck)
+		h.appendLog(dep, fmt.Sprintf("Waiting up to %ds for the %s health check to pass...", check.DeadlineSeconds, check.Type))
+		if err := waitDockerHealthy(client, name, check); err != nil {
+			h.failDeployment(dep, app, err.Error())
+			return err
+		}
+		h.appendLog(dep, "Container is healthy.")
+	}
+
+	if err := reconcileDockerReplicas(client, app, image, envFile, volumeArgs, true); err != nil {
+		h.failDeployment(dep, app, fmt.Sprintf("Starting replicas failed: %v", err))
+		return err
+	}
+	if app.Replicas > 1 {
+		h.appendLog(dep, fmt.Sprintf("Started %d more replica(s) on loopback ports.", app.Replicas-1))
+	}
+
+	// nginx balances over the published port and every replica; sites left
+	// pointing at a blue/green slot go back to the published port.
+	if app.Port > 0 {
+		h.beginStep(dep, model.StepRouteTraffic)
+		sites, err := h.appNginxSites(app)
+		if err == nil && len(sites) == 0 && app.Replicas > 1 {
+			h.appendLog(dep, fmt.Sprintf("WARNING: no nginx site routes to the application, so only port %d receives traffic.", app.Port))
+		}
+		var ports []int
+		if err == nil && len(sites) > 0 {
+			ports, err = dockerUpstreamPorts(client, app, app.Port)
+		}
+		if err == nil && len(sites) > 0 {
+			err = h.pointNginxAt(client, dep, sites, ports)
+		}
+		if err != nil {
+			h.appendLog(dep, fmt.Sprintf("WARNING: routing nginx to the application's containers failed: %v", err))
+		}
+	}
 	return nil
 }
 
-func (h *AppTaskHandler) buildEnvArgs(app model.Application) string {
-	var parts []string
-	if app.EnvVars.Production != nil {
-		for k, v := range app.EnvVars.Production {
-			parts = append(parts, fmt.Sprintf("-e %s='%s'", k, v))
-		}
+// dockerEnv loads an env file into a docker command: args are the
+// --env-file flags, and exports, if set, is the script the command sources
+// first for values the file cannot hold (see envFileContent).
+type dockerEnv struct {
+	args    []string
+	exports string
+}
+
+// command renders cmd so that it runs with the env file's exports set.
+func (e dockerEnv) command(cmd *sshpkg.Command) string {
+	if e.exports == "" {
+		return cmd.String()
+	}
+	return sshpkg.Shellf(". %s && ", e.exports) + cmd.String()
+}
+
+// writeDockerEnv writes vars to a 0600 env file at path, and the exports
+// the file relies on to path+".sh", removing a stale one when there are
+// none.
+func writeDockerEnv(client *sshpkg.Client, path string, vars map[string]string) (dockerEnv, error) {
+	content, exports, err := envFileContent(vars)
+	if err != nil {
+		return dockerEnv{}, err
 	}
-	return strings.Join(parts, " ")
+	if err := client.WriteFile(path, []byte(content), 0600); err != nil {
+		return dockerEnv{}, fmt.Errorf("write env file: %w", err)
+	}
+	env := dockerEnv{args: []string{"--env-file", path}}
+	script := path + ".sh"
+	if exports == "" {
+		client.ExecuteCommand(sshpkg.Cmd("rm", "-f", script).String())
+		return env, nil
+	}
+	if err := client.WriteFile(script, []byte(exports), 0600); err != nil {
+		return dockerEnv{}, fmt.Errorf("write env exports: %w", err)
+	}
+	env.exports = script
+	return env, nil
+}
+
+// writeEnvFile writes vars to the app's env file and returns what loads it
+// into a docker command, or nothing when there is nothing to load.
+func (h *AppTaskHandler) writeEnvFile(client *sshpkg.Client, dep *model.Deployment, app *model.Application, vars map[string]string) (dockerEnv, error) {
+	if len(vars) == 0 {
+		return dockerEnv{}, nil
+	}
+	env, err := writeDockerEnv(client, appDirFor(*app)+"/.env", vars)
+	if err != nil {
+		h.failDeployment(dep, app, fmt.Sprintf("Writing env file failed: %v", err))
+		return dockerEnv{}, err
+	}
+	return env, nil
+}
+
+// applyK8sEnvSecret stores vars in the <name>-env Secret: the app's pods load
+// their environment from its own, and each hook or command Job from one
+// named after the Job.
+func applyK8sEnvSecret(client *sshpkg.Client, name, namespace string, vars map[string]string) error {
+	manifest := k8sEnvSecretManifest(name+"-env", namespace, vars)
+	result, err := client.ExecuteCommandWithInput("kubectl apply -f - 2>&1", []byte(manifest))
+	if err := commandError(result, err); err != nil {
+		return fmt.Errorf("applying env secret failed: %v: %s", err, commandOutput(result))
+	}
+	return nil
+}
+
+// k8sEnvSecretManifest renders an Opaque Secret holding vars.
+func k8sEnvSecretManifest(name, namespace string, vars map[string]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "apiVersion: v1\nkind: Secret\nmetadata:\n  name: %s\n  namespace: %s\ntype: Opaque\ndata:\n", name, namespace)
+	for _, k := range sortedKeys(vars) {
+		fmt.Fprintf(&b, "  %s: %s\n", k, base64.StdEncoding.EncodeToString([]byte(vars[k])))
+	}
+	return b.String()
+}
+
+// commandError folds a non-zero exit status into the error returned by
+// ExecuteCommand, which only reports transport failures.
+func commandError(result *sshpkg.CommandResult, err error) error {
+	if err != nil {
+		return err
+	}
+	if result != nil && result.ExitCode != 0 {
+		return fmt.Errorf("exit status %d", result.ExitCode)
+	}
+	return nil
+}
+
+// commandOutput returns the most useful text from a command result for an
+// error message.
+func commandOutput(result *sshpkg.CommandResult) string {
+	if result == nil {
+		return ""
+	}
+	if out := strings.TrimSpace(result.Stderr); out != "" {
+		return out
+	}
+	return strings.TrimSpace(result.Stdout)
 }
 
 func (h *AppTaskHandler) failDeployment(dep *model.Deployment, app *model.Application, msg string) {
 	h.appendLog(dep, fmt.Sprintf("ERROR: %s", msg))
-	h.DB.Model(dep).Update("status", model.DeploymentStatusFailed)
-	h.DB.Model(app).Update("status", "failed")
+	h.endStep(dep, model.StepStatusFailed)
+	res := h.DB.Model(dep).Where("status <> ?", model.DeploymentStatusCancelled).Update("status", model.DeploymentStatusFailed)
+	if res.RowsAffected > 0 {
+		h.DB.Model(app).Update("status", "failed")
+	}
 }
 
 func (h *AppTaskHandler) appendLog(dep *model.Deployment, line string) {
-	h.DB.Model(dep).Update("logs", gorm.Expr("COALESCE(logs, '') || ?", line+"\n"))
+	h.appendEntries(dep, deploylog.System(line))
+}
+
+// appendEntries adds entries to the deployment log under the running step.
+func (h *AppTaskHandler) appendEntries(dep *model.Deployment, entries []deploylog.Entry) {
+	if err := deploylog.Append(h.DB, dep, h.runningStep(dep), entries); err != nil {
+		log.Printf("Deployment %d: failed to write log: %v", dep.ID, err)
+	}
+}
+
+// appDirFor returns the working directory used for an app on its manager.
+func appDirFor(app model.Application) string {
+	return fmt.Sprintf("/opt/orchestra/apps/%s", sanitizeName(app.Name))
 }
 
 func sanitizeName(name string) string {
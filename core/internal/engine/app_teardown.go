@@ -0,0 +1,396 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const TypeTeardownApplication = "app:teardown"
+
+// Application statuses used while and after tearing an application down.
+const (
+	AppStatusDeleting       = "deleting"
+	AppStatusTeardownFailed = "teardown_failed"
+)
+
+// ErrAppDeleting is returned when a deployment is requested for an
+// application that is being deleted.
+var ErrAppDeleting = errors.New("application is being deleted")
+
+// Timing of a teardown.
+const (
+	// teardownSlotWait is how long a teardown waits for a cancelled
+	// deployment to release the deploy slot before taking it over.
+	teardownSlotWait = 5 * time.Minute
+	// swarmSecretAttempts bounds the wait for a removed service's tasks to
+	// stop using its secrets.
+	swarmSecretAttempts = 10
+)
+
+type TeardownAppPayload struct {
+	AppID       uint      `json:"app_id"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// NewTeardownAppTask removes an application's runtime resources and then
+// its record. It is enqueued by EnqueueTeardown.
+func NewTeardownAppTask(appID uint, requestedAt time.Time) (*asynq.Task, error) {
+	payload, err := json.Marshal(TeardownAppPayload{AppID: appID, RequestedAt: requestedAt})
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TypeTeardownApplication, payload, asynq.Queue("deployment"), asynq.MaxRetry(3)), nil
+}
+
+// EnqueueTeardown marks the application as deleting, cancels its queued and
+// running deployments and enqueues the task that tears it down. Deleting an
+// application that is already being deleted only makes sure the task is
+// queued.
+func EnqueueTeardown(db *gorm.DB, client *asynq.Client, app *model.Application) error {
+	if err := db.Model(app).Updates(map[string]interface{}{
+		"status":          AppStatusDeleting,
+		"teardown_report": nil,
+	}).Error; err != nil {
+		return fmt.Errorf("mark application deleting: %w", err)
+	}
+	app.Status = AppStatusDeleting
+	app.TeardownReport = nil
+
+	var cancelled []model.Deployment
+	db.Model(&cancelled).Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}, {Name: "application_id"}}}).
+		Where("application_id = ? AND status IN ?", app.ID, model.DeploymentStatusesActive).
+		Update("status", model.DeploymentStatusCancelled)
+	for i := range cancelled {
+		appendQueueLog(db, &cancelled[i], "Cancelled: the application is being deleted.")
+	}
+
+	task, err := NewTeardownAppTask(app.ID, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = client.Enqueue(task, asynq.TaskID(fmt.Sprintf("teardown:%d", app.ID)))
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("enqueue teardown: %w", err)
+	}
+	return nil
+}
+
+// HandleTeardownAppTask removes everything the application left on its
+// cluster: containers, Swarm services and secrets, Kubernetes objects, nginx
+// sites, images and the app directory on every node. The application record
+// is deleted once everything is gone; otherwise it stays, marked
+// teardown_failed, with a report of what is left.
+func (h *AppTaskHandler) HandleTeardownAppTask(ctx context.Context, t *asynq.Task) error {
+	var p TeardownAppPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+
+	var app model.Application
+	if err := h.DB.Preload("Cluster").Preload("Cluster.ManagerServer").First(&app, p.AppID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Application %d is already deleted; nothing to tear down", p.AppID)
+			return nil
+		}
+		return fmt.Errorf("app lookup failed: %w", err)
+	}
+	if app.Status != AppStatusDeleting {
+		log.Printf("Application %d is %s, not deleting; skipping teardown", app.ID, app.Status)
+		return nil
+	}
+
+	// A cancelled deployment may still be stopping its remote commands.
+	if app.ActiveDeploymentID != nil && time.Since(p.RequestedAt) < teardownSlotWait {
+		return h.requeue(ctx, t)
+	}
+	h.DB.Model(&app).Update("active_deployment_id", nil)
+
+	td := &teardown{h: h, app: &app, report: &model.TeardownReport{StartedAt: time.Now()}}
+	if err := td.run(ctx); err != nil {
+		if willRetry(ctx, err) {
+			return err
+		}
+		if len(td.report.Failed) == 0 {
+			td.fail("all resources", "", err)
+		}
+	}
+
+	now := time.Now()
+	td.report.FinishedAt = &now
+	if len(td.report.Failed) > 0 {
+		h.DB.Model(&app).Updates(map[string]interface{}{
+			"status":          AppStatusTeardownFailed,
+			"teardown_report": td.report,
+		})
+		logActivity(h.DB, model.ActivityTypeAppDeleted,
+			fmt.Sprintf("Application '%s' could not be fully torn down: %d resource(s) left", app.Name, len(td.report.Failed)),
+			"application", app.ID)
+		return nil
+	}
+
+	h.DB.Model(&app).Update("teardown_report", td.report)
+	if err := h.DB.Delete(&app).Error; err != nil {
+		return fmt.Errorf("delete application: %w", err)
+	}
+	h.DB.Where("application_id = ?", app.ID).Delete(&model.NginxConfig{})
+	h.DB.Where("application_id = ?", app.ID).Delete(&model.AppVolume{})
+	logActivity(h.DB, model.ActivityTypeAppDeleted,
+		fmt.Sprintf("Application '%s' deleted and its resources removed", app.Name), "application", app.ID)
+	log.Printf("Application %s torn down", app.Name)
+	return nil
+}
+
+// teardown removes one application's runtime resources and records the
+// outcome of each removal.
+type teardown struct {
+	h      *AppTaskHandler
+	app    *model.Application
+	report *model.TeardownReport
+}
+
+func (td *teardown) removed(resource, server string) {
+	if server != "" {
+		resource += " on " + server
+	}
+	td.report.Removed = append(td.report.Removed, resource)
+}
+
+func (td *teardown) fail(resource, server string, err error) {
+	td.report.Failed = append(td.report.Failed, model.TeardownFailure{Resource: resource, Server: server, Error: err.Error()})
+}
+
+// exec runs cmd and records resource as removed or failed.
+func (td *teardown) exec(client *sshpkg.Client, server, resource, cmd string) bool {
+	result, err := client.ExecuteCommand(cmd)
+	if err := commandError(result, err); err != nil {
+		td.fail(resource, server, fmt.Errorf("%v: %s", err, commandOutput(result)))
+		return false
+	}
+	td.removed(resource, server)
+	return true
+}
+
+func (td *teardown) run(ctx context.Context) error {
+	app := td.app
+	name := sanitizeName(app.Name)
+
+	if app.Cluster.ManagerServer.ID == 0 {
+		return fmt.Errorf("cluster has no manager server: %w", asynq.SkipRetry)
+	}
+	servers, err := td.nodes()
+	if err != nil {
+		return err
+	}
+	clients := map[uint]*sshpkg.Client{}
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	for _, s := range servers {
+		client, err := td.h.dial(s)
+		if err != nil {
+			td.fail("all resources", serverLabel(s), err)
+			continue
+		}
+		clients[s.ID] = client.WithContext(ctx)
+	}
+	manager, ok := clients[app.Cluster.ManagerServer.ID]
+	if !ok {
+		// Nothing can be removed without the manager; try again later.
+		return fmt.Errorf("SSH to manager %s failed", app.Cluster.ManagerServer.IP)
+	}
+	managerName := serverLabel(app.Cluster.ManagerServer)
+
+	switch app.Cluster.Type {
+	case model.ClusterTypeK8s:
+		td.exec(manager, managerName, fmt.Sprintf("Kubernetes workload, Service and Secret %s in %s", name, app.Namespace),
+			sshpkg.Cmd("kubectl", "delete", "deployment/"+name, "statefulset/"+name, "service/"+name, "secret/"+name+"-env",
+				"-n", app.Namespace, "--ignore-not-found", "--wait=true").Raw("2>&1").String())
+		td.exec(manager, managerName, fmt.Sprintf("persistent volume claims of %s in %s", name, app.Namespace),
+			sshpkg.Cmd("kubectl", "delete", "pvc", "-l", "orchestra.app="+name,
+				"-n", app.Namespace, "--ignore-not-found", "--wait=false").Raw("2>&1").String())
+	case model.ClusterTypeDockerSwarm:
+		if swarmServiceExists(manager, name) {
+			td.exec(manager, managerName, "Swarm service "+name,
+				sshpkg.Shellf("docker service rm %s 2>&1", name))
+		}
+		td.removeSwarmSecrets(ctx, manager, managerName, name)
+	}
+
+	for _, nginx := range td.nginxSites() {
+		client, ok := clients[nginx.ServerID]
+		if !ok {
+			if client, err = td.h.dial(nginx.Server); err != nil {
+				td.fail("nginx site "+nginx.Domain, serverLabel(nginx.Server), err)
+				continue
+			}
+			clients[nginx.ServerID] = client
+		}
+		td.removeNginxSite(client, &nginx)
+	}
+
+	images := td.images()
+	for _, s := range servers {
+		client, ok := clients[s.ID]
+		if !ok {
+			continue
+		}
+		// Docker containers, including blue/green slots, carry the app label;
+		// on Swarm nodes this also catches tasks still shutting down.
+		td.exec(client, serverLabel(s), "containers of "+name,
+			sshpkg.Shellf("command -v docker >/dev/null || exit 0; docker ps -aq --filter %s | xargs -r docker rm -f 2>&1",
+				"label=orchestra.app="+name))
+		td.exec(client, serverLabel(s), "volumes of "+name,
+			sshpkg.Shellf("command -v docker >/dev/null || exit 0; docker volume ls -q --filter %s | xargs -r docker volume rm 2>&1",
+				"label=orchestra.app="+name))
+		for _, image := range images {
+			td.removeImage(client, serverLabel(s), image)
+		}
+		td.exec(client, serverLabel(s), "directory "+appDirFor(*app),
+			sshpkg.Cmd("rm", "-rf", "--", appDirFor(*app)).String())
+	}
+	return nil
+}
+
+// nodes returns the servers of the application's cluster, manager first.
+func (td *teardown) nodes() ([]model.Server, error) {
+	manager := td.app.Cluster.ManagerServer
+	var workers []model.Server
+	if err := td.h.DB.Where("cluster_id = ? AND id <> ?", td.app.ClusterID, manager.ID).Find(&workers).Error; err != nil {
+		return nil, fmt.Errorf("load cluster servers: %w", err)
+	}
+	if manager.ID == 0 {
+		return workers, nil
+	}
+	return append([]model.Server{manager}, workers...), nil
+}
+
+func (td *teardown) nginxSites() []model.NginxConfig {
+	var sites []model.NginxConfig
+	td.h.DB.Preload("Server").Where("application_id = ?", td.app.ID).Find(&sites)
+	return sites
+}
+
+// images returns the images this application's deployments ran. Images named
+// directly by the application are kept when another application uses them.
+func (td *teardown) images() []string {
+	var tags []string
+	td.h.DB.Model(&model.Deployment{}).Where("application_id = ? AND image_tag <> ''", td.app.ID).
+		Distinct().Pluck("image_tag", &tags)
+	if td.app.DockerImage != "" && !containsTag(tags, td.app.DockerImage) {
+		tags = append(tags, td.app.DockerImage)
+	}
+
+	var shared []string
+	td.h.DB.Model(&model.Application{}).Where("id <> ? AND cluster_id = ? AND docker_image IN ?", td.app.ID, td.app.ClusterID, tags).
+		Pluck("docker_image", &shared)
+	var images []string
+	for _, tag := range tags {
+		if !containsTag(shared, tag) {
+			images = append(images, tag)
+		}
+	}
+	return images
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// removeImage removes image from one node if it is present there.
+func (td *teardown) removeImage(client *sshpkg.Client, server, image string) {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker image inspect %s >/dev/null 2>&1", image))
+	if err != nil || result.ExitCode != 0 {
+		return
+	}
+	td.exec(client, server, "image "+image, sshpkg.Shellf("docker image rm %s 2>&1", image))
+}
+
+// removeSwarmSecrets removes the application's Swarm secrets. Secrets cannot
+// be removed while tasks of the removed service are still shutting down, so
+// removal is retried for a while.
+func (td *teardown) removeSwarmSecrets(ctx context.Context, client *sshpkg.Client, server, name string) {
+	list := sshpkg.Shellf("docker secret ls --filter %s --format %s", "label=orchestra.app="+name, "{{.Name}}")
+	var left []string
+	for attempt := 0; attempt < swarmSecretAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				td.fail("Swarm secrets "+strings.Join(left, ", "), server, ctx.Err())
+				return
+			case <-time.After(dockerHealthPollInterval):
+			}
+		}
+		result, err := client.ExecuteCommand(list)
+		if err := commandError(result, err); err != nil {
+			td.fail("Swarm secrets of "+name, server, fmt.Errorf("%v: %s", err, commandOutput(result)))
+			return
+		}
+		left = left[:0]
+		for _, secret := range strings.Fields(result.Stdout) {
+			rm, err := client.ExecuteCommand(sshpkg.Shellf("docker secret rm %s 2>&1", secret))
+			if commandError(rm, err) == nil {
+				td.removed("Swarm secret "+secret, server)
+			} else {
+				left = append(left, secret)
+			}
+		}
+		if len(left) == 0 {
+			return
+		}
+	}
+	td.fail("Swarm secrets "+strings.Join(left, ", "), server, errors.New("still in use"))
+}
+
+// removeNginxSite removes a site's config and upstream and reloads nginx.
+func (td *teardown) removeNginxSite(client *sshpkg.Client, site *model.NginxConfig) {
+	file := sanitizeName(site.Domain)
+	cmd := sshpkg.Shellf("rm -f -- %s %s %s && { nginx -t 2>&1 && systemctl reload nginx 2>&1; }",
+		"/etc/nginx/sites-enabled/"+file, nginxSitePath(site.Domain), nginxUpstreamPath(site.Domain))
+	if td.exec(client, serverLabel(site.Server), "nginx site "+site.Domain, cmd) {
+		td.h.DB.Delete(site)
+	}
+}
+
+// serverLabel names a server in a teardown report.
+func serverLabel(s model.Server) string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	return s.IP
+}
+
+// dial opens an SSH connection to server.
+func (h *AppTaskHandler) dial(server model.Server) (*sshpkg.Client, error) {
+	return dialServer(server, h.EncryptionKey)
+}
+
+// dialServer opens an SSH connection to server with its stored key.
+func dialServer(server model.Server, keyHex string) (*sshpkg.Client, error) {
+	sshKey, err := decrypt(server.SSHKeyEncrypted, keyHex)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt SSH key: %w", err)
+	}
+	client, err := sshpkg.NewClient(server.IP, server.SSHPort, server.SSHUser, sshKey, "")
+	if err != nil {
+		return nil, fmt.Errorf("SSH to %s: %w", server.IP, err)
+	}
+	return client, nil
+}
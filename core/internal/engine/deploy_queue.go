@@ -0,0 +1,430 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/deploylog"
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Deployments of one application run one at a time. Each is recorded as a
+// queued Deployment when it is requested; its task waits for the
+// application's deploy slot (Application.ActiveDeploymentID), runs, and
+// releases it. Cancelling sets the deployment's status, which the running
+// task notices and turns into aborting its remote commands.
+//
+// Handlers check a deployment against its cluster's capacity
+// (service.CheckCapacity) before queueing it. Restarts the engine queues
+// after an environment push, and automatic rollbacks of unhealthy deploys,
+// are not checked: they must not be refused for want of room.
+
+// Timing of the deploy queue.
+const (
+	deploySlotRetryDelay = 5 * time.Second // how soon a task waiting for the slot tries again
+	cancelPollInterval   = 2 * time.Second // how often a running deployment checks for cancellation
+	queuedStaleAfter     = 5 * time.Minute // how long a queued deployment goes untouched before its task is checked
+)
+
+// errDeploySlotBusy means another deployment of the application holds its
+// deploy slot, or an earlier one is still waiting for it.
+var errDeploySlotBusy = errors.New("another deployment of this application is queued or running")
+
+// EnqueueDeploy records a queued deployment of the application's current
+// configuration and enqueues the task that runs it.
+func EnqueueDeploy(db *gorm.DB, client *asynq.Client, app *model.Application) (*model.Deployment, error) {
+	dep := model.Deployment{ApplicationID: app.ID, Kind: model.DeploymentKindDeploy}
+	return enqueueDeployment(db, client, app, &dep, "", func(id uint) (*asynq.Task, error) {
+		return NewDeployAppTask(app.ID, id)
+	})
+}
+
+// EnqueueRestart records a queued restart of the application on its live
+// image. Applications that have never gone live have nothing to restart and
+// get no deployment: it returns nil, nil.
+func EnqueueRestart(db *gorm.DB, client *asynq.Client, app *model.Application, reason string) (*model.Deployment, error) {
+	var live int64
+	db.Model(&model.Deployment{}).Where("application_id = ? AND status = ? AND image_tag <> ''", app.ID, model.DeploymentStatusLive).Count(&live)
+	if live == 0 {
+		return nil, nil
+	}
+	dep := model.Deployment{ApplicationID: app.ID, Kind: model.DeploymentKindRestart}
+	return enqueueDeployment(db, client, app, &dep, "Restart requested: "+reason, func(id uint) (*asynq.Task, error) {
+		return NewRestartAppTask(app.ID, id, reason)
+	})
+}
+
+// EnqueueRollback records a queued deployment that restores target's image
+// and spec.
+func EnqueueRollback(db *gorm.DB, client *asynq.Client, app *model.Application, target *model.Deployment) (*model.Deployment, error) {
+	targetID := target.ID
+	dep := model.Deployment{
+		ApplicationID: app.ID,
+		Kind:          model.DeploymentKindRollback,
+		ImageTag:      target.ImageTag,
+		RollbackOfID:  &targetID,
+	}
+	return enqueueDeployment(db, client, app, &dep, fmt.Sprintf("Rollback to %s requested.", target.Version), NewRollbackTask)
+}
+
+func enqueueDeployment(db *gorm.DB, client *asynq.Client, app *model.Application, dep *model.Deployment,
+	note string, newTask func(deploymentID uint) (*asynq.Task, error)) (*model.Deployment, error) {
+
+	var status string
+	db.Model(&model.Application{}).Where("id = ?", app.ID).Select("status").Scan(&status)
+	switch status {
+	case AppStatusDeleting, AppStatusTeardownFailed:
+		return nil, ErrAppDeleting
+	case AppStatusStopping, AppStatusStarting, AppStatusScaling:
+		return nil, ErrLifecycleBusy
+	}
+
+	version, err := nextVersion(db, app.ID)
+	if err != nil {
+		return nil, err
+	}
+	dep.Version = version
+	dep.Status = model.DeploymentStatusQueued
+	if err := db.Create(dep).Error; err != nil {
+		return nil, fmt.Errorf("create deployment: %w", err)
+	}
+	if note != "" {
+		appendQueueLog(db, dep, note)
+	}
+
+	if app.DeployQueueMode == model.DeployQueueModeSupersede {
+		var superseded []model.Deployment
+		res := db.Model(&superseded).Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}, {Name: "application_id"}}}).
+			Where("application_id = ? AND status = ? AND id < ?", app.ID, model.DeploymentStatusQueued, dep.ID).
+			Update("status", model.DeploymentStatusSuperseded)
+		for i := range superseded {
+			appendQueueLog(db, &superseded[i], fmt.Sprintf("Superseded by %s.", dep.Version))
+		}
+		if res.RowsAffected > 0 {
+			log.Printf("Deployment %s of app %d superseded %d queued deployment(s)", dep.Version, app.ID, res.RowsAffected)
+		}
+	}
+
+	// The task ID makes enqueueing the same deployment twice a no-op.
+	task, err := newTask(dep.ID)
+	if err == nil {
+		_, err = client.Enqueue(task, asynq.TaskID(deploymentTaskID(dep.ID, 0)))
+	}
+	if err != nil {
+		db.Model(dep).Update("status", model.DeploymentStatusFailed)
+		appendQueueLog(db, dep, fmt.Sprintf("ERROR: queuing failed: %v", err))
+		return nil, fmt.Errorf("enqueue deployment: %w", err)
+	}
+	return dep, nil
+}
+
+// appendQueueLog adds a line to the log of a deployment no worker is running.
+func appendQueueLog(db *gorm.DB, dep *model.Deployment, line string) {
+	if err := deploylog.Append(db, dep, "", deploylog.System(line)); err != nil {
+		log.Printf("Deployment %d: failed to write log: %v", dep.ID, err)
+	}
+}
+
+// nextVersion allocates the version label for an application's next
+// deployment. The counter is incremented in a single statement, so
+// concurrent requests never get the same number. Applications created before
+// the counter existed continue from their number of deployments.
+func nextVersion(db *gorm.DB, appID uint) (string, error) {
+	var seq int
+	err := db.Raw(`UPDATE applications
+		SET deployment_seq = GREATEST(deployment_seq, (SELECT COUNT(*) FROM deployments WHERE application_id = ?)) + 1
+		WHERE id = ? RETURNING deployment_seq`, appID, appID).Scan(&seq).Error
+	if err != nil {
+		return "", fmt.Errorf("allocate version: %w", err)
+	}
+	if seq == 0 {
+		return "", fmt.Errorf("allocate version: application %d not found", appID)
+	}
+	return fmt.Sprintf("v%d", seq), nil
+}
+
+// DeploymentQueue returns the application's queued and running deployments,
+// oldest first.
+func DeploymentQueue(db *gorm.DB, appID uint) ([]model.Deployment, error) {
+	var queue []model.Deployment
+	err := db.Omit("logs").Where("application_id = ? AND status IN ?", appID, model.DeploymentStatusesActive).
+		Order("id").Find(&queue).Error
+	return queue, err
+}
+
+// SettleAppStatus sets an application's status once a deployment ended
+// without going live, unless another is still queued or running: "running"
+// when an earlier deployment is still live, "cancelled" otherwise.
+func SettleAppStatus(db *gorm.DB, appID uint) {
+	var active int64
+	db.Model(&model.Deployment{}).Where("application_id = ? AND status IN ?", appID, model.DeploymentStatusesActive).Count(&active)
+	if active > 0 {
+		return
+	}
+	var live int64
+	db.Model(&model.Deployment{}).Where("application_id = ? AND status = ?", appID, model.DeploymentStatusLive).Count(&live)
+	status := "cancelled"
+	if live > 0 {
+		status = "running"
+	}
+	db.Model(&model.Application{}).Where("id = ? AND status <> ?", appID, AppStatusDeleting).Update("status", status)
+}
+
+// runDeployment runs the queued deployment depID with run once it holds the
+// application's deploy slot. While the slot is busy the task is put back on
+// the queue; deployments that were cancelled or superseded while waiting are
+// dropped. run's context is cancelled if the deployment is cancelled.
+func (h *AppTaskHandler) runDeployment(ctx context.Context, t *asynq.Task, depID uint,
+	run func(ctx context.Context, dep *model.Deployment, app *model.Application) error) error {
+
+	var dep model.Deployment
+	if err := h.DB.First(&dep, depID).Error; err != nil {
+		return fmt.Errorf("deployment lookup failed: %v: %w", err, asynq.SkipRetry)
+	}
+	if !dep.Status.IsActive() {
+		log.Printf("Deployment %d is %s; nothing to run", dep.ID, dep.Status)
+		return nil
+	}
+
+	var app model.Application
+	if err := h.DB.Preload("Cluster").Preload("Cluster.ManagerServer").First(&app, dep.ApplicationID).Error; err != nil {
+		return fmt.Errorf("app lookup failed: %v", err)
+	}
+
+	if err := h.acquireDeploySlot(&app, &dep); err != nil {
+		if !errors.Is(err, errDeploySlotBusy) {
+			return err
+		}
+		return h.requeueDeployment(ctx, t, &dep)
+	}
+	defer h.releaseDeploySlot(&app, &dep)
+
+	h.DB.Model(&dep).Update("attempt", gorm.Expr("attempt + 1"))
+	h.DB.Model(&model.Deployment{}).Where("id = ?", dep.ID).Select("attempt").Scan(&dep.Attempt)
+	if dep.Attempt > 1 {
+		h.appendLog(&dep, fmt.Sprintf("Attempt %d:", dep.Attempt))
+	}
+	h.initSteps(&dep)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go h.watchCancel(runCtx, cancel, dep.ID)
+
+	err := run(runCtx, &dep, &app)
+
+	var status model.DeploymentStatus
+	h.DB.Model(&model.Deployment{}).Where("id = ?", dep.ID).Select("status").Scan(&status)
+	if status == model.DeploymentStatusCancelled {
+		h.appendLog(&dep, "Deployment cancelled.")
+		h.finishSteps(&dep, model.StepStatusCancelled)
+		SettleAppStatus(h.DB, app.ID)
+		log.Printf("Deployment %s of app %s cancelled", dep.Version, app.Name)
+		return nil
+	}
+	if err == nil {
+		h.finishSteps(&dep, model.StepStatusSucceeded)
+		return nil
+	}
+	h.finishSteps(&dep, model.StepStatusFailed)
+
+	if willRetry(ctx, err) {
+		// The retry runs this same deployment again; it keeps its place at
+		// the head of the application's queue.
+		h.DB.Model(&dep).Update("status", model.DeploymentStatusQueued)
+		h.appendLog(&dep, fmt.Sprintf("Attempt %d failed: %v. Retrying.", dep.Attempt, err))
+		h.DB.Model(&app).Where("status <> ?", AppStatusDeleting).Update("status", "pending")
+		return err
+	}
+	// Errors returned without failing the deployment must not leave it
+	// looking like it is still running.
+	h.DB.Model(&dep).Where("status IN ?", model.DeploymentStatusesActive).Update("status", model.DeploymentStatusFailed)
+	return err
+}
+
+// willRetry reports whether asynq will run the task again after err.
+func willRetry(ctx context.Context, err error) bool {
+	if errors.Is(err, asynq.SkipRetry) {
+		return false
+	}
+	retried, ok1 := asynq.GetRetryCount(ctx)
+	maxRetry, ok2 := asynq.GetMaxRetry(ctx)
+	return ok1 && ok2 && retried < maxRetry
+}
+
+// acquireDeploySlot makes dep the application's active deployment if the slot
+// is free and no earlier deployment is still queued. A slot held by a
+// deployment that has since ended (e.g. its worker died) is taken over.
+func (h *AppTaskHandler) acquireDeploySlot(app *model.Application, dep *model.Deployment) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		earlier := h.DB.Model(&model.Deployment{}).Select("1").
+			Where("application_id = ? AND status = ? AND id < ?", app.ID, model.DeploymentStatusQueued, dep.ID)
+		res := h.DB.Model(&model.Application{}).
+			Where("id = ? AND (active_deployment_id IS NULL OR active_deployment_id = ?)", app.ID, dep.ID).
+			Where("NOT EXISTS (?)", earlier).
+			Update("active_deployment_id", dep.ID)
+		if res.Error != nil {
+			return fmt.Errorf("acquire deploy slot: %w", res.Error)
+		}
+		if res.RowsAffected == 1 {
+			app.ActiveDeploymentID = &dep.ID
+			return nil
+		}
+
+		var current model.Application
+		if err := h.DB.Select("id", "active_deployment_id").First(&current, app.ID).Error; err != nil {
+			return fmt.Errorf("app lookup failed: %w", err)
+		}
+		if current.ActiveDeploymentID == nil {
+			h.recoverLostDeployments(app.ID, dep.ID)
+			return errDeploySlotBusy // an earlier deployment is waiting
+		}
+		var holder model.Deployment
+		err := h.DB.Select("id", "status").First(&holder, *current.ActiveDeploymentID).Error
+		if err == nil && holder.Status.IsActive() {
+			return errDeploySlotBusy
+		}
+		h.DB.Model(&model.Application{}).
+			Where("id = ? AND active_deployment_id = ?", app.ID, *current.ActiveDeploymentID).
+			Update("active_deployment_id", nil)
+	}
+	return errDeploySlotBusy
+}
+
+func (h *AppTaskHandler) releaseDeploySlot(app *model.Application, dep *model.Deployment) {
+	h.DB.Model(&model.Application{}).
+		Where("id = ? AND active_deployment_id = ?", app.ID, dep.ID).
+		Update("active_deployment_id", nil)
+}
+
+// requeue puts t back on the deployment queue to try for the slot again
+// shortly. Waiting this way does not use up the task's retries.
+func (h *AppTaskHandler) requeue(ctx context.Context, t *asynq.Task, extra ...asynq.Option) error {
+	if h.AsynqClient == nil {
+		return errDeploySlotBusy
+	}
+	opts := []asynq.Option{asynq.Queue("deployment"), asynq.ProcessIn(deploySlotRetryDelay)}
+	if maxRetry, ok := asynq.GetMaxRetry(ctx); ok {
+		opts = append(opts, asynq.MaxRetry(maxRetry))
+	}
+	if _, err := h.AsynqClient.Enqueue(asynq.NewTask(t.Type(), t.Payload()), append(opts, extra...)...); err != nil {
+		return fmt.Errorf("requeue deployment: %w", err)
+	}
+	return nil
+}
+
+// A queued deployment whose task was lost, for example when Redis lost its
+// data, would wait forever and hold up every deployment of the application
+// queued after it. Each requeue of a waiting deployment's task uses the next
+// of its task IDs and is counted on the deployment, which also touches it.
+// Deployments left untouched for queuedStaleAfter have their task enqueued
+// again under the ID it should have: if the task still exists, asynq
+// rejects the duplicate and nothing changes.
+
+// deploymentTaskID is the ID of the task carrying a deployment after it was
+// requeued requeues times.
+func deploymentTaskID(depID uint, requeues int) string {
+	if requeues == 0 {
+		return fmt.Sprintf("deployment:%d", depID)
+	}
+	return fmt.Sprintf("deployment:%d:%d", depID, requeues)
+}
+
+// requeueDeployment requeues the task of a deployment waiting for the slot
+// and counts the requeue.
+func (h *AppTaskHandler) requeueDeployment(ctx context.Context, t *asynq.Task, dep *model.Deployment) error {
+	next := dep.Requeues + 1
+	err := h.requeue(ctx, t, asynq.TaskID(deploymentTaskID(dep.ID, next)))
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return err
+	}
+	h.DB.Model(dep).Update("requeues", next)
+	return nil
+}
+
+// staleQueued returns the deployments in deps that are queued and were last
+// touched before cutoff.
+func staleQueued(deps []model.Deployment, cutoff time.Time) []model.Deployment {
+	var stale []model.Deployment
+	for _, dep := range deps {
+		if dep.Status == model.DeploymentStatusQueued && dep.UpdatedAt.Before(cutoff) {
+			stale = append(stale, dep)
+		}
+	}
+	return stale
+}
+
+// deploymentTask rebuilds the task that runs a queued deployment. A
+// restart's reason is only carried by its task, so a rebuilt restart task
+// gives a generic one.
+func deploymentTask(dep model.Deployment) (*asynq.Task, error) {
+	switch dep.Kind {
+	case model.DeploymentKindRestart:
+		return NewRestartAppTask(dep.ApplicationID, dep.ID, "re-queued after its task was lost")
+	case model.DeploymentKindRollback:
+		return NewRollbackTask(dep.ID)
+	}
+	return NewDeployAppTask(dep.ApplicationID, dep.ID)
+}
+
+// recoverLostDeployments enqueues again the tasks of the application's
+// deployments queued before depID that have gone stale and lost their task.
+func (h *AppTaskHandler) recoverLostDeployments(appID, depID uint) {
+	if h.AsynqClient == nil {
+		return
+	}
+	var queued []model.Deployment
+	if err := h.DB.Omit("logs", "spec").Where("application_id = ? AND status = ? AND id < ?",
+		appID, model.DeploymentStatusQueued, depID).Find(&queued).Error; err != nil {
+		log.Printf("Failed to list queued deployments of app %d: %v", appID, err)
+		return
+	}
+	for _, dep := range staleQueued(queued, time.Now().Add(-queuedStaleAfter)) {
+		task, err := deploymentTask(dep)
+		if err == nil {
+			_, err = h.AsynqClient.Enqueue(task, asynq.TaskID(deploymentTaskID(dep.ID, dep.Requeues)))
+		}
+		switch {
+		case errors.Is(err, asynq.ErrTaskIDConflict):
+			// Still there, waiting for a retry or a free worker.
+		case err != nil:
+			log.Printf("Failed to re-queue deployment %d: %v", dep.ID, err)
+			continue
+		default:
+			appendQueueLog(h.DB, &dep, "Re-queued: the task that was to run this deployment was lost.")
+			log.Printf("Deployment %d of app %d lost its task; re-queued", dep.ID, appID)
+		}
+		// Not checked again until it goes stale again.
+		h.DB.Model(&dep).Update("updated_at", time.Now())
+	}
+}
+
+// watchCancel calls cancel once the deployment's status becomes cancelled.
+// It returns when ctx is done.
+func (h *AppTaskHandler) watchCancel(ctx context.Context, cancel context.CancelFunc, depID uint) {
+	ticker := time.NewTicker(cancelPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var status model.DeploymentStatus
+			h.DB.Model(&model.Deployment{}).Where("id = ?", depID).Select("status").Scan(&status)
+			if status == model.DeploymentStatusCancelled {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// setStatus moves a running deployment to status, unless it was cancelled.
+func (h *AppTaskHandler) setStatus(dep *model.Deployment, status model.DeploymentStatus) {
+	h.DB.Model(dep).Where("status <> ?", model.DeploymentStatusCancelled).Update("status", status)
+}
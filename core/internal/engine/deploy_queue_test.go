@@ -0,0 +1,73 @@
+package tasks
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+)
+
+func TestStaleQueued(t *testing.T) {
+	now := time.Now()
+	cutoff := now.Add(-queuedStaleAfter)
+	deps := []model.Deployment{
+		{ID: 1, Status: model.DeploymentStatusQueued, UpdatedAt: now.Add(-time.Hour)},
+		{ID: 2, Status: model.DeploymentStatusQueued, UpdatedAt: now.Add(-time.Second)},
+		{ID: 3, Status: model.DeploymentStatusBuilding, UpdatedAt: now.Add(-time.Hour)},
+		{ID: 4, Status: model.DeploymentStatusQueued, UpdatedAt: cutoff.Add(-time.Millisecond)},
+		{ID: 5, Status: model.DeploymentStatusCancelled, UpdatedAt: now.Add(-time.Hour)},
+	}
+	var got []uint
+	for _, dep := range staleQueued(deps, cutoff) {
+		got = append(got, dep.ID)
+	}
+	if len(got) != 2 || got[0] != 1 || got[1] != 4 {
+		t.Errorf("staleQueued = %v, want [1 4]", got)
+	}
+}
+
+func TestDeploymentTaskID(t *testing.T) {
+	tests := []struct {
+		requeues int
+		want     string
+	}{
+		{0, "deployment:7"}, // the ID enqueueDeployment gives the first task
+		{1, "deployment:7:1"},
+		{12, "deployment:7:12"},
+	}
+	for _, tt := range tests {
+		if got := deploymentTaskID(7, tt.requeues); got != tt.want {
+			t.Errorf("deploymentTaskID(7, %d) = %q, want %q", tt.requeues, got, tt.want)
+		}
+	}
+}
+
+// TestDeploymentTask checks that a lost deployment's task is rebuilt as the
+// one its kind was enqueued with, for the same deployment.
+func TestDeploymentTask(t *testing.T) {
+	tests := []struct {
+		kind     model.DeploymentKind
+		wantType string
+	}{
+		{model.DeploymentKindDeploy, TypeDeployApplication},
+		{"", TypeDeployApplication},
+		{model.DeploymentKindRestart, TypeRestartApplication},
+		{model.DeploymentKindRollback, TypeRollbackDeployment},
+	}
+	for _, tt := range tests {
+		task, err := deploymentTask(model.Deployment{ID: 9, ApplicationID: 3, Kind: tt.kind})
+		if err != nil {
+			t.Fatalf("deploymentTask(%q): %v", tt.kind, err)
+		}
+		if task.Type() != tt.wantType {
+			t.Errorf("deploymentTask(%q) type = %q, want %q", tt.kind, task.Type(), tt.wantType)
+		}
+		var payload struct {
+			DeploymentID uint `json:"deployment_id"`
+		}
+		if err := json.Unmarshal(task.Payload(), &payload); err != nil || payload.DeploymentID != 9 {
+			t.Errorf("deploymentTask(%q) payload = %s, want deployment_id 9", tt.kind, task.Payload())
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package tasks
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
+)
+
+// Blue/green slots. Each slot is a container named <app>-<slot>.
+const (
+	slotBlue  = "blue"
+	slotGreen = "green"
+)
+
+// Health check timing for a new blue/green container.
+const (
+	blueGreenHealthAttempts = 30
+	blueGreenHealthInterval = 2 * time.Second
+)
+
+// deployDockerBlueGreen starts the new version in the idle slot on a
+// loopback-only ephemeral host port, waits for it to become healthy, points
+// the app's nginx sites at it and only then stops the old container. If the
+// new container never becomes healthy, or nginx cannot be switched, it is
+// removed and the old one keeps serving.
+func (h *AppTaskHandler) deployDockerBlueGreen(client *sshpkg.Client, dep *model.Deployment, app *model.Application, image, name string, env *resolvedEnv, ports []string, vols *appVolumes) error {
+	sites, err := h.appNginxSites(app)
+	if err != nil {
+		h.failDeployment(dep, app, fmt.Sprintf("Loading nginx configs failed: %v", err))
+		return err
+	}
+	if app.Port == 0 || len(sites) == 0 {
+		h.appendLog(dep, "Blue/green needs a port and an nginx site on the manager; falling back to recreate.")
+		recreate := *app
+		recreate.DeployStrategy = model.DeployStrategyRecreate
+		return h.deployDocker(client, dep, &recreate, image, name, env, ports, vols)
+	}
+
+	h.appendLog(dep, "Deploying with Docker (blue/green)...")
+	if app.Replicas > 1 {
+		h.appendLog(dep, "WARNING: blue/green runs a single container; extra replicas are not started.")
+	}
+	if err := reconcileDockerReplicas(client, &model.Application{Name: app.Name, Replicas: 1}, image, dockerEnv{}, nil, false); err != nil {
+		h.appendLog(dep, fmt.Sprintf("WARNING: removing extra replicas failed: %v", err))
+	}
+
+	envFile, err := h.writeEnvFile(client, dep, app, env.Vars)
+	if err != nil {
+		return err
+	}
+
+	active := activeSlotContainer(client, name)
+	slot := slotBlue
+	if active == name+"-"+slotBlue {
+		slot = slotGreen
+	}
+	next := name + "-" + slot
+
+	// A leftover container in the idle slot is from a failed or aborted deploy.
+	client.ExecuteCommand(sshpkg.Shellf("docker rm -f %s 2>/dev/null", next))
+
+	check := app.HealthCheck.WithDefaults(app.Port)
+	cmd := sshpkg.Cmd("docker", "run", "-d", "--name", next,
+		"--label", "orchestra.app="+name, "--label", "orchestra.slot="+slot, "--restart", "unless-stopped").
+		Arg(dockerResourceArgs(app.Resources)...).
+		Arg(dockerHealthArgs(check)...).
+		Arg(envFile.args...).
+		Arg(dockerVolumeArgs(app, vols.list)...).
+		Arg("-p", fmt.Sprintf("127.0.0.1::%d", app.Port)).
+		Arg(image).
+		Raw("2>&1")
+	result, err := client.ExecuteCommand(envFile.command(cmd))
+	if err := commandError(result, err); err != nil {
+		h.failDeployment(dep, app, fmt.Sprintf("Docker run failed: %s", commandOutput(result)))
+		return fmt.Errorf("docker run: %w", err)
+	}
+
+	hostPort, err := containerHostPort(client, next, app.Port)
+	if err != nil {
+		client.ExecuteCommand(sshpkg.Shellf("docker rm -f %s 2>/dev/null", next))
+		h.failDeployment(dep, app, fmt.Sprintf("Reading host port of %s failed: %v", next, err))
+		return err
+	}
+	h.beginStep(dep, model.StepHealthCheck)
+	h.appendLog(dep, fmt.Sprintf("Started %s on 127.0.0.1:%d; waiting for it to become healthy...", next, hostPort))
+
+	// The app's own health check decides when one is configured; otherwise
+	// any non-5xx answer on / will do.
+	var waitErr error
+	if check.Enabled() {
+		waitErr = waitDockerHealthy(client, next, check)
+	} else {
+		waitErr = waitHealthy(client, next, hostPort)
+	}
+	if err := waitErr; err != nil {
+		client.ExecuteCommand(sshpkg.Shellf("docker rm -f %s 2>/dev/null", next))
+		msg := fmt.Sprintf("New container never became healthy: %v", err)
+		if active != "" {
+			msg += fmt.Sprintf("; %s is still serving", active)
+		}
+		h.failDeployment(dep, app, msg)
+		return fmt.Errorf("health check: %w", err)
+	}
+	h.appendLog(dep, fmt.Sprintf("%s is healthy.", next))
+
+	h.beginStep(dep, model.StepRouteTraffic)
+	if err := h.pointNginxAt(client, dep, sites, []int{hostPort}); err != nil {
+		client.ExecuteCommand(sshpkg.Shellf("docker rm -f %s 2>/dev/null", next))
+		h.failDeployment(dep, app, fmt.Sprintf("Switching nginx failed: %v", err))
+		return err
+	}
+
+	if active != "" {
+		client.ExecuteCommand(sshpkg.Shellf("docker stop %[1]s 2>/dev/null; docker rm %[1]s 2>/dev/null", active))
+		h.appendLog(dep, fmt.Sprintf("Stopped previous container %s.", active))
+	}
+	h.appendLog(dep, "Docker container started.")
+	return nil
+}
+
+// appNginxSites returns the nginx configs that route to app on its cluster's
+// manager, where Docker apps run.
+func (h *AppTaskHandler) appNginxSites(app *model.Application) ([]model.NginxConfig, error) {
+	var sites []model.NginxConfig
+	err := h.DB.Where("application_id = ? AND server_id = ?", app.ID, app.Cluster.ManagerServerID).Find(&sites).Error
+	return sites, err
+}
+
+// pointNginxAt switches sites to proxy to the given loopback ports, the
+// first of which is the application's main container, and logs the change.
+// Sites with a custom config are left alone.
+func (h *AppTaskHandler) pointNginxAt(client *sshpkg.Client, dep *model.Deployment, sites []model.NginxConfig, ports []int) error {
+	for _, site := range sites {
+		if site.CustomConfig != "" && (site.UpstreamPort != ports[0] || len(ports) > 1) {
+			h.appendLog(dep, fmt.Sprintf("WARNING: nginx site %s uses a custom config; its upstream was not changed.", site.Domain))
+		}
+	}
+	moved, err := h.routeNginxSites(client, sites, ports)
+	if err != nil {
+		return err
+	}
+	for _, site := range moved {
+		h.appendLog(dep, fmt.Sprintf("nginx site %s now proxies to 127.0.0.1:%d.", site.Domain, ports[0]))
+	}
+	if len(ports) > 1 {
+		h.appendLog(dep, fmt.Sprintf("nginx balances requests over %d instances.", len(ports)))
+	}
+	return nil
+}
+
+// routeNginxSites points the generated sites among sites at ports on the
+// loopback interface and records the first as their upstream port. Only
+// their upstreams change, so HTTPS set up by certbot survives. On failure
+// every site is restored to its recorded upstream port. It returns the
+// sites whose upstream port changed.
+func (h *AppTaskHandler) routeNginxSites(client *sshpkg.Client, sites []model.NginxConfig, ports []int) ([]model.NginxConfig, error) {
+	var switched []model.NginxConfig
+	for _, site := range sites {
+		if site.CustomConfig != "" {
+			continue
+		}
+		if err := pointNginxUpstream(client, &site, ports...); err != nil {
+			pointNginxUpstream(client, &site, site.UpstreamPort)
+			for i := range switched {
+				pointNginxUpstream(client, &switched[i], switched[i].UpstreamPort)
+			}
+			return nil, fmt.Errorf("%s: %w", site.Domain, err)
+		}
+		switched = append(switched, site)
+	}
+
+	var moved []model.NginxConfig
+	for _, site := range switched {
+		if site.UpstreamPort != ports[0] {
+			h.DB.Model(&model.NginxConfig{}).Where("id = ?", site.ID).Update("upstream_port", ports[0])
+			moved = append(moved, site)
+		}
+	}
+	return moved, nil
+}
+
+// activeSlotContainer returns the running container currently serving the
+// app: one of its blue/green slots, or the container a recreate deploy left.
+func activeSlotContainer(client *sshpkg.Client, name string) string {
+	for _, c := range []string{name + "-" + slotBlue, name + "-" + slotGreen, name} {
+		result, err := client.ExecuteCommand(sshpkg.Shellf("docker inspect -f %s %s 2>/dev/null", "{{.State.Running}}", c))
+		if commandError(result, err) == nil && strings.TrimSpace(result.Stdout) == "true" {
+			return c
+		}
+	}
+	return ""
+}
+
+// containerHostPort returns the host port Docker bound to containerPort.
+func containerHostPort(client *sshpkg.Client, container string, containerPort int) (int, error) {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker port %s %d/tcp 2>&1", container, containerPort))
+	if err := commandError(result, err); err != nil {
+		return 0, fmt.Errorf("%v: %s", err, commandOutput(result))
+	}
+	// Output is one line per binding, e.g. "127.0.0.1:49153".
+	line := strings.TrimSpace(strings.SplitN(result.Stdout, "\n", 2)[0])
+	idx := strings.LastIndex(line, ":")
+	if idx < 0 {
+		return 0, fmt.Errorf("unexpected docker port output %q", line)
+	}
+	return strconv.Atoi(line[idx+1:])
+}
+
+// waitHealthy polls until the container is running and answers HTTP on
+// 127.0.0.1:port with a non-5xx status.
+func waitHealthy(client *sshpkg.Client, container string, port int) error {
+	cmd := sshpkg.Shellf("[ \"$(docker inspect -f %s %s 2>/dev/null)\" = true ] && curl -s -o /dev/null -w '%%{http_code}' --max-time 5 http://127.0.0.1:%d/",
+		"{{.State.Running}}", container, port)
+	lastErr := "no response"
+	for i := 0; i < blueGreenHealthAttempts; i++ {
+		if i > 0 {
+			time.Sleep(blueGreenHealthInterval)
+		}
+		result, err := client.ExecuteCommand(cmd)
+		if err != nil {
+			lastErr = err.Error()
+			continue
+		}
+		code, convErr := strconv.Atoi(strings.TrimSpace(result.Stdout))
+		switch {
+		case result.ExitCode != 0 && strings.TrimSpace(result.Stdout) == "":
+			lastErr = "container not running or not accepting connections"
+		case convErr != nil || code == 0:
+			lastErr = "no HTTP response"
+		case code >= 500:
+			lastErr = fmt.Sprintf("HTTP %d", code)
+		default:
+			return nil
+		}
+	}
+	return fmt.Errorf("%s after %d attempts", lastErr, blueGreenHealthAttempts)
+}
@@ -2,37 +2,65 @@ package tasks
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
 	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
 	"github.com/hibiken/asynq"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-const TypePushEnv = "env:push"
+const (
+	TypePushEnv   = "env:push"
+	TypeVerifyEnv = "env:verify"
+)
 
 type PushEnvPayload struct {
-	EnvironmentID uint `json:"environment_id"`
+	EnvironmentID uint   `json:"environment_id"`
+	ServerIDs     []uint `json:"server_ids,omitempty"` // retry: limit the push to these servers
+	RestartApps   bool   `json:"restart_apps"`         // restart consuming apps once every server is synced
 }
 
-func NewPushEnvTask(envID uint) (*asynq.Task, error) {
-	payload, err := json.Marshal(PushEnvPayload{EnvironmentID: envID})
+// NewPushEnvTask pushes an environment to every server in its cluster, or
+// only to serverIDs when given (used to retry failed servers).
+func NewPushEnvTask(envID uint, restartApps bool, serverIDs ...uint) (*asynq.Task, error) {
+	payload, err := json.Marshal(PushEnvPayload{EnvironmentID: envID, ServerIDs: serverIDs, RestartApps: restartApps})
 	if err != nil {
 		return nil, err
 	}
 	return asynq.NewTask(TypePushEnv, payload, asynq.Queue("provisioning"), asynq.MaxRetry(2)), nil
 }
 
+type VerifyEnvPayload struct {
+	EnvironmentID uint `json:"environment_id"`
+}
+
+// NewVerifyEnvTask checks the on-disk env file on every server an
+// environment was pushed to.
+func NewVerifyEnvTask(envID uint) (*asynq.Task, error) {
+	payload, err := json.Marshal(VerifyEnvPayload{EnvironmentID: envID})
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TypeVerifyEnv, payload, asynq.Queue("default"), asynq.MaxRetry(0)), nil
+}
+
 type EnvTaskHandler struct {
 	DB            *gorm.DB
 	EncryptionKey string
+	AsynqClient   *asynq.Client // enqueues app restarts after a push
 }
 
-// HandlePushEnv pushes environment variables to all servers in a cluster.
+// HandlePushEnv pushes environment variables to the servers in a cluster and
+// records the outcome for each server.
 func (h *EnvTaskHandler) HandlePushEnv(ctx context.Context, t *asynq.Task) error {
 	var payload PushEnvPayload
 	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
@@ -52,45 +80,285 @@ func (h *EnvTaskHandler) HandlePushEnv(ctx context.Context, t *asynq.Task) error
 
 	if len(servers) == 0 {
 		log.Printf("No servers in cluster %d for env push", env.ClusterID)
-		h.DB.Model(&env).Update("synced", true)
+		h.DB.Model(&env).Updates(map[string]interface{}{"synced": true, "sync_status": model.EnvSyncSynced})
+		if payload.RestartApps {
+			h.restartConsumers(env)
+		}
 		return nil
 	}
 
-	// Build .env file content
-	var envLines []string
-	for k, v := range env.Variables {
-		envLines = append(envLines, fmt.Sprintf("%s=%s", k, v))
+	// Build .env file content with secret references resolved
+	resolved, err := resolveEnv(h.DB, h.EncryptionKey, env.ClusterID, env.Variables)
+	if err != nil {
+		return fmt.Errorf("resolve env: %v: %w", err, asynq.SkipRetry)
+	}
+	defer redact.Track(resolved.secretValues()...)()
+	envContent := pushedEnvContent(resolved.Vars)
+	checksum := checksumOf([]byte(envContent))
+	envFile := envFilePath(env)
+
+	targets := servers
+	if len(payload.ServerIDs) > 0 {
+		targets = h.retryTargets(env.ID, servers, payload.ServerIDs, checksum)
+	}
+
+	for _, server := range targets {
+		result := model.EnvPushResult{
+			EnvironmentID: env.ID,
+			ServerID:      server.ID,
+			FilePath:      envFile,
+			PushedAt:      time.Now(),
+		}
+		if err := h.pushToServer(server, envFile, []byte(envContent)); err != nil {
+			log.Printf("Failed to push env %d to server %d: %v", env.ID, server.ID, err)
+			result.Status = model.EnvPushFailed
+			result.Error = err.Error()
+		} else {
+			log.Printf("Pushed env to server %d: %s", server.ID, envFile)
+			result.Status = model.EnvPushSuccess
+			result.Checksum = checksum
+		}
+		h.saveResult(&result)
 	}
-	envContent := strings.Join(envLines, "\n")
 
-	envDir := "/opt/orchestra/envs"
-	envFile := fmt.Sprintf("%s/%s-%s.env", envDir, sanitizeName(env.Cluster.Name), string(env.Scope))
+	now := time.Now()
+	status := h.syncStatus(env.ID, servers, checksum)
+	h.DB.Model(&env).Updates(map[string]interface{}{
+		"synced":         status == model.EnvSyncSynced,
+		"sync_status":    status,
+		"checksum":       checksum,
+		"last_pushed_at": &now,
+	})
+	log.Printf("Environment %d pushed to %d of %d servers: %s", env.ID, len(targets), len(servers), status)
 
-	for _, server := range servers {
-		sshKey, err := decrypt(server.SSHKeyEncrypted, h.EncryptionKey)
-		if err != nil {
-			log.Printf("Failed to decrypt SSH key for server %d: %v", server.ID, err)
-			continue
+	if payload.RestartApps {
+		if status == model.EnvSyncSynced {
+			h.restartConsumers(env)
+		} else {
+			logActivity(h.DB, model.ActivityTypeEnvPushed,
+				fmt.Sprintf("Environment '%s' push %s; applications were not restarted", env.Name, status),
+				"environment", env.ID)
 		}
+	}
+	return nil
+}
+
+// restartConsumers queues a restart of every application in the cluster that
+// consumes env and records which ones in the activity log.
+func (h *EnvTaskHandler) restartConsumers(env model.Environment) {
+	var apps []model.Application
+	if err := h.DB.Where("cluster_id = ? AND environment_id = ?", env.ClusterID, env.ID).
+		Order("name").Find(&apps).Error; err != nil {
+		log.Printf("Failed to find apps consuming environment %d: %v", env.ID, err)
+		return
+	}
+	if len(apps) == 0 {
+		return
+	}
+	if h.AsynqClient == nil {
+		log.Printf("No task client configured; cannot restart apps for environment %d", env.ID)
+		return
+	}
 
-		client, err := sshpkg.NewClient(server.IP, server.SSHPort, server.SSHUser, sshKey, "")
+	reason := fmt.Sprintf("environment '%s' was pushed", env.Name)
+	var restarted, failed []string
+	for _, app := range apps {
+		dep, err := EnqueueRestart(h.DB, h.AsynqClient, &app, reason)
+		if err == nil && dep == nil {
+			continue // never deployed
+		}
 		if err != nil {
-			log.Printf("SSH failed for server %d: %v", server.ID, err)
+			log.Printf("Failed to enqueue restart for app %d: %v", app.ID, err)
+			failed = append(failed, app.Name)
 			continue
 		}
+		restarted = append(restarted, app.Name)
+	}
 
-		client.ExecuteCommand(fmt.Sprintf("mkdir -p %s", envDir))
-		writeCmd := fmt.Sprintf("cat > %s << 'ORCHESTRA_EOF'\n%s\nORCHESTRA_EOF", envFile, envContent)
-		if result, err := client.ExecuteCommand(writeCmd); err != nil {
-			log.Printf("Failed to push env to server %d: %s", server.ID, result.Stderr)
-		} else {
-			log.Printf("Pushed env to server %d: %s", server.ID, envFile)
-		}
+	msg := fmt.Sprintf("Environment '%s' pushed; restarting applications: %s", env.Name, strings.Join(restarted, ", "))
+	if len(failed) > 0 {
+		msg += fmt.Sprintf(" (failed to queue: %s)", strings.Join(failed, ", "))
+	}
+	logActivity(h.DB, model.ActivityTypeEnvPushed, msg, "environment", env.ID)
+}
+
+// HandleVerifyEnv compares the env file on each server with the checksum
+// last pushed there and records any drift.
+func (h *EnvTaskHandler) HandleVerifyEnv(ctx context.Context, t *asynq.Task) error {
+	var payload VerifyEnvPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+
+	var env model.Environment
+	if err := h.DB.First(&env, payload.EnvironmentID).Error; err != nil {
+		return fmt.Errorf("environment not found: %w", err)
+	}
+
+	var results []model.EnvPushResult
+	if err := h.DB.Preload("Server").Where("environment_id = ?", env.ID).Find(&results).Error; err != nil {
+		return fmt.Errorf("fetch push results: %w", err)
+	}
+
+	for _, result := range results {
+		status, onDisk, verifyErr := h.verifyServer(result)
+		now := time.Now()
+		h.DB.Model(&result).Updates(map[string]interface{}{
+			"verify_status":    status,
+			"verify_error":     verifyErr,
+			"on_disk_checksum": onDisk,
+			"verified_at":      &now,
+		})
+		log.Printf("Verified env %d on server %d: %s", env.ID, result.ServerID, status)
+	}
+
+	var servers []model.Server
+	if err := h.DB.Where("cluster_id = ?", env.ClusterID).Find(&servers).Error; err != nil {
+		return fmt.Errorf("fetch servers: %w", err)
+	}
+	if env.Checksum != "" {
+		status := h.syncStatus(env.ID, servers, env.Checksum)
+		h.DB.Model(&env).Updates(map[string]interface{}{
+			"synced":      status == model.EnvSyncSynced,
+			"sync_status": status,
+		})
+	}
+	return nil
+}
 
-		client.Close()
+func (h *EnvTaskHandler) pushToServer(server model.Server, path string, content []byte) error {
+	sshKey, err := decrypt(server.SSHKeyEncrypted, h.EncryptionKey)
+	if err != nil {
+		return fmt.Errorf("decrypt SSH key: %w", err)
+	}
+	client, err := sshpkg.NewClient(server.IP, server.SSHPort, server.SSHUser, sshKey, "")
+	if err != nil {
+		return fmt.Errorf("SSH connect: %w", err)
 	}
+	defer client.Close()
 
-	h.DB.Model(&env).Update("synced", true)
-	log.Printf("Environment %d pushed to %d servers", env.ID, len(servers))
+	if err := client.WriteFile(path, content, 0600); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
 	return nil
 }
+
+// verifyServer returns the verification status, the on-disk checksum and an
+// error message for one push result.
+func (h *EnvTaskHandler) verifyServer(result model.EnvPushResult) (model.EnvVerifyStatus, string, string) {
+	if result.Status != model.EnvPushSuccess {
+		return model.EnvVerifyError, "", "last push to this server failed"
+	}
+	sshKey, err := decrypt(result.Server.SSHKeyEncrypted, h.EncryptionKey)
+	if err != nil {
+		return model.EnvVerifyError, "", fmt.Sprintf("decrypt SSH key: %v", err)
+	}
+	client, err := sshpkg.NewClient(result.Server.IP, result.Server.SSHPort, result.Server.SSHUser, sshKey, "")
+	if err != nil {
+		return model.EnvVerifyError, "", fmt.Sprintf("SSH connect: %v", err)
+	}
+	defer client.Close()
+
+	cmd := sshpkg.Shellf("if [ -f %[1]s ]; then sha256sum -- %[1]s; else echo missing; fi", result.FilePath)
+	out, err := client.ExecuteCommand(cmd)
+	if err := commandError(out, err); err != nil {
+		return model.EnvVerifyError, "", fmt.Sprintf("sha256sum: %v: %s", err, commandOutput(out))
+	}
+	fields := strings.Fields(out.Stdout)
+	if len(fields) == 0 {
+		return model.EnvVerifyError, "", "empty sha256sum output"
+	}
+	if fields[0] == "missing" {
+		return model.EnvVerifyMissing, "", ""
+	}
+	if fields[0] != result.Checksum {
+		return model.EnvVerifyMismatch, fields[0], ""
+	}
+	return model.EnvVerifyMatch, fields[0], ""
+}
+
+// retryTargets returns the requested servers plus any whose last successful
+// push does not hold the current content, so a retry never leaves the
+// cluster with mixed versions.
+func (h *EnvTaskHandler) retryTargets(envID uint, servers []model.Server, serverIDs []uint, checksum string) []model.Server {
+	var current []uint
+	h.DB.Model(&model.EnvPushResult{}).
+		Where("environment_id = ? AND status = ? AND checksum = ?", envID, model.EnvPushSuccess, checksum).
+		Pluck("server_id", &current)
+
+	var targets []model.Server
+	for _, s := range servers {
+		if containsID(serverIDs, s.ID) || !containsID(current, s.ID) {
+			targets = append(targets, s)
+		}
+	}
+	return targets
+}
+
+// syncStatus reports how many of servers hold checksum, according to the
+// latest push and verification results.
+func (h *EnvTaskHandler) syncStatus(envID uint, servers []model.Server, checksum string) model.EnvSyncStatus {
+	var inSync []uint
+	h.DB.Model(&model.EnvPushResult{}).
+		Where("environment_id = ? AND status = ? AND checksum = ?", envID, model.EnvPushSuccess, checksum).
+		Where("verify_status IS NULL OR verify_status NOT IN ?", []model.EnvVerifyStatus{model.EnvVerifyMismatch, model.EnvVerifyMissing}).
+		Pluck("server_id", &inSync)
+
+	synced := 0
+	for _, s := range servers {
+		if containsID(inSync, s.ID) {
+			synced++
+		}
+	}
+	switch {
+	case synced == len(servers):
+		return model.EnvSyncSynced
+	case synced == 0:
+		return model.EnvSyncFailed
+	}
+	return model.EnvSyncPartiallySynced
+}
+
+// saveResult replaces the stored result for the result's environment and
+// server, clearing any earlier verification.
+func (h *EnvTaskHandler) saveResult(result *model.EnvPushResult) {
+	err := h.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "environment_id"}, {Name: "server_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"status":           result.Status,
+			"error":            result.Error,
+			"file_path":        result.FilePath,
+			"checksum":         result.Checksum,
+			"pushed_at":        result.PushedAt,
+			"verify_status":    nil,
+			"verify_error":     "",
+			"on_disk_checksum": "",
+			"verified_at":      nil,
+			"updated_at":       time.Now(),
+		}),
+	}).Create(result).Error
+	if err != nil {
+		log.Printf("Failed to record env push result for server %d: %v", result.ServerID, err)
+	}
+}
+
+// envFilePath is where an environment's file lives on each server. A
+// cluster can have several environments per scope, so the ID keeps their
+// files apart.
+func envFilePath(env model.Environment) string {
+	return fmt.Sprintf("/opt/orchestra/envs/%s-%s-%d.env", sanitizeName(env.Cluster.Name), string(env.Scope), env.ID)
+}
+
+func checksumOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func containsID(ids []uint, id uint) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
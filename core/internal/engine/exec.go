@@ -0,0 +1,158 @@
+package tasks
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
+	"gorm.io/gorm"
+)
+
+// execShell starts bash where the image has it and sh otherwise.
+const execShell = "if command -v bash >/dev/null 2>&1; then exec bash; else exec sh; fi"
+
+// Terminal is an interactive shell on a remote pseudo-terminal, either in
+// an application instance or on a server. Close ends the shell and the SSH
+// connection it runs over.
+type Terminal struct {
+	*sshpkg.PTY
+	Server   model.Server // the server the SSH connection goes to
+	Instance string       // the pod, task or container entered; empty for a server shell
+	client   *sshpkg.Client
+}
+
+// Close ends the shell and its SSH connection.
+func (t *Terminal) Close() error {
+	t.PTY.Close()
+	return t.client.Close()
+}
+
+// OpenServerTerminal starts a login shell on server.
+func OpenServerTerminal(keyHex string, server model.Server, cols, rows int) (*Terminal, error) {
+	client, err := dialServer(server, keyHex)
+	if err != nil {
+		return nil, err
+	}
+	pty, err := client.StartPTY("", cols, rows)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &Terminal{PTY: pty, Server: server, client: client}, nil
+}
+
+// OpenAppTerminal starts a shell inside a running instance of app: the
+// named pod, Swarm task slot or container, or the first running one when
+// instance is empty. It returns ErrUnknownInstance when instance is not a
+// running instance of app. app must have its Cluster and
+// Cluster.ManagerServer loaded.
+func OpenAppTerminal(db *gorm.DB, keyHex string, app *model.Application, instance string, cols, rows int) (*Terminal, error) {
+	manager := app.Cluster.ManagerServer
+	if manager.ID == 0 {
+		return nil, fmt.Errorf("cluster has no manager server")
+	}
+	client, err := dialServer(manager, keyHex)
+	if err != nil {
+		return nil, err
+	}
+	server := manager
+
+	name := sanitizeName(app.Name)
+	var cmd *sshpkg.Command
+	switch app.Cluster.Type {
+	case model.ClusterTypeK8s:
+		instance, err = pickInstance(client, instance, sshpkg.Shellf(
+			"kubectl get pods -n %s -l %s --field-selector status.phase=Running -o %s 2>&1",
+			app.Namespace, "app="+name, "jsonpath={range .items[*]}{.metadata.name}{\"\\n\"}{end}"))
+		cmd = sshpkg.Cmd("kubectl", "exec", "-it", "-n", app.Namespace, instance, "--")
+	case model.ClusterTypeDockerSwarm:
+		// Task containers run on whichever node Swarm picked, so the shell
+		// has to be opened from that node.
+		var container, node string
+		instance, container, node, err = swarmTaskContainer(client, name, instance)
+		if err == nil {
+			client.Close()
+			server, err = clusterServer(db, app.ClusterID, node)
+			if err != nil {
+				return nil, err
+			}
+			if client, err = dialServer(server, keyHex); err != nil {
+				return nil, err
+			}
+			cmd = sshpkg.Cmd("docker", "exec", "-it", container)
+		}
+	default:
+		instance, err = pickInstance(client, instance, sshpkg.Shellf(
+			"docker ps --filter %s --filter status=running --format %s 2>&1", "label=orchestra.app="+name, "{{.Names}}"))
+		cmd = sshpkg.Cmd("docker", "exec", "-it", instance)
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	pty, err := client.StartPTY(cmd.Arg("sh", "-c", execShell).String(), cols, rows)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &Terminal{PTY: pty, Server: server, Instance: instance, client: client}, nil
+}
+
+// pickInstance runs list, which prints one running instance per line, and
+// returns instance if it is among them, or the first when instance is empty.
+func pickInstance(client *sshpkg.Client, instance, list string) (string, error) {
+	result, err := client.ExecuteCommand(list)
+	if err := commandError(result, err); err != nil {
+		return "", fmt.Errorf("list instances: %v: %s", err, commandOutput(result))
+	}
+	running := strings.Fields(result.Stdout)
+	if len(running) == 0 {
+		return "", fmt.Errorf("the application has no running instances")
+	}
+	if instance == "" {
+		return running[0], nil
+	}
+	if !containsLine(result.Stdout, instance) {
+		return "", ErrUnknownInstance
+	}
+	return instance, nil
+}
+
+// swarmTaskContainer finds the running task in the named slot of service
+// name, or its first running task when slot is empty, and returns the
+// task's slot, container and the node it runs on.
+func swarmTaskContainer(client *sshpkg.Client, name, slot string) (taskSlot, container, node string, err error) {
+	result, err := client.ExecuteCommand(sshpkg.Shellf(
+		"docker service ps %s --no-trunc --filter desired-state=running --format %s 2>&1",
+		name, "{{.Name}} {{.ID}} {{.Node}} {{.CurrentState}}"))
+	if err := commandError(result, err); err != nil {
+		return "", "", "", fmt.Errorf("docker service ps: %v: %s", err, commandOutput(result))
+	}
+	for _, line := range strings.Split(strings.TrimSpace(result.Stdout), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 || !strings.EqualFold(f[3], "running") {
+			continue
+		}
+		if slot == "" || f[0] == slot {
+			// Swarm names task containers <service>.<slot>.<task ID>.
+			return f[0], f[0] + "." + f[1], f[2], nil
+		}
+	}
+	if slot == "" {
+		return "", "", "", fmt.Errorf("the application has no running instances")
+	}
+	return "", "", "", ErrUnknownInstance
+}
+
+// clusterServer finds the registered server of a cluster by the hostname
+// or IP a runtime knows it by.
+func clusterServer(db *gorm.DB, clusterID uint, node string) (model.Server, error) {
+	var server model.Server
+	err := db.Where("cluster_id = ? AND (hostname = ? OR ip = ?)", clusterID, node, node).First(&server).Error
+	if err != nil {
+		return server, fmt.Errorf("node %s is not a registered server of this cluster", node)
+	}
+	return server, nil
+}
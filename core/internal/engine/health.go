@@ -0,0 +1,167 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
+)
+
+// errUnhealthy marks a deployment whose instances did not pass their health
+// check before the deadline.
+var errUnhealthy = errors.New("health check did not pass")
+
+const dockerHealthPollInterval = 2 * time.Second
+
+// healthCommand is the shell command run inside the container for Docker and
+// Swarm HEALTHCHECKs. Images vary, so HTTP checks try curl then wget, and TCP
+// checks try nc then bash's /dev/tcp.
+func healthCommand(check model.HealthCheck) string {
+	switch check.Type {
+	case model.HealthCheckHTTP:
+		url := fmt.Sprintf("http://127.0.0.1:%d%s", check.Port, check.Path)
+		return sshpkg.Shellf("curl -fsS -o /dev/null %[1]s || wget -q -O /dev/null %[1]s || exit 1", url)
+	case model.HealthCheckTCP:
+		return fmt.Sprintf("nc -z 127.0.0.1 %[1]d || bash -c 'echo > /dev/tcp/127.0.0.1/%[1]d' || exit 1", check.Port)
+	}
+	return check.Command
+}
+
+// dockerHealthArgs returns HEALTHCHECK flags for docker run and docker
+// service create/update, or nothing when no check is configured.
+func dockerHealthArgs(check model.HealthCheck) []string {
+	if !check.Enabled() {
+		return nil
+	}
+	return []string{
+		"--health-cmd", healthCommand(check),
+		"--health-interval", fmt.Sprintf("%ds", check.IntervalSeconds),
+		"--health-timeout", fmt.Sprintf("%ds", check.TimeoutSeconds),
+		"--health-retries", strconv.Itoa(check.UnhealthyThreshold),
+		"--health-start-period", fmt.Sprintf("%ds", check.StartPeriodSeconds),
+	}
+}
+
+// k8sProbesYaml renders readiness and liveness probes for a container, or
+// "" when no check is configured. Liveness only starts failing after the
+// start period and always uses a success threshold of 1, as Kubernetes
+// requires.
+func k8sProbesYaml(check model.HealthCheck) string {
+	if !check.Enabled() {
+		return ""
+	}
+	var handler string
+	switch check.Type {
+	case model.HealthCheckHTTP:
+		handler = fmt.Sprintf("          httpGet:\n            path: %s\n            port: %d\n", strconv.Quote(check.Path), check.Port)
+	case model.HealthCheckTCP:
+		handler = fmt.Sprintf("          tcpSocket:\n            port: %d\n", check.Port)
+	default:
+		handler = fmt.Sprintf("          exec:\n            command: [\"sh\", \"-c\", %s]\n", strconv.Quote(check.Command))
+	}
+	timing := func(success int) string {
+		return fmt.Sprintf("          initialDelaySeconds: %d\n          periodSeconds: %d\n          timeoutSeconds: %d\n          successThreshold: %d\n          failureThreshold: %d\n",
+			check.StartPeriodSeconds, check.IntervalSeconds, check.TimeoutSeconds, success, check.UnhealthyThreshold)
+	}
+	return "\n        readinessProbe:\n" + handler + timing(check.HealthyThreshold) +
+		"        livenessProbe:\n" + handler + timing(1)
+}
+
+// waitK8sReady waits until every pod of the app's workload is ready, which
+// with probes configured means its health check passes.
+func waitK8sReady(client *sshpkg.Client, app *model.Application, check model.HealthCheck) error {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("kubectl rollout status %s -n %s --timeout=%ds 2>&1",
+		k8sWorkload(client, app), app.Namespace, check.DeadlineSeconds))
+	if err := commandError(result, err); err != nil {
+		return fmt.Errorf("%w: %s", errUnhealthy, commandOutput(result))
+	}
+	return nil
+}
+
+// waitDockerHealthy polls the container's HEALTHCHECK status until it is
+// healthy, reported unhealthy, the container exits, or the deadline passes.
+func waitDockerHealthy(client *sshpkg.Client, container string, check model.HealthCheck) error {
+	deadline := time.Now().Add(time.Duration(check.DeadlineSeconds) * time.Second)
+	cmd := sshpkg.Shellf("docker inspect -f %s %s 2>&1",
+		"{{.State.Running}} {{.State.ExitCode}} {{if .State.Health}}{{.State.Health.Status}}{{else}}none{{end}}", container)
+	for {
+		result, err := client.ExecuteCommand(cmd)
+		if err := commandError(result, err); err != nil {
+			return fmt.Errorf("%w: inspect %s: %s", errUnhealthy, container, commandOutput(result))
+		}
+		fields := strings.Fields(result.Stdout)
+		if len(fields) == 3 {
+			running, exitCode, status := fields[0], fields[1], fields[2]
+			switch {
+			case running != "true":
+				return fmt.Errorf("%w: container exited with code %s", errUnhealthy, exitCode)
+			case status == "healthy":
+				return nil
+			case status == "unhealthy":
+				return fmt.Errorf("%w: %s", errUnhealthy, lastHealthOutput(client, container))
+			case status == "none":
+				return fmt.Errorf("%w: container has no HEALTHCHECK", errUnhealthy)
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: still starting after %ds", errUnhealthy, check.DeadlineSeconds)
+		}
+		time.Sleep(dockerHealthPollInterval)
+	}
+}
+
+// lastHealthOutput returns the output of the container's latest health probe.
+func lastHealthOutput(client *sshpkg.Client, container string) string {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker inspect -f %s %s 2>/dev/null | tail -n 5",
+		"{{with .State.Health}}{{range .Log}}{{.Output}}{{end}}{{end}}", container))
+	if commandError(result, err) != nil {
+		return "unhealthy"
+	}
+	if out := strings.TrimSpace(result.Stdout); out != "" {
+		return "unhealthy: " + out
+	}
+	return "unhealthy"
+}
+
+// rollbackUnhealthy restores the previous version after a deployment failed
+// its health check, for applications that ask for it. Blue/green Docker and
+// Swarm (through its update failure action) never stop the old version, so
+// only Kubernetes and recreate Docker deployments need anything here.
+func (h *AppTaskHandler) rollbackUnhealthy(client *sshpkg.Client, dep *model.Deployment, app *model.Application) {
+	switch app.Cluster.Type {
+	case model.ClusterTypeK8s:
+		result, err := client.ExecuteCommand(sshpkg.Shellf("kubectl rollout undo %s -n %s 2>&1", k8sWorkload(client, app), app.Namespace))
+		if err := commandError(result, err); err != nil {
+			h.appendLog(dep, fmt.Sprintf("Automatic rollback failed: %s", commandOutput(result)))
+			return
+		}
+		h.appendLog(dep, "Rolled the Kubernetes workload back to its previous revision.")
+		h.DB.Model(app).Update("status", "running")
+	case model.ClusterTypeDockerSwarm:
+		return
+	default:
+		if app.DeployStrategy == model.DeployStrategyBlueGreen {
+			return
+		}
+		var previous model.Deployment
+		if err := h.DB.Where("application_id = ? AND status = ? AND id < ?", app.ID, model.DeploymentStatusLive, dep.ID).
+			Order("id DESC").First(&previous).Error; err != nil {
+			h.appendLog(dep, "No earlier live deployment to roll back to.")
+			return
+		}
+		if h.AsynqClient == nil {
+			h.appendLog(dep, "Automatic rollback unavailable: no task client configured.")
+			return
+		}
+		rollback, err := EnqueueRollback(h.DB, h.AsynqClient, app, &previous)
+		if err != nil {
+			h.appendLog(dep, fmt.Sprintf("Queuing automatic rollback failed: %v", err))
+			return
+		}
+		h.appendLog(dep, fmt.Sprintf("Queued automatic rollback to %s as %s.", previous.Version, rollback.Version))
+	}
+}
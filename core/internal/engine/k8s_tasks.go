@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
 	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
 	"github.com/hibiken/asynq"
 	"gorm.io/gorm"
@@ -127,6 +128,7 @@ func (h *K8sTaskHandler) HandleDesignateManager(ctx context.Context, t *asynq.Ta
 		return fmt.Errorf("failed to get node token: %w", err)
 	}
 	nodeToken := strings.TrimSpace(result.Stdout)
+	defer redact.Track(nodeToken)()
 
 	// Encrypt and store kubeconfig
 	encryptedKubeconfig, err := encrypt([]byte(kubeconfig), h.EncryptionKey)
@@ -169,6 +171,7 @@ func (h *K8sTaskHandler) HandleJoinWorker(ctx context.Context, t *asynq.Task) er
 	if cluster.NodeToken == "" {
 		return fmt.Errorf("cluster %d has no node token, manager not ready", payload.ClusterID)
 	}
+	defer redact.Track(cluster.NodeToken)()
 
 	// Fetch worker server
 	var worker model.Server
@@ -191,8 +194,8 @@ func (h *K8sTaskHandler) HandleJoinWorker(ctx context.Context, t *asynq.Task) er
 
 	// Join the worker to the cluster
 	managerURL := fmt.Sprintf("https://%s:6443", cluster.ManagerServer.IP)
-	joinCmd := fmt.Sprintf(
-		"curl -sfL https://get.k3s.io | K3S_URL='%s' K3S_TOKEN='%s' sh -",
+	joinCmd := sshpkg.Shellf(
+		"curl -sfL https://get.k3s.io | K3S_URL=%s K3S_TOKEN=%s sh -",
 		managerURL,
 		cluster.NodeToken,
 	)
@@ -216,6 +219,6 @@ func (h *K8sTaskHandler) HandleJoinWorker(ctx context.Context, t *asynq.Task) er
 func (h *K8sTaskHandler) setClusterError(cluster *model.Cluster, msg string) {
 	h.DB.Model(cluster).Updates(map[string]interface{}{
 		"status":        model.ClusterStatusError,
-		"error_message": msg,
+		"error_message": redact.String(msg),
 	})
 }
@@ -0,0 +1,78 @@
+package tasks
+
+import (
+	"sync"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/deploylog"
+	"github.com/enochcodes/orchestra/core/internal/model"
+	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
+)
+
+// logFlushInterval is how often streamed command output is written to the
+// deployment log. Batching keeps a chatty docker build from issuing a
+// database write per line.
+const logFlushInterval = 500 * time.Millisecond
+
+// logStream appends lines to a deployment's log in batches.
+type logStream struct {
+	h       *AppTaskHandler
+	dep     *model.Deployment
+	mu      sync.Mutex
+	entries []deploylog.Entry
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func (h *AppTaskHandler) newLogStream(dep *model.Deployment) *logStream {
+	s := &logStream{h: h, dep: dep, stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(logFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.flush()
+			case <-s.stop:
+				s.flush()
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *logStream) line(stream model.LogStream, text string) {
+	s.mu.Lock()
+	s.entries = append(s.entries, deploylog.Entry{Time: time.Now(), Stream: stream, Text: text})
+	s.mu.Unlock()
+}
+
+func (s *logStream) flush() {
+	s.mu.Lock()
+	entries := s.entries
+	s.entries = nil
+	s.mu.Unlock()
+	if len(entries) > 0 {
+		s.h.appendEntries(s.dep, entries)
+	}
+}
+
+// close writes out any remaining lines.
+func (s *logStream) close() {
+	close(s.stop)
+	<-s.done
+}
+
+// streamCommand runs cmd, appending its stdout and stderr to the deployment
+// log as they arrive, indented under the step that runs it. As with
+// ExecuteCommand, a non-zero exit is reported in the result, not the error;
+// check both with commandError.
+func (h *AppTaskHandler) streamCommand(client *sshpkg.Client, dep *model.Deployment, cmd string) (*sshpkg.CommandResult, error) {
+	s := h.newLogStream(dep)
+	defer s.close()
+	return client.ExecuteCommandStream(cmd, func(stream sshpkg.Stream, line string) {
+		s.line(model.LogStream(stream), "  "+line)
+	})
+}
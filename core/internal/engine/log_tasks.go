@@ -0,0 +1,37 @@
+package tasks
+
+import (
+	"context"
+	"log"
+
+	"github.com/enochcodes/orchestra/core/internal/deploylog"
+	"github.com/enochcodes/orchestra/core/pkg/objstore"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+)
+
+const TypeCompactLogs = "logs:compact"
+
+// NewCompactLogsTask compacts and expires old deployment logs. The worker
+// schedules it periodically; a missed run is caught up by the next one.
+func NewCompactLogsTask() *asynq.Task {
+	return asynq.NewTask(TypeCompactLogs, nil, asynq.Queue("default"), asynq.MaxRetry(0))
+}
+
+type LogTaskHandler struct {
+	DB     *gorm.DB
+	Store  objstore.Store // where compacted logs are offloaded; nil keeps them in the database
+	Policy deploylog.Policy
+}
+
+// HandleCompactLogs applies the log retention and compaction policy.
+func (h *LogTaskHandler) HandleCompactLogs(ctx context.Context, t *asynq.Task) error {
+	res, err := deploylog.Compact(ctx, h.DB, h.Store, h.Policy)
+	if err != nil {
+		return err
+	}
+	if res.Compacted > 0 || res.Purged > 0 {
+		log.Printf("Deployment logs: compacted %d, deleted %d", res.Compacted, res.Purged)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package tasks
+
+import (
+	"context"
+
+	"github.com/enochcodes/orchestra/core/pkg/redact"
+	"github.com/hibiken/asynq"
+)
+
+// RedactErrors masks secrets in the errors tasks return, which asynq keeps
+// with the task and shows in its tooling.
+func RedactErrors(next asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		return redact.Error(next.ProcessTask(ctx, t))
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/enochcodes/orchestra/core/internal/model"
 	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
@@ -60,51 +61,110 @@ func (h *NginxTaskHandler) HandleNginxProvision(ctx context.Context, t *asynq.Ta
 	installCmd := `command -v nginx >/dev/null 2>&1 || { apt-get update -qq && apt-get install -y -qq nginx; } || { yum install -y nginx; }`
 	client.ExecuteCommand(installCmd)
 
-	// Generate nginx config
-	nginxConf := h.generateNginxConfig(&cfg)
+	if err := writeNginxSite(client, &cfg); err != nil {
+		h.setStatus(&cfg, "error")
+		return err
+	}
+
+	// Setup Let's Encrypt if requested
+	if cfg.LetsEncrypt && cfg.SSLEnabled {
+		log.Printf("Setting up Let's Encrypt for %s", cfg.Domain)
+		certCmd := sshpkg.Shellf(
+			`command -v certbot >/dev/null 2>&1 || { apt-get install -y -qq certbot python3-certbot-nginx; } && certbot --nginx -d %s --non-interactive --agree-tos --email %s 2>&1`,
+			cfg.Domain, "admin@"+cfg.Domain,
+		)
+		client.ExecuteCommand(certCmd)
+	}
+
+	h.setStatus(&cfg, "active")
+	log.Printf("Nginx configured for %s on server %d", cfg.Domain, server.ID)
+	return nil
+}
+
+// A generated site proxies to a named upstream kept in a file of its own,
+// so that moving an application to other ports rewrites only that file and
+// leaves the site's server blocks, including what certbot added for HTTPS,
+// untouched.
 
-	// Write config
-	confPath := fmt.Sprintf("/etc/nginx/sites-available/%s", sanitizeName(cfg.Domain))
+// nginxSitePath is the file holding the site for domain.
+func nginxSitePath(domain string) string {
+	return fmt.Sprintf("/etc/nginx/sites-available/%s", sanitizeName(domain))
+}
+
+// nginxUpstreamName names the upstream the site for domain proxies to.
+func nginxUpstreamName(domain string) string {
+	return "orchestra-" + sanitizeName(domain)
+}
+
+// nginxUpstreamPath is the file holding the upstream of the site for domain.
+func nginxUpstreamPath(domain string) string {
+	return fmt.Sprintf("/etc/nginx/conf.d/%s.upstream.conf", nginxUpstreamName(domain))
+}
+
+// writeNginxSite writes and enables the site for cfg, then tests and reloads
+// nginx.
+func writeNginxSite(client *sshpkg.Client, cfg *model.NginxConfig) error {
+	confPath := nginxSitePath(cfg.Domain)
 	enabledPath := fmt.Sprintf("/etc/nginx/sites-enabled/%s", sanitizeName(cfg.Domain))
 
-	writeCmd := fmt.Sprintf("cat > %s << 'ORCHESTRA_EOF'\n%s\nORCHESTRA_EOF", confPath, nginxConf)
-	if result, err := client.ExecuteCommand(writeCmd); err != nil {
-		h.setStatus(&cfg, "error")
-		return fmt.Errorf("write nginx config: %s %w", result.Stderr, err)
+	if cfg.CustomConfig == "" {
+		client.ExecuteCommand("mkdir -p /etc/nginx/conf.d")
+		if err := client.WriteFile(nginxUpstreamPath(cfg.Domain), []byte(generateNginxUpstream(cfg.Domain, cfg.UpstreamPort)), 0644); err != nil {
+			return fmt.Errorf("write nginx upstream: %w", err)
+		}
+	}
+	if err := client.WriteFile(confPath, []byte(generateNginxConfig(cfg)+"\n"), 0644); err != nil {
+		return fmt.Errorf("write nginx config: %w", err)
 	}
 
 	// Enable site
 	client.ExecuteCommand("mkdir -p /etc/nginx/sites-enabled")
-	client.ExecuteCommand(fmt.Sprintf("ln -sf %s %s", confPath, enabledPath))
+	client.ExecuteCommand(sshpkg.Cmd("ln", "-sf", "--", confPath, enabledPath).String())
 
 	// Test and reload nginx
 	result, err := client.ExecuteCommand("nginx -t 2>&1 && systemctl reload nginx 2>&1")
-	if err != nil {
-		h.setStatus(&cfg, "error")
-		return fmt.Errorf("nginx reload failed: %s %w", result.Stderr, err)
+	if err := commandError(result, err); err != nil {
+		return fmt.Errorf("nginx reload failed: %s %w", commandOutput(result), err)
 	}
+	return nil
+}
 
-	// Setup Let's Encrypt if requested
-	if cfg.LetsEncrypt && cfg.SSLEnabled {
-		log.Printf("Setting up Let's Encrypt for %s", cfg.Domain)
-		certCmd := fmt.Sprintf(
-			`command -v certbot >/dev/null 2>&1 || { apt-get install -y -qq certbot python3-certbot-nginx; } && certbot --nginx -d %s --non-interactive --agree-tos --email admin@%s 2>&1`,
-			cfg.Domain, cfg.Domain,
-		)
-		client.ExecuteCommand(certCmd)
+// pointNginxUpstream makes the generated site for cfg proxy to ports on the
+// loopback interface by rewriting its upstream file, then tests and reloads
+// nginx. A site written before sites had an upstream file has its
+// proxy_pass switched to the upstream in place.
+func pointNginxUpstream(client *sshpkg.Client, cfg *model.NginxConfig, ports ...int) error {
+	client.ExecuteCommand("mkdir -p /etc/nginx/conf.d")
+	if err := client.WriteFile(nginxUpstreamPath(cfg.Domain), []byte(generateNginxUpstream(cfg.Domain, ports...)), 0644); err != nil {
+		return fmt.Errorf("write nginx upstream: %w", err)
+	}
+	migrate := `s#proxy_pass http://127\.0\.0\.1:[0-9]+;#proxy_pass http://` + nginxUpstreamName(cfg.Domain) + `;#`
+	result, err := client.ExecuteCommand(sshpkg.Shellf("sed -i -E %s %s 2>&1 && nginx -t 2>&1 && systemctl reload nginx 2>&1",
+		migrate, nginxSitePath(cfg.Domain)))
+	if err := commandError(result, err); err != nil {
+		return fmt.Errorf("nginx reload failed: %s %w", commandOutput(result), err)
 	}
-
-	h.setStatus(&cfg, "active")
-	log.Printf("Nginx configured for %s on server %d", cfg.Domain, server.ID)
 	return nil
 }
 
-func (h *NginxTaskHandler) generateNginxConfig(cfg *model.NginxConfig) string {
+// generateNginxUpstream renders the upstream of the site for domain,
+// balancing requests over ports on the loopback interface.
+func generateNginxUpstream(domain string, ports ...int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "upstream %s {\n", nginxUpstreamName(domain))
+	for _, port := range ports {
+		fmt.Fprintf(&b, "    server 127.0.0.1:%d;\n", port)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func generateNginxConfig(cfg *model.NginxConfig) string {
 	if cfg.CustomConfig != "" {
 		return cfg.CustomConfig
 	}
 
-	upstream := fmt.Sprintf("http://127.0.0.1:%d", cfg.UpstreamPort)
+	upstream := "http://" + nginxUpstreamName(cfg.Domain)
 
 	return fmt.Sprintf(`server {
     listen 80;
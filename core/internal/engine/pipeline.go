@@ -0,0 +1,101 @@
+package tasks
+
+import (
+	"log"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/deploylog"
+	"github.com/enochcodes/orchestra/core/internal/model"
+)
+
+// A deployment runs as a pipeline of steps, persisted as DeploymentSteps.
+// At most one step is running at a time; log lines appended while it runs
+// are tagged with its name.
+
+// Steps run by each kind of deployment, in order.
+var pipelineSteps = map[model.DeploymentKind][]model.DeploymentStepName{
+	model.DeploymentKindDeploy: {
+		model.StepFetchSource, model.StepGenerateDockerfile, model.StepBuild, model.StepPush,
+		model.StepPreDeploy, model.StepDeploy, model.StepHealthCheck, model.StepRouteTraffic,
+		model.StepPostDeploy,
+	},
+	model.DeploymentKindRestart: {
+		model.StepDeploy, model.StepHealthCheck, model.StepRouteTraffic,
+	},
+	model.DeploymentKindRollback: {
+		model.StepFetchSource, model.StepDeploy, model.StepHealthCheck, model.StepRouteTraffic,
+	},
+}
+
+// initSteps replaces the deployment's steps with a fresh pending pipeline
+// for a new attempt.
+func (h *AppTaskHandler) initSteps(dep *model.Deployment) {
+	h.DB.Where("deployment_id = ?", dep.ID).Delete(&model.DeploymentStep{})
+	names := pipelineSteps[dep.Kind]
+	if len(names) == 0 {
+		names = pipelineSteps[model.DeploymentKindDeploy]
+	}
+	steps := make([]model.DeploymentStep, len(names))
+	for i, name := range names {
+		steps[i] = model.DeploymentStep{DeploymentID: dep.ID, Name: name, Position: i + 1, Status: model.StepStatusPending}
+	}
+	h.DB.Create(&steps)
+}
+
+// beginStep finishes the running step, if any, as succeeded and starts name.
+func (h *AppTaskHandler) beginStep(dep *model.Deployment, name model.DeploymentStepName) {
+	h.endStep(dep, model.StepStatusSucceeded)
+	now := time.Now()
+	h.DB.Model(&model.DeploymentStep{}).
+		Where("deployment_id = ? AND name = ?", dep.ID, name).
+		Updates(map[string]interface{}{"status": model.StepStatusRunning, "started_at": now})
+}
+
+// skipStep marks a step that is not needed for this deployment as skipped,
+// recording why in the log under the step's name.
+func (h *AppTaskHandler) skipStep(dep *model.Deployment, name model.DeploymentStepName, reason string) {
+	res := h.DB.Model(&model.DeploymentStep{}).
+		Where("deployment_id = ? AND name = ? AND status = ?", dep.ID, name, model.StepStatusPending).
+		Update("status", model.StepStatusSkipped)
+	if res.RowsAffected > 0 {
+		if err := deploylog.Append(h.DB, dep, name, deploylog.System(reason)); err != nil {
+			log.Printf("Deployment %d: failed to write log: %v", dep.ID, err)
+		}
+	}
+}
+
+// endStep finishes the running step with status.
+func (h *AppTaskHandler) endStep(dep *model.Deployment, status model.DeploymentStepStatus) {
+	var step model.DeploymentStep
+	if err := h.DB.Where("deployment_id = ? AND status = ?", dep.ID, model.StepStatusRunning).First(&step).Error; err != nil {
+		return
+	}
+	now := time.Now()
+	updates := map[string]interface{}{"status": status, "finished_at": now}
+	if step.StartedAt != nil {
+		updates["duration_ms"] = now.Sub(*step.StartedAt).Milliseconds()
+	}
+	h.DB.Model(&step).Updates(updates)
+}
+
+// finishSteps closes the pipeline once the attempt ends: the running step
+// gets status, and steps never reached are marked skipped.
+func (h *AppTaskHandler) finishSteps(dep *model.Deployment, status model.DeploymentStepStatus) {
+	h.endStep(dep, status)
+	h.DB.Model(&model.DeploymentStep{}).
+		Where("deployment_id = ? AND status = ?", dep.ID, model.StepStatusPending).
+		Update("status", model.StepStatusSkipped)
+}
+
+// runningStep returns the name of the deployment's running step, or "" when
+// none is.
+func (h *AppTaskHandler) runningStep(dep *model.Deployment) model.DeploymentStepName {
+	var names []model.DeploymentStepName
+	h.DB.Model(&model.DeploymentStep{}).
+		Where("deployment_id = ? AND status = ?", dep.ID, model.StepStatusRunning).
+		Limit(1).Pluck("name", &names)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
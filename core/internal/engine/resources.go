@@ -0,0 +1,70 @@
+package tasks
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+)
+
+// cpus formats millicores as a number of cores, as Docker takes them.
+func cpus(millicores int) string {
+	return strconv.FormatFloat(float64(millicores)/1000, 'f', -1, 64)
+}
+
+// k8sResourcesYaml renders r as the resources of a container in a pod
+// template, or nothing when r is unset.
+func k8sResourcesYaml(r model.Resources) string {
+	if r.IsZero() {
+		return ""
+	}
+	section := func(name string, cpu, memory int) string {
+		if cpu == 0 && memory == 0 {
+			return ""
+		}
+		s := fmt.Sprintf("          %s:\n", name)
+		if cpu > 0 {
+			s += fmt.Sprintf("            cpu: %dm\n", cpu)
+		}
+		if memory > 0 {
+			s += fmt.Sprintf("            memory: %dMi\n", memory)
+		}
+		return s
+	}
+	return "\n        resources:\n" +
+		section("requests", r.CPURequestMillicores, r.MemoryRequestMB) +
+		section("limits", r.CPULimitMillicores, r.MemoryLimitMB)
+}
+
+// swarmResourceArgs returns the reservation and limit flags for r. They are
+// accepted by both docker service create and docker service update, and
+// are always all given so that 0 clears a setting that was removed.
+func swarmResourceArgs(r model.Resources) []string {
+	return []string{
+		"--reserve-cpu", cpus(r.CPURequestMillicores),
+		"--reserve-memory", fmt.Sprintf("%dM", r.MemoryRequestMB),
+		"--limit-cpu", cpus(r.CPULimitMillicores),
+		"--limit-memory", fmt.Sprintf("%dM", r.MemoryLimitMB),
+	}
+}
+
+// dockerResourceArgs returns the docker run flags for r. Docker cannot
+// reserve CPU, so a CPU request becomes a proportional share of CPU time
+// (1024 per core), and a memory request a soft limit the kernel enforces
+// when the host runs short.
+func dockerResourceArgs(r model.Resources) []string {
+	var args []string
+	if r.CPULimitMillicores > 0 {
+		args = append(args, "--cpus", cpus(r.CPULimitMillicores))
+	}
+	if r.CPURequestMillicores > 0 {
+		args = append(args, "--cpu-shares", strconv.Itoa(max(r.CPURequestMillicores*1024/1000, 2)))
+	}
+	if r.MemoryLimitMB > 0 {
+		args = append(args, "--memory", fmt.Sprintf("%dm", r.MemoryLimitMB))
+	}
+	if r.MemoryRequestMB > 0 {
+		args = append(args, "--memory-reservation", fmt.Sprintf("%dm", r.MemoryRequestMB))
+	}
+	return args
+}
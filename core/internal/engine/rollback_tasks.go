@@ -0,0 +1,154 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
+	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
+	"github.com/hibiken/asynq"
+)
+
+const TypeRollbackDeployment = "deployment:rollback"
+
+type RollbackPayload struct {
+	DeploymentID uint `json:"deployment_id"` // the queued rollback deployment; it restores its RollbackOfID
+}
+
+// NewRollbackTask runs a rollback queued by EnqueueRollback.
+func NewRollbackTask(deploymentID uint) (*asynq.Task, error) {
+	payload, err := json.Marshal(RollbackPayload{DeploymentID: deploymentID})
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TypeRollbackDeployment, payload, asynq.Queue("deployment"), asynq.MaxRetry(0)), nil
+}
+
+// HandleRollbackTask runs the target deployment's image tag and spec as a new
+// deployment, without rebuilding. On success the deployment it replaces is
+// marked rolled back.
+func (h *AppTaskHandler) HandleRollbackTask(ctx context.Context, t *asynq.Task) error {
+	var p RollbackPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+	return h.runDeployment(ctx, t, p.DeploymentID, h.rollback)
+}
+
+func (h *AppTaskHandler) rollback(ctx context.Context, deployment *model.Deployment, app *model.Application) error {
+	var target model.Deployment
+	if deployment.RollbackOfID == nil || h.DB.First(&target, *deployment.RollbackOfID).Error != nil {
+		h.failDeployment(deployment, app, "Deployment to roll back to not found")
+		return fmt.Errorf("rollback target lookup failed: %w", asynq.SkipRetry)
+	}
+
+	// The deployment being replaced, if any, is the newest live one made after
+	// the target.
+	var current model.Deployment
+	hasCurrent := h.DB.Where("application_id = ? AND status = ? AND id > ?", app.ID, model.DeploymentStatusLive, target.ID).
+		Order("created_at DESC").First(&current).Error == nil
+
+	spec := target.Spec
+	if spec.IsZero() {
+		// Deployments made before specs were recorded: reuse the image with
+		// the application's current configuration.
+		vars, err := h.appEnvVars(*app)
+		if err != nil {
+			h.failDeployment(deployment, app, fmt.Sprintf("Loading environment failed: %v", err))
+			return fmt.Errorf("app env: %v: %w", err, asynq.SkipRetry)
+		}
+		spec = specFor(*app, target.ImageTag, vars, h.mountedVolumes(app.ID))
+	}
+	// Volumes hold data rather than configuration: a rollback mounts the
+	// application's current ones.
+	spec.Volumes = volumeMounts(h.mountedVolumes(app.ID))
+
+	deployment.Spec = spec
+	h.DB.Model(deployment).Update("spec", spec)
+	h.setStatus(deployment, model.DeploymentStatusDeploying)
+	h.appendLog(deployment, fmt.Sprintf("Rolling back %s to %s (%s)", app.Name, target.Version, target.ImageTag))
+	if target.Spec.IsZero() {
+		h.appendLog(deployment, fmt.Sprintf("No spec was recorded for %s; using the application's current configuration.", target.Version))
+	}
+	h.DB.Model(app).Update("status", "deploying")
+
+	managerServer := app.Cluster.ManagerServer
+	sshKey, err := decrypt(managerServer.SSHKeyEncrypted, h.EncryptionKey)
+	if err != nil {
+		h.failDeployment(deployment, app, "Failed to decrypt manager SSH key")
+		return fmt.Errorf("decrypt SSH key: %w", err)
+	}
+	client, err := sshpkg.NewClient(managerServer.IP, managerServer.SSHPort, managerServer.SSHUser, sshKey, "")
+	if err != nil {
+		h.failDeployment(deployment, app, fmt.Sprintf("SSH to manager failed: %v", err))
+		return fmt.Errorf("SSH to manager: %w", err)
+	}
+	defer client.Close()
+	client = client.WithContext(ctx)
+
+	env, err := resolveEnv(h.DB, h.EncryptionKey, app.ClusterID, spec.Env)
+	if err != nil {
+		h.failDeployment(deployment, app, fmt.Sprintf("Resolving environment failed: %v", err))
+		return fmt.Errorf("resolve env: %v: %w", err, asynq.SkipRetry)
+	}
+	defer redact.Track(env.secretValues()...)()
+
+	if app.Cluster.Type != model.ClusterTypeK8s {
+		h.beginStep(deployment, model.StepFetchSource)
+		if err := h.ensureImage(client, deployment, app, target.ImageTag); err != nil {
+			return err
+		}
+	} else {
+		h.skipStep(deployment, model.StepFetchSource, "Kubernetes nodes pull the image themselves.")
+	}
+
+	runApp := applySpec(*app, spec)
+	h.beginStep(deployment, model.StepDeploy)
+	if err := h.deployRuntime(client, deployment, &runApp, target.ImageTag, env); err != nil {
+		return err
+	}
+	if app.Cluster.Type == model.ClusterTypeK8s && hasCurrent && current.ImageTag == target.ImageTag {
+		if err := h.rolloutRestart(client, deployment, &runApp); err != nil {
+			return err
+		}
+	}
+
+	h.setStatus(deployment, model.DeploymentStatusLive)
+	if hasCurrent {
+		h.DB.Model(&current).Update("status", model.DeploymentStatusRolledBack)
+		h.appendLog(deployment, fmt.Sprintf("Marked %s as rolled back.", current.Version))
+	}
+	h.DB.Model(app).Update("status", "running")
+	h.appendLog(deployment, fmt.Sprintf("Deployment %s is live!", deployment.Version))
+	logActivity(h.DB, model.ActivityTypeAppRolledBack,
+		fmt.Sprintf("Application '%s' rolled back to %s as %s", app.Name, target.Version, deployment.Version),
+		"application", app.ID)
+
+	log.Printf("Rollback of app %s to %s complete", app.Name, target.Version)
+	return nil
+}
+
+// ensureImage makes sure image is present on the manager. Locally built
+// images cannot be recreated without a rebuild, so only registry images are
+// pulled again.
+func (h *AppTaskHandler) ensureImage(client *sshpkg.Client, dep *model.Deployment, app *model.Application, image string) error {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker image inspect %s >/dev/null 2>&1", image))
+	if commandError(result, err) == nil {
+		return nil
+	}
+	if app.SourceType != model.DeploymentSourceDocker {
+		msg := fmt.Sprintf("Image %s is no longer present on the manager", image)
+		h.failDeployment(dep, app, msg)
+		return fmt.Errorf("%s: %w", msg, asynq.SkipRetry)
+	}
+	h.appendLog(dep, fmt.Sprintf("Pulling Docker image: %s", image))
+	result, err = h.streamCommand(client, dep, sshpkg.Shellf("docker pull -- %s 2>&1", image))
+	if err := commandError(result, err); err != nil {
+		h.failDeployment(dep, app, fmt.Sprintf("Docker pull failed: %s", commandOutput(result)))
+		return fmt.Errorf("docker pull: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,374 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
+	"gorm.io/gorm"
+)
+
+// Overall runtime states reported by InspectRuntime.
+const (
+	RuntimeRunning  = "running"  // every desired instance is ready
+	RuntimeDegraded = "degraded" // some, but not all, desired instances are ready
+	RuntimeDown     = "down"     // instances are desired but none is ready
+	RuntimeStopped  = "stopped"  // no instances are desired
+)
+
+// maxInstanceEvents bounds the Kubernetes events reported per pod.
+const maxInstanceEvents = 5
+
+// Instance is one running copy of an application as its runtime sees it: a
+// Kubernetes pod, a Swarm task or a Docker container.
+type Instance struct {
+	Name      string     `json:"name"`
+	Server    string     `json:"server,omitempty"`    // node the instance is scheduled on
+	ServerID  *uint      `json:"server_id,omitempty"` // set when the node is a registered server
+	State     string     `json:"state"`               // e.g. running, waiting, exited, failed
+	Ready     bool       `json:"ready"`
+	Health    string     `json:"health,omitempty"` // Docker health check status
+	Restarts  int        `json:"restarts"`
+	ExitCode  *int       `json:"exit_code,omitempty"`
+	Reason    string     `json:"reason,omitempty"`  // e.g. CrashLoopBackOff, ImagePullBackOff, OOMKilled
+	Message   string     `json:"message,omitempty"` // the runtime's explanation or error
+	Image     string     `json:"image,omitempty"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	Events    []string   `json:"events,omitempty"` // recent warning events (Kubernetes)
+}
+
+// RuntimeStatus is the observed state of an application's instances.
+type RuntimeStatus struct {
+	Status    string     `json:"status"`
+	Desired   int        `json:"desired"`
+	Ready     int        `json:"ready"`
+	Instances []Instance `json:"instances"`
+	CheckedAt time.Time  `json:"checked_at"`
+}
+
+// InspectRuntime asks the application's runtime for the state of each of its
+// instances. app must have its Cluster and Cluster.ManagerServer loaded.
+func InspectRuntime(ctx context.Context, db *gorm.DB, keyHex string, app *model.Application) (*RuntimeStatus, error) {
+	manager := app.Cluster.ManagerServer
+	if manager.ID == 0 {
+		return nil, fmt.Errorf("cluster has no manager server")
+	}
+	client, err := dialServer(manager, keyHex)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	client = client.WithContext(ctx)
+
+	name := sanitizeName(app.Name)
+	var instances []Instance
+	switch app.Cluster.Type {
+	case model.ClusterTypeK8s:
+		instances, err = k8sInstances(client, name, app.Namespace)
+	case model.ClusterTypeDockerSwarm:
+		instances, err = swarmInstances(client, name)
+	default:
+		instances, err = dockerInstances(client, name, serverLabel(manager))
+	}
+	if err != nil {
+		return nil, err
+	}
+	resolveInstanceServers(db, app.ClusterID, instances)
+
+	status := &RuntimeStatus{Desired: app.Replicas, Instances: instances, CheckedAt: time.Now()}
+	switch {
+	case app.Status == AppStatusStopped:
+		status.Desired = 0
+	case app.DeployStrategy == model.DeployStrategyBlueGreen &&
+		app.Cluster.Type != model.ClusterTypeK8s && app.Cluster.Type != model.ClusterTypeDockerSwarm:
+		status.Desired = 1 // blue/green runs a single container on plain Docker
+	}
+	for _, in := range instances {
+		if in.Ready {
+			status.Ready++
+		}
+	}
+	switch {
+	case status.Desired == 0:
+		status.Status = RuntimeStopped
+	case status.Ready >= status.Desired:
+		status.Status = RuntimeRunning
+	case status.Ready == 0:
+		status.Status = RuntimeDown
+	default:
+		status.Status = RuntimeDegraded
+	}
+	return status, nil
+}
+
+// resolveInstanceServers links instances to the registered servers they
+// run on, matching the node name against hostnames and IPs.
+func resolveInstanceServers(db *gorm.DB, clusterID uint, instances []Instance) {
+	var servers []model.Server
+	db.Select("id", "hostname", "ip").Where("cluster_id = ?", clusterID).Find(&servers)
+	for i := range instances {
+		for _, s := range servers {
+			if instances[i].Server != "" && (instances[i].Server == s.Hostname || instances[i].Server == s.IP) {
+				id := s.ID
+				instances[i].ServerID = &id
+				break
+			}
+		}
+	}
+}
+
+// k8sPod is the part of a pod's JSON used here.
+type k8sPod struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		Phase             string `json:"phase"`
+		Reason            string `json:"reason"`
+		Message           string `json:"message"`
+		ContainerStatuses []struct {
+			Ready        bool              `json:"ready"`
+			RestartCount int               `json:"restartCount"`
+			Image        string            `json:"image"`
+			State        k8sContainerState `json:"state"`
+			LastState    k8sContainerState `json:"lastState"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+type k8sContainerState struct {
+	Running *struct {
+		StartedAt time.Time `json:"startedAt"`
+	} `json:"running"`
+	Waiting *struct {
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	} `json:"waiting"`
+	Terminated *struct {
+		ExitCode int    `json:"exitCode"`
+		Reason   string `json:"reason"`
+		Message  string `json:"message"`
+	} `json:"terminated"`
+}
+
+type k8sEvent struct {
+	InvolvedObject struct {
+		Name string `json:"name"`
+	} `json:"involvedObject"`
+	Reason        string    `json:"reason"`
+	Message       string    `json:"message"`
+	Count         int       `json:"count"`
+	LastTimestamp time.Time `json:"lastTimestamp"`
+}
+
+func k8sInstances(client *sshpkg.Client, name, namespace string) ([]Instance, error) {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("kubectl get pods -n %s -l %s -o json 2>&1", namespace, "app="+name))
+	if err := commandError(result, err); err != nil {
+		return nil, fmt.Errorf("kubectl get pods: %v: %s", err, commandOutput(result))
+	}
+	var pods struct {
+		Items []k8sPod `json:"items"`
+	}
+	if err := json.Unmarshal([]byte(result.Stdout), &pods); err != nil {
+		return nil, fmt.Errorf("parse pods: %w", err)
+	}
+
+	events := map[string][]k8sEvent{}
+	result, err = client.ExecuteCommand(sshpkg.Shellf("kubectl get events -n %s --field-selector %s -o json 2>/dev/null",
+		namespace, "involvedObject.kind=Pod,type=Warning"))
+	if commandError(result, err) == nil {
+		var list struct {
+			Items []k8sEvent `json:"items"`
+		}
+		if json.Unmarshal([]byte(result.Stdout), &list) == nil {
+			for _, e := range list.Items {
+				events[e.InvolvedObject.Name] = append(events[e.InvolvedObject.Name], e)
+			}
+		}
+	}
+
+	instances := make([]Instance, 0, len(pods.Items))
+	for _, pod := range pods.Items {
+		in := Instance{
+			Name:    pod.Metadata.Name,
+			Server:  pod.Spec.NodeName,
+			State:   strings.ToLower(pod.Status.Phase),
+			Reason:  pod.Status.Reason,
+			Message: pod.Status.Message,
+		}
+		if len(pod.Status.ContainerStatuses) > 0 {
+			cs := pod.Status.ContainerStatuses[0]
+			in.Ready = cs.Ready
+			in.Restarts = cs.RestartCount
+			in.Image = cs.Image
+			switch st := cs.State; {
+			case st.Running != nil:
+				in.State = "running"
+				started := st.Running.StartedAt
+				in.StartedAt = &started
+			case st.Waiting != nil:
+				in.State = "waiting"
+				in.Reason, in.Message = st.Waiting.Reason, st.Waiting.Message
+			case st.Terminated != nil:
+				in.State = "terminated"
+				code := st.Terminated.ExitCode
+				in.ExitCode = &code
+				in.Reason, in.Message = st.Terminated.Reason, st.Terminated.Message
+			}
+			// A crash-looping container is running or waiting now; why it
+			// last died is the useful part.
+			if last := cs.LastState.Terminated; last != nil && in.ExitCode == nil {
+				code := last.ExitCode
+				in.ExitCode = &code
+				if in.Reason == "" {
+					in.Reason = last.Reason
+				}
+			}
+		}
+		podEvents := events[pod.Metadata.Name]
+		sort.Slice(podEvents, func(i, j int) bool { return podEvents[i].LastTimestamp.After(podEvents[j].LastTimestamp) })
+		for i, e := range podEvents {
+			if i == maxInstanceEvents {
+				break
+			}
+			line := fmt.Sprintf("%s: %s", e.Reason, e.Message)
+			if e.Count > 1 {
+				line += fmt.Sprintf(" (x%d)", e.Count)
+			}
+			in.Events = append(in.Events, line)
+		}
+		instances = append(instances, in)
+	}
+	return instances, nil
+}
+
+// swarmTask is one line of docker service ps --format '{{json .}}'.
+type swarmTask struct {
+	Name         string
+	Image        string
+	Node         string
+	DesiredState string
+	CurrentState string
+	Error        string
+}
+
+func swarmInstances(client *sshpkg.Client, name string) ([]Instance, error) {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker service ps %s --no-trunc --format %s 2>&1", name, "{{json .}}"))
+	if err := commandError(result, err); err != nil {
+		return nil, fmt.Errorf("docker service ps: %v: %s", err, commandOutput(result))
+	}
+
+	// Tasks are listed newest first for each slot; earlier tasks of a slot
+	// are the ones it replaced.
+	var order []string
+	slots := map[string][]swarmTask{}
+	for _, line := range strings.Split(strings.TrimSpace(result.Stdout), "\n") {
+		var t swarmTask
+		if json.Unmarshal([]byte(line), &t) != nil {
+			continue
+		}
+		t.Name = strings.TrimLeft(t.Name, `\_ `)
+		if _, ok := slots[t.Name]; !ok {
+			order = append(order, t.Name)
+		}
+		slots[t.Name] = append(slots[t.Name], t)
+	}
+
+	var instances []Instance
+	for _, slot := range order {
+		history := slots[slot]
+		current := history[0]
+		if !strings.EqualFold(current.DesiredState, "running") {
+			continue // the slot was scaled away
+		}
+		state := strings.ToLower(strings.Fields(current.CurrentState + " unknown")[0])
+		in := Instance{
+			Name:    slot,
+			Server:  current.Node,
+			State:   state,
+			Ready:   state == "running",
+			Image:   current.Image,
+			Message: current.Error,
+		}
+		for _, t := range history[1:] {
+			in.Restarts++
+			if in.Message == "" && t.Error != "" {
+				in.Message = t.Error
+			}
+		}
+		instances = append(instances, in)
+	}
+	return instances, nil
+}
+
+// dockerContainer is the part of docker inspect output used here.
+type dockerContainer struct {
+	Name         string
+	RestartCount int
+	Config       struct {
+		Image string
+	}
+	State struct {
+		Status     string
+		Running    bool
+		Restarting bool
+		OOMKilled  bool
+		ExitCode   int
+		Error      string
+		StartedAt  time.Time
+		Health     *struct {
+			Status string
+		}
+	}
+}
+
+func dockerInstances(client *sshpkg.Client, name, server string) ([]Instance, error) {
+	label := "label=orchestra.app=" + name
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker ps -aq --filter %s | xargs -r docker inspect 2>&1", label))
+	if err := commandError(result, err); err != nil {
+		return nil, fmt.Errorf("docker inspect: %v: %s", err, commandOutput(result))
+	}
+	var containers []dockerContainer
+	if out := strings.TrimSpace(result.Stdout); out != "" {
+		if err := json.Unmarshal([]byte(out), &containers); err != nil {
+			return nil, fmt.Errorf("parse containers: %w", err)
+		}
+	}
+
+	instances := make([]Instance, 0, len(containers))
+	for _, c := range containers {
+		in := Instance{
+			Name:     strings.TrimPrefix(c.Name, "/"),
+			Server:   server,
+			State:    c.State.Status,
+			Restarts: c.RestartCount,
+			Image:    c.Config.Image,
+			Message:  c.State.Error,
+		}
+		if c.State.Health != nil {
+			in.Health = c.State.Health.Status
+		}
+		in.Ready = c.State.Running && !c.State.Restarting && (in.Health == "" || in.Health == "healthy")
+		if c.State.Running {
+			started := c.State.StartedAt
+			in.StartedAt = &started
+		} else {
+			code := c.State.ExitCode
+			in.ExitCode = &code
+		}
+		if c.State.OOMKilled {
+			in.Reason = "OOMKilled"
+		}
+		instances = append(instances, in)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+	return instances, nil
+}
@@ -0,0 +1,137 @@
+package tasks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
+	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
+	"gorm.io/gorm"
+)
+
+// resolvedEnv is a set of variables after ${secret:NAME} references have
+// been replaced with their decrypted values.
+type resolvedEnv struct {
+	Vars    map[string]string // every variable, in plaintext
+	Secrets map[string]bool   // keys whose value came (wholly or partly) from a secret
+	plain   []string          // the decrypted secrets themselves
+}
+
+// secretValues returns the values that must never appear in logs: those
+// that came from secrets, and those of variables named like credentials.
+func (e *resolvedEnv) secretValues() []string {
+	values := append([]string(nil), e.plain...)
+	for k, v := range e.Vars {
+		if e.Secrets[k] || redact.SensitiveName(k) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// resolveEnv decrypts every secret referenced by vars from the cluster's
+// secret store and substitutes it in place.
+func resolveEnv(db *gorm.DB, keyHex string, clusterID uint, vars map[string]string) (*resolvedEnv, error) {
+	env := &resolvedEnv{
+		Vars:    make(map[string]string, len(vars)),
+		Secrets: map[string]bool{},
+	}
+
+	names := model.SecretRefs(vars)
+	plain := make(map[string]string, len(names))
+	if len(names) > 0 {
+		var secrets []model.Secret
+		if err := db.Where("cluster_id = ? AND name IN ?", clusterID, names).Find(&secrets).Error; err != nil {
+			return nil, fmt.Errorf("load secrets: %w", err)
+		}
+		for _, s := range secrets {
+			value, err := decrypt(s.ValueEncrypted, keyHex)
+			if err != nil {
+				return nil, fmt.Errorf("decrypt secret %s: %w", s.Name, err)
+			}
+			plain[s.Name] = string(value)
+			env.plain = append(env.plain, string(value))
+		}
+		var missing []string
+		for _, n := range names {
+			if _, ok := plain[n]; !ok {
+				missing = append(missing, n)
+			}
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("unknown secret reference(s): %s", strings.Join(missing, ", "))
+		}
+	}
+
+	for k, v := range vars {
+		if model.SecretRefPattern.MatchString(v) {
+			env.Secrets[k] = true
+			v = model.SecretRefPattern.ReplaceAllStringFunc(v, func(ref string) string {
+				return plain[model.SecretRefPattern.FindStringSubmatch(ref)[1]]
+			})
+		}
+		env.Vars[k] = v
+	}
+	return env, nil
+}
+
+// sortedKeys returns the keys of vars in a stable order so rendered files and
+// manifests do not change between deploys when the values have not.
+func sortedKeys(vars map[string]string) []string {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// envFileContent renders vars in the KEY=VALUE format read by `docker --env-file`.
+// That format has no quoting or escaping, so a value with a newline is not
+// written: the file names the variable alone, which makes the docker CLI
+// take its value from the CLI's own environment, and exports holds the shell
+// lines that put it there.
+func envFileContent(vars map[string]string) (content, exports string, err error) {
+	var b, x strings.Builder
+	for _, k := range sortedKeys(vars) {
+		v := vars[k]
+		if !strings.ContainsAny(v, "\r\n") {
+			fmt.Fprintf(&b, "%s=%s\n", k, v)
+			continue
+		}
+		if !exportableEnvKey(k) {
+			return "", "", fmt.Errorf("value of %s contains a newline, which only reaches docker through its environment, and %s cannot be exported", k, k)
+		}
+		fmt.Fprintf(&b, "%s\n", k)
+		fmt.Fprintf(&x, "export %s=%s\n", k, sshpkg.Quote(v))
+	}
+	return b.String(), x.String(), nil
+}
+
+// pushedEnvContent renders vars for an environment file pushed to servers.
+// Values with a newline are double-quoted with \n escapes, as dotenv readers
+// and Compose env_file expect; every other line is plain KEY=VALUE.
+func pushedEnvContent(vars map[string]string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	var b strings.Builder
+	for _, k := range sortedKeys(vars) {
+		v := vars[k]
+		if strings.ContainsAny(v, "\r\n") {
+			v = `"` + r.Replace(v) + `"`
+		}
+		fmt.Fprintf(&b, "%s=%s\n", k, v)
+	}
+	return b.String()
+}
+
+// swarmSecretName derives an immutable Docker Swarm secret name for one
+// variable. Swarm secrets cannot be updated in place, so the value's hash is
+// part of the name and a rotated value produces a new secret.
+func swarmSecretName(appName, key, value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return fmt.Sprintf("orchestra_%s_%s_%s", appName, strings.ToLower(key), hex.EncodeToString(sum[:])[:12])
+}
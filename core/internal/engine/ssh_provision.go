@@ -7,6 +7,7 @@ import (
 	"log"
 
 	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
 	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
 	"github.com/hibiken/asynq"
 	"gorm.io/gorm"
@@ -154,8 +155,9 @@ func (h *SSHProvisionHandler) HandleInstallK3s(ctx context.Context, t *asynq.Tas
 	if payload.Role == "server" {
 		installCmd = "curl -sfL https://get.k3s.io | INSTALL_K3S_EXEC='server' sh -"
 	} else {
-		installCmd = fmt.Sprintf(
-			"curl -sfL https://get.k3s.io | K3S_URL='%s' K3S_TOKEN='%s' sh -",
+		defer redact.Track(payload.Token)()
+		installCmd = sshpkg.Shellf(
+			"curl -sfL https://get.k3s.io | K3S_URL=%s K3S_TOKEN=%s sh -",
 			payload.ServerURL,
 			payload.Token,
 		)
@@ -183,6 +185,6 @@ func (h *SSHProvisionHandler) HandleInstallK3s(ctx context.Context, t *asynq.Tas
 func (h *SSHProvisionHandler) setServerError(server *model.Server, msg string) {
 	h.DB.Model(server).Updates(map[string]interface{}{
 		"status":        model.ServerStatusError,
-		"error_message": msg,
+		"error_message": redact.String(msg),
 	})
 }
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
 	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
 	"github.com/hibiken/asynq"
 	"gorm.io/gorm"
@@ -92,7 +93,7 @@ func (h *SwarmTaskHandler) HandleSwarmInit(ctx context.Context, t *asynq.Task) e
 	}
 
 	// Initialize Swarm
-	initCmd := fmt.Sprintf("docker swarm init --advertise-addr %s 2>/dev/null || echo ALREADY_SWARM", server.IP)
+	initCmd := sshpkg.Shellf("docker swarm init --advertise-addr %s 2>/dev/null || echo ALREADY_SWARM", server.IP)
 	result, err := client.ExecuteCommand(initCmd)
 	if err != nil {
 		h.setClusterError(&cluster, fmt.Sprintf("Swarm init failed: %s", result.Stderr))
@@ -106,6 +107,7 @@ func (h *SwarmTaskHandler) HandleSwarmInit(ctx context.Context, t *asynq.Task) e
 		return fmt.Errorf("get join token: %w", err)
 	}
 	joinToken := strings.TrimSpace(tokenResult.Stdout)
+	defer redact.Track(joinToken)()
 
 	// Update cluster
 	h.DB.Model(&cluster).Updates(map[string]interface{}{
@@ -139,6 +141,7 @@ func (h *SwarmTaskHandler) HandleSwarmJoin(ctx context.Context, t *asynq.Task) e
 	if cluster.SwarmJoinToken == "" {
 		return fmt.Errorf("cluster %d has no swarm join token, manager not ready", payload.ClusterID)
 	}
+	defer redact.Track(cluster.SwarmJoinToken)()
 
 	var worker model.Server
 	if err := h.DB.First(&worker, payload.ServerID).Error; err != nil {
@@ -163,8 +166,8 @@ func (h *SwarmTaskHandler) HandleSwarmJoin(ctx context.Context, t *asynq.Task) e
 	}
 
 	// Join Swarm
-	joinCmd := fmt.Sprintf("docker swarm join --token %s %s:2377",
-		cluster.SwarmJoinToken, cluster.ManagerServer.IP)
+	joinCmd := sshpkg.Shellf("docker swarm join --token %s %s",
+		cluster.SwarmJoinToken, cluster.ManagerServer.IP+":2377")
 	result, err := client.ExecuteCommand(joinCmd)
 	if err != nil {
 		return fmt.Errorf("swarm join failed: %v\n%s", err, result.Stderr)
@@ -182,6 +185,6 @@ func (h *SwarmTaskHandler) HandleSwarmJoin(ctx context.Context, t *asynq.Task) e
 func (h *SwarmTaskHandler) setClusterError(cluster *model.Cluster, msg string) {
 	h.DB.Model(cluster).Updates(map[string]interface{}{
 		"status":        model.ClusterStatusError,
-		"error_message": msg,
+		"error_message": redact.String(msg),
 	})
 }
@@ -0,0 +1,309 @@
+package tasks
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
+)
+
+// shellNamePattern matches the variable names a POSIX shell can export.
+var shellNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// swarmSecretRef is a Swarm secret mounted into a service at /run/secrets/<Target>.
+type swarmSecretRef struct {
+	Name   string
+	Target string
+}
+
+// swarmServiceExists reports whether a Swarm service with this name exists.
+func swarmServiceExists(client *sshpkg.Client, name string) bool {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker service inspect %s >/dev/null 2>&1", name))
+	return commandError(result, err) == nil
+}
+
+// swarmPolicyArgs returns the update and rollback flags for a policy. They
+// are accepted by both docker service create and docker service update.
+func swarmPolicyArgs(p model.UpdatePolicy) []string {
+	return []string{
+		"--update-parallelism", strconv.Itoa(p.Parallelism),
+		"--update-delay", p.Delay,
+		"--update-failure-action", p.FailureAction,
+		"--update-monitor", p.Monitor,
+		"--update-order", p.Order,
+		"--rollback-parallelism", strconv.Itoa(p.Parallelism),
+		"--rollback-monitor", p.Monitor,
+		"--rollback-order", p.Order,
+	}
+}
+
+// updateSwarmService rolls the existing service to image and the given
+// environment, secrets and volumes in place, then checks how the update
+// ended.
+func (h *AppTaskHandler) updateSwarmService(client *sshpkg.Client, dep *model.Deployment, app *model.Application,
+	image, name string, env map[string]string, secrets []swarmSecretRef, vols *appVolumes, policy model.UpdatePolicy, timeout time.Duration) error {
+
+	var constraints []string
+	var published []int
+	current, err := inspectSwarmService(client, name)
+	if err == nil {
+		constraints, err = swarmConstraints(client, name)
+	}
+	if err == nil {
+		published, err = swarmPublishedPorts(client, name)
+	}
+	if err != nil {
+		h.failDeployment(dep, app, fmt.Sprintf("Inspecting swarm service failed: %v", err))
+		return err
+	}
+
+	cmd := sshpkg.Cmd("timeout", strconv.Itoa(int(timeout.Seconds())), "docker", "service", "update",
+		"--quiet",
+		"--image", image,
+		"--replicas", strconv.Itoa(app.Replicas),
+		"--label-add", "orchestra.app="+name,
+	)
+	cmd.Arg(swarmPolicyArgs(policy)...)
+	cmd.Arg(swarmResourceArgs(app.Resources)...)
+	cmd.Arg(swarmVolumeUpdateArgs(app, vols, current, constraints)...)
+	if check := app.HealthCheck.WithDefaults(app.Port); check.Enabled() {
+		cmd.Arg(dockerHealthArgs(check)...)
+	} else if current.hasHealthCheck() {
+		cmd.Arg("--no-healthcheck")
+	}
+
+	// Values stay off the command line, where ps and shell history would
+	// show them. Unchanged variables are left alone, and changed ones are
+	// exported to the docker CLI, which takes the value of an --env-add that
+	// names a variable without one from its own environment.
+	var exports strings.Builder
+	running := current.env()
+	for _, k := range current.envKeys() {
+		if _, ok := env[k]; !ok {
+			cmd.Arg("--env-rm", k)
+		}
+	}
+	for _, k := range sortedKeys(env) {
+		if v, ok := running[k]; ok && v == env[k] {
+			continue
+		}
+		if !exportableEnvKey(k) {
+			h.appendLog(dep, fmt.Sprintf("WARNING: %s cannot be passed through the environment; its value is given on the command line.", k))
+			cmd.Arg("--env-add", k+"="+env[k])
+			continue
+		}
+		fmt.Fprintf(&exports, "export %s=%s\n", k, sshpkg.Quote(env[k]))
+		cmd.Arg("--env-add", k)
+	}
+
+	wanted := map[string]bool{}
+	for _, sec := range secrets {
+		wanted[sec.Name] = true
+	}
+	attached := map[string]bool{}
+	for _, sec := range current.Secrets {
+		attached[sec.SecretName] = true
+		if !wanted[sec.SecretName] {
+			cmd.Arg("--secret-rm", sec.SecretName)
+		}
+	}
+	for _, sec := range secrets {
+		if !attached[sec.Name] {
+			cmd.Arg("--secret-add", fmt.Sprintf("source=%s,target=%s", sec.Name, sec.Target))
+		}
+	}
+
+	// The service only ever publishes the app's port, so any other mapping is
+	// from before the port changed. --publish-rm matches on the target port.
+	for _, target := range published {
+		if target != app.Port {
+			cmd.Arg("--publish-rm", strconv.Itoa(target))
+		}
+	}
+	if app.Port > 0 {
+		cmd.Arg("--publish-add", fmt.Sprintf("published=%d,target=%d", app.Port, app.Port))
+	}
+
+	h.appendLog(dep, fmt.Sprintf("Rolling update: parallelism %d, delay %s, order %s, on failure %s.",
+		policy.Parallelism, policy.Delay, policy.Order, policy.FailureAction))
+
+	// UpdateStatus outlives the update it describes: an update that changes
+	// nothing leaves the previous one's status in place. Only a status that
+	// started after this point is this update's.
+	before := swarmUpdateStatus(client, name)
+	cmd.Arg(name).Raw("2>&1")
+	result, err := client.ExecuteCommandWithInput("sh -s", []byte(exports.String()+cmd.String()+"\n"))
+	updateErr := commandError(result, err)
+
+	status := swarmUpdateStatus(client, name)
+	if status.StartedAt == before.StartedAt {
+		status = swarmUpdate{}
+	}
+	switch {
+	case strings.HasPrefix(status.State, "rollback"):
+		h.failDeployment(dep, app, fmt.Sprintf("Swarm update failed and was rolled back (%s): %s", status.State, status.Message))
+		h.DB.Model(app).Update("status", "running") // the previous version is serving again
+		return fmt.Errorf("swarm update rolled back: %s", status.Message)
+	case status.State == "paused":
+		h.failDeployment(dep, app, fmt.Sprintf("Swarm update paused after task failures: %s", status.Message))
+		return fmt.Errorf("swarm update paused: %s", status.Message)
+	case updateErr != nil:
+		h.failDeployment(dep, app, fmt.Sprintf("Swarm update failed: %s", swarmCommandFailure(result)))
+		return fmt.Errorf("swarm update: %w", updateErr)
+	}
+	h.appendLog(dep, "Swarm service updated.")
+	return nil
+}
+
+// swarmService is the part of docker service inspect output used here.
+type swarmService struct {
+	Env     []string
+	Secrets []struct {
+		SecretName string
+	}
+	Healthcheck *struct {
+		Test []string
+	}
+	Mounts []struct {
+		Source string
+		Target string
+	}
+}
+
+// hasHealthCheck reports whether a health check command was set on the
+// service, as opposed to inherited from the image.
+func (s swarmService) hasHealthCheck() bool {
+	return s.Healthcheck != nil && len(s.Healthcheck.Test) > 0 && s.Healthcheck.Test[0] != "NONE"
+}
+
+// env returns the service's variables by name.
+func (s swarmService) env() map[string]string {
+	vars := map[string]string{}
+	for _, kv := range s.Env {
+		k, v, _ := strings.Cut(kv, "=")
+		vars[k] = v
+	}
+	return vars
+}
+
+// exportableEnvKey reports whether a variable can be handed to the docker
+// CLI through its environment: a shell can export it, and neither the
+// shell, the dynamic loader nor the CLI reads it for itself.
+func exportableEnvKey(k string) bool {
+	switch k {
+	case "PATH", "HOME", "IFS", "ENV":
+		return false
+	}
+	return shellNamePattern.MatchString(k) && !strings.HasPrefix(k, "DOCKER_") && !strings.HasPrefix(k, "LD_")
+}
+
+func (s swarmService) envKeys() []string {
+	var keys []string
+	for _, kv := range s.Env {
+		keys = append(keys, strings.SplitN(kv, "=", 2)[0])
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func inspectSwarmService(client *sshpkg.Client, name string) (*swarmService, error) {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker service inspect --format %s %s 2>&1",
+		"{{json .Spec.TaskTemplate.ContainerSpec}}", name))
+	if err := commandError(result, err); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, commandOutput(result))
+	}
+	var svc swarmService
+	if err := json.Unmarshal([]byte(strings.TrimSpace(result.Stdout)), &svc); err != nil {
+		return nil, fmt.Errorf("parse service spec: %w", err)
+	}
+	return &svc, nil
+}
+
+// swarmConstraints returns the service's placement constraints.
+func swarmConstraints(client *sshpkg.Client, name string) ([]string, error) {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker service inspect --format %s %s 2>&1",
+		"{{if .Spec.TaskTemplate.Placement}}{{json .Spec.TaskTemplate.Placement.Constraints}}{{else}}null{{end}}", name))
+	if err := commandError(result, err); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, commandOutput(result))
+	}
+	var constraints []string
+	if err := json.Unmarshal([]byte(strings.TrimSpace(result.Stdout)), &constraints); err != nil {
+		return nil, fmt.Errorf("parse placement constraints: %w", err)
+	}
+	return constraints, nil
+}
+
+// swarmPublishedPorts returns the target ports the service publishes.
+func swarmPublishedPorts(client *sshpkg.Client, name string) ([]int, error) {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker service inspect --format %s %s 2>&1",
+		"{{if .Spec.EndpointSpec}}{{json .Spec.EndpointSpec.Ports}}{{else}}null{{end}}", name))
+	if err := commandError(result, err); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, commandOutput(result))
+	}
+	var ports []struct {
+		TargetPort int
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(result.Stdout)), &ports); err != nil {
+		return nil, fmt.Errorf("parse published ports: %w", err)
+	}
+	var targets []int
+	for _, p := range ports {
+		targets = append(targets, p.TargetPort)
+	}
+	return targets, nil
+}
+
+// swarmUpdate is the state and message of a service's last update, and
+// when it started.
+type swarmUpdate struct {
+	State     string
+	StartedAt string
+	Message   string
+}
+
+// swarmUpdateStatus returns the service's last update, or a zero
+// swarmUpdate if it has never been updated.
+func swarmUpdateStatus(client *sshpkg.Client, name string) swarmUpdate {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker service inspect --format %s %s 2>/dev/null",
+		"{{if .UpdateStatus}}{{.UpdateStatus.State}}|{{.UpdateStatus.StartedAt}}|{{.UpdateStatus.Message}}{{end}}", name))
+	if commandError(result, err) != nil {
+		return swarmUpdate{}
+	}
+	parts := strings.SplitN(strings.TrimSpace(result.Stdout), "|", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return swarmUpdate{State: parts[0], StartedAt: parts[1], Message: parts[2]}
+}
+
+// swarmCommandFailure explains a failed service create/update, which is run
+// under timeout(1).
+func swarmCommandFailure(result *sshpkg.CommandResult) string {
+	if result != nil && result.ExitCode == 124 {
+		return "service did not converge before the timeout"
+	}
+	return commandOutput(result)
+}
+
+// logSwarmTasks appends the state of each of the service's current tasks to
+// the deployment log.
+func (h *AppTaskHandler) logSwarmTasks(client *sshpkg.Client, dep *model.Deployment, name string) {
+	result, err := client.ExecuteCommand(sshpkg.Shellf("docker service ps %s --filter desired-state=running --format %s 2>&1",
+		name, "{{.Name}} on {{.Node}}: {{.CurrentState}} {{.Error}}"))
+	if commandError(result, err) != nil {
+		h.appendLog(dep, fmt.Sprintf("WARNING: could not list swarm tasks: %s", commandOutput(result)))
+		return
+	}
+	h.appendLog(dep, "Swarm tasks:")
+	for _, line := range strings.Split(strings.TrimSpace(result.Stdout), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			h.appendLog(dep, "  "+line)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package tasks
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	sshpkg "github.com/enochcodes/orchestra/core/pkg/ssh"
+)
+
+// An application's volumes are created by the deployment after they are
+// declared and mounted by every deployment from then on. Deleting one marks
+// it; the next deployment stops mounting it and then removes it, data
+// included.
+//
+// On Kubernetes an application with volumes runs as a StatefulSet, and a
+// volume is one of its claim templates: every replica gets a
+// PersistentVolumeClaim of its own, named <volume>-<app>-<ordinal>, which
+// it keeps across restarts and rescheduling. Replicas do not share data,
+// and scaling down leaves the claims of removed replicas for when they
+// return. On Docker and Swarm a volume is a named volume on one server,
+// shared by the replicas there: the manager of a Docker host, or a chosen
+// node of a Swarm cluster, which the service is then constrained to.
+
+// appVolumes are the volumes a deployment mounts.
+type appVolumes struct {
+	list []model.AppVolume
+	node string // hostname of the Swarm node holding them
+}
+
+// volumeName names the Docker volume holding v.
+func volumeName(app *model.Application, v model.AppVolume) string {
+	return sanitizeName(app.Name) + "-" + v.Name
+}
+
+// volumesIn returns the application's volumes in the given statuses, by name.
+func (h *AppTaskHandler) volumesIn(appID uint, statuses ...model.AppVolumeStatus) []model.AppVolume {
+	var volumes []model.AppVolume
+	h.DB.Where("application_id = ? AND status IN ?", appID, statuses).Order("name").Find(&volumes)
+	return volumes
+}
+
+// mountedVolumes returns the volumes a deployment of the application mounts.
+func (h *AppTaskHandler) mountedVolumes(appID uint) []model.AppVolume {
+	return h.volumesIn(appID, model.AppVolumePending, model.AppVolumeReady)
+}
+
+// volumeMounts returns volumes as a deployment spec records them.
+func volumeMounts(volumes []model.AppVolume) []model.VolumeMount {
+	var mounts []model.VolumeMount
+	for _, v := range volumes {
+		mounts = append(mounts, model.VolumeMount{Name: v.Name, MountPath: v.MountPath, SizeGB: v.SizeGB})
+	}
+	return mounts
+}
+
+// prepareVolumes creates the application's volumes that the runtime does
+// not have yet and returns every volume the deployment mounts.
+func (h *AppTaskHandler) prepareVolumes(client *sshpkg.Client, dep *model.Deployment, app *model.Application) (*appVolumes, error) {
+	vols := &appVolumes{list: h.mountedVolumes(app.ID)}
+	if len(vols.list) == 0 {
+		return vols, nil
+	}
+	var server *model.Server
+	switch app.Cluster.Type {
+	case model.ClusterTypeK8s:
+		// The StatefulSet creates each replica's claims from its templates.
+	case model.ClusterTypeDockerSwarm:
+		// All of an application's volumes live on the node the first was
+		// placed on, the manager unless another node was chosen.
+		pinned := app.Cluster.ManagerServer
+		for _, v := range vols.list {
+			if v.ServerID != nil && *v.ServerID != pinned.ID {
+				pinned = model.Server{}
+				if err := h.DB.First(&pinned, *v.ServerID).Error; err != nil {
+					h.failDeployment(dep, app, fmt.Sprintf("The server holding volume %s is gone", v.Name))
+					return nil, fmt.Errorf("volume server: %w", err)
+				}
+				break
+			}
+		}
+		server = &pinned
+		nodeClient := client
+		if pinned.ID != app.Cluster.ManagerServer.ID {
+			c, err := h.dial(pinned)
+			if err != nil {
+				h.failDeployment(dep, app, fmt.Sprintf("SSH to volume node %s failed: %v", serverLabel(pinned), err))
+				return nil, err
+			}
+			defer c.Close()
+			nodeClient = c
+		}
+		if err := createDockerVolumes(nodeClient, app, vols.list); err != nil {
+			h.failDeployment(dep, app, fmt.Sprintf("Creating volumes on %s failed: %v", serverLabel(pinned), err))
+			return nil, err
+		}
+		result, err := nodeClient.ExecuteCommand("hostname")
+		if err := commandError(result, err); err != nil {
+			h.failDeployment(dep, app, fmt.Sprintf("Reading the hostname of %s failed: %s", serverLabel(pinned), commandOutput(result)))
+			return nil, fmt.Errorf("hostname: %w", err)
+		}
+		vols.node = strings.TrimSpace(result.Stdout)
+		h.appendLog(dep, fmt.Sprintf("Volumes are kept on %s; the service is constrained to it.", serverLabel(pinned)))
+	default:
+		manager := app.Cluster.ManagerServer
+		server = &manager
+		if err := createDockerVolumes(client, app, vols.list); err != nil {
+			h.failDeployment(dep, app, fmt.Sprintf("Creating volumes failed: %v", err))
+			return nil, err
+		}
+	}
+
+	var created []string
+	for i := range vols.list {
+		v := &vols.list[i]
+		if v.Status == model.AppVolumePending {
+			created = append(created, v.Name)
+		}
+		updates := map[string]interface{}{"status": model.AppVolumeReady}
+		if server != nil {
+			updates["server_id"] = server.ID
+			v.ServerID = &server.ID
+		}
+		h.DB.Model(v).Updates(updates)
+		v.Status = model.AppVolumeReady
+	}
+	if len(created) > 0 {
+		h.appendLog(dep, fmt.Sprintf("Created volume(s) %s.", strings.Join(created, ", ")))
+	}
+	return vols, nil
+}
+
+// k8sClaimName names the claim holding v for the replica with ordinal.
+func k8sClaimName(app *model.Application, v model.AppVolume, ordinal int) string {
+	return fmt.Sprintf("%s-%s-%d", v.Name, sanitizeName(app.Name), ordinal)
+}
+
+// k8sClaimTemplatesYaml renders the claim templates of the application's
+// StatefulSet. Without a storage class of its own or a configured default,
+// a volume uses the cluster's default class, which on k3s is the
+// local-path provisioner.
+func (h *AppTaskHandler) k8sClaimTemplatesYaml(app *model.Application, volumes []model.AppVolume) string {
+	if len(volumes) == 0 {
+		return ""
+	}
+	s := "\n  volumeClaimTemplates:\n"
+	for _, v := range volumes {
+		class := v.StorageClass
+		if class == "" {
+			class = h.StorageClass
+		}
+		classYaml := ""
+		if class != "" {
+			classYaml = fmt.Sprintf("      storageClassName: %s\n", class)
+		}
+		s += fmt.Sprintf(`  - metadata:
+      name: %s
+      labels:
+        orchestra.app: %s
+        orchestra.volume: %s
+    spec:
+      accessModes: ["ReadWriteOnce"]
+%s      resources:
+        requests:
+          storage: %dGi
+`, v.Name, sanitizeName(app.Name), v.Name, classYaml, v.SizeGB)
+	}
+	return s
+}
+
+// syncClaimTemplates prepares the application's StatefulSet for claim
+// templates named after volumes. Kubernetes does not allow the templates of
+// a StatefulSet to change, so one with other templates is deleted with its
+// pods left running; the StatefulSet applied next adopts them and replaces
+// them one at a time.
+func (h *AppTaskHandler) syncClaimTemplates(client *sshpkg.Client, dep *model.Deployment, app *model.Application, volumes []model.AppVolume) error {
+	name := sanitizeName(app.Name)
+	result, err := client.ExecuteCommand(sshpkg.Shellf("kubectl get statefulset %s -n %s --ignore-not-found -o %s 2>&1",
+		name, app.Namespace, "jsonpath={.metadata.name}:{.spec.volumeClaimTemplates[*].metadata.name}"))
+	if err := commandError(result, err); err != nil {
+		return fmt.Errorf("%v: %s", err, commandOutput(result))
+	}
+	current, found := strings.CutPrefix(strings.TrimSpace(result.Stdout), name+":")
+	if !found {
+		return nil
+	}
+	var names []string
+	for _, v := range volumes {
+		names = append(names, v.Name)
+	}
+	existing := strings.Fields(current)
+	sort.Strings(existing)
+	sort.Strings(names)
+	if strings.Join(existing, " ") == strings.Join(names, " ") {
+		return nil
+	}
+	result, err = client.ExecuteCommand(sshpkg.Shellf("kubectl delete statefulset %s -n %s --cascade=orphan 2>&1", name, app.Namespace))
+	if err := commandError(result, err); err != nil {
+		return fmt.Errorf("%v: %s", err, commandOutput(result))
+	}
+	h.appendLog(dep, "The StatefulSet's volumes changed; it is recreated and its pods are replaced one at a time.")
+	return nil
+}
+
+// createDockerVolumes creates the named volumes that do not exist yet.
+func createDockerVolumes(client *sshpkg.Client, app *model.Application, volumes []model.AppVolume) error {
+	for _, v := range volumes {
+		vname := volumeName(app, v)
+		result, err := client.ExecuteCommand(sshpkg.Shellf(
+			"docker volume inspect %s >/dev/null 2>&1 || docker volume create --label %s %s 2>&1",
+			vname, "orchestra.app="+sanitizeName(app.Name), vname))
+		if err := commandError(result, err); err != nil {
+			return fmt.Errorf("docker volume create %s: %v: %s", vname, err, commandOutput(result))
+		}
+	}
+	return nil
+}
+
+// pruneVolumes removes the volumes marked for deletion, which the runtime
+// has just stopped mounting, and forgets them. A volume that cannot be
+// removed yet stays marked and is tried again by the next deployment.
+func (h *AppTaskHandler) pruneVolumes(client *sshpkg.Client, dep *model.Deployment, app *model.Application) {
+	for _, v := range h.volumesIn(app.ID, model.AppVolumeDeleting) {
+		vname := volumeName(app, v)
+		var err error
+		switch {
+		case app.Cluster.Type == model.ClusterTypeK8s:
+			result, execErr := client.ExecuteCommand(sshpkg.Shellf("kubectl delete pvc -l %s -n %s --ignore-not-found --wait=false 2>&1",
+				"orchestra.app="+sanitizeName(app.Name)+",orchestra.volume="+v.Name, app.Namespace))
+			if execErr := commandError(result, execErr); execErr != nil {
+				err = fmt.Errorf("%v: %s", execErr, commandOutput(result))
+			}
+		case v.ServerID != nil:
+			err = h.removeDockerVolume(client, app, *v.ServerID, vname)
+		}
+		if err != nil {
+			h.appendLog(dep, fmt.Sprintf("WARNING: removing volume %s failed, will retry with the next deployment: %v", v.Name, err))
+			continue
+		}
+		h.DB.Delete(&v)
+		h.appendLog(dep, fmt.Sprintf("Removed volume %s and its data.", v.Name))
+	}
+}
+
+// removeDockerVolume removes a named volume from the server holding it,
+// along with stopped containers that still refer to it, such as Swarm's
+// task history.
+func (h *AppTaskHandler) removeDockerVolume(client *sshpkg.Client, app *model.Application, serverID uint, vname string) error {
+	if serverID != app.Cluster.ManagerServer.ID {
+		var server model.Server
+		if err := h.DB.First(&server, serverID).Error; err != nil {
+			return fmt.Errorf("server %d not found", serverID)
+		}
+		c, err := h.dial(server)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		client = c
+	}
+	result, err := client.ExecuteCommand(sshpkg.Shellf(
+		"docker ps -aq --filter %s --filter status=exited --filter status=created | xargs -r docker rm >/dev/null 2>&1; "+
+			"docker volume inspect %s >/dev/null 2>&1 || exit 0; docker volume rm %s 2>&1",
+		"volume="+vname, vname, vname))
+	if err := commandError(result, err); err != nil {
+		return fmt.Errorf("%v: %s", err, commandOutput(result))
+	}
+	return nil
+}
+
+// dockerVolumeArgs returns the docker run flags that mount volumes.
+func dockerVolumeArgs(app *model.Application, volumes []model.AppVolume) []string {
+	var args []string
+	for _, v := range volumes {
+		args = append(args, "-v", volumeName(app, v)+":"+v.MountPath)
+	}
+	return args
+}
+
+// swarmVolumeArgs returns the docker service create flags that mount
+// volumes and keep the service on the node holding them.
+func swarmVolumeArgs(app *model.Application, vols *appVolumes) []string {
+	var args []string
+	for _, v := range vols.list {
+		args = append(args, "--mount", swarmMount(app, v))
+	}
+	if vols.node != "" {
+		args = append(args, "--constraint", "node.hostname=="+vols.node)
+	}
+	return args
+}
+
+// swarmVolumeUpdateArgs returns the docker service update flags that turn
+// the service's mounts and node constraint from current into vols.
+func swarmVolumeUpdateArgs(app *model.Application, vols *appVolumes, current *swarmService, constraints []string) []string {
+	wanted := map[string]string{}
+	for _, v := range vols.list {
+		wanted[v.MountPath] = volumeName(app, v)
+	}
+	var args []string
+	mounted := map[string]bool{}
+	for _, m := range current.Mounts {
+		if wanted[m.Target] == m.Source {
+			mounted[m.Target] = true
+			continue
+		}
+		args = append(args, "--mount-rm", m.Target)
+	}
+	for _, v := range vols.list {
+		if !mounted[v.MountPath] {
+			args = append(args, "--mount-add", swarmMount(app, v))
+		}
+	}
+
+	want := ""
+	if vols.node != "" {
+		want = "node.hostname==" + vols.node
+	}
+	has := false
+	for _, c := range constraints {
+		switch {
+		case c == want:
+			has = true
+		case strings.HasPrefix(strings.ReplaceAll(c, " ", ""), "node.hostname=="):
+			args = append(args, "--constraint-rm", c)
+		}
+	}
+	if want != "" && !has {
+		args = append(args, "--constraint-add", want)
+	}
+	return args
+}
+
+func swarmMount(app *model.Application, v model.AppVolume) string {
+	return fmt.Sprintf("type=volume,source=%s,target=%s", volumeName(app, v), v.MountPath)
+}
+
+// k8sVolumeMountsYaml renders the volume mounts of a container. It must
+// follow every other container field.
+func k8sVolumeMountsYaml(volumes []model.AppVolume) string {
+	if len(volumes) == 0 {
+		return ""
+	}
+	mounts := "\n        volumeMounts:\n"
+	for _, v := range volumes {
+		mounts += fmt.Sprintf("        - name: %s\n          mountPath: %s\n", v.Name, strconv.Quote(v.MountPath))
+	}
+	return mounts
+}
+
+// k8sJobVolumesYaml renders the volume mounts of a Job's container and the
+// claims its pod uses: those of the application's first replica. It must
+// follow every other container field.
+func k8sJobVolumesYaml(app *model.Application, volumes []model.AppVolume) string {
+	if len(volumes) == 0 {
+		return ""
+	}
+	claims := "      volumes:\n"
+	for _, v := range volumes {
+		claims += fmt.Sprintf("      - name: %s\n        persistentVolumeClaim:\n          claimName: %s\n", v.Name, k8sClaimName(app, v, 0))
+	}
+	return k8sVolumeMountsYaml(volumes) + claims
+}
+
+// k8sWorkload returns the kind/name of the application's Kubernetes
+// workload: a StatefulSet once it mounts volumes, a Deployment otherwise.
+func k8sWorkload(client *sshpkg.Client, app *model.Application) string {
+	name := sanitizeName(app.Name)
+	result, err := client.ExecuteCommand(sshpkg.Shellf("kubectl get statefulset %s -n %s -o name 2>/dev/null", name, app.Namespace))
+	if commandError(result, err) == nil && strings.TrimSpace(result.Stdout) != "" {
+		return "statefulset/" + name
+	}
+	return "deployment/" + name
+}
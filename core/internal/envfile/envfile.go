@@ -0,0 +1,206 @@
+// Package envfile reads and writes sets of environment variables in the
+// dotenv, JSON and YAML formats accepted by the import/export API.
+package envfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Format is a serialization format for a set of variables.
+type Format string
+
+const (
+	FormatDotenv Format = "dotenv"
+	FormatJSON   Format = "json"
+	FormatYAML   Format = "yaml"
+)
+
+// KeyPattern is the set of variable names accepted on import.
+var KeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// ParseDotenv parses a dotenv file. It understands:
+//
+//   - blank lines and full-line or trailing "# comments"
+//   - an optional "export " prefix
+//   - unquoted values, trimmed of surrounding whitespace
+//   - 'single quoted' values, taken literally and allowed to span lines
+//   - "double quoted" values, with \n \r \t \" \\ escapes, allowed to span lines
+//
+// Later definitions of a key override earlier ones. Variable expansion is
+// deliberately not performed so ${secret:NAME} references survive intact.
+func ParseDotenv(data []byte) (map[string]string, error) {
+	vars := map[string]string{}
+	src := strings.ReplaceAll(string(data), "\r\n", "\n")
+	src = strings.TrimPrefix(src, "\ufeff")
+	lines := strings.Split(src, "\n")
+
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimLeft(lines[i], " \t")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		line = strings.TrimLeft(line, " \t")
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", lineNo)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if !KeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid variable name %q", lineNo, key)
+		}
+		rest := strings.TrimLeft(line[eq+1:], " \t")
+
+		if rest == "" || (rest[0] != '"' && rest[0] != '\'') {
+			vars[key] = stripInlineComment(rest)
+			continue
+		}
+
+		// Quoted value: keep consuming lines until the closing quote.
+		quote := rest[0]
+		body := rest[1:]
+		for {
+			if end := closingQuote(body, quote); end >= 0 {
+				if trailing := strings.TrimSpace(body[end+1:]); trailing != "" && !strings.HasPrefix(trailing, "#") {
+					return nil, fmt.Errorf("line %d: unexpected text after closing quote", lineNo)
+				}
+				body = body[:end]
+				break
+			}
+			i++
+			if i >= len(lines) {
+				return nil, fmt.Errorf("line %d: unterminated %c quote for %s", lineNo, quote, key)
+			}
+			body += "\n" + lines[i]
+		}
+
+		if quote == '"' {
+			vars[key] = unescapeDouble(body)
+		} else {
+			vars[key] = body
+		}
+	}
+	return vars, nil
+}
+
+// closingQuote returns the index of the unescaped closing quote in s, or -1.
+// Single-quoted values have no escapes.
+func closingQuote(s string, quote byte) int {
+	for i := 0; i < len(s); i++ {
+		if quote == '"' && s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == quote {
+			return i
+		}
+	}
+	return -1
+}
+
+// stripInlineComment removes a " #comment" suffix from an unquoted value.
+func stripInlineComment(v string) string {
+	for i := 0; i < len(v); i++ {
+		if v[i] == '#' && (i == 0 || v[i-1] == ' ' || v[i-1] == '\t') {
+			return strings.TrimSpace(v[:i])
+		}
+	}
+	return strings.TrimSpace(v)
+}
+
+func unescapeDouble(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '"', '\\':
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// Marshal renders vars in the given format with keys sorted.
+func Marshal(vars map[string]string, format Format) ([]byte, error) {
+	switch format {
+	case FormatDotenv, "":
+		return marshalDotenv(vars), nil
+	case FormatJSON:
+		return json.MarshalIndent(vars, "", "  ")
+	case FormatYAML:
+		return marshalYAML(vars), nil
+	}
+	return nil, fmt.Errorf("unsupported format %q (want dotenv, json or yaml)", format)
+}
+
+// ContentType returns the MIME type to serve a format with.
+func ContentType(format Format) string {
+	switch format {
+	case FormatJSON:
+		return "application/json"
+	case FormatYAML:
+		return "application/yaml"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+func marshalDotenv(vars map[string]string) []byte {
+	var b bytes.Buffer
+	for _, k := range sortedKeys(vars) {
+		v := vars[k]
+		if needsQuoting(v) {
+			r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+			v = `"` + r.Replace(v) + `"`
+		}
+		fmt.Fprintf(&b, "%s=%s\n", k, v)
+	}
+	return b.Bytes()
+}
+
+func needsQuoting(v string) bool {
+	if v == "" {
+		return false
+	}
+	return strings.ContainsAny(v, " \t\r\n#\"'\\") || strings.TrimSpace(v) != v
+}
+
+// marshalYAML writes a flat mapping. Every value is emitted as a
+// double-quoted scalar, whose escapes are a superset of Go's, so values like
+// "yes", "0755" or "null" are never reinterpreted by a YAML reader.
+func marshalYAML(vars map[string]string) []byte {
+	var b bytes.Buffer
+	for _, k := range sortedKeys(vars) {
+		fmt.Fprintf(&b, "%s: %s\n", k, strconv.Quote(vars[k]))
+	}
+	return b.Bytes()
+}
+
+func sortedKeys(vars map[string]string) []string {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
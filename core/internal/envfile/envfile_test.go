@@ -0,0 +1,91 @@
+package envfile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDotenv(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{"plain", "A=1\nB=two", map[string]string{"A": "1", "B": "two"}},
+		{"blank lines and comments", "# header\n\nA=1\n  # indented\n", map[string]string{"A": "1"}},
+		{"trailing comment", "A=1 # note\nB=a#b", map[string]string{"A": "1", "B": "a#b"}},
+		{"surrounding whitespace", "  A =  padded value  \t", map[string]string{"A": "padded value"}},
+		{"empty value", "A=\nB= # comment", map[string]string{"A": "", "B": ""}},
+		{"export prefix", "export A=1\nexport  B=2", map[string]string{"A": "1", "B": "2"}},
+		{"later definition wins", "A=1\nA=2", map[string]string{"A": "2"}},
+		{"value with equals", "URL=postgres://u:p@h/db?x=1", map[string]string{"URL": "postgres://u:p@h/db?x=1"}},
+		{"single quoted is literal", `A='x # \n ${B}'`, map[string]string{"A": `x # \n ${B}`}},
+		{"double quoted escapes", `A="a\nb\tc \"q\" \\ \$"`, map[string]string{"A": "a\nb\tc \"q\" \\ \\$"}},
+		{"quoted with comment after", `A="x" # note`, map[string]string{"A": "x"}},
+		{"double quoted multiline", "A=\"line1\nline2\"\nB=3", map[string]string{"A": "line1\nline2", "B": "3"}},
+		{"single quoted multiline", "A='line1\n# not a comment\nline3'", map[string]string{"A": "line1\n# not a comment\nline3"}},
+		{"crlf line endings", "A=1\r\nB=\"x\r\ny\"\r\n", map[string]string{"A": "1", "B": "x\ny"}},
+		{"byte order mark", "\ufeffA=1", map[string]string{"A": "1"}},
+		{"secret reference kept", "DB=${secret:DB_PASSWORD}", map[string]string{"DB": "${secret:DB_PASSWORD}"}},
+		{"dotted and dashed keys", "a.b-c=1", map[string]string{"a.b-c": "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDotenv([]byte(tt.in))
+			if err != nil {
+				t.Fatalf("ParseDotenv(%q): %v", tt.in, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseDotenv(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDotenvErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantErr string
+	}{
+		{"missing equals", "A=1\nJUSTAKEY", "line 2: expected KEY=VALUE"},
+		{"invalid key", "1A=x", `invalid variable name "1A"`},
+		{"space in key", "MY KEY=x", `invalid variable name "MY KEY"`},
+		{"unterminated double quote", "A=\"open\nB=2", "line 1: unterminated \" quote for A"},
+		{"unterminated single quote", "X=1\nA='open", "line 2: unterminated ' quote for A"},
+		{"text after closing quote", `A="x" y`, "line 1: unexpected text after closing quote"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseDotenv([]byte(tt.in))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseDotenv(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMarshalDotenvRoundTrip(t *testing.T) {
+	vars := map[string]string{
+		"PLAIN":  "value",
+		"SPACES": " padded ",
+		"QUOTES": `say "hi" it's`,
+		"HASH":   "a #b",
+		"MULTI":  "line1\nline2\r\n",
+		"SLASH":  `C:\path\n`,
+		"EMPTY":  "",
+	}
+	out, err := Marshal(vars, FormatDotenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseDotenv(out)
+	if err != nil {
+		t.Fatalf("ParseDotenv(Marshal()): %v\n%s", err, out)
+	}
+	if !reflect.DeepEqual(got, vars) {
+		t.Errorf("round trip = %q, want %q", got, vars)
+	}
+}
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	tasks "github.com/enochcodes/orchestra/core/internal/engine"
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/internal/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+// RunCommand handles POST /api/v1/applications/:id/commands. It queues a
+// one-off command, such as a database seed, to run once in the image of the
+// application's live deployment with its environment, and returns the run
+// with 202. Poll GetCommand for its output and exit code.
+func (h *ApplicationHandler) RunCommand(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	if err := authorizeApp(c, h.DB, uint(id), model.ApplicationRoleManager); err != nil {
+		return err
+	}
+	var app model.Application
+	if err := h.DB.First(&app, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Application not found")
+	}
+
+	var req struct {
+		Command        string `json:"command"`
+		TimeoutSeconds int    `json:"timeout_seconds"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	}
+	if strings.TrimSpace(req.Command) == "" || strings.ContainsRune(req.Command, 0) {
+		return fiber.NewError(fiber.StatusBadRequest, "command is required and must not contain NUL bytes")
+	}
+	if req.TimeoutSeconds < 0 || req.TimeoutSeconds > model.MaxHookTimeoutSeconds {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("timeout_seconds must be between 0 and %d", model.MaxHookTimeoutSeconds))
+	}
+
+	run, err := tasks.EnqueueAppCommand(h.DB, h.AsynqClient, &app, req.Command, req.TimeoutSeconds, currentUserID(c))
+	if errors.Is(err, tasks.ErrAppDeleting) || errors.Is(err, tasks.ErrNotDeployed) {
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	_ = service.LogActivity(h.DB, model.ActivityTypeCommandRun,
+		fmt.Sprintf("One-off command run in '%s': %s", app.Name, req.Command), "application", app.ID, currentUserID(c),
+		map[string]interface{}{"command_run_id": run.ID})
+	return c.Status(fiber.StatusAccepted).JSON(run)
+}
+
+// ListCommands handles GET /api/v1/applications/:id/commands: the
+// application's recent one-off command runs, newest first, without output.
+func (h *ApplicationHandler) ListCommands(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	if err := authorizeApp(c, h.DB, uint(id), model.ApplicationRoleViewer); err != nil {
+		return err
+	}
+	limit := 50
+	if l := c.Query("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 100 {
+			limit = n
+		}
+	}
+	var runs []model.AppCommandRun
+	if err := h.DB.Omit("output").Where("application_id = ?", uint(id)).
+		Order("created_at DESC").Limit(limit).Find(&runs).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to fetch command runs")
+	}
+	return c.JSON(fiber.Map{"commands": runs, "count": len(runs)})
+}
+
+// GetCommand handles GET /api/v1/applications/:id/commands/:runId, output
+// included.
+func (h *ApplicationHandler) GetCommand(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	runID, err := strconv.ParseUint(c.Params("runId"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid command run ID")
+	}
+	if err := authorizeApp(c, h.DB, uint(id), model.ApplicationRoleViewer); err != nil {
+		return err
+	}
+	var run model.AppCommandRun
+	if err := h.DB.Where("application_id = ?", uint(id)).First(&run, uint(runID)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Command run not found")
+	}
+	return c.JSON(run)
+}
@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	tasks "github.com/enochcodes/orchestra/core/internal/engine"
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/internal/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ListVolumes handles GET /api/v1/applications/:id/volumes.
+func (h *ApplicationHandler) ListVolumes(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	if err := authorizeApp(c, h.DB, uint(id), model.ApplicationRoleViewer); err != nil {
+		return err
+	}
+	var volumes []model.AppVolume
+	if err := h.DB.Preload("Server").Where("application_id = ?", uint(id)).Order("name").Find(&volumes).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to fetch volumes")
+	}
+	return c.JSON(fiber.Map{"volumes": volumes, "count": len(volumes)})
+}
+
+// CreateVolume handles POST /api/v1/applications/:id/volumes. It declares a
+// volume, which the application's next deployment creates and mounts. On
+// Swarm, server_id picks the node that holds the application's volumes;
+// the manager is used otherwise, and the service is pinned to that node.
+func (h *ApplicationHandler) CreateVolume(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	if err := authorizeApp(c, h.DB, uint(id), model.ApplicationRoleManager); err != nil {
+		return err
+	}
+	var app model.Application
+	if err := h.DB.Preload("Cluster").First(&app, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Application not found")
+	}
+	if app.Status == tasks.AppStatusDeleting || app.Status == tasks.AppStatusTeardownFailed {
+		return fiber.NewError(fiber.StatusConflict, tasks.ErrAppDeleting.Error())
+	}
+
+	var req struct {
+		Name         string `json:"name"`
+		MountPath    string `json:"mount_path"`
+		SizeGB       int    `json:"size_gb"`
+		StorageClass string `json:"storage_class"`
+		ServerID     *uint  `json:"server_id"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	}
+	vol := model.AppVolume{
+		ApplicationID: app.ID,
+		Name:          req.Name,
+		MountPath:     req.MountPath,
+		SizeGB:        req.SizeGB,
+		StorageClass:  req.StorageClass,
+		Status:        model.AppVolumePending,
+	}
+	if err := vol.Validate(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if vol.StorageClass != "" && app.Cluster.Type != model.ClusterTypeK8s {
+		return fiber.NewError(fiber.StatusBadRequest, "storage_class applies to Kubernetes clusters only")
+	}
+	if req.ServerID != nil && app.Cluster.Type != model.ClusterTypeDockerSwarm {
+		return fiber.NewError(fiber.StatusBadRequest, "server_id applies to Swarm clusters only; Docker hosts keep volumes on the manager")
+	}
+
+	var existing []model.AppVolume
+	h.DB.Where("application_id = ?", app.ID).Find(&existing)
+	for _, v := range existing {
+		switch {
+		case v.Name == vol.Name && v.Status == model.AppVolumeDeleting:
+			return fiber.NewError(fiber.StatusConflict, "a volume of that name is still being deleted")
+		case v.Name == vol.Name:
+			return fiber.NewError(fiber.StatusConflict, "the application already has a volume of that name")
+		case v.MountPath == vol.MountPath && v.Status != model.AppVolumeDeleting:
+			return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("volume %s is already mounted at %s", v.Name, v.MountPath))
+		}
+	}
+
+	// All of an application's volumes are kept on one server, so a new one
+	// follows those placed before it.
+	if app.Cluster.Type == model.ClusterTypeDockerSwarm {
+		var placed *uint
+		for _, v := range existing {
+			if v.ServerID != nil && v.Status != model.AppVolumeDeleting {
+				placed = v.ServerID
+				break
+			}
+		}
+		switch {
+		case req.ServerID == nil:
+			vol.ServerID = placed
+		case placed != nil && *placed != *req.ServerID:
+			return fiber.NewError(fiber.StatusBadRequest,
+				fmt.Sprintf("the application's volumes are kept on server %d; new volumes must be too", *placed))
+		default:
+			var count int64
+			h.DB.Model(&model.Server{}).Where("id = ? AND cluster_id = ?", *req.ServerID, app.ClusterID).Count(&count)
+			if count == 0 {
+				return fiber.NewError(fiber.StatusBadRequest, "server_id is not a server of the application's cluster")
+			}
+			vol.ServerID = req.ServerID
+		}
+	}
+
+	if err := h.DB.Create(&vol).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to create volume")
+	}
+	_ = service.LogActivity(h.DB, model.ActivityTypeVolumeCreated,
+		fmt.Sprintf("Volume %s (%d GB at %s) added to '%s'", vol.Name, vol.SizeGB, vol.MountPath, app.Name),
+		"application", app.ID, currentUserID(c), map[string]interface{}{"volume_id": vol.ID})
+	return c.Status(fiber.StatusCreated).JSON(vol)
+}
+
+// DeleteVolume handles DELETE /api/v1/applications/:id/volumes/:volumeId. A
+// volume that was never created is forgotten at once. Otherwise it is marked
+// for deletion and the application is restarted on its live image without
+// it, which then removes the volume and its data; an application that never
+// went live removes it with its next successful deployment. Only
+// application admins may delete data.
+func (h *ApplicationHandler) DeleteVolume(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	volumeID, err := strconv.ParseUint(c.Params("volumeId"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid volume ID")
+	}
+	if err := authorizeApp(c, h.DB, uint(id), model.ApplicationRoleAdmin); err != nil {
+		return err
+	}
+	var app model.Application
+	if err := h.DB.First(&app, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Application not found")
+	}
+	var vol model.AppVolume
+	if err := h.DB.Where("application_id = ?", app.ID).First(&vol, uint(volumeID)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Volume not found")
+	}
+
+	switch {
+	case vol.Status == model.AppVolumeDeleting:
+		return fiber.NewError(fiber.StatusConflict, "volume is already being deleted")
+	case vol.Status == model.AppVolumePending:
+		if err := h.DB.Delete(&vol).Error; err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to delete volume")
+		}
+		h.logVolumeDeleted(c, &app, &vol)
+		return c.JSON(fiber.Map{"message": "deleted"})
+	case app.Status == tasks.AppStatusStopped:
+		return fiber.NewError(fiber.StatusConflict, "a stopped application still mounts its volumes; start it first")
+	}
+
+	if err := checkCapacity(h.DB, &app, app.Replicas); err != nil {
+		return err
+	}
+	if err := h.DB.Model(&vol).Update("status", model.AppVolumeDeleting).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to delete volume")
+	}
+	deployment, err := tasks.EnqueueRestart(h.DB, h.AsynqClient, &app, fmt.Sprintf("volume %s deleted", vol.Name))
+	if err != nil {
+		h.DB.Model(&vol).Update("status", model.AppVolumeReady)
+		if errors.Is(err, tasks.ErrAppDeleting) || errors.Is(err, tasks.ErrLifecycleBusy) {
+			return fiber.NewError(fiber.StatusConflict, err.Error())
+		}
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to enqueue restart task")
+	}
+	h.logVolumeDeleted(c, &app, &vol)
+	if deployment == nil {
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": "volume will be removed by the next deployment", "volume": vol})
+	}
+	h.DB.Model(&app).Update("status", "pending")
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": "restart queued to remove the volume", "volume": vol, "deployment": deployment})
+}
+
+func (h *ApplicationHandler) logVolumeDeleted(c *fiber.Ctx, app *model.Application, vol *model.AppVolume) {
+	_ = service.LogActivity(h.DB, model.ActivityTypeVolumeDeleted,
+		fmt.Sprintf("Volume %s of '%s' deleted", vol.Name, app.Name),
+		"application", app.ID, currentUserID(c), map[string]interface{}{"volume_id": vol.ID})
+}
@@ -1,11 +1,18 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	tasks "github.com/enochcodes/orchestra/core/internal/engine"
+	"github.com/enochcodes/orchestra/core/internal/envfile"
 	"github.com/enochcodes/orchestra/core/internal/model"
 	"github.com/enochcodes/orchestra/core/internal/service"
 	"github.com/gofiber/fiber/v2"
@@ -13,15 +20,21 @@ import (
 	"gorm.io/gorm"
 )
 
+// runtimeInspectTimeout bounds how long an instance status request waits
+// on the cluster.
+const runtimeInspectTimeout = 20 * time.Second
+
 type ApplicationHandler struct {
-	DB          *gorm.DB
-	AsynqClient *asynq.Client
+	DB            *gorm.DB
+	AsynqClient   *asynq.Client
+	EncryptionKey string
 }
 
-func NewApplicationHandler(db *gorm.DB, client *asynq.Client) *ApplicationHandler {
+func NewApplicationHandler(db *gorm.DB, client *asynq.Client, encryptionKey string) *ApplicationHandler {
 	return &ApplicationHandler{
-		DB:          db,
-		AsynqClient: client,
+		DB:            db,
+		AsynqClient:   client,
+		EncryptionKey: encryptionKey,
 	}
 }
 
@@ -45,7 +58,39 @@ func (h *ApplicationHandler) Get(c *fiber.Ctx) error {
 	if err := h.DB.Preload("Cluster").First(&app, id).Error; err != nil {
 		return fiber.NewError(fiber.StatusNotFound, "Application not found")
 	}
-	return c.JSON(app)
+	queue, err := tasks.DeploymentQueue(h.DB, app.ID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load deployment queue")
+	}
+	for i := range queue {
+		maskSpecEnv(&queue[i])
+	}
+	return c.JSON(struct {
+		model.Application
+		DeployQueue []model.Deployment `json:"deploy_queue"` // queued and running deployments, oldest first
+	}{app, queue})
+}
+
+// Instances reports the live state of each of an application's instances as
+// its runtime sees them, which may differ from the status its last deploy
+// recorded.
+func (h *ApplicationHandler) Instances(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	var app model.Application
+	if err := h.DB.Preload("Cluster").Preload("Cluster.ManagerServer").First(&app, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Application not found")
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), runtimeInspectTimeout)
+	defer cancel()
+	status, err := tasks.InspectRuntime(ctx, h.DB, h.EncryptionKey, &app)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadGateway, fmt.Sprintf("inspecting runtime failed: %v", err))
+	}
+	return c.JSON(fiber.Map{"application_status": app.Status, "runtime": status})
 }
 
 // Update application
@@ -55,6 +100,9 @@ func (h *ApplicationHandler) Update(c *fiber.Ctx) error {
 	if err := h.DB.Preload("Cluster").First(&app, id).Error; err != nil {
 		return fiber.NewError(fiber.StatusNotFound, "Application not found")
 	}
+	if app.Status == tasks.AppStatusDeleting {
+		return fiber.NewError(fiber.StatusConflict, tasks.ErrAppDeleting.Error())
+	}
 
 	var req struct {
 		Name     *string            `json:"name"`
@@ -66,11 +114,22 @@ func (h *ApplicationHandler) Update(c *fiber.Ctx) error {
 		Port     *int               `json:"port"`
 		Domain   *string            `json:"domain"`
 		Branch   *string            `json:"branch"`
+		Message  string             `json:"message"` // optional note recorded on env revisions
+
+		EnvironmentID  *uint                 `json:"environment_id"` // 0 detaches the shared environment
+		DeployStrategy *model.DeployStrategy `json:"deploy_strategy"`
+		UpdatePolicy   *model.UpdatePolicy   `json:"update_policy"`
+		HealthCheck    *model.HealthCheck    `json:"health_check"` // {"type":""} disables it
+		Hooks          *model.DeployHooks    `json:"hooks"`
+		Resources      *model.Resources      `json:"resources"` // checked against capacity at the next deploy
+
+		DeployQueueMode *model.DeployQueueMode `json:"deploy_queue_mode"`
 	}
 	if err := c.BodyParser(&req); err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 	}
 
+	previousEnv := app.EnvVars
 	if req.Name != nil {
 		app.Name = *req.Name
 	}
@@ -84,6 +143,12 @@ func (h *ApplicationHandler) Update(c *fiber.Ctx) error {
 		app.StartCmd = *req.StartCmd
 	}
 	if req.EnvVars != nil {
+		if err := validateEnvKeys(req.EnvVars.Production, req.EnvVars.Preview); err != nil {
+			return err
+		}
+		if err := validateSecretRefs(h.DB, app.ClusterID, req.EnvVars.Production, req.EnvVars.Preview); err != nil {
+			return err
+		}
 		app.EnvVars = *req.EnvVars
 	}
 	if req.Status != nil {
@@ -98,8 +163,70 @@ func (h *ApplicationHandler) Update(c *fiber.Ctx) error {
 	if req.Branch != nil {
 		app.Branch = *req.Branch
 	}
+	if req.Domain != nil || req.Branch != nil {
+		if err := validateAppSource(&app); err != nil {
+			return err
+		}
+	}
+	if req.DeployStrategy != nil {
+		if err := validateDeployStrategy(*req.DeployStrategy); err != nil {
+			return err
+		}
+		app.DeployStrategy = *req.DeployStrategy
+	}
+	if req.UpdatePolicy != nil {
+		if err := req.UpdatePolicy.Validate(); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "update_policy: "+err.Error())
+		}
+		app.UpdatePolicy = *req.UpdatePolicy
+	}
+	if req.HealthCheck != nil {
+		app.HealthCheck = *req.HealthCheck
+	}
+	if req.Hooks != nil {
+		if err := req.Hooks.Validate(); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "hooks: "+err.Error())
+		}
+		app.Hooks = *req.Hooks
+	}
+	if req.Resources != nil {
+		if err := req.Resources.Validate(); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "resources: "+err.Error())
+		}
+		app.Resources = *req.Resources
+	}
+	if req.DeployQueueMode != nil {
+		if err := validateDeployQueueMode(*req.DeployQueueMode); err != nil {
+			return err
+		}
+		app.DeployQueueMode = *req.DeployQueueMode
+	}
+	if req.HealthCheck != nil || req.Port != nil {
+		if err := app.HealthCheck.Validate(app.Port); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "health_check: "+err.Error())
+		}
+	}
+	if req.EnvironmentID != nil {
+		if *req.EnvironmentID == 0 {
+			app.EnvironmentID = nil
+		} else {
+			if err := validateAppEnvironment(h.DB, app.ClusterID, *req.EnvironmentID); err != nil {
+				return err
+			}
+			app.EnvironmentID = req.EnvironmentID
+		}
+	}
 
-	if err := h.DB.Save(&app).Error; err != nil {
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&app).Error; err != nil {
+			return err
+		}
+		if req.EnvVars == nil {
+			return nil
+		}
+		return recordApplicationRevisions(tx, c, &app, previousEnv, req.Message)
+	})
+	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to update application")
 	}
 	return c.JSON(app)
@@ -112,6 +239,47 @@ func (h *ApplicationHandler) Create(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 	}
 
+	if err := validateAppSource(&app); err != nil {
+		return err
+	}
+	if err := validateEnvKeys(app.EnvVars.Production, app.EnvVars.Preview); err != nil {
+		return err
+	}
+	if err := validateSecretRefs(h.DB, app.ClusterID, app.EnvVars.Production, app.EnvVars.Preview); err != nil {
+		return err
+	}
+	if app.EnvironmentID != nil {
+		if err := validateAppEnvironment(h.DB, app.ClusterID, *app.EnvironmentID); err != nil {
+			return err
+		}
+	}
+
+	if app.DeployStrategy == "" {
+		app.DeployStrategy = model.DeployStrategyRecreate
+	}
+	if err := validateDeployStrategy(app.DeployStrategy); err != nil {
+		return err
+	}
+	if err := app.UpdatePolicy.Validate(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "update_policy: "+err.Error())
+	}
+	if err := app.HealthCheck.Validate(app.Port); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "health_check: "+err.Error())
+	}
+	if err := app.Hooks.Validate(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "hooks: "+err.Error())
+	}
+	if err := app.Resources.Validate(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "resources: "+err.Error())
+	}
+	if app.DeployQueueMode == "" {
+		app.DeployQueueMode = model.DeployQueueModeQueue
+	}
+	if err := validateDeployQueueMode(app.DeployQueueMode); err != nil {
+		return err
+	}
+	app.ActiveDeploymentID = nil
+
 	app.Status = "pending"
 	if app.Replicas == 0 {
 		app.Replicas = 1
@@ -119,20 +287,24 @@ func (h *ApplicationHandler) Create(c *fiber.Ctx) error {
 	if app.Namespace == "" {
 		app.Namespace = "default"
 	}
+	if err := checkCapacity(h.DB, &app, app.Replicas); err != nil {
+		return err
+	}
 
-	if err := h.DB.Create(&app).Error; err != nil {
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&app).Error; err != nil {
+			return err
+		}
+		return recordApplicationRevisions(tx, c, &app, model.ScopedEnvs{}, "Application created")
+	})
+	if err != nil {
 		log.Printf("Failed to create app: %v", err)
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create application")
 	}
 
 	// Trigger deployment
-	task, err := tasks.NewDeployAppTask(app.ID)
-	if err != nil {
-		log.Printf("Failed to create deploy task: %v", err)
-	} else {
-		if _, err := h.AsynqClient.Enqueue(task); err != nil {
-			log.Printf("Failed to enqueue deploy task: %v", err)
-		}
+	if _, err := tasks.EnqueueDeploy(h.DB, h.AsynqClient, &app); err != nil {
+		log.Printf("Failed to enqueue deploy task: %v", err)
 	}
 
 	var userID *uint
@@ -158,12 +330,15 @@ func (h *ApplicationHandler) Redeploy(c *fiber.Ctx) error {
 	if err := h.DB.First(&app, uint(id)).Error; err != nil {
 		return fiber.NewError(fiber.StatusNotFound, "Application not found")
 	}
+	if err := checkCapacity(h.DB, &app, app.Replicas); err != nil {
+		return err
+	}
 
-	task, err := tasks.NewDeployAppTask(app.ID)
-	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to create deploy task")
+	deployment, err := tasks.EnqueueDeploy(h.DB, h.AsynqClient, &app)
+	if errors.Is(err, tasks.ErrAppDeleting) || errors.Is(err, tasks.ErrLifecycleBusy) {
+		return fiber.NewError(fiber.StatusConflict, err.Error())
 	}
-	if _, err := h.AsynqClient.Enqueue(task); err != nil {
+	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to enqueue deploy task")
 	}
 
@@ -178,17 +353,287 @@ func (h *ApplicationHandler) Redeploy(c *fiber.Ctx) error {
 		fmt.Sprintf("Application '%s' redeployment triggered", app.Name),
 		"application", app.ID, userID, nil)
 
-	return c.JSON(fiber.Map{"message": "redeployment queued"})
+	return c.JSON(fiber.Map{"message": "redeployment queued", "deployment": deployment})
+}
+
+// Stop stops every instance of an application without removing it.
+func (h *ApplicationHandler) Stop(c *fiber.Ctx) error {
+	return h.lifecycle(c, tasks.LifecycleStop, 0)
+}
+
+// Start brings a stopped application back with its configured replicas.
+func (h *ApplicationHandler) Start(c *fiber.Ctx) error {
+	return h.lifecycle(c, tasks.LifecycleStart, 0)
+}
+
+// Scale changes the number of running instances of an application without
+// redeploying it. Scaling a stopped application only records the number
+// used when it is started.
+func (h *ApplicationHandler) Scale(c *fiber.Ctx) error {
+	var req struct {
+		Replicas int `json:"replicas"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	}
+	if req.Replicas < 1 {
+		return fiber.NewError(fiber.StatusBadRequest, "replicas must be at least 1; stop the application to run none")
+	}
+	return h.lifecycle(c, tasks.LifecycleScale, req.Replicas)
 }
 
-// Delete removes an application
+func (h *ApplicationHandler) lifecycle(c *fiber.Ctx, action tasks.LifecycleAction, replicas int) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	var app model.Application
+	if err := h.DB.First(&app, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Application not found")
+	}
+
+	switch {
+	case action == tasks.LifecycleStop && app.Status == tasks.AppStatusStopped:
+		return fiber.NewError(fiber.StatusConflict, "application is already stopped")
+	case action == tasks.LifecycleStart && app.Status != tasks.AppStatusStopped && app.Status != "failed":
+		return fiber.NewError(fiber.StatusConflict, "only a stopped application can be started")
+	case action == tasks.LifecycleScale && replicas == app.Replicas:
+		return c.JSON(fiber.Map{"message": "already at this scale", "application": app})
+	case action == tasks.LifecycleScale && app.Status == tasks.AppStatusStopped:
+		previous := app.Replicas
+		if err := h.DB.Model(&app).Update("replicas", replicas).Error; err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to update replicas")
+		}
+		_ = service.LogActivity(h.DB, model.ActivityTypeAppScaled,
+			fmt.Sprintf("Application '%s' will start with %d replica(s) instead of %d", app.Name, replicas, previous),
+			"application", app.ID, currentUserID(c), nil)
+		return c.JSON(fiber.Map{"message": "replicas updated; the application is stopped", "application": app})
+	}
+
+	switch action {
+	case tasks.LifecycleScale:
+		err = checkCapacity(h.DB, &app, replicas)
+	case tasks.LifecycleStart:
+		err = checkCapacity(h.DB, &app, app.Replicas)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = tasks.EnqueueLifecycle(h.DB, h.AsynqClient, &app, action, replicas)
+	switch {
+	case errors.Is(err, tasks.ErrAppDeleting), errors.Is(err, tasks.ErrLifecycleBusy):
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	case err != nil:
+		log.Printf("Failed to enqueue %s of app %d: %v", action, app.ID, err)
+		return fiber.NewError(fiber.StatusInternalServerError, fmt.Sprintf("failed to enqueue %s task", action))
+	}
+
+	msg := fmt.Sprintf("Application '%s' %s requested", app.Name, action)
+	if action == tasks.LifecycleScale {
+		msg = fmt.Sprintf("Application '%s' scale to %d replica(s) requested", app.Name, replicas)
+	}
+	_ = service.LogActivity(h.DB, action.Activity(), msg, "application", app.ID, currentUserID(c), nil)
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": fmt.Sprintf("%s queued", action), "application": app})
+}
+
+// Restart recreates an application's instances on its live image with
+// freshly resolved environment values, without rebuilding.
+func (h *ApplicationHandler) Restart(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	var app model.Application
+	if err := h.DB.First(&app, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Application not found")
+	}
+	if err := checkCapacity(h.DB, &app, app.Replicas); err != nil {
+		return err
+	}
+	deployment, err := tasks.EnqueueRestart(h.DB, h.AsynqClient, &app, "requested by user")
+	if errors.Is(err, tasks.ErrAppDeleting) || errors.Is(err, tasks.ErrLifecycleBusy) {
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to enqueue restart task")
+	}
+	if deployment == nil {
+		return fiber.NewError(fiber.StatusConflict, "application has never gone live; deploy it first")
+	}
+	h.DB.Model(&app).Update("status", "pending")
+
+	_ = service.LogActivity(h.DB, model.ActivityTypeAppRestarted,
+		fmt.Sprintf("Application '%s' restart requested", app.Name),
+		"application", app.ID, currentUserID(c), nil)
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": "restart queued", "deployment": deployment})
+}
+
+// Delete tears an application down: its deployments are cancelled and a
+// task removes its containers, services, volumes, nginx sites, images and
+// files from the cluster before deleting the record. The application is "deleting"
+// until then, or "teardown_failed" with a teardown_report if anything could
+// not be removed; deleting it again retries. ?force=true deletes the record
+// without touching the cluster.
 func (h *ApplicationHandler) Delete(c *fiber.Ctx) error {
 	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
 	if err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
 	}
-	if err := h.DB.Delete(&model.Application{}, uint(id)).Error; err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to delete")
+	var app model.Application
+	if err := h.DB.First(&app, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Application not found")
+	}
+
+	userID := currentUserID(c)
+	if c.QueryBool("force") {
+		if err := h.DB.Delete(&app).Error; err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to delete")
+		}
+		_ = service.LogActivity(h.DB, model.ActivityTypeAppDeleted,
+			fmt.Sprintf("Application '%s' deleted without teardown", app.Name),
+			"application", app.ID, userID, nil)
+		return c.JSON(fiber.Map{"message": "deleted"})
+	}
+
+	if err := tasks.EnqueueTeardown(h.DB, h.AsynqClient, &app); err != nil {
+		log.Printf("Failed to enqueue teardown of app %d: %v", app.ID, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to enqueue teardown")
+	}
+	_ = service.LogActivity(h.DB, model.ActivityTypeAppDeleted,
+		fmt.Sprintf("Application '%s' deletion requested", app.Name),
+		"application", app.ID, userID, nil)
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": "teardown queued", "application": app})
+}
+
+// validateAppEnvironment checks that a shared environment exists in the
+// application's cluster.
+func validateAppEnvironment(db *gorm.DB, clusterID, envID uint) error {
+	var env model.Environment
+	if err := db.First(&env, envID).Error; err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "environment not found")
+	}
+	if env.ClusterID != clusterID {
+		return fiber.NewError(fiber.StatusBadRequest, "environment belongs to a different cluster")
+	}
+	return nil
+}
+
+// checkCapacity rejects running replicas instances of app when their
+// resource requests would not fit on its cluster.
+func checkCapacity(db *gorm.DB, app *model.Application, replicas int) error {
+	err := service.CheckCapacity(db, app, replicas)
+	switch {
+	case errors.Is(err, service.ErrInsufficientCapacity):
+		return fiber.NewError(fiber.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return fiber.NewError(fiber.StatusBadRequest, "cluster not found")
+	case err != nil:
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to check cluster capacity")
+	}
+	return nil
+}
+
+func validateDeployQueueMode(m model.DeployQueueMode) error {
+	switch m {
+	case model.DeployQueueModeQueue, model.DeployQueueModeSupersede:
+		return nil
+	}
+	return fiber.NewError(fiber.StatusBadRequest, "deploy_queue_mode must be queue or supersede")
+}
+
+func validateDeployStrategy(s model.DeployStrategy) error {
+	switch s {
+	case model.DeployStrategyRecreate, model.DeployStrategyBlueGreen:
+		return nil
+	}
+	return fiber.NewError(fiber.StatusBadRequest, "deploy_strategy must be recreate or blue_green")
+}
+
+var (
+	branchPattern     = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+	imagePattern      = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(:[0-9]+)?(/[a-z0-9]+([._-]+[a-z0-9]+)*)*(:[A-Za-z0-9_][A-Za-z0-9_.-]{0,127})?(@sha256:[a-f0-9]{64})?$`)
+	manualPathPattern = regexp.MustCompile(`^/[A-Za-z0-9._/-]*$`)
+	domainPattern     = regexp.MustCompile(`^(\*\.)?([A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?\.)*[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+	scpRepoPattern    = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[A-Za-z0-9._~/-]+$`)
+)
+
+// validateAppSource rejects source and routing fields that could not name a
+// real branch, repository, image, path or host. The engine quotes every value
+// it puts in a command, so this is about clear errors rather than safety.
+func validateAppSource(app *model.Application) error {
+	if app.Branch != "" {
+		if err := validateBranch(app.Branch); err != nil {
+			return err
+		}
+	}
+	if app.RepoURL != "" {
+		if err := validateRepoURL(app.RepoURL); err != nil {
+			return err
+		}
+	}
+	if app.DockerImage != "" && !imagePattern.MatchString(app.DockerImage) {
+		return fiber.NewError(fiber.StatusBadRequest, "docker_image is not a valid image reference")
+	}
+	if app.ManualPath != "" {
+		if !manualPathPattern.MatchString(app.ManualPath) || containsString(strings.Split(app.ManualPath, "/"), "..") {
+			return fiber.NewError(fiber.StatusBadRequest, "manual_path must be an absolute path of letters, digits, '.', '_', '-' and '/'")
+		}
+	}
+	if app.Domain != "" {
+		if err := validateDomain(app.Domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateBranch applies the parts of git check-ref-format that matter here.
+func validateBranch(b string) error {
+	if len(b) > 100 || !branchPattern.MatchString(b) ||
+		strings.HasPrefix(b, "-") || strings.HasPrefix(b, "/") || strings.HasSuffix(b, "/") ||
+		strings.HasSuffix(b, ".lock") || strings.Contains(b, "..") || strings.Contains(b, "//") {
+		return fiber.NewError(fiber.StatusBadRequest, "branch is not a valid git branch name")
+	}
+	return nil
+}
+
+func validateRepoURL(raw string) error {
+	if strings.HasPrefix(raw, "-") || strings.ContainsAny(raw, " \t\r\n\x00") {
+		return fiber.NewError(fiber.StatusBadRequest, "repo_url is not a valid repository URL")
+	}
+	if scpRepoPattern.MatchString(raw) {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "repo_url is not a valid repository URL")
+	}
+	switch u.Scheme {
+	case "https", "http", "ssh", "git":
+		return nil
+	}
+	return fiber.NewError(fiber.StatusBadRequest, "repo_url must use https, http, ssh or git")
+}
+
+func validateDomain(d string) error {
+	if len(d) > 253 || !domainPattern.MatchString(d) {
+		return fiber.NewError(fiber.StatusBadRequest, "domain is not a valid host name")
+	}
+	return nil
+}
+
+// validateEnvKeys returns a 400 error if any variable name could not be
+// written to an env file.
+func validateEnvKeys(maps ...map[string]string) error {
+	for _, m := range maps {
+		for k := range m {
+			if !envfile.KeyPattern.MatchString(k) {
+				return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("invalid variable name %q", k))
+			}
+		}
 	}
-	return c.JSON(fiber.Map{"message": "deleted"})
+	return nil
 }
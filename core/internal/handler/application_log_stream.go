@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	tasks "github.com/enochcodes/orchestra/core/internal/engine"
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Limits of application log requests.
+const (
+	appLogDefaultTail     = 100             // lines per instance a stream starts with
+	appLogDownloadTimeout = 5 * time.Minute // how long a download may read
+	appLogBuffer          = 256             // lines queued between the runtime and the client
+)
+
+// appLogOptions reads the ?instance=, ?since= and ?tail= filters. since is
+// a duration such as 15m or an RFC 3339 time; tail is a line count per
+// instance, or "all".
+func appLogOptions(c *fiber.Ctx, defaultTail int) (tasks.LogOptions, error) {
+	opts := tasks.LogOptions{
+		Instance: c.Query("instance"),
+		Since:    c.Query("since"),
+		Tail:     defaultTail,
+	}
+	if opts.Since != "" {
+		if _, err := time.ParseDuration(opts.Since); err != nil {
+			if _, err := time.Parse(time.RFC3339, opts.Since); err != nil {
+				return opts, fiber.NewError(fiber.StatusBadRequest, "since must be a duration such as 15m or an RFC 3339 time")
+			}
+		}
+	}
+	switch tail := c.Query("tail"); tail {
+	case "":
+	case "all":
+		opts.Tail = -1
+	default:
+		n, err := strconv.Atoi(tail)
+		if err != nil || n < 0 {
+			return opts, fiber.NewError(fiber.StatusBadRequest, `tail must be a non-negative number or "all"`)
+		}
+		opts.Tail = n
+	}
+	return opts, nil
+}
+
+// loadAppForLogs loads the application named by :id with its cluster after
+// checking the user may view it.
+func (h *ApplicationHandler) loadAppForLogs(c *fiber.Ctx) (*model.Application, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	if err := authorizeApp(c, h.DB, uint(id), model.ApplicationRoleViewer); err != nil {
+		return nil, err
+	}
+	var app model.Application
+	if err := h.DB.Preload("Cluster").Preload("Cluster.ManagerServer").First(&app, uint(id)).Error; err != nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Application not found")
+	}
+	return &app, nil
+}
+
+// StreamLogs handles GET /api/v1/applications/:id/logs/stream. It follows
+// the container output of the application's instances and sends it as
+// Server-Sent Events, one "log" event per line with a tasks.LogLine as
+// data. It starts with the last ?tail= lines of each instance (default
+// 100); ?instance= and ?since= narrow it further. If the runtime ends the
+// stream, an "end" event follows, preceded by an "error" event if it failed.
+func (h *ApplicationHandler) StreamLogs(c *fiber.Ctx) error {
+	app, err := h.loadAppForLogs(c)
+	if err != nil {
+		return err
+	}
+	opts, err := appLogOptions(c, appLogDefaultTail)
+	if err != nil {
+		return err
+	}
+	opts.Follow = true
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no") // stop nginx from buffering the stream
+
+	key := h.EncryptionKey
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// Cancelling stops the remote log command once the client is gone.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		lines := make(chan tasks.LogLine, appLogBuffer)
+		done := make(chan error, 1)
+		go func() {
+			done <- tasks.StreamAppLogs(ctx, key, app, opts, func(l tasks.LogLine) {
+				select {
+				case lines <- l:
+				case <-ctx.Done():
+				}
+			})
+		}()
+
+		send := func(l tasks.LogLine) {
+			data, _ := json.Marshal(l)
+			fmt.Fprintf(w, "event: log\ndata: %s\n\n", data)
+		}
+		heartbeat := time.NewTicker(logStreamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case l := <-lines:
+				send(l)
+				if len(lines) > 0 {
+					continue // flush once the burst is written
+				}
+			case err := <-done:
+				for len(lines) > 0 {
+					send(<-lines)
+				}
+				if err != nil {
+					fmt.Fprintf(w, "event: error\ndata: %q\n\n", err.Error())
+				}
+				fmt.Fprint(w, "event: end\ndata: {}\n\n")
+				w.Flush()
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			}
+			if err := w.Flush(); err != nil {
+				return // client went away
+			}
+		}
+	})
+	return nil
+}
+
+// DownloadLogs handles GET /api/v1/applications/:id/logs. It returns the
+// existing container output of the application's instances as a plain text
+// attachment, one "<time> [<instance>] <message>" line each. All of it is
+// returned unless ?tail= limits the lines per instance; ?instance= and
+// ?since= filter as for StreamLogs. Should the runtime fail part way, the
+// last line says why.
+func (h *ApplicationHandler) DownloadLogs(c *fiber.Ctx) error {
+	app, err := h.loadAppForLogs(c)
+	if err != nil {
+		return err
+	}
+	opts, err := appLogOptions(c, -1)
+	if err != nil {
+		return err
+	}
+
+	filename := fmt.Sprintf("%s-%s.log", app.Name, time.Now().UTC().Format("20060102-150405"))
+	c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+
+	key := h.EncryptionKey
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx, cancel := context.WithTimeout(context.Background(), appLogDownloadTimeout)
+		defer cancel()
+		written := 0
+		err := tasks.StreamAppLogs(ctx, key, app, opts, func(l tasks.LogLine) {
+			stamp := "-"
+			if l.Time != nil {
+				stamp = l.Time.UTC().Format(time.RFC3339Nano)
+			}
+			fmt.Fprintf(w, "%s [%s] %s\n", stamp, l.Instance, l.Message)
+			if written++; written%appLogBuffer == 0 && w.Flush() != nil {
+				cancel() // client went away
+			}
+		})
+		if err != nil {
+			fmt.Fprintf(w, "error reading logs: %v\n", err)
+		} else if ctx.Err() != nil {
+			fmt.Fprintf(w, "log download stopped after %s\n", appLogDownloadTimeout)
+		}
+		w.Flush()
+	})
+	return nil
+}
@@ -75,3 +75,18 @@ func (h *ClusterHandler) Get(c *fiber.Ctx) error {
 	}
 	return c.JSON(cluster)
 }
+
+// Capacity handles GET /api/v1/clusters/:id/capacity: the CPU and memory of
+// the cluster's servers and how much of it applications reserve.
+func (h *ClusterHandler) Capacity(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid cluster ID")
+	}
+
+	capacity, err := service.GetClusterCapacity(h.Service.DB, uint(id), 0)
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	return c.JSON(capacity)
+}
@@ -1,17 +1,30 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/deploylog"
+	tasks "github.com/enochcodes/orchestra/core/internal/engine"
 	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/internal/service"
+	"github.com/enochcodes/orchestra/core/pkg/objstore"
 	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
 	"gorm.io/gorm"
 )
 
 type DeploymentHandler struct {
-	DB *gorm.DB
+	DB          *gorm.DB
+	AsynqClient *asynq.Client
+	LogStore    objstore.Store // where compacted logs were offloaded; may be nil
 }
 
-func NewDeploymentHandler(db *gorm.DB) *DeploymentHandler {
-	return &DeploymentHandler{DB: db}
+func NewDeploymentHandler(db *gorm.DB, client *asynq.Client, logStore objstore.Store) *DeploymentHandler {
+	return &DeploymentHandler{DB: db, AsynqClient: client, LogStore: logStore}
 }
 
 // List deployments
@@ -20,32 +33,394 @@ func (h *DeploymentHandler) List(c *fiber.Ctx) error {
 	if err := h.DB.Preload("Application").Order("created_at desc").Find(&deployments).Error; err != nil {
 		return err
 	}
+	for i := range deployments {
+		maskSpecEnv(&deployments[i])
+	}
 	return c.JSON(deployments)
 }
 
-// Get deployment by ID
+// Get deployment by ID, with its pipeline steps
 func (h *DeploymentHandler) Get(c *fiber.Ctx) error {
 	id := c.Params("id")
 	var deployment model.Deployment
-	if err := h.DB.Preload("Application").First(&deployment, id).Error; err != nil {
+	if err := h.DB.Preload("Application").Preload("Steps", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	}).First(&deployment, id).Error; err != nil {
 		return fiber.NewError(fiber.StatusNotFound, "Deployment not found")
 	}
+	maskSpecEnv(&deployment)
 	return c.JSON(deployment)
 }
 
-// GetLogs handles GET /api/v1/deployments/:id/logs
+// maskSpecEnv masks the env values recorded in a deployment's spec before it
+// is returned, as Diff does for the values it compares.
+func maskSpecEnv(d *model.Deployment) {
+	if d.Spec.Env != nil {
+		d.Spec.Env = service.MaskEnvVars(d.Spec.Env)
+	}
+}
+
+// GetLogs handles GET /api/v1/deployments/:id/logs. It returns a page of the
+// deployment's log lines in order, optionally filtered by ?step=, ?level=
+// (that level and above) and ?stream=. Pass the returned next_after as
+// ?after= to fetch the next page. "logs" holds the page as plain text.
 func (h *DeploymentHandler) GetLogs(c *fiber.Ctx) error {
-	id := c.Params("id")
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid deployment ID")
+	}
+	q, err := logQuery(c)
+	if err != nil {
+		return err
+	}
+	var deployment model.Deployment
+	if err := h.DB.Omit("logs").Preload("Application").First(&deployment, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Deployment not found")
+	}
+
+	lines, more, err := deploylog.Read(c.Context(), h.DB, h.LogStore, deployment.ID, q)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, fmt.Sprintf("failed to read logs: %v", err))
+	}
+	nextAfter := q.After
+	if len(lines) > 0 {
+		nextAfter = lines[len(lines)-1].Seq
+	}
+	if lines == nil {
+		lines = []model.DeploymentLogLine{}
+	}
+	return c.JSON(fiber.Map{
+		"deployment_id":  deployment.ID,
+		"application":    deployment.Application.Name,
+		"version":        deployment.Version,
+		"status":         deployment.Status,
+		"lines":          lines,
+		"next_after":     nextAfter,
+		"has_more":       more,
+		"logs":           deploylog.Text(lines),
+		"logs_purged_at": deployment.LogsPurgedAt,
+		"created_at":     deployment.CreatedAt,
+	})
+}
+
+// logQuery reads the paging and filter parameters of a deployment log request.
+func logQuery(c *fiber.Ctx) (deploylog.Query, error) {
+	q := deploylog.Query{
+		After:  c.QueryInt("after", 0),
+		Limit:  c.QueryInt("limit", 1000),
+		Step:   model.DeploymentStepName(c.Query("step")),
+		Level:  model.LogLevel(c.Query("level")),
+		Stream: model.LogStream(c.Query("stream")),
+	}
+	if q.After < 0 {
+		return q, fiber.NewError(fiber.StatusBadRequest, "after must not be negative")
+	}
+	if q.Limit < 1 || q.Limit > 5000 {
+		return q, fiber.NewError(fiber.StatusBadRequest, "limit must be between 1 and 5000")
+	}
+	switch q.Level {
+	case "", model.LogLevelInfo, model.LogLevelWarn, model.LogLevelError:
+	default:
+		return q, fiber.NewError(fiber.StatusBadRequest, "level must be info, warn or error")
+	}
+	switch q.Stream {
+	case "", model.LogStreamStdout, model.LogStreamStderr, model.LogStreamSystem:
+	default:
+		return q, fiber.NewError(fiber.StatusBadRequest, "stream must be stdout, stderr or system")
+	}
+	return q, nil
+}
+
+// SearchLogs handles GET /api/v1/applications/:id/logs/search?q=. It finds
+// log lines containing every word of q across the application's
+// deployments, newest first. Pass the id of the last match as ?before= for
+// the next page. Logs that have been compacted are not searched.
+func (h *DeploymentHandler) SearchLogs(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	text := strings.TrimSpace(c.Query("q"))
+	if text == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "q is required")
+	}
+	limit := c.QueryInt("limit", 50)
+	if limit < 1 || limit > 500 {
+		return fiber.NewError(fiber.StatusBadRequest, "limit must be between 1 and 500")
+	}
+	var before uint64
+	if v := c.Query("before"); v != "" {
+		if before, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid before")
+		}
+	}
+	level := model.LogLevel(c.Query("level"))
+	switch level {
+	case "", model.LogLevelInfo, model.LogLevelWarn, model.LogLevelError:
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, "level must be info, warn or error")
+	}
+
+	var app model.Application
+	if err := h.DB.Select("id").First(&app, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Application not found")
+	}
+	matches, err := deploylog.Search(h.DB, app.ID, deploylog.SearchQuery{Text: text, Before: before, Limit: limit, Level: level})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to search logs")
+	}
+	if matches == nil {
+		matches = []deploylog.Match{}
+	}
+	return c.JSON(fiber.Map{"query": text, "matches": matches})
+}
+
+// maxStepLogLines caps the log lines GetSteps returns with the steps.
+const maxStepLogLines = 20000
+
+// stepWithLogs is a pipeline step with the log lines written while it ran.
+type stepWithLogs struct {
+	model.DeploymentStep
+	Logs string `json:"logs,omitempty"`
+}
+
+// GetSteps handles GET /api/v1/deployments/:id/steps. It returns the
+// pipeline steps of the deployment's latest attempt, with their logs.
+func (h *DeploymentHandler) GetSteps(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid deployment ID")
+	}
 	var deployment model.Deployment
-	if err := h.DB.Preload("Application").First(&deployment, id).Error; err != nil {
+	if err := h.DB.Omit("logs").First(&deployment, uint(id)).Error; err != nil {
 		return fiber.NewError(fiber.StatusNotFound, "Deployment not found")
 	}
+	var steps []model.DeploymentStep
+	if err := h.DB.Where("deployment_id = ?", deployment.ID).Order("position").Find(&steps).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to fetch steps")
+	}
+	lines, truncated, err := deploylog.Read(c.Context(), h.DB, h.LogStore, deployment.ID, deploylog.Query{Limit: maxStepLogLines})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, fmt.Sprintf("failed to read logs: %v", err))
+	}
+	byStep := map[model.DeploymentStepName][]model.DeploymentLogLine{}
+	for _, l := range lines {
+		if l.Step != "" {
+			byStep[l.Step] = append(byStep[l.Step], l)
+		}
+	}
+	withLogs := make([]stepWithLogs, len(steps))
+	for i, step := range steps {
+		withLogs[i] = stepWithLogs{DeploymentStep: step, Logs: deploylog.Text(byStep[step.Name])}
+	}
+	return c.JSON(fiber.Map{
+		"deployment_id":  deployment.ID,
+		"status":         deployment.Status,
+		"attempt":        deployment.Attempt,
+		"steps":          withLogs,
+		"logs_truncated": truncated,
+	})
+}
+
+// stepTiming is one deployment's step durations in StepTimings.
+type stepTiming struct {
+	DeploymentID uint                               `json:"deployment_id"`
+	Version      string                             `json:"version"`
+	Status       model.DeploymentStatus             `json:"status"`
+	CreatedAt    time.Time                          `json:"created_at"`
+	DurationsMs  map[model.DeploymentStepName]int64 `json:"durations_ms"` // finished steps only
+}
+
+// stepStats summarises one step's successful runs in StepTimings.
+type stepStats struct {
+	Runs  int   `json:"runs"`
+	AvgMs int64 `json:"avg_ms"`
+	MaxMs int64 `json:"max_ms"`
+}
+
+// StepTimings handles GET /api/v1/applications/:id/step-timings?limit=20. It
+// returns how long each pipeline step took in the application's most recent
+// deployments, newest first, and per-step averages over their successful runs.
+func (h *DeploymentHandler) StepTimings(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	limit := c.QueryInt("limit", 20)
+	if limit < 1 || limit > 200 {
+		return fiber.NewError(fiber.StatusBadRequest, "limit must be between 1 and 200")
+	}
+
+	var deployments []model.Deployment
+	if err := h.DB.Omit("logs").Preload("Steps", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	}).Where("application_id = ? AND status NOT IN ?", uint(id), model.DeploymentStatusesActive).
+		Order("id DESC").Limit(limit).Find(&deployments).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to fetch deployments")
+	}
+
+	timings := make([]stepTiming, 0, len(deployments))
+	stats := map[model.DeploymentStepName]*stepStats{}
+	total := map[model.DeploymentStepName]int64{}
+	for _, d := range deployments {
+		t := stepTiming{DeploymentID: d.ID, Version: d.Version, Status: d.Status, CreatedAt: d.CreatedAt,
+			DurationsMs: map[model.DeploymentStepName]int64{}}
+		for _, step := range d.Steps {
+			if step.FinishedAt == nil {
+				continue
+			}
+			t.DurationsMs[step.Name] = step.DurationMs
+			if step.Status != model.StepStatusSucceeded {
+				continue
+			}
+			st := stats[step.Name]
+			if st == nil {
+				st = &stepStats{}
+				stats[step.Name] = st
+			}
+			st.Runs++
+			total[step.Name] += step.DurationMs
+			if step.DurationMs > st.MaxMs {
+				st.MaxMs = step.DurationMs
+			}
+		}
+		timings = append(timings, t)
+	}
+	for name, st := range stats {
+		st.AvgMs = total[name] / int64(st.Runs)
+	}
+
+	return c.JSON(fiber.Map{"deployments": timings, "steps": stats})
+}
+
+// Rollback handles POST /api/v1/deployments/:id/rollback. It re-deploys the
+// image and spec recorded on an earlier successful deployment, without
+// rebuilding, as a new deployment.
+func (h *DeploymentHandler) Rollback(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid deployment ID")
+	}
+	var target model.Deployment
+	if err := h.DB.Preload("Application").First(&target, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Deployment not found")
+	}
+	if target.Status != model.DeploymentStatusLive && target.Status != model.DeploymentStatusRolledBack {
+		return fiber.NewError(fiber.StatusBadRequest, "only deployments that went live can be rolled back to")
+	}
+	if target.ImageTag == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "deployment has no recorded image")
+	}
+
+	var current model.Deployment
+	if err := h.DB.Where("application_id = ? AND status = ?", target.ApplicationID, model.DeploymentStatusLive).
+		Order("created_at DESC").First(&current).Error; err == nil && current.ID == target.ID {
+		return fiber.NewError(fiber.StatusBadRequest, "deployment is already the current one")
+	}
+
+	// The rollback runs with the replicas and resources target recorded.
+	restored := target.Application
+	if !target.Spec.IsZero() {
+		restored.Replicas = target.Spec.Replicas
+		restored.Resources = model.Resources{}
+		if target.Spec.Resources != nil {
+			restored.Resources = *target.Spec.Resources
+		}
+	}
+	if err := checkCapacity(h.DB, &restored, restored.Replicas); err != nil {
+		return err
+	}
+
+	deployment, err := tasks.EnqueueRollback(h.DB, h.AsynqClient, &target.Application, &target)
+	if errors.Is(err, tasks.ErrAppDeleting) || errors.Is(err, tasks.ErrLifecycleBusy) {
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to enqueue rollback task")
+	}
+	h.DB.Model(&target.Application).Update("status", "pending")
+
+	_ = service.LogActivity(h.DB, model.ActivityTypeAppRolledBack,
+		fmt.Sprintf("Application '%s' rollback to %s triggered", target.Application.Name, target.Version),
+		"deployment", target.ID, currentUserID(c), nil)
+
+	return c.JSON(fiber.Map{"message": "rollback queued", "target_version": target.Version, "deployment": deployment})
+}
+
+// Cancel handles POST /api/v1/deployments/:id/cancel. A queued deployment is
+// dropped from the queue; a running one is marked cancelled and the worker
+// running it aborts its remote commands within a few seconds.
+func (h *DeploymentHandler) Cancel(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid deployment ID")
+	}
+	var deployment model.Deployment
+	if err := h.DB.Preload("Application").First(&deployment, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Deployment not found")
+	}
+
+	res := h.DB.Model(&model.Deployment{}).
+		Where("id = ? AND status IN ?", deployment.ID, model.DeploymentStatusesActive).
+		Update("status", model.DeploymentStatusCancelled)
+	if res.Error != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to cancel deployment")
+	}
+	if res.RowsAffected == 0 {
+		return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("deployment is %s, not queued or running", deployment.Status))
+	}
+	_ = deploylog.Append(h.DB, &deployment, "", deploylog.System("Cancellation requested."))
+	if deployment.Status == model.DeploymentStatusQueued {
+		// No worker holds it; its task will find it cancelled and skip it.
+		tasks.SettleAppStatus(h.DB, deployment.ApplicationID)
+	}
+
+	_ = service.LogActivity(h.DB, model.ActivityTypeDeploymentCancelled,
+		fmt.Sprintf("Deployment %s of '%s' cancelled", deployment.Version, deployment.Application.Name),
+		"deployment", deployment.ID, currentUserID(c), nil)
+
+	return c.JSON(fiber.Map{"message": "deployment cancelled", "previous_status": deployment.Status})
+}
+
+// Diff handles GET /api/v1/deployments/:id/diff?from=<deployment id>. It
+// compares the spec of the deployment given by from (default: the previous
+// deployment of the same application) with this deployment's spec.
+func (h *DeploymentHandler) Diff(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid deployment ID")
+	}
+	var to model.Deployment
+	if err := h.DB.First(&to, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Deployment not found")
+	}
+
+	var from model.Deployment
+	if fromParam := c.Query("from"); fromParam != "" {
+		fromID, err := strconv.ParseUint(fromParam, 10, 32)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid from deployment ID")
+		}
+		if err := h.DB.First(&from, uint(fromID)).Error; err != nil {
+			return fiber.NewError(fiber.StatusNotFound, "from deployment not found")
+		}
+		if from.ApplicationID != to.ApplicationID {
+			return fiber.NewError(fiber.StatusBadRequest, "deployments belong to different applications")
+		}
+	} else if err := h.DB.Where("application_id = ? AND id < ?", to.ApplicationID, to.ID).
+		Order("id DESC").First(&from).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "no earlier deployment to compare with")
+	}
+
+	if from.Spec.IsZero() || to.Spec.IsZero() {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "no spec was recorded for one of the deployments")
+	}
+
+	changes, envChanges := service.DiffDeploymentSpecs(from.Spec, to.Spec)
 	return c.JSON(fiber.Map{
-		"deployment_id": deployment.ID,
-		"application":   deployment.Application.Name,
-		"version":       deployment.Version,
-		"status":        deployment.Status,
-		"logs":          deployment.Logs,
-		"created_at":    deployment.CreatedAt,
+		"from":        fiber.Map{"id": from.ID, "version": from.Version, "created_at": from.CreatedAt},
+		"to":          fiber.Map{"id": to.ID, "version": to.Version, "created_at": to.CreatedAt},
+		"changes":     changes,
+		"env_changes": envChanges,
 	})
 }
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/enochcodes/orchestra/core/internal/deploylog"
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Timing of deployment log streams.
+const (
+	logStreamPollInterval = time.Second
+	logStreamHeartbeat    = 15 * time.Second
+	logStreamSettlePolls  = 3   // quiet polls after the deployment ends before closing
+	logStreamBatch        = 500 // lines read per poll
+)
+
+// StreamLogs handles GET /api/v1/deployments/:id/logs/stream. It sends the
+// deployment log as Server-Sent Events, one "log" event per line with the
+// line record as data and its sequence number as id, then follows new lines
+// as the engine appends them. ?offset=N starts after line N; a reconnecting
+// EventSource resumes after its Last-Event-ID. The filters of GetLogs apply.
+// Once the deployment has finished and no more lines arrive, an "end" event
+// carries the final status and the stream closes.
+func (h *DeploymentHandler) StreamLogs(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid deployment ID")
+	}
+	var deployment model.Deployment
+	if err := h.DB.Select("id", "status").First(&deployment, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Deployment not found")
+	}
+
+	q, err := logQuery(c)
+	if err != nil {
+		return err
+	}
+	q.After = c.QueryInt("offset", 0)
+	q.Limit = logStreamBatch
+	if last := c.Get("Last-Event-ID"); last != "" {
+		if n, err := strconv.Atoi(last); err == nil {
+			q.After = n
+		}
+	}
+	if q.After < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "offset must not be negative")
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no") // stop nginx from buffering the stream
+
+	db := h.DB
+	store := h.LogStore
+	depID := deployment.ID
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx := context.Background()
+		sent := 0
+		quiet := 0
+		lastWrite := time.Now()
+		for {
+			var status model.DeploymentStatus
+			if err := db.Model(&model.Deployment{}).Where("id = ?", depID).Select("status").Scan(&status).Error; err != nil {
+				return
+			}
+			lines, more, err := deploylog.Read(ctx, db, store, depID, q)
+			if err != nil {
+				fmt.Fprintf(w, "event: error\ndata: %q\n\n", err.Error())
+				w.Flush()
+				return
+			}
+
+			for _, l := range lines {
+				data, _ := json.Marshal(l)
+				fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", l.Seq, data)
+				q.After = l.Seq
+				sent++
+			}
+			if len(lines) > 0 {
+				lastWrite = time.Now()
+				quiet = 0
+			} else {
+				quiet++
+			}
+
+			// The engine may append a final line just after setting the
+			// status, so wait for the log to go quiet before ending.
+			if !status.IsActive() && quiet >= logStreamSettlePolls {
+				fmt.Fprintf(w, "event: end\ndata: {\"status\":%q,\"lines\":%d,\"last_seq\":%d}\n\n", status, sent, q.After)
+				w.Flush()
+				return
+			}
+			if time.Since(lastWrite) >= logStreamHeartbeat {
+				fmt.Fprint(w, ": keep-alive\n\n")
+				lastWrite = time.Now()
+			}
+			if err := w.Flush(); err != nil {
+				return // client went away
+			}
+			if !more {
+				time.Sleep(logStreamPollInterval)
+			}
+		}
+	})
+	return nil
+}
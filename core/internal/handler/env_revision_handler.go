@@ -0,0 +1,365 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	tasks "github.com/enochcodes/orchestra/core/internal/engine"
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+)
+
+// EnvRevisionHandler serves the revision history of Environment variables
+// and Application EnvVars: listing, diffing and rolling back.
+type EnvRevisionHandler struct {
+	DB          *gorm.DB
+	AsynqClient *asynq.Client
+}
+
+// NewEnvRevisionHandler creates a new EnvRevisionHandler.
+func NewEnvRevisionHandler(db *gorm.DB, client *asynq.Client) *EnvRevisionHandler {
+	return &EnvRevisionHandler{DB: db, AsynqClient: client}
+}
+
+// ListForEnvironment handles GET /api/v1/environments/:id/revisions
+func (h *EnvRevisionHandler) ListForEnvironment(c *fiber.Ctx) error {
+	env, err := h.loadEnvironment(c)
+	if err != nil {
+		return err
+	}
+	return h.list(c, model.EnvironmentRevisionTarget(env.ID))
+}
+
+// GetForEnvironment handles GET /api/v1/environments/:id/revisions/:rev
+func (h *EnvRevisionHandler) GetForEnvironment(c *fiber.Ctx) error {
+	env, err := h.loadEnvironment(c)
+	if err != nil {
+		return err
+	}
+	return h.get(c, model.EnvironmentRevisionTarget(env.ID))
+}
+
+// DiffForEnvironment handles GET /api/v1/environments/:id/revisions/diff?from=&to=
+func (h *EnvRevisionHandler) DiffForEnvironment(c *fiber.Ctx) error {
+	env, err := h.loadEnvironment(c)
+	if err != nil {
+		return err
+	}
+	return h.diff(c, model.EnvironmentRevisionTarget(env.ID), env.Variables)
+}
+
+// RollbackEnvironment handles POST /api/v1/environments/:id/revisions/:rev/rollback
+// Body: {"push": true} to push the restored variables to the cluster's servers,
+// plus "restart_apps": true to restart the applications consuming them.
+func (h *EnvRevisionHandler) RollbackEnvironment(c *fiber.Ctx) error {
+	env, err := h.loadEnvironment(c)
+	if err != nil {
+		return err
+	}
+	rev, err := h.loadRevision(c, model.EnvironmentRevisionTarget(env.ID))
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Push        bool `json:"push"`
+		RestartApps bool `json:"restart_apps"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+		}
+	}
+	if err := validateSecretRefs(h.DB, env.ClusterID, rev.Variables); err != nil {
+		return err
+	}
+
+	previous := env.Variables
+	env.Variables = copyVars(rev.Variables)
+	env.MarkChanged()
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(env).Error; err != nil {
+			return err
+		}
+		return recordEnvironmentRevision(tx, c, env, previous, fmt.Sprintf("Rollback to revision %d", rev.Revision), &rev.Revision)
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to restore revision")
+	}
+
+	_ = service.LogActivity(h.DB, model.ActivityTypeEnvRolledBack,
+		fmt.Sprintf("Environment '%s' rolled back to revision %d", env.Name, rev.Revision),
+		"environment", env.ID, currentUserID(c), nil)
+
+	if req.Push {
+		task, err := tasks.NewPushEnvTask(env.ID, req.RestartApps)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to create push task")
+		}
+		if _, err := h.AsynqClient.Enqueue(task); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to enqueue push task")
+		}
+	}
+
+	return c.JSON(fiber.Map{"environment": env, "restored_revision": rev.Revision, "pushed": req.Push})
+}
+
+// ListForApplication handles GET /api/v1/applications/:id/env/revisions?scope=
+func (h *EnvRevisionHandler) ListForApplication(c *fiber.Ctx) error {
+	app, scope, err := h.loadApplication(c)
+	if err != nil {
+		return err
+	}
+	return h.list(c, model.ApplicationRevisionTarget(app.ID, scope))
+}
+
+// GetForApplication handles GET /api/v1/applications/:id/env/revisions/:rev?scope=
+func (h *EnvRevisionHandler) GetForApplication(c *fiber.Ctx) error {
+	app, scope, err := h.loadApplication(c)
+	if err != nil {
+		return err
+	}
+	return h.get(c, model.ApplicationRevisionTarget(app.ID, scope))
+}
+
+// DiffForApplication handles GET /api/v1/applications/:id/env/revisions/diff?scope=&from=&to=
+func (h *EnvRevisionHandler) DiffForApplication(c *fiber.Ctx) error {
+	app, scope, err := h.loadApplication(c)
+	if err != nil {
+		return err
+	}
+	return h.diff(c, model.ApplicationRevisionTarget(app.ID, scope), app.EnvVars.ForScope(scope))
+}
+
+// RollbackApplication handles POST /api/v1/applications/:id/env/revisions/:rev/rollback?scope=
+// Body: {"redeploy": true} to redeploy the application with the restored variables.
+func (h *EnvRevisionHandler) RollbackApplication(c *fiber.Ctx) error {
+	app, scope, err := h.loadApplication(c)
+	if err != nil {
+		return err
+	}
+	rev, err := h.loadRevision(c, model.ApplicationRevisionTarget(app.ID, scope))
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Redeploy bool `json:"redeploy"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+		}
+	}
+	if err := validateSecretRefs(h.DB, app.ClusterID, rev.Variables); err != nil {
+		return err
+	}
+	if req.Redeploy {
+		if err := checkCapacity(h.DB, app, app.Replicas); err != nil {
+			return err
+		}
+	}
+
+	previous := app.EnvVars.ForScope(scope)
+	app.EnvVars.SetScope(scope, copyVars(rev.Variables))
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(app).Error; err != nil {
+			return err
+		}
+		return recordApplicationRevision(tx, c, app, scope, previous, fmt.Sprintf("Rollback to revision %d", rev.Revision), &rev.Revision)
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to restore revision")
+	}
+
+	_ = service.LogActivity(h.DB, model.ActivityTypeEnvRolledBack,
+		fmt.Sprintf("Application '%s' %s env rolled back to revision %d", app.Name, scope, rev.Revision),
+		"application", app.ID, currentUserID(c), nil)
+
+	if req.Redeploy {
+		if _, err := tasks.EnqueueDeploy(h.DB, h.AsynqClient, app); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to enqueue deploy task")
+		}
+		h.DB.Model(app).Update("status", "pending")
+	}
+
+	return c.JSON(fiber.Map{"application": app, "restored_revision": rev.Revision, "redeployed": req.Redeploy})
+}
+
+func (h *EnvRevisionHandler) list(c *fiber.Ctx, target string) error {
+	var revisions []model.EnvRevision
+	if err := h.DB.Preload("Author").Where("target = ?", target).
+		Order("revision DESC").Find(&revisions).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to fetch revisions")
+	}
+	return c.JSON(fiber.Map{"revisions": revisions, "count": len(revisions)})
+}
+
+func (h *EnvRevisionHandler) get(c *fiber.Ctx, target string) error {
+	rev, err := h.loadRevision(c, target)
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{
+		"revision":  rev,
+		"variables": service.MaskEnvVars(rev.Variables),
+	})
+}
+
+// diff compares revision ?from= with revision ?to=. When to is omitted the
+// current variables are used; when from is omitted it defaults to the
+// revision before to.
+func (h *EnvRevisionHandler) diff(c *fiber.Ctx, target string, current map[string]string) error {
+	toVars, toLabel := map[string]string(current), "current"
+	toRev := 0
+	if v := c.Query("to"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid to revision")
+		}
+		rev, err := service.GetEnvRevision(h.DB, target, n)
+		if err != nil {
+			return fiber.NewError(fiber.StatusNotFound, err.Error())
+		}
+		toVars, toLabel, toRev = rev.Variables, strconv.Itoa(n), n
+	}
+
+	fromRev := 0
+	if v := c.Query("from"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid from revision")
+		}
+		fromRev = n
+	} else if toRev > 1 {
+		fromRev = toRev - 1
+	} else if toRev == 0 {
+		h.DB.Model(&model.EnvRevision{}).Where("target = ?", target).
+			Select("COALESCE(MAX(revision), 0)").Scan(&fromRev)
+	}
+
+	fromVars := map[string]string{}
+	if fromRev > 0 {
+		rev, err := service.GetEnvRevision(h.DB, target, fromRev)
+		if err != nil {
+			return fiber.NewError(fiber.StatusNotFound, err.Error())
+		}
+		fromVars = rev.Variables
+	}
+
+	return c.JSON(fiber.Map{
+		"from":    fromRev,
+		"to":      toLabel,
+		"changes": service.DiffEnvVars(fromVars, toVars),
+	})
+}
+
+func (h *EnvRevisionHandler) loadEnvironment(c *fiber.Ctx) (*model.Environment, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "invalid environment ID")
+	}
+	var env model.Environment
+	if err := h.DB.First(&env, uint(id)).Error; err != nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, "environment not found")
+	}
+	return &env, nil
+}
+
+func (h *EnvRevisionHandler) loadApplication(c *fiber.Ctx) (*model.Application, model.EnvScope, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return nil, "", fiber.NewError(fiber.StatusBadRequest, "invalid application ID")
+	}
+	scope, err := applicationEnvScope(c.Query("scope"))
+	if err != nil {
+		return nil, "", err
+	}
+	var app model.Application
+	if err := h.DB.First(&app, uint(id)).Error; err != nil {
+		return nil, "", fiber.NewError(fiber.StatusNotFound, "Application not found")
+	}
+	return &app, scope, nil
+}
+
+func (h *EnvRevisionHandler) loadRevision(c *fiber.Ctx, target string) (*model.EnvRevision, error) {
+	n, err := strconv.Atoi(c.Params("rev"))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "invalid revision")
+	}
+	rev, err := service.GetEnvRevision(h.DB, target, n)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	return rev, nil
+}
+
+// applicationEnvScope validates the scope of an application's EnvVars,
+// defaulting to production.
+func applicationEnvScope(s string) (model.EnvScope, error) {
+	switch model.EnvScope(s) {
+	case "", model.EnvScopeProduction:
+		return model.EnvScopeProduction, nil
+	case model.EnvScopePreview:
+		return model.EnvScopePreview, nil
+	}
+	return "", fiber.NewError(fiber.StatusBadRequest, "scope must be production or preview")
+}
+
+// recordEnvironmentRevision records a revision for env after its variables
+// changed from previous. tx is the transaction that saved the change, so a
+// change is never stored without its revision.
+func recordEnvironmentRevision(tx *gorm.DB, c *fiber.Ctx, env *model.Environment, previous map[string]string, message string, rolledBackFrom *int) error {
+	_, err := service.RecordEnvRevision(tx, model.EnvRevision{
+		Target:         model.EnvironmentRevisionTarget(env.ID),
+		EnvironmentID:  &env.ID,
+		Scope:          env.Scope,
+		Message:        message,
+		RolledBackFrom: rolledBackFrom,
+		AuthorID:       currentUserID(c),
+	}, previous, env.Variables)
+	if err != nil {
+		log.Printf("Failed to record revision for environment %d: %v", env.ID, err)
+	}
+	return err
+}
+
+// recordApplicationRevisions records a revision for each scope of the app's
+// EnvVars that differs from previous.
+func recordApplicationRevisions(tx *gorm.DB, c *fiber.Ctx, app *model.Application, previous model.ScopedEnvs, message string) error {
+	for _, scope := range []model.EnvScope{model.EnvScopeProduction, model.EnvScopePreview} {
+		if err := recordApplicationRevision(tx, c, app, scope, previous.ForScope(scope), message, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordApplicationRevision records a revision for one scope of the app's
+// EnvVars, in the transaction that saved the change.
+func recordApplicationRevision(tx *gorm.DB, c *fiber.Ctx, app *model.Application, scope model.EnvScope, previous map[string]string, message string, rolledBackFrom *int) error {
+	_, err := service.RecordEnvRevision(tx, model.EnvRevision{
+		Target:         model.ApplicationRevisionTarget(app.ID, scope),
+		ApplicationID:  &app.ID,
+		Scope:          scope,
+		Message:        message,
+		RolledBackFrom: rolledBackFrom,
+		AuthorID:       currentUserID(c),
+	}, previous, app.EnvVars.ForScope(scope))
+	if err != nil {
+		log.Printf("Failed to record %s env revision for application %d: %v", scope, app.ID, err)
+	}
+	return err
+}
+
+func copyVars(vars map[string]string) model.EnvVarMap {
+	out := make(model.EnvVarMap, len(vars))
+	for k, v := range vars {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,347 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/enochcodes/orchestra/core/internal/envfile"
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Env transfer modes control how incoming variables are applied to a target.
+const (
+	envModeMerge   = "merge"   // add new keys and overwrite changed ones
+	envModeMissing = "missing" // only add keys the target does not have
+	envModeSync    = "sync"    // make the target identical, removing extra keys
+)
+
+// EnvTransferHandler imports, exports and copies variable sets between
+// Environments and Application env scopes, across clusters if needed.
+type EnvTransferHandler struct {
+	DB *gorm.DB
+}
+
+// NewEnvTransferHandler creates a new EnvTransferHandler.
+func NewEnvTransferHandler(db *gorm.DB) *EnvTransferHandler {
+	return &EnvTransferHandler{DB: db}
+}
+
+// EnvScopeRef identifies a variable set: an Environment, or one scope of an
+// Application's EnvVars.
+type EnvScopeRef struct {
+	EnvironmentID uint   `json:"environment_id,omitempty"`
+	ApplicationID uint   `json:"application_id,omitempty"`
+	Scope         string `json:"scope,omitempty"` // application scope: production (default) or preview
+}
+
+// envTarget is a loaded variable set that can be written back.
+type envTarget struct {
+	Label     string
+	ClusterID uint
+	Vars      map[string]string
+	env       *model.Environment
+	app       *model.Application
+	scope     model.EnvScope
+}
+
+// ImportEnvironment handles POST /api/v1/environments/:id/import?mode=&dry_run=
+func (h *EnvTransferHandler) ImportEnvironment(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid environment ID")
+	}
+	return h.importInto(c, EnvScopeRef{EnvironmentID: uint(id)})
+}
+
+// ExportEnvironment handles GET /api/v1/environments/:id/export?format=dotenv|json|yaml
+func (h *EnvTransferHandler) ExportEnvironment(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid environment ID")
+	}
+	return h.export(c, EnvScopeRef{EnvironmentID: uint(id)})
+}
+
+// ImportApplication handles POST /api/v1/applications/:id/env/import?scope=&mode=&dry_run=
+func (h *EnvTransferHandler) ImportApplication(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid application ID")
+	}
+	return h.importInto(c, EnvScopeRef{ApplicationID: uint(id), Scope: c.Query("scope")})
+}
+
+// ExportApplication handles GET /api/v1/applications/:id/env/export?scope=&format=
+func (h *EnvTransferHandler) ExportApplication(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid application ID")
+	}
+	return h.export(c, EnvScopeRef{ApplicationID: uint(id), Scope: c.Query("scope")})
+}
+
+// CopyRequest is the body of POST /api/v1/env/copy.
+type CopyRequest struct {
+	Source EnvScopeRef `json:"source"`
+	Target EnvScopeRef `json:"target"`
+	Mode   string      `json:"mode"`    // merge (default), missing or sync
+	Keys   []string    `json:"keys"`    // optional subset of source keys to copy
+	DryRun bool        `json:"dry_run"` // return the diff without applying it
+}
+
+// Copy handles POST /api/v1/env/copy. It copies or syncs variables from one
+// scope to another, possibly in a different cluster. Secret references are
+// copied as references; any that do not exist in the target cluster are
+// reported and block the copy.
+func (h *EnvTransferHandler) Copy(c *fiber.Ctx) error {
+	var req CopyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	source, err := h.load(req.Source)
+	if err != nil {
+		return err
+	}
+	target, err := h.load(req.Target)
+	if err != nil {
+		return err
+	}
+	if source.Label == target.Label {
+		return fiber.NewError(fiber.StatusBadRequest, "source and target are the same")
+	}
+
+	incoming := source.Vars
+	if len(req.Keys) > 0 {
+		incoming = map[string]string{}
+		for _, k := range req.Keys {
+			v, ok := source.Vars[k]
+			if !ok {
+				return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("key %s not found in %s", k, source.Label))
+			}
+			incoming[k] = v
+		}
+	}
+
+	return h.apply(c, target, incoming, req.Mode, req.DryRun, model.ActivityTypeEnvCopied, fmt.Sprintf("Copied from %s", source.Label))
+}
+
+func (h *EnvTransferHandler) importInto(c *fiber.Ctx, ref EnvScopeRef) error {
+	target, err := h.load(ref)
+	if err != nil {
+		return err
+	}
+	incoming, err := readDotenvUpload(c)
+	if err != nil {
+		return err
+	}
+
+	dryRun := c.QueryBool("dry_run", false)
+	return h.apply(c, target, incoming, c.Query("mode"), dryRun, model.ActivityTypeEnvImported, "Imported from dotenv file")
+}
+
+// readDotenvUpload parses the dotenv file sent as the request body or as
+// the multipart field "file".
+func readDotenvUpload(c *fiber.Ctx) (map[string]string, error) {
+	data := c.Body()
+	if fh, err := c.FormFile("file"); err == nil {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "failed to read uploaded file")
+		}
+		defer f.Close()
+		if data, err = io.ReadAll(f); err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "failed to read uploaded file")
+		}
+	}
+	if len(data) == 0 {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "request body must contain a dotenv file")
+	}
+
+	vars, err := envfile.ParseDotenv(data)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("invalid dotenv file: %v", err))
+	}
+	return vars, nil
+}
+
+func (h *EnvTransferHandler) export(c *fiber.Ctx, ref EnvScopeRef) error {
+	target, err := h.load(ref)
+	if err != nil {
+		return err
+	}
+	return sendEnvExport(c, target.Label, target.Vars)
+}
+
+// sendEnvExport writes vars in the format the request asks for.
+func sendEnvExport(c *fiber.Ctx, label string, vars map[string]string) error {
+	format := envfile.Format(c.Query("format", string(envfile.FormatDotenv)))
+	out, err := envfile.Marshal(vars, format)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	c.Set(fiber.HeaderContentType, envfile.ContentType(format))
+	if c.QueryBool("download", false) {
+		c.Attachment(exportFilename(label, format))
+	}
+	return c.Send(out)
+}
+
+// apply merges incoming into target according to mode and, unless dryRun,
+// saves the result and records a revision.
+func (h *EnvTransferHandler) apply(c *fiber.Ctx, target *envTarget, incoming map[string]string, mode string, dryRun bool, activity model.ActivityType, message string) error {
+	if mode == "" {
+		mode = envModeMerge
+	}
+	if err := validateEnvKeys(incoming); err != nil {
+		return err
+	}
+
+	next := map[string]string{}
+	switch mode {
+	case envModeMerge, envModeMissing:
+		for k, v := range target.Vars {
+			next[k] = v
+		}
+		for k, v := range incoming {
+			if _, exists := next[k]; exists && mode == envModeMissing {
+				continue
+			}
+			next[k] = v
+		}
+	case envModeSync:
+		for k, v := range incoming {
+			next[k] = v
+		}
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, "mode must be merge, missing or sync")
+	}
+
+	changes := service.DiffEnvVars(target.Vars, next)
+	missingSecrets := h.missingSecrets(target.ClusterID, next)
+
+	result := fiber.Map{
+		"target":          target.Label,
+		"mode":            mode,
+		"dry_run":         dryRun,
+		"changes":         changes,
+		"missing_secrets": missingSecrets,
+	}
+	if dryRun || len(changes) == 0 {
+		result["applied"] = false
+		return c.JSON(result)
+	}
+	if len(missingSecrets) > 0 {
+		return fiber.NewError(fiber.StatusBadRequest,
+			fmt.Sprintf("secrets missing in target cluster: %s", strings.Join(missingSecrets, ", ")))
+	}
+
+	if err := h.save(c, target, next, activity, message); err != nil {
+		return err
+	}
+	result["applied"] = true
+	return c.JSON(result)
+}
+
+func (h *EnvTransferHandler) save(c *fiber.Ctx, target *envTarget, vars map[string]string, activity model.ActivityType, message string) error {
+	if target.env != nil {
+		previous := target.env.Variables
+		target.env.Variables = copyVars(vars)
+		target.env.MarkChanged()
+		err := h.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Save(target.env).Error; err != nil {
+				return err
+			}
+			return recordEnvironmentRevision(tx, c, target.env, previous, message, nil)
+		})
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to save environment")
+		}
+		_ = service.LogActivity(h.DB, activity,
+			fmt.Sprintf("%s: %s", target.Label, message), "environment", target.env.ID, currentUserID(c), nil)
+		return nil
+	}
+
+	previous := target.app.EnvVars.ForScope(target.scope)
+	target.app.EnvVars.SetScope(target.scope, copyVars(vars))
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(target.app).Error; err != nil {
+			return err
+		}
+		return recordApplicationRevision(tx, c, target.app, target.scope, previous, message, nil)
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to save application")
+	}
+	_ = service.LogActivity(h.DB, activity,
+		fmt.Sprintf("%s: %s", target.Label, message), "application", target.app.ID, currentUserID(c), nil)
+	return nil
+}
+
+func (h *EnvTransferHandler) load(ref EnvScopeRef) (*envTarget, error) {
+	switch {
+	case ref.EnvironmentID != 0 && ref.ApplicationID != 0:
+		return nil, fiber.NewError(fiber.StatusBadRequest, "specify either environment_id or application_id, not both")
+	case ref.EnvironmentID != 0:
+		var env model.Environment
+		if err := h.DB.First(&env, ref.EnvironmentID).Error; err != nil {
+			return nil, fiber.NewError(fiber.StatusNotFound, "environment not found")
+		}
+		return &envTarget{
+			Label:     fmt.Sprintf("environment '%s'", env.Name),
+			ClusterID: env.ClusterID,
+			Vars:      env.Variables,
+			env:       &env,
+		}, nil
+	case ref.ApplicationID != 0:
+		scope, err := applicationEnvScope(ref.Scope)
+		if err != nil {
+			return nil, err
+		}
+		var app model.Application
+		if err := h.DB.First(&app, ref.ApplicationID).Error; err != nil {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Application not found")
+		}
+		return &envTarget{
+			Label:     fmt.Sprintf("application '%s' (%s)", app.Name, scope),
+			ClusterID: app.ClusterID,
+			Vars:      app.EnvVars.ForScope(scope),
+			app:       &app,
+			scope:     scope,
+		}, nil
+	}
+	return nil, fiber.NewError(fiber.StatusBadRequest, "environment_id or application_id is required")
+}
+
+// missingSecrets returns the secret references in vars that do not exist in the cluster.
+func (h *EnvTransferHandler) missingSecrets(clusterID uint, vars map[string]string) []string {
+	missing := []string{}
+	names := model.SecretRefs(vars)
+	if len(names) == 0 {
+		return missing
+	}
+	var found []string
+	h.DB.Model(&model.Secret{}).Where("cluster_id = ? AND name IN ?", clusterID, names).Pluck("name", &found)
+	for _, n := range names {
+		if !containsString(found, n) {
+			missing = append(missing, n)
+		}
+	}
+	return missing
+}
+
+func exportFilename(label string, format envfile.Format) string {
+	name := strings.NewReplacer("'", "", " ", "-", "(", "", ")", "").Replace(label)
+	switch format {
+	case envfile.FormatJSON:
+		return name + ".json"
+	case envfile.FormatYAML:
+		return name + ".yaml"
+	}
+	return name + ".env"
+}
@@ -61,6 +61,12 @@ func (h *EnvironmentHandler) Create(c *fiber.Ctx) error {
 	if req.ClusterID == 0 || req.Name == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "cluster_id and name are required")
 	}
+	if err := validateEnvKeys(req.Variables); err != nil {
+		return err
+	}
+	if err := validateSecretRefs(h.DB, req.ClusterID, req.Variables); err != nil {
+		return err
+	}
 	scope := model.EnvScope(req.Scope)
 	if scope == "" {
 		scope = model.EnvScopeProduction
@@ -72,7 +78,13 @@ func (h *EnvironmentHandler) Create(c *fiber.Ctx) error {
 		Name:      req.Name,
 		Variables: req.Variables,
 	}
-	if err := h.DB.Create(&env).Error; err != nil {
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&env).Error; err != nil {
+			return err
+		}
+		return recordEnvironmentRevision(tx, c, &env, nil, "Environment created", nil)
+	})
+	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to create environment")
 	}
 
@@ -102,6 +114,7 @@ func (h *EnvironmentHandler) Update(c *fiber.Ctx) error {
 	var req struct {
 		Name      *string           `json:"name"`
 		Variables *model.EnvVarMap `json:"variables"`
+		Message   string            `json:"message"` // optional note recorded on the revision
 	}
 	if err := c.BodyParser(&req); err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid request")
@@ -109,32 +122,124 @@ func (h *EnvironmentHandler) Update(c *fiber.Ctx) error {
 	if req.Name != nil {
 		env.Name = *req.Name
 	}
+	previous := env.Variables
 	if req.Variables != nil {
+		if err := validateEnvKeys(*req.Variables); err != nil {
+			return err
+		}
+		if err := validateSecretRefs(h.DB, env.ClusterID, *req.Variables); err != nil {
+			return err
+		}
 		env.Variables = *req.Variables
-		env.Synced = false
+		env.MarkChanged()
 	}
-	if err := h.DB.Save(&env).Error; err != nil {
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&env).Error; err != nil {
+			return err
+		}
+		if req.Variables == nil {
+			return nil
+		}
+		return recordEnvironmentRevision(tx, c, &env, previous, req.Message, nil)
+	})
+	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to update")
 	}
 	return c.JSON(env)
 }
 
-// Push pushes environment variables to all servers in the cluster
+// Push pushes environment variables to all servers in the cluster.
+// Body: {"restart_apps": true} to restart the applications consuming the
+// environment once every server has the new file.
 func (h *EnvironmentHandler) Push(c *fiber.Ctx) error {
 	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
 	if err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
 	}
+	req, err := parsePushOptions(c)
+	if err != nil {
+		return err
+	}
+
+	task, err := tasks.NewPushEnvTask(uint(id), req.RestartApps)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to create push task")
+	}
+	if _, err := h.AsynqClient.Enqueue(task); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to enqueue push task")
+	}
+
+	return c.JSON(fiber.Map{"message": "environment push queued", "restart_apps": req.RestartApps})
+}
+
+// PushResults returns the latest push outcome for each server in the cluster
+func (h *EnvironmentHandler) PushResults(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	var env model.Environment
+	if err := h.DB.First(&env, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "environment not found")
+	}
+	var results []model.EnvPushResult
+	if err := h.DB.Preload("Server").Where("environment_id = ?", env.ID).
+		Order("server_id").Find(&results).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to fetch push results")
+	}
+	return c.JSON(fiber.Map{
+		"sync_status":    env.SyncStatus,
+		"checksum":       env.Checksum,
+		"last_pushed_at": env.LastPushedAt,
+		"results":        results,
+		"count":          len(results),
+	})
+}
+
+// Retry re-pushes the environment to the servers whose last push failed
+func (h *EnvironmentHandler) Retry(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	req, err := parsePushOptions(c)
+	if err != nil {
+		return err
+	}
+	var failed []uint
+	if err := h.DB.Model(&model.EnvPushResult{}).
+		Where("environment_id = ? AND status = ?", uint(id), model.EnvPushFailed).
+		Pluck("server_id", &failed).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to fetch push results")
+	}
+	if len(failed) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "no failed servers to retry")
+	}
 
-	task, err := tasks.NewPushEnvTask(uint(id))
+	task, err := tasks.NewPushEnvTask(uint(id), req.RestartApps, failed...)
 	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to create push task")
 	}
 	if _, err := h.AsynqClient.Enqueue(task); err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to enqueue push task")
 	}
+	return c.JSON(fiber.Map{"message": "environment push retry queued", "server_ids": failed})
+}
 
-	return c.JSON(fiber.Map{"message": "environment push queued"})
+// Verify checks that the env file on each server still matches the last push
+func (h *EnvironmentHandler) Verify(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	task, err := tasks.NewVerifyEnvTask(uint(id))
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to create verify task")
+	}
+	if _, err := h.AsynqClient.Enqueue(task); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to enqueue verify task")
+	}
+	return c.JSON(fiber.Map{"message": "environment verification queued"})
 }
 
 // Delete removes an environment
@@ -143,8 +248,29 @@ func (h *EnvironmentHandler) Delete(c *fiber.Ctx) error {
 	if err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
 	}
+	var consumers int64
+	h.DB.Model(&model.Application{}).Where("environment_id = ?", uint(id)).Count(&consumers)
+	if consumers > 0 {
+		return fiber.NewError(fiber.StatusConflict,
+			fmt.Sprintf("environment is used by %d application(s); detach them first", consumers))
+	}
 	if err := h.DB.Delete(&model.Environment{}, uint(id)).Error; err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to delete")
 	}
 	return c.JSON(fiber.Map{"message": "deleted"})
 }
+
+// pushOptions is the optional body of the push and retry endpoints.
+type pushOptions struct {
+	RestartApps bool `json:"restart_apps"`
+}
+
+func parsePushOptions(c *fiber.Ctx) (pushOptions, error) {
+	var req pushOptions
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return req, fiber.NewError(fiber.StatusBadRequest, "invalid request")
+		}
+	}
+	return req, nil
+}
@@ -0,0 +1,295 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	tasks "github.com/enochcodes/orchestra/core/internal/engine"
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/internal/service"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Limits of exec sessions.
+const (
+	execDefaultCols   = 80
+	execDefaultRows   = 24
+	execMaxTranscript = 1 << 20          // bytes of output kept per session
+	execIdleTimeout   = 30 * time.Minute // a session with no input for this long is closed
+)
+
+// ExecHandler opens interactive terminals into application instances and
+// onto servers over WebSocket, and lists the sessions recorded.
+type ExecHandler struct {
+	DB                *gorm.DB
+	EncryptionKey     string
+	RecordTranscripts bool
+}
+
+// NewExecHandler creates a new ExecHandler.
+func NewExecHandler(db *gorm.DB, encryptionKey string, recordTranscripts bool) *ExecHandler {
+	return &ExecHandler{DB: db, EncryptionKey: encryptionKey, RecordTranscripts: recordTranscripts}
+}
+
+// execMessage is a control message sent as a WebSocket text frame. The
+// client sends "input" and "resize"; the server sends "error" and "exit".
+type execMessage struct {
+	Type     string `json:"type"`
+	Data     string `json:"data,omitempty"`
+	Cols     int    `json:"cols,omitempty"`
+	Rows     int    `json:"rows,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// PrepareApp checks a request to GET /api/v1/applications/:id/exec before
+// it is upgraded to a WebSocket: only members with the manager role or
+// above may open a shell in an application.
+func (h *ExecHandler) PrepareApp(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	if err := authorizeApp(c, h.DB, uint(id), model.ApplicationRoleManager); err != nil {
+		return err
+	}
+	var app model.Application
+	if err := h.DB.Preload("Cluster").Preload("Cluster.ManagerServer").First(&app, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Application not found")
+	}
+	c.Locals("exec_app", &app)
+	return c.Next()
+}
+
+// PrepareServer checks a request to GET /api/v1/servers/:id/exec before it
+// is upgraded to a WebSocket: only members with the devops role or above
+// may open a shell on a server.
+func (h *ExecHandler) PrepareServer(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	if err := authorizeServer(c, h.DB, uint(id), model.ServerRoleTypeDevOps); err != nil {
+		return err
+	}
+	var server model.Server
+	if err := h.DB.First(&server, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Server not found")
+	}
+	c.Locals("exec_server", &server)
+	return c.Next()
+}
+
+// App runs a shell inside an instance of the application, the one named by
+// ?instance= or else the first running one. See serve for the protocol.
+func (h *ExecHandler) App(conn *websocket.Conn) {
+	app := conn.Locals("exec_app").(*model.Application)
+	cols, rows := terminalSize(conn)
+	term, err := tasks.OpenAppTerminal(h.DB, h.EncryptionKey, app, conn.Query("instance"), cols, rows)
+	if err != nil {
+		closeWithError(conn, err)
+		return
+	}
+	session := &model.ExecSession{
+		Target:        model.ExecTargetApplication,
+		ApplicationID: &app.ID,
+		ServerID:      term.Server.ID,
+		Instance:      term.Instance,
+	}
+	h.serve(conn, term, session, "application", app.ID,
+		fmt.Sprintf("Shell opened in %s of application %s", term.Instance, app.Name))
+}
+
+// Server runs a login shell on the server. See serve for the protocol.
+func (h *ExecHandler) Server(conn *websocket.Conn) {
+	server := conn.Locals("exec_server").(*model.Server)
+	cols, rows := terminalSize(conn)
+	term, err := tasks.OpenServerTerminal(h.EncryptionKey, *server, cols, rows)
+	if err != nil {
+		closeWithError(conn, err)
+		return
+	}
+	session := &model.ExecSession{Target: model.ExecTargetServer, ServerID: server.ID}
+	h.serve(conn, term, session, "server", server.ID,
+		fmt.Sprintf("Shell opened on server %s", serverName(server)))
+}
+
+// serve connects term to the WebSocket until either side ends, recording
+// the session. Binary frames carry terminal output to the client and
+// keystrokes from it; text frames carry execMessages. When the shell exits
+// the server sends an "exit" message and closes the socket.
+func (h *ExecHandler) serve(conn *websocket.Conn, term *tasks.Terminal, session *model.ExecSession, entity string, entityID uint, opened string) {
+	defer term.Close()
+
+	userID, _ := conn.Locals("user_id").(uint)
+	session.UserID = userID
+	session.RemoteAddr = conn.IP()
+	session.StartedAt = time.Now()
+	if err := h.DB.Create(session).Error; err != nil {
+		closeWithError(conn, fmt.Errorf("recording session: %w", err))
+		return
+	}
+	service.LogActivity(h.DB, model.ActivityTypeExecStarted, opened, entity, entityID, &userID,
+		map[string]interface{}{"exec_session_id": session.ID})
+
+	var mu sync.Mutex
+	var transcript []byte
+	truncated := false
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := term.Read(buf)
+			if n > 0 {
+				if h.RecordTranscripts {
+					mu.Lock()
+					if room := execMaxTranscript - len(transcript); room > 0 {
+						transcript = append(transcript, buf[:min(n, room)]...)
+					}
+					truncated = truncated || len(transcript) >= execMaxTranscript
+					mu.Unlock()
+				}
+				if conn.WriteMessage(websocket.BinaryMessage, buf[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Keystrokes are read here; the loop ends when the client leaves or the
+	// shell exits and the socket is closed below.
+	go func() {
+		for {
+			conn.SetReadDeadline(time.Now().Add(execIdleTimeout))
+			kind, data, err := conn.ReadMessage()
+			if err != nil {
+				term.Close()
+				return
+			}
+			if kind == websocket.BinaryMessage {
+				term.Write(data)
+				continue
+			}
+			var msg execMessage
+			if json.Unmarshal(data, &msg) != nil {
+				continue
+			}
+			switch msg.Type {
+			case "input":
+				term.Write([]byte(msg.Data))
+			case "resize":
+				if msg.Cols > 0 && msg.Rows > 0 {
+					term.Resize(msg.Cols, msg.Rows)
+				}
+			}
+		}
+	}()
+
+	<-done
+	code, _ := term.Wait()
+	conn.WriteJSON(execMessage{Type: "exit", ExitCode: &code})
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
+
+	now := time.Now()
+	updates := map[string]interface{}{"ended_at": &now, "exit_code": code}
+	if h.RecordTranscripts {
+		mu.Lock()
+		updates["transcript"] = redact.String(string(transcript))
+		updates["transcript_truncated"] = truncated
+		mu.Unlock()
+	}
+	h.DB.Model(session).Updates(updates)
+	service.LogActivity(h.DB, model.ActivityTypeExecEnded,
+		fmt.Sprintf("Shell closed after %s (exit code %d)", now.Sub(session.StartedAt).Round(time.Second), code),
+		entity, entityID, &userID, map[string]interface{}{"exec_session_id": session.ID})
+}
+
+// ListSessions handles GET /api/v1/exec-sessions. It lists recent exec
+// sessions without their transcripts, newest first, optionally filtered by
+// ?application_id=, ?server_id= or ?user_id=.
+func (h *ExecHandler) ListSessions(c *fiber.Ctx) error {
+	limit := 50
+	if l := c.Query("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 100 {
+			limit = n
+		}
+	}
+	q := h.DB.Model(&model.ExecSession{}).Omit("transcript").Preload("User")
+	for _, f := range []string{"application_id", "server_id", "user_id"} {
+		if v := c.Query(f); v != "" {
+			id, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("invalid %s", f))
+			}
+			q = q.Where(f+" = ?", uint(id))
+		}
+	}
+	var sessions []model.ExecSession
+	if err := q.Order("started_at DESC").Limit(limit).Find(&sessions).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to fetch exec sessions")
+	}
+	return c.JSON(fiber.Map{"sessions": sessions, "count": len(sessions)})
+}
+
+// GetSession handles GET /api/v1/exec-sessions/:id, transcript included.
+func (h *ExecHandler) GetSession(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid ID")
+	}
+	var session model.ExecSession
+	if err := h.DB.Preload("User").First(&session, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Exec session not found")
+	}
+	return c.JSON(session)
+}
+
+// terminalSize reads the initial ?cols= and ?rows= of a terminal.
+func terminalSize(conn *websocket.Conn) (cols, rows int) {
+	cols, rows = execDefaultCols, execDefaultRows
+	if n, err := strconv.Atoi(conn.Query("cols")); err == nil && n > 0 {
+		cols = n
+	}
+	if n, err := strconv.Atoi(conn.Query("rows")); err == nil && n > 0 {
+		rows = n
+	}
+	return cols, rows
+}
+
+// closeWithError tells the client why no terminal was opened and closes
+// the socket.
+func closeWithError(conn *websocket.Conn, err error) {
+	msg := redact.Error(err).Error()
+	if errors.Is(err, tasks.ErrUnknownInstance) {
+		msg = "no running instance of that name"
+	}
+	conn.WriteJSON(execMessage{Type: "error", Message: msg})
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""))
+	conn.Close()
+}
+
+// serverName names a server in activity messages.
+func serverName(s *model.Server) string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	return s.IP
+}
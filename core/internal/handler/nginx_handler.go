@@ -49,6 +49,9 @@ func (h *NginxHandler) Create(c *fiber.Ctx) error {
 	if req.ServerID == 0 || req.Domain == "" || req.UpstreamPort == 0 {
 		return fiber.NewError(fiber.StatusBadRequest, "server_id, domain, and upstream_port required")
 	}
+	if err := validateDomain(req.Domain); err != nil {
+		return err
+	}
 
 	cfg := model.NginxConfig{
 		ServerID:      req.ServerID,
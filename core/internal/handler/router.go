@@ -4,6 +4,9 @@ import (
 	"time"
 
 	"github.com/enochcodes/orchestra/core/internal/service"
+	"github.com/enochcodes/orchestra/core/pkg/objstore"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
+	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -13,7 +16,7 @@ import (
 )
 
 // SetupRouter configures the Fiber app with middleware and routes.
-func SetupRouter(db *gorm.DB, asynqClient *asynq.Client, encryptionKey, jwtSecret string, skipAuth bool) *fiber.App {
+func SetupRouter(db *gorm.DB, asynqClient *asynq.Client, logStore objstore.Store, encryptionKey, jwtSecret string, skipAuth, recordExecTranscripts bool) *fiber.App {
 	app := fiber.New(fiber.Config{
 		AppName:      "Orchestra API",
 		ErrorHandler: customErrorHandler,
@@ -56,6 +59,12 @@ func SetupRouter(db *gorm.DB, asynqClient *asynq.Client, encryptionKey, jwtSecre
 	admin.Get("/users/:id", userHandler.Get)
 	admin.Patch("/users/:id", userHandler.Update)
 
+	// Exec sessions: terminals are opened from the server and application
+	// routes; the audit of them is admin-only.
+	execHandler := NewExecHandler(db, encryptionKey, recordExecTranscripts)
+	admin.Get("/exec-sessions", execHandler.ListSessions)
+	admin.Get("/exec-sessions/:id", execHandler.GetSession)
+
 	// Server routes
 	serverHandler := NewServerHandler(db, asynqClient, encryptionKey)
 	servers := auth.Group("/servers")
@@ -66,6 +75,7 @@ func SetupRouter(db *gorm.DB, asynqClient *asynq.Client, encryptionKey, jwtSecre
 	servers.Post("/teams", serverHandler.CreateTeam)
 	servers.Get("/:id", serverHandler.Get)
 	servers.Get("/:id/logs", serverHandler.GetLogs)
+	servers.Get("/:id/exec", execHandler.PrepareServer, websocket.New(execHandler.Server))
 	servers.Patch("/:id", serverHandler.Update)
 	servers.Delete("/:id", serverHandler.Delete)
 
@@ -76,6 +86,7 @@ func SetupRouter(db *gorm.DB, asynqClient *asynq.Client, encryptionKey, jwtSecre
 	clusters.Post("/design", clusterHandler.Design)
 	clusters.Get("/", clusterHandler.List)
 	clusters.Get("/:id", clusterHandler.Get)
+	clusters.Get("/:id/capacity", clusterHandler.Capacity)
 
 	// Metadata routes
 	metadata := auth.Group("/metadata")
@@ -83,21 +94,55 @@ func SetupRouter(db *gorm.DB, asynqClient *asynq.Client, encryptionKey, jwtSecre
 	metadata.Get("/stacks", GetStacks)
 
 	// Application routes
-	appHandler := NewApplicationHandler(db, asynqClient)
+	appHandler := NewApplicationHandler(db, asynqClient, encryptionKey)
 	applications := auth.Group("/applications")
 	applications.Get("/", appHandler.List)
 	applications.Post("/", appHandler.Create)
 	applications.Get("/:id", appHandler.Get)
+	applications.Get("/:id/instances", appHandler.Instances)
+	applications.Get("/:id/logs", appHandler.DownloadLogs)
+	applications.Get("/:id/logs/stream", appHandler.StreamLogs)
+	applications.Get("/:id/exec", execHandler.PrepareApp, websocket.New(execHandler.App))
+	applications.Post("/:id/commands", appHandler.RunCommand)
+	applications.Get("/:id/commands", appHandler.ListCommands)
+	applications.Get("/:id/commands/:runId", appHandler.GetCommand)
+	applications.Get("/:id/volumes", appHandler.ListVolumes)
+	applications.Post("/:id/volumes", appHandler.CreateVolume)
+	applications.Delete("/:id/volumes/:volumeId", appHandler.DeleteVolume)
 	applications.Patch("/:id", appHandler.Update)
 	applications.Delete("/:id", appHandler.Delete)
 	applications.Post("/:id/redeploy", appHandler.Redeploy)
+	applications.Post("/:id/stop", appHandler.Stop)
+	applications.Post("/:id/start", appHandler.Start)
+	applications.Post("/:id/restart", appHandler.Restart)
+	applications.Post("/:id/scale", appHandler.Scale)
+
+	// Application env revision routes
+	revHandler := NewEnvRevisionHandler(db, asynqClient)
+	applications.Get("/:id/env/revisions", revHandler.ListForApplication)
+	applications.Get("/:id/env/revisions/diff", revHandler.DiffForApplication)
+	applications.Get("/:id/env/revisions/:rev", revHandler.GetForApplication)
+	applications.Post("/:id/env/revisions/:rev/rollback", revHandler.RollbackApplication)
+
+	// Env import/export and copy routes
+	transferHandler := NewEnvTransferHandler(db)
+	applications.Post("/:id/env/import", transferHandler.ImportApplication)
+	applications.Get("/:id/env/export", transferHandler.ExportApplication)
+	auth.Post("/env/copy", transferHandler.Copy)
 
 	// Deployment routes
-	depHandler := NewDeploymentHandler(db)
+	depHandler := NewDeploymentHandler(db, asynqClient, logStore)
 	deployments := auth.Group("/deployments")
 	deployments.Get("/", depHandler.List)
 	deployments.Get("/:id", depHandler.Get)
 	deployments.Get("/:id/logs", depHandler.GetLogs)
+	deployments.Get("/:id/logs/stream", depHandler.StreamLogs)
+	deployments.Get("/:id/diff", depHandler.Diff)
+	deployments.Post("/:id/rollback", depHandler.Rollback)
+	deployments.Post("/:id/cancel", depHandler.Cancel)
+	deployments.Get("/:id/steps", depHandler.GetSteps)
+	applications.Get("/:id/step-timings", depHandler.StepTimings)
+	applications.Get("/:id/logs/search", depHandler.SearchLogs)
 
 	// Environment routes
 	envHandler := NewEnvironmentHandler(db, asynqClient)
@@ -108,6 +153,24 @@ func SetupRouter(db *gorm.DB, asynqClient *asynq.Client, encryptionKey, jwtSecre
 	environments.Patch("/:id", envHandler.Update)
 	environments.Delete("/:id", envHandler.Delete)
 	environments.Post("/:id/push", envHandler.Push)
+	environments.Get("/:id/push-results", envHandler.PushResults)
+	environments.Post("/:id/retry", envHandler.Retry)
+	environments.Post("/:id/verify", envHandler.Verify)
+	environments.Get("/:id/revisions", revHandler.ListForEnvironment)
+	environments.Get("/:id/revisions/diff", revHandler.DiffForEnvironment)
+	environments.Get("/:id/revisions/:rev", revHandler.GetForEnvironment)
+	environments.Post("/:id/revisions/:rev/rollback", revHandler.RollbackEnvironment)
+	environments.Post("/:id/import", transferHandler.ImportEnvironment)
+	environments.Get("/:id/export", transferHandler.ExportEnvironment)
+
+	// Secret routes (write-only values)
+	secretHandler := NewSecretHandler(db, encryptionKey)
+	secrets := auth.Group("/secrets")
+	secrets.Get("/", secretHandler.List)
+	secrets.Post("/", secretHandler.Create)
+	secrets.Get("/:id", secretHandler.Get)
+	secrets.Patch("/:id", secretHandler.Update)
+	secrets.Delete("/:id", secretHandler.Delete)
 
 	// Nginx routes
 	nginxHandler := NewNginxHandler(db, asynqClient)
@@ -140,6 +203,6 @@ func customErrorHandler(c *fiber.Ctx, err error) error {
 
 	return c.Status(code).JSON(fiber.Map{
 		"error":   true,
-		"message": err.Error(),
+		"message": redact.String(err.Error()),
 	})
 }
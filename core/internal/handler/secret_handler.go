@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	tasks "github.com/enochcodes/orchestra/core/internal/engine"
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// SecretHandler handles the write-only secrets store. Values are encrypted
+// on the way in and are never returned by any endpoint.
+type SecretHandler struct {
+	DB            *gorm.DB
+	EncryptionKey string
+}
+
+// NewSecretHandler creates a new SecretHandler.
+func NewSecretHandler(db *gorm.DB, encryptionKey string) *SecretHandler {
+	return &SecretHandler{DB: db, EncryptionKey: encryptionKey}
+}
+
+// List handles GET /api/v1/secrets, optionally filtered by cluster_id
+func (h *SecretHandler) List(c *fiber.Ctx) error {
+	var secrets []model.Secret
+	query := h.DB.Order("name")
+	if clusterID := c.Query("cluster_id"); clusterID != "" {
+		query = query.Where("cluster_id = ?", clusterID)
+	}
+	if err := query.Find(&secrets).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to fetch secrets")
+	}
+	return c.JSON(fiber.Map{"secrets": secrets, "count": len(secrets)})
+}
+
+// Get handles GET /api/v1/secrets/:id
+func (h *SecretHandler) Get(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid secret ID")
+	}
+	var secret model.Secret
+	if err := h.DB.First(&secret, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "secret not found")
+	}
+	return c.JSON(secret)
+}
+
+// Create handles POST /api/v1/secrets
+func (h *SecretHandler) Create(c *fiber.Ctx) error {
+	var req struct {
+		ClusterID   uint   `json:"cluster_id"`
+		Name        string `json:"name"`
+		Value       string `json:"value"`
+		Description string `json:"description"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if req.ClusterID == 0 || req.Name == "" || req.Value == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "cluster_id, name and value are required")
+	}
+	if !model.SecretNamePattern.MatchString(req.Name) {
+		return fiber.NewError(fiber.StatusBadRequest, "name may only contain letters, digits, '_', '.' and '-'")
+	}
+
+	var exists int64
+	h.DB.Model(&model.Secret{}).Where("cluster_id = ? AND name = ?", req.ClusterID, req.Name).Count(&exists)
+	if exists > 0 {
+		return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("secret %s already exists in this cluster", req.Name))
+	}
+
+	encrypted, err := tasks.Encrypt([]byte(req.Value), h.EncryptionKey)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to encrypt secret")
+	}
+
+	userID := currentUserID(c)
+	secret := model.Secret{
+		ClusterID:       req.ClusterID,
+		Name:            req.Name,
+		Description:     req.Description,
+		ValueEncrypted:  encrypted,
+		Version:         1,
+		CreatedByUserID: userID,
+	}
+	if err := h.DB.Create(&secret).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to create secret")
+	}
+
+	_ = service.LogActivity(h.DB, model.ActivityTypeSecretCreated,
+		fmt.Sprintf("Secret '%s' created for cluster %d", secret.Name, secret.ClusterID),
+		"secret", secret.ID, userID, nil)
+
+	return c.Status(fiber.StatusCreated).JSON(secret)
+}
+
+// Update handles PATCH /api/v1/secrets/:id. Setting value rotates the secret;
+// running applications pick it up on their next deploy.
+func (h *SecretHandler) Update(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid secret ID")
+	}
+	var secret model.Secret
+	if err := h.DB.First(&secret, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "secret not found")
+	}
+
+	var req struct {
+		Value       *string `json:"value"`
+		Description *string `json:"description"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if req.Description != nil {
+		secret.Description = *req.Description
+	}
+	if req.Value != nil {
+		if *req.Value == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "value cannot be empty")
+		}
+		encrypted, err := tasks.Encrypt([]byte(*req.Value), h.EncryptionKey)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to encrypt secret")
+		}
+		secret.ValueEncrypted = encrypted
+		secret.Version++
+	}
+	if err := h.DB.Save(&secret).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to update secret")
+	}
+
+	if req.Value != nil {
+		_ = service.LogActivity(h.DB, model.ActivityTypeSecretRotated,
+			fmt.Sprintf("Secret '%s' rotated to version %d", secret.Name, secret.Version),
+			"secret", secret.ID, currentUserID(c), nil)
+	}
+	return c.JSON(secret)
+}
+
+// Delete handles DELETE /api/v1/secrets/:id. Secrets still referenced by an
+// environment or application cannot be deleted.
+func (h *SecretHandler) Delete(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid secret ID")
+	}
+	var secret model.Secret
+	if err := h.DB.First(&secret, uint(id)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "secret not found")
+	}
+
+	if users := h.secretUsers(secret); len(users) > 0 {
+		return fiber.NewError(fiber.StatusConflict,
+			fmt.Sprintf("secret is still referenced by %s", strings.Join(users, ", ")))
+	}
+
+	// Hard delete: there is no reason to keep ciphertext around.
+	if err := h.DB.Delete(&secret).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to delete secret")
+	}
+
+	_ = service.LogActivity(h.DB, model.ActivityTypeSecretDeleted,
+		fmt.Sprintf("Secret '%s' deleted from cluster %d", secret.Name, secret.ClusterID),
+		"secret", secret.ID, currentUserID(c), nil)
+
+	return c.JSON(fiber.Map{"message": "deleted"})
+}
+
+// secretUsers lists the environments and applications in the secret's
+// cluster that reference it.
+func (h *SecretHandler) secretUsers(secret model.Secret) []string {
+	var users []string
+
+	var envs []model.Environment
+	h.DB.Where("cluster_id = ?", secret.ClusterID).Find(&envs)
+	for _, e := range envs {
+		if containsString(model.SecretRefs(e.Variables), secret.Name) {
+			users = append(users, fmt.Sprintf("environment '%s'", e.Name))
+		}
+	}
+
+	var apps []model.Application
+	h.DB.Where("cluster_id = ?", secret.ClusterID).Find(&apps)
+	for _, a := range apps {
+		if containsString(model.SecretRefs(a.EnvVars.Production), secret.Name) ||
+			containsString(model.SecretRefs(a.EnvVars.Preview), secret.Name) {
+			users = append(users, fmt.Sprintf("application '%s'", a.Name))
+		}
+	}
+	return users
+}
+
+// validateSecretRefs returns a 400 error if any of the variable maps
+// reference a secret that does not exist in the cluster.
+func validateSecretRefs(db *gorm.DB, clusterID uint, maps ...map[string]string) error {
+	merged := map[string]string{}
+	for i, m := range maps {
+		for k, v := range m {
+			merged[fmt.Sprintf("%d/%s", i, k)] = v
+		}
+	}
+	names := model.SecretRefs(merged)
+	if len(names) == 0 {
+		return nil
+	}
+
+	var found []string
+	db.Model(&model.Secret{}).Where("cluster_id = ? AND name IN ?", clusterID, names).Pluck("name", &found)
+	var missing []string
+	for _, n := range names {
+		if !containsString(found, n) {
+			missing = append(missing, n)
+		}
+	}
+	if len(missing) > 0 {
+		return fiber.NewError(fiber.StatusBadRequest,
+			fmt.Sprintf("unknown secret reference(s): %s", strings.Join(missing, ", ")))
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
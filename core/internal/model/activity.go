@@ -10,15 +10,33 @@ import (
 type ActivityType string
 
 const (
-	ActivityTypeServerRegistered   ActivityType = "server_registered"
-	ActivityTypeClusterCreated     ActivityType = "cluster_created"
-	ActivityTypeClusterProvisioned ActivityType = "cluster_provisioned"
-	ActivityTypeAppDeployed        ActivityType = "app_deployed"
-	ActivityTypeDeploymentFailed   ActivityType = "deployment_failed"
-	ActivityTypeUserLogin          ActivityType = "user_login"
-	ActivityTypeEnvPushed          ActivityType = "env_pushed"
-	ActivityTypeNginxConfigured    ActivityType = "nginx_configured"
-	ActivityTypeAppRedeployed      ActivityType = "app_redeployed"
+	ActivityTypeServerRegistered    ActivityType = "server_registered"
+	ActivityTypeClusterCreated      ActivityType = "cluster_created"
+	ActivityTypeClusterProvisioned  ActivityType = "cluster_provisioned"
+	ActivityTypeAppDeployed         ActivityType = "app_deployed"
+	ActivityTypeDeploymentFailed    ActivityType = "deployment_failed"
+	ActivityTypeUserLogin           ActivityType = "user_login"
+	ActivityTypeEnvPushed           ActivityType = "env_pushed"
+	ActivityTypeNginxConfigured     ActivityType = "nginx_configured"
+	ActivityTypeAppRedeployed       ActivityType = "app_redeployed"
+	ActivityTypeSecretCreated       ActivityType = "secret_created"
+	ActivityTypeSecretRotated       ActivityType = "secret_rotated"
+	ActivityTypeSecretDeleted       ActivityType = "secret_deleted"
+	ActivityTypeEnvRolledBack       ActivityType = "env_rolled_back"
+	ActivityTypeEnvImported         ActivityType = "env_imported"
+	ActivityTypeEnvCopied           ActivityType = "env_copied"
+	ActivityTypeAppRestarted        ActivityType = "app_restarted"
+	ActivityTypeAppRolledBack       ActivityType = "app_rolled_back"
+	ActivityTypeDeploymentCancelled ActivityType = "deployment_cancelled"
+	ActivityTypeAppDeleted          ActivityType = "app_deleted"
+	ActivityTypeAppStopped          ActivityType = "app_stopped"
+	ActivityTypeAppStarted          ActivityType = "app_started"
+	ActivityTypeAppScaled           ActivityType = "app_scaled"
+	ActivityTypeExecStarted         ActivityType = "exec_started"
+	ActivityTypeExecEnded           ActivityType = "exec_ended"
+	ActivityTypeCommandRun          ActivityType = "command_run"
+	ActivityTypeVolumeCreated       ActivityType = "volume_created"
+	ActivityTypeVolumeDeleted       ActivityType = "volume_deleted"
 )
 
 // Activity represents an audit/activity log entry.
@@ -0,0 +1,37 @@
+package model
+
+import "time"
+
+// AppCommandStatus is the state of a one-off command run.
+type AppCommandStatus string
+
+const (
+	AppCommandQueued    AppCommandStatus = "queued"
+	AppCommandRunning   AppCommandStatus = "running"
+	AppCommandSucceeded AppCommandStatus = "succeeded" // exited 0
+	AppCommandFailed    AppCommandStatus = "failed"    // exited non-zero, timed out or could not be started
+)
+
+// AppCommandRun is a one-off command, such as a database seed or creating an
+// admin user, run once in an application's live image with its environment.
+type AppCommandRun struct {
+	ID             uint             `gorm:"primaryKey" json:"id"`
+	ApplicationID  uint             `gorm:"not null;index" json:"application_id"`
+	UserID         *uint            `json:"user_id,omitempty"`
+	Command        string           `gorm:"type:text;not null" json:"command"`
+	Image          string           `gorm:"size:500" json:"image"`
+	TimeoutSeconds int              `json:"timeout_seconds"`
+	Status         AppCommandStatus `gorm:"size:20;not null;default:'queued'" json:"status"`
+	ExitCode       *int             `json:"exit_code,omitempty"`
+	Output         string           `gorm:"type:text" json:"output,omitempty"` // stdout and stderr interleaved, secrets masked
+	Truncated      bool             `json:"truncated,omitempty"`               // output was longer than was kept
+	Error          string           `gorm:"type:text" json:"error,omitempty"`
+	StartedAt      *time.Time       `json:"started_at,omitempty"`
+	FinishedAt     *time.Time       `json:"finished_at,omitempty"`
+	CreatedAt      time.Time        `json:"created_at"`
+}
+
+// TableName overrides the table name.
+func (AppCommandRun) TableName() string {
+	return "app_command_runs"
+}
@@ -0,0 +1,78 @@
+package model
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// AppVolumeStatus is the state of an application volume.
+type AppVolumeStatus string
+
+const (
+	AppVolumePending  AppVolumeStatus = "pending"  // declared; created by the next deployment
+	AppVolumeReady    AppVolumeStatus = "ready"    // exists on the runtime and is mounted
+	AppVolumeDeleting AppVolumeStatus = "deleting" // unmounted by the next deployment, then removed with its data
+)
+
+// MaxVolumeSizeGB bounds the size of a volume.
+const MaxVolumeSizeGB = 16384
+
+var (
+	// volumeNamePattern keeps volume names valid in Kubernetes object and
+	// Docker volume names.
+	volumeNamePattern   = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,38}[a-z0-9])?$`)
+	storageClassPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]{0,251}[a-z0-9])?$`)
+)
+
+// AppVolume is a named volume an application's instances mount, so that
+// their data outlives the containers. On Kubernetes every replica gets a
+// PersistentVolumeClaim of its own; on Docker and Swarm it is a named
+// volume on one server, which the application's instances are then pinned
+// to and share.
+type AppVolume struct {
+	ID            uint            `gorm:"primaryKey" json:"id"`
+	ApplicationID uint            `gorm:"not null;uniqueIndex:idx_app_volume_name" json:"application_id"`
+	Name          string          `gorm:"size:40;not null;uniqueIndex:idx_app_volume_name" json:"name"`
+	MountPath     string          `gorm:"size:500;not null" json:"mount_path"`
+	SizeGB        int             `gorm:"not null" json:"size_gb"`                 // requested of Kubernetes; Docker's local driver does not enforce it
+	StorageClass  string          `gorm:"size:255" json:"storage_class,omitempty"` // Kubernetes only; empty uses the configured or cluster default
+	ServerID      *uint           `json:"server_id,omitempty"`                     // the server holding the data, on Docker and Swarm
+	Server        *Server         `gorm:"foreignKey:ServerID;constraint:false" json:"server,omitempty"`
+	Status        AppVolumeStatus `gorm:"size:20;not null;default:'pending'" json:"status"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+}
+
+// VolumeMount is a volume as a deployment spec records it.
+type VolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mount_path"`
+	SizeGB    int    `json:"size_gb"`
+}
+
+// TableName overrides the table name.
+func (AppVolume) TableName() string {
+	return "app_volumes"
+}
+
+// Validate checks the volume's name, mount path, size and storage class.
+func (v AppVolume) Validate() error {
+	if !volumeNamePattern.MatchString(v.Name) {
+		return fmt.Errorf("name must be 1-40 lowercase letters, digits or dashes, starting and ending with a letter or digit")
+	}
+	if !strings.HasPrefix(v.MountPath, "/") || path.Clean(v.MountPath) != v.MountPath || v.MountPath == "/" ||
+		strings.ContainsAny(v.MountPath, ",:") || strings.IndexFunc(v.MountPath, unicode.IsControl) >= 0 {
+		return fmt.Errorf("mount_path must be a clean absolute path other than / without commas, colons or control characters")
+	}
+	if v.SizeGB < 1 || v.SizeGB > MaxVolumeSizeGB {
+		return fmt.Errorf("size_gb must be between 1 and %d", MaxVolumeSizeGB)
+	}
+	if v.StorageClass != "" && !storageClassPattern.MatchString(v.StorageClass) {
+		return fmt.Errorf("storage_class is not a valid storage class name")
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"gorm.io/gorm"
@@ -18,6 +19,23 @@ const (
 	DeploymentSourceDocker DeploymentSourceType = "docker_image"
 )
 
+// DeployStrategy selects how a new version replaces the running one.
+type DeployStrategy string
+
+const (
+	DeployStrategyRecreate  DeployStrategy = "recreate"   // stop the old version, then start the new one
+	DeployStrategyBlueGreen DeployStrategy = "blue_green" // Docker only: start alongside, health check, switch nginx
+)
+
+// DeployQueueMode decides what happens to a deploy requested while another
+// deployment of the same application is queued or running.
+type DeployQueueMode string
+
+const (
+	DeployQueueModeQueue     DeployQueueMode = "queue"     // run every deployment, one at a time, in order
+	DeployQueueModeSupersede DeployQueueMode = "supersede" // a new deployment replaces any still waiting in the queue
+)
+
 // Application represents a deployable application bound to a cluster.
 type Application struct {
 	ID        uint    `gorm:"primaryKey" json:"id"`
@@ -39,12 +57,33 @@ type Application struct {
 	StartCmd  string     `gorm:"size:500" json:"start_cmd"`
 	EnvVars   ScopedEnvs `gorm:"type:jsonb" json:"env_vars"`
 
+	// Shared Environment the app consumes in production. Its variables are
+	// applied first and the app's own production vars override them.
+	EnvironmentID *uint        `gorm:"index" json:"environment_id,omitempty"`
+	Environment   *Environment `gorm:"foreignKey:EnvironmentID;constraint:false" json:"environment,omitempty"`
+
 	// Runtime
 	Port     int    `gorm:"default:0" json:"port"`
 	Domain   string `gorm:"size:255" json:"domain,omitempty"`
 	Replicas int    `gorm:"default:1" json:"replicas"`
 
-	Status    string         `gorm:"size:20;default:'pending'" json:"status"`
+	DeployStrategy DeployStrategy `gorm:"size:20;default:'recreate'" json:"deploy_strategy"`
+	UpdatePolicy   UpdatePolicy   `gorm:"type:jsonb" json:"update_policy"` // Swarm rolling update settings
+	HealthCheck    HealthCheck    `gorm:"type:jsonb" json:"health_check"`
+	Hooks          DeployHooks    `gorm:"type:jsonb" json:"hooks"`     // release-phase commands run by deployments
+	Resources      Resources      `gorm:"type:jsonb" json:"resources"` // CPU and memory of each instance
+
+	// At most one deployment runs per application; it holds the slot below
+	// and later ones wait or are superseded according to DeployQueueMode.
+	DeployQueueMode    DeployQueueMode `gorm:"size:20;default:'queue'" json:"deploy_queue_mode"`
+	ActiveDeploymentID *uint           `json:"active_deployment_id,omitempty"`
+	DeploymentSeq      int             `gorm:"default:0" json:"-"` // number of the last allocated deployment version
+
+	// Deleting an application tears down its runtime resources first; the
+	// report says what was removed and what was left behind.
+	TeardownReport *TeardownReport `gorm:"type:jsonb" json:"teardown_report,omitempty"`
+
+	Status    string         `gorm:"size:20;default:'pending'" json:"status"` // "deleting" while teardown runs
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
@@ -59,6 +98,17 @@ const (
 	ApplicationRoleViewer  ApplicationRole = "viewer"
 )
 
+var applicationRoleRank = map[ApplicationRole]int{
+	ApplicationRoleViewer:  1,
+	ApplicationRoleManager: 2,
+	ApplicationRoleAdmin:   3,
+}
+
+// Allows reports whether r grants at least the access of min.
+func (r ApplicationRole) Allows(min ApplicationRole) bool {
+	return applicationRoleRank[r] > 0 && applicationRoleRank[r] >= applicationRoleRank[min]
+}
+
 // ApplicationMembership links a user to an application with a role.
 type ApplicationMembership struct {
 	ID            uint            `gorm:"primaryKey" json:"id"`
@@ -77,6 +127,91 @@ func (ApplicationMembership) TableName() string {
 	return "application_memberships"
 }
 
+// UpdatePolicy controls how Swarm services roll out a new version. Zero
+// values fall back to the defaults below.
+type UpdatePolicy struct {
+	Parallelism     int    `json:"parallelism"`      // tasks updated at once (default 1)
+	Delay           string `json:"delay"`            // pause between batches, e.g. "10s" (default 5s)
+	FailureAction   string `json:"failure_action"`   // pause, continue or rollback (default rollback)
+	Monitor         string `json:"monitor"`          // how long each task is watched for failure (default 10s)
+	Order           string `json:"order"`            // stop-first or start-first (default start-first)
+	ConvergeTimeout string `json:"converge_timeout"` // how long to wait for the update to finish (default 10m)
+}
+
+// Update policy defaults.
+const (
+	DefaultUpdateParallelism     = 1
+	DefaultUpdateDelay           = "5s"
+	DefaultUpdateFailureAction   = "rollback"
+	DefaultUpdateMonitor         = "10s"
+	DefaultUpdateOrder           = "start-first"
+	DefaultUpdateConvergeTimeout = "10m"
+)
+
+// WithDefaults returns the policy with unset fields filled in.
+func (p UpdatePolicy) WithDefaults() UpdatePolicy {
+	if p.Parallelism <= 0 {
+		p.Parallelism = DefaultUpdateParallelism
+	}
+	if p.Delay == "" {
+		p.Delay = DefaultUpdateDelay
+	}
+	if p.FailureAction == "" {
+		p.FailureAction = DefaultUpdateFailureAction
+	}
+	if p.Monitor == "" {
+		p.Monitor = DefaultUpdateMonitor
+	}
+	if p.Order == "" {
+		p.Order = DefaultUpdateOrder
+	}
+	if p.ConvergeTimeout == "" {
+		p.ConvergeTimeout = DefaultUpdateConvergeTimeout
+	}
+	return p
+}
+
+// Validate checks the policy's enumerations and durations.
+func (p UpdatePolicy) Validate() error {
+	switch p.FailureAction {
+	case "", "pause", "continue", "rollback":
+	default:
+		return fmt.Errorf("failure_action must be pause, continue or rollback")
+	}
+	switch p.Order {
+	case "", "stop-first", "start-first":
+	default:
+		return fmt.Errorf("order must be stop-first or start-first")
+	}
+	if p.Parallelism < 0 {
+		return fmt.Errorf("parallelism must not be negative")
+	}
+	for name, d := range map[string]string{"delay": p.Delay, "monitor": p.Monitor, "converge_timeout": p.ConvergeTimeout} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return fmt.Errorf("%s: invalid duration %q", name, d)
+		}
+	}
+	return nil
+}
+
+func (p UpdatePolicy) Value() (driver.Value, error) {
+	return json.Marshal(p)
+}
+
+func (p *UpdatePolicy) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, p)
+}
+
 type ScopedEnvs struct {
 	Production map[string]string `json:"production"`
 	Preview    map[string]string `json:"preview"`
@@ -96,6 +231,24 @@ func (m *ScopedEnvs) Scan(value interface{}) error {
 	return json.Unmarshal(b, &m)
 }
 
+// ForScope returns the variables for an application env scope. Anything
+// other than preview maps to production, matching what the engine deploys.
+func (m ScopedEnvs) ForScope(scope EnvScope) map[string]string {
+	if scope == EnvScopePreview {
+		return m.Preview
+	}
+	return m.Production
+}
+
+// SetScope replaces the variables for an application env scope.
+func (m *ScopedEnvs) SetScope(scope EnvScope, vars map[string]string) {
+	if scope == EnvScopePreview {
+		m.Preview = vars
+		return
+	}
+	m.Production = vars
+}
+
 // TableName overrides the table name.
 func (Application) TableName() string {
 	return "applications"
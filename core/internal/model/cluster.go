@@ -3,6 +3,7 @@ package model
 import (
 	"time"
 
+	"github.com/enochcodes/orchestra/core/pkg/redact"
 	"gorm.io/gorm"
 )
 
@@ -50,3 +51,10 @@ type Cluster struct {
 func (Cluster) TableName() string {
 	return "clusters"
 }
+
+// AfterFind masks secrets in error messages recorded before they were
+// redacted on write.
+func (c *Cluster) AfterFind(tx *gorm.DB) error {
+	c.ErrorMessage = redact.String(c.ErrorMessage)
+	return nil
+}
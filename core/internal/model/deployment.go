@@ -1,6 +1,9 @@
 package model
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"time"
 
 	"gorm.io/gorm"
@@ -10,12 +13,40 @@ import (
 type DeploymentStatus string
 
 const (
-	DeploymentStatusPending   DeploymentStatus = "pending"
-	DeploymentStatusBuilding  DeploymentStatus = "building"
-	DeploymentStatusDeploying DeploymentStatus = "deploying"
-	DeploymentStatusLive      DeploymentStatus = "live"
-	DeploymentStatusFailed    DeploymentStatus = "failed"
+	DeploymentStatusPending    DeploymentStatus = "pending"
+	DeploymentStatusQueued     DeploymentStatus = "queued" // waiting for the application's deploy slot
+	DeploymentStatusBuilding   DeploymentStatus = "building"
+	DeploymentStatusDeploying  DeploymentStatus = "deploying"
+	DeploymentStatusLive       DeploymentStatus = "live"
+	DeploymentStatusFailed     DeploymentStatus = "failed"
 	DeploymentStatusRolledBack DeploymentStatus = "rolled_back"
+	DeploymentStatusCancelled  DeploymentStatus = "cancelled"
+	DeploymentStatusSuperseded DeploymentStatus = "superseded" // dropped from the queue by a newer deployment
+)
+
+// DeploymentStatusesActive are the statuses of deployments that are queued or
+// running.
+var DeploymentStatusesActive = []DeploymentStatus{
+	DeploymentStatusQueued, DeploymentStatusBuilding, DeploymentStatusDeploying,
+}
+
+// IsActive reports whether a deployment with this status is queued or running.
+func (s DeploymentStatus) IsActive() bool {
+	for _, active := range DeploymentStatusesActive {
+		if s == active {
+			return true
+		}
+	}
+	return false
+}
+
+// DeploymentKind is what a deployment does.
+type DeploymentKind string
+
+const (
+	DeploymentKindDeploy   DeploymentKind = "deploy"   // build or pull, then run the app's current config
+	DeploymentKindRestart  DeploymentKind = "restart"  // re-run the live image with fresh env
+	DeploymentKindRollback DeploymentKind = "rollback" // re-run an earlier deployment's image and spec
 )
 
 // Deployment represents a single deployment attempt for an application.
@@ -26,7 +57,15 @@ type Deployment struct {
 	Version       string           `gorm:"size:100;not null" json:"version"`
 	ImageTag      string           `gorm:"size:255" json:"image_tag"`
 	Status        DeploymentStatus `gorm:"size:20;default:'pending'" json:"status"`
-	Logs          string           `gorm:"type:text" json:"logs,omitempty"`
+	Kind          DeploymentKind   `gorm:"size:20;default:'deploy'" json:"kind"`
+	Attempt       int              `gorm:"default:0" json:"attempt"`                       // runs so far, counting retries
+	Requeues      int              `gorm:"default:0" json:"-"`                             // times its task was put back to wait for the deploy slot
+	Spec          DeploymentSpec   `gorm:"type:jsonb" json:"spec"`                         // written once when the deployment starts
+	RollbackOfID  *uint            `gorm:"<-:create" json:"rollback_of_id,omitempty"`      // deployment whose image and spec this one restored
+	Logs          string           `gorm:"type:text" json:"logs,omitempty"`                // legacy: log text of deployments made before DeploymentLogLines
+	LogLines      int              `gorm:"default:0" json:"log_lines"`                     // DeploymentLogLines written so far
+	LogsPurgedAt  *time.Time       `json:"logs_purged_at,omitempty"`                       // when retention deleted the log
+	Steps         []DeploymentStep `gorm:"foreignKey:DeploymentID" json:"steps,omitempty"` // pipeline of the latest attempt
 	CreatedAt     time.Time        `json:"created_at"`
 	UpdatedAt     time.Time        `json:"updated_at"`
 	DeletedAt     gorm.DeletedAt   `gorm:"index" json:"-"`
@@ -36,3 +75,56 @@ type Deployment struct {
 func (Deployment) TableName() string {
 	return "deployments"
 }
+
+// DeploymentSpec is the full application spec a deployment ran with,
+// captured when the deployment starts. It is never updated afterwards, so
+// it can be re-applied or compared long after the Application has changed.
+type DeploymentSpec struct {
+	// Source and build
+	AppName     string               `json:"app_name"`
+	SourceType  DeploymentSourceType `json:"source_type"`
+	RepoURL     string               `json:"repo_url,omitempty"`
+	Branch      string               `json:"branch,omitempty"`
+	DockerImage string               `json:"docker_image,omitempty"`
+	ManualPath  string               `json:"manual_path,omitempty"`
+	BuildType   string               `json:"build_type,omitempty"`
+	BuildCmd    string               `json:"build_cmd,omitempty"`
+	StartCmd    string               `json:"start_cmd,omitempty"`
+
+	// Runtime
+	ClusterType   ClusterType       `json:"cluster_type"`
+	Image         string            `json:"image"`
+	Namespace     string            `json:"namespace"`
+	Replicas      int               `json:"replicas"`
+	Port          int               `json:"port"`
+	Domain        string            `json:"domain,omitempty"`
+	Strategy      DeployStrategy    `json:"strategy,omitempty"`
+	UpdatePolicy  *UpdatePolicy     `json:"update_policy,omitempty"` // Swarm only, defaults applied
+	HealthCheck   *HealthCheck      `json:"health_check,omitempty"`  // defaults applied
+	Hooks         *DeployHooks      `json:"hooks,omitempty"`
+	Resources     *Resources        `json:"resources,omitempty"`
+	Volumes       []VolumeMount     `json:"volumes,omitempty"`
+	EnvironmentID *uint             `json:"environment_id,omitempty"` // shared environment merged into Env
+	Env           map[string]string `json:"env"`                      // production vars incl. shared environment, secret references unresolved
+}
+
+func (s DeploymentSpec) Value() (driver.Value, error) {
+	return json.Marshal(s)
+}
+
+func (s *DeploymentSpec) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, s)
+}
+
+// IsZero reports whether no spec was recorded, as for deployments created
+// before specs were captured.
+func (s DeploymentSpec) IsZero() bool {
+	return s.Image == "" && s.Replicas == 0
+}
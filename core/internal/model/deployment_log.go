@@ -0,0 +1,59 @@
+package model
+
+import "time"
+
+// LogStream is where a deployment log line came from.
+type LogStream string
+
+const (
+	LogStreamStdout LogStream = "stdout" // output of a remote command
+	LogStreamStderr LogStream = "stderr"
+	LogStreamSystem LogStream = "system" // written by Orchestra itself
+)
+
+// LogLevel is the severity of a deployment log line.
+type LogLevel string
+
+const (
+	LogLevelInfo  LogLevel = "info"
+	LogLevelWarn  LogLevel = "warn"
+	LogLevelError LogLevel = "error"
+)
+
+// DeploymentLogLine is one line of a deployment's log. Seq numbers a
+// deployment's lines from 1 in the order they were written.
+type DeploymentLogLine struct {
+	ID            uint64             `gorm:"primaryKey" json:"id"`
+	DeploymentID  uint               `gorm:"not null;uniqueIndex:idx_deployment_log_seq" json:"deployment_id"`
+	ApplicationID uint               `gorm:"not null;index" json:"application_id"`
+	Seq           int                `gorm:"not null;uniqueIndex:idx_deployment_log_seq" json:"seq"`
+	Step          DeploymentStepName `gorm:"size:50" json:"step,omitempty"` // step running when the line was written
+	Stream        LogStream          `gorm:"size:10;not null;default:'system'" json:"stream"`
+	Level         LogLevel           `gorm:"size:10;not null;default:'info'" json:"level"`
+	Text          string             `gorm:"type:text;not null" json:"text"`
+	Time          time.Time          `gorm:"not null;index" json:"time"`
+}
+
+// TableName overrides the table name.
+func (DeploymentLogLine) TableName() string {
+	return "deployment_log_lines"
+}
+
+// DeploymentLogArchive holds a deployment's compacted log: its lines as
+// gzipped JSON, one line record per row. The archive is kept in Data, or in
+// the log object store under Location when offloading is configured.
+type DeploymentLogArchive struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	DeploymentID  uint      `gorm:"not null;uniqueIndex" json:"deployment_id"`
+	ApplicationID uint      `gorm:"not null;index" json:"application_id"`
+	Location      string    `gorm:"size:500" json:"location,omitempty"` // object key; empty when stored in Data
+	Data          []byte    `gorm:"type:bytea" json:"-"`
+	Lines         int       `json:"lines"`
+	SizeBytes     int64     `json:"size_bytes"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// TableName overrides the table name.
+func (DeploymentLogArchive) TableName() string {
+	return "deployment_log_archives"
+}
@@ -0,0 +1,50 @@
+package model
+
+import "time"
+
+// DeploymentStepName identifies a phase of the deployment pipeline.
+type DeploymentStepName string
+
+const (
+	StepFetchSource        DeploymentStepName = "fetch_source"
+	StepGenerateDockerfile DeploymentStepName = "generate_dockerfile"
+	StepBuild              DeploymentStepName = "build"
+	StepPush               DeploymentStepName = "push"
+	StepPreDeploy          DeploymentStepName = "pre_deploy"
+	StepDeploy             DeploymentStepName = "deploy"
+	StepHealthCheck        DeploymentStepName = "health_check"
+	StepRouteTraffic       DeploymentStepName = "route_traffic"
+	StepPostDeploy         DeploymentStepName = "post_deploy"
+)
+
+// DeploymentStepStatus is the state of one pipeline step.
+type DeploymentStepStatus string
+
+const (
+	StepStatusPending   DeploymentStepStatus = "pending"
+	StepStatusRunning   DeploymentStepStatus = "running"
+	StepStatusSucceeded DeploymentStepStatus = "succeeded"
+	StepStatusFailed    DeploymentStepStatus = "failed"
+	StepStatusSkipped   DeploymentStepStatus = "skipped" // not needed for this deployment, or never reached
+	StepStatusCancelled DeploymentStepStatus = "cancelled"
+)
+
+// DeploymentStep records one phase of a deployment's latest attempt. Steps
+// are created when an attempt starts and run in Position order.
+type DeploymentStep struct {
+	ID           uint                 `gorm:"primaryKey" json:"id"`
+	DeploymentID uint                 `gorm:"not null;uniqueIndex:idx_deployment_step" json:"deployment_id"`
+	Name         DeploymentStepName   `gorm:"size:50;not null;uniqueIndex:idx_deployment_step" json:"name"`
+	Position     int                  `gorm:"not null" json:"position"`
+	Status       DeploymentStepStatus `gorm:"size:20;not null;default:'pending'" json:"status"`
+	StartedAt    *time.Time           `json:"started_at,omitempty"`
+	FinishedAt   *time.Time           `json:"finished_at,omitempty"`
+	DurationMs   int64                `json:"duration_ms"`
+	CreatedAt    time.Time            `json:"created_at"`
+	UpdatedAt    time.Time            `json:"updated_at"`
+}
+
+// TableName overrides the table name.
+func (DeploymentStep) TableName() string {
+	return "deployment_steps"
+}
@@ -0,0 +1,45 @@
+package model
+
+import "time"
+
+// EnvPushStatus is the outcome of pushing an environment file to one server.
+type EnvPushStatus string
+
+const (
+	EnvPushSuccess EnvPushStatus = "success"
+	EnvPushFailed  EnvPushStatus = "failed"
+)
+
+// EnvVerifyStatus is the outcome of comparing a server's on-disk file with
+// the checksum Orchestra last pushed there.
+type EnvVerifyStatus string
+
+const (
+	EnvVerifyMatch    EnvVerifyStatus = "match"
+	EnvVerifyMismatch EnvVerifyStatus = "mismatch"
+	EnvVerifyMissing  EnvVerifyStatus = "missing" // file no longer exists
+	EnvVerifyError    EnvVerifyStatus = "error"   // server could not be checked
+)
+
+// EnvPushResult records the latest push of an Environment to one server.
+// There is one row per environment and server, overwritten on every push.
+type EnvPushResult struct {
+	ID             uint            `gorm:"primaryKey" json:"id"`
+	EnvironmentID  uint            `gorm:"not null;uniqueIndex:idx_env_push_server" json:"environment_id"`
+	ServerID       uint            `gorm:"not null;uniqueIndex:idx_env_push_server" json:"server_id"`
+	Server         Server          `gorm:"foreignKey:ServerID" json:"server,omitempty"`
+	Status         EnvPushStatus   `gorm:"size:20;not null" json:"status"`
+	Error          string          `gorm:"type:text" json:"error,omitempty"`
+	FilePath       string          `gorm:"size:500" json:"file_path"`
+	Checksum       string          `gorm:"size:64" json:"checksum,omitempty"` // sha256 of the file written
+	PushedAt       time.Time       `json:"pushed_at"`
+	VerifyStatus   EnvVerifyStatus `gorm:"size:20" json:"verify_status,omitempty"`
+	VerifyError    string          `gorm:"type:text" json:"verify_error,omitempty"`
+	OnDiskChecksum string          `gorm:"size:64" json:"on_disk_checksum,omitempty"`
+	VerifiedAt     *time.Time      `json:"verified_at,omitempty"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+func (EnvPushResult) TableName() string {
+	return "env_push_results"
+}
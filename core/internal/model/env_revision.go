@@ -0,0 +1,94 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrRevisionImmutable is returned when something tries to modify a stored revision.
+var ErrRevisionImmutable = errors.New("env revisions are immutable")
+
+// EnvChangeAction describes what happened to a single key between revisions.
+type EnvChangeAction string
+
+const (
+	EnvChangeAdded   EnvChangeAction = "added"
+	EnvChangeRemoved EnvChangeAction = "removed"
+	EnvChangeChanged EnvChangeAction = "changed"
+)
+
+// EnvChange is one key's difference between two variable sets. Values are
+// stored already masked so a change list is always safe to display.
+type EnvChange struct {
+	Key      string          `json:"key"`
+	Action   EnvChangeAction `json:"action"`
+	OldValue string          `json:"old_value,omitempty"`
+	NewValue string          `json:"new_value,omitempty"`
+}
+
+// EnvChanges is a JSON-serializable list of EnvChange.
+type EnvChanges []EnvChange
+
+func (c EnvChanges) Value() (driver.Value, error) {
+	if c == nil {
+		return json.Marshal([]EnvChange{})
+	}
+	return json.Marshal(c)
+}
+
+func (c *EnvChanges) Scan(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, c)
+}
+
+// EnvRevision is an immutable snapshot of an Environment's variables, or of
+// one scope of an Application's EnvVars, taken every time they change.
+type EnvRevision struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	Target         string     `gorm:"size:100;not null;uniqueIndex:idx_env_revision" json:"target"` // see EnvironmentRevisionTarget / ApplicationRevisionTarget
+	EnvironmentID  *uint      `gorm:"index" json:"environment_id,omitempty"`
+	ApplicationID  *uint      `gorm:"index" json:"application_id,omitempty"`
+	Scope          EnvScope   `gorm:"size:30" json:"scope"`
+	Revision       int        `gorm:"not null;uniqueIndex:idx_env_revision" json:"revision"`
+	Variables      EnvVarMap  `gorm:"type:jsonb" json:"-"` // full unmasked snapshot, used for rollback
+	Changes        EnvChanges `gorm:"type:jsonb" json:"changes"`
+	Message        string     `gorm:"type:text" json:"message,omitempty"`
+	RolledBackFrom *int       `json:"rolled_back_from,omitempty"` // revision this one restored
+	AuthorID       *uint      `json:"author_id,omitempty"`
+	Author         *User      `gorm:"foreignKey:AuthorID;constraint:false" json:"author,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// TableName overrides the table name.
+func (EnvRevision) TableName() string {
+	return "env_revisions"
+}
+
+// BeforeUpdate rejects any modification of a stored revision.
+func (r *EnvRevision) BeforeUpdate(tx *gorm.DB) error {
+	return ErrRevisionImmutable
+}
+
+// BeforeDelete rejects deletion of a stored revision.
+func (r *EnvRevision) BeforeDelete(tx *gorm.DB) error {
+	return ErrRevisionImmutable
+}
+
+// EnvironmentRevisionTarget identifies the revision history of an Environment.
+func EnvironmentRevisionTarget(envID uint) string {
+	return fmt.Sprintf("environment:%d", envID)
+}
+
+// ApplicationRevisionTarget identifies the revision history of one scope of
+// an Application's EnvVars.
+func ApplicationRevisionTarget(appID uint, scope EnvScope) string {
+	return fmt.Sprintf("application:%d:%s", appID, scope)
+}
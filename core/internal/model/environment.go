@@ -18,18 +18,37 @@ const (
 	EnvScopeStaging    EnvScope = "staging"
 )
 
+// EnvSyncStatus summarizes the outcome of the latest push across a cluster's servers.
+type EnvSyncStatus string
+
+const (
+	EnvSyncPending         EnvSyncStatus = "pending"          // changed since the last push
+	EnvSyncSynced          EnvSyncStatus = "synced"           // every server has the current file
+	EnvSyncPartiallySynced EnvSyncStatus = "partially_synced" // some servers failed
+	EnvSyncFailed          EnvSyncStatus = "failed"           // no server has the current file
+)
+
 // Environment stores a set of key-value environment variables for a cluster+scope.
 type Environment struct {
-	ID        uint           `gorm:"primaryKey" json:"id"`
-	ClusterID uint           `gorm:"not null" json:"cluster_id"`
-	Cluster   Cluster        `gorm:"foreignKey:ClusterID" json:"cluster,omitempty"`
-	Scope     EnvScope       `gorm:"size:30;not null;default:'production'" json:"scope"`
-	Name      string         `gorm:"size:255;not null" json:"name"` // e.g. "production-v1", "staging"
-	Variables EnvVarMap      `gorm:"type:jsonb" json:"variables"`
-	Synced    bool           `gorm:"default:false" json:"synced"` // whether pushed to servers
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	ID           uint           `gorm:"primaryKey" json:"id"`
+	ClusterID    uint           `gorm:"not null" json:"cluster_id"`
+	Cluster      Cluster        `gorm:"foreignKey:ClusterID" json:"cluster,omitempty"`
+	Scope        EnvScope       `gorm:"size:30;not null;default:'production'" json:"scope"`
+	Name         string         `gorm:"size:255;not null" json:"name"` // e.g. "production-v1", "staging"
+	Variables    EnvVarMap      `gorm:"type:jsonb" json:"variables"`
+	Synced       bool           `gorm:"default:false" json:"synced"` // whether pushed to servers
+	SyncStatus   EnvSyncStatus  `gorm:"size:20;default:'pending'" json:"sync_status"`
+	Checksum     string         `gorm:"size:64" json:"checksum,omitempty"` // sha256 of the last pushed file
+	LastPushedAt *time.Time     `json:"last_pushed_at,omitempty"`
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// MarkChanged flags the environment as needing a push after its variables change.
+func (e *Environment) MarkChanged() {
+	e.Synced = false
+	e.SyncStatus = EnvSyncPending
 }
 
 func (Environment) TableName() string {
@@ -0,0 +1,37 @@
+package model
+
+import "time"
+
+// ExecTarget is what an interactive exec session opened a shell in.
+type ExecTarget string
+
+const (
+	ExecTargetApplication ExecTarget = "application"
+	ExecTargetServer      ExecTarget = "server"
+)
+
+// ExecSession records an interactive terminal a user opened into an
+// application instance or onto a server.
+type ExecSession struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	UserID        uint       `gorm:"not null;index" json:"user_id"`
+	User          User       `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Target        ExecTarget `gorm:"size:20;not null" json:"target"`
+	ApplicationID *uint      `gorm:"index" json:"application_id,omitempty"`
+	ServerID      uint       `gorm:"index" json:"server_id"`             // the server the shell ran on or through
+	Instance      string     `gorm:"size:255" json:"instance,omitempty"` // pod, task or container entered
+	RemoteAddr    string     `gorm:"size:100" json:"remote_addr"`
+	StartedAt     time.Time  `json:"started_at"`
+	EndedAt       *time.Time `json:"ended_at,omitempty"`
+	ExitCode      *int       `json:"exit_code,omitempty"`
+	// Transcript is the terminal output, secrets masked, when transcripts
+	// are recorded. Typed input shows where the terminal echoed it.
+	Transcript          string    `gorm:"type:text" json:"transcript,omitempty"`
+	TranscriptTruncated bool      `json:"transcript_truncated,omitempty"`
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+// TableName overrides the table name.
+func (ExecSession) TableName() string {
+	return "exec_sessions"
+}
@@ -0,0 +1,115 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// HealthCheckType selects how an application instance is probed.
+type HealthCheckType string
+
+const (
+	HealthCheckHTTP    HealthCheckType = "http"    // GET Path on Port must return 2xx/3xx
+	HealthCheckTCP     HealthCheckType = "tcp"     // Port must accept connections
+	HealthCheckCommand HealthCheckType = "command" // Command run in the container must exit 0
+)
+
+// HealthCheck defines how to tell that a deployed instance is healthy. The
+// engine waits for it to pass before marking a deployment live, and wires it
+// into Kubernetes probes and Docker/Swarm HEALTHCHECK. An empty Type disables
+// health checking.
+type HealthCheck struct {
+	Type               HealthCheckType `json:"type"`
+	Path               string          `json:"path,omitempty"`    // http only, default "/"
+	Port               int             `json:"port,omitempty"`    // http/tcp, default the app port
+	Command            string          `json:"command,omitempty"` // command only, run with sh -c
+	IntervalSeconds    int             `json:"interval_seconds"`
+	TimeoutSeconds     int             `json:"timeout_seconds"`
+	StartPeriodSeconds int             `json:"start_period_seconds"` // failures are ignored this long after start
+	HealthyThreshold   int             `json:"healthy_threshold"`    // consecutive passes to become healthy
+	UnhealthyThreshold int             `json:"unhealthy_threshold"`  // consecutive failures to become unhealthy
+	DeadlineSeconds    int             `json:"deadline_seconds"`     // how long a deploy waits for health
+	RollbackOnFailure  bool            `json:"rollback_on_failure"`  // restore the previous version if the deadline passes
+}
+
+// Enabled reports whether a health check is configured.
+func (h HealthCheck) Enabled() bool {
+	return h.Type != ""
+}
+
+// WithDefaults returns the check with unset fields filled in. appPort is used
+// when no port is given.
+func (h HealthCheck) WithDefaults(appPort int) HealthCheck {
+	if h.Type == HealthCheckHTTP && h.Path == "" {
+		h.Path = "/"
+	}
+	if h.Port == 0 {
+		h.Port = appPort
+	}
+	if h.IntervalSeconds <= 0 {
+		h.IntervalSeconds = 10
+	}
+	if h.TimeoutSeconds <= 0 {
+		h.TimeoutSeconds = 5
+	}
+	if h.StartPeriodSeconds < 0 {
+		h.StartPeriodSeconds = 0
+	}
+	if h.HealthyThreshold <= 0 {
+		h.HealthyThreshold = 1
+	}
+	if h.UnhealthyThreshold <= 0 {
+		h.UnhealthyThreshold = 3
+	}
+	if h.DeadlineSeconds <= 0 {
+		h.DeadlineSeconds = 300
+	}
+	return h
+}
+
+// Validate checks that the check is complete for its type.
+func (h HealthCheck) Validate(appPort int) error {
+	switch h.Type {
+	case "":
+		return nil
+	case HealthCheckHTTP, HealthCheckTCP:
+		if h.Port == 0 && appPort == 0 {
+			return fmt.Errorf("%s health check needs a port", h.Type)
+		}
+		if h.Type == HealthCheckHTTP && h.Path != "" && h.Path[0] != '/' {
+			return fmt.Errorf("path must start with /")
+		}
+		if strings.IndexFunc(h.Path, unicode.IsControl) >= 0 {
+			return fmt.Errorf("path must not contain control characters")
+		}
+	case HealthCheckCommand:
+		if h.Command == "" {
+			return fmt.Errorf("command health check needs a command")
+		}
+	default:
+		return fmt.Errorf("type must be http, tcp or command")
+	}
+	if h.Port < 0 || h.Port > 65535 {
+		return fmt.Errorf("port out of range")
+	}
+	return nil
+}
+
+func (h HealthCheck) Value() (driver.Value, error) {
+	return json.Marshal(h)
+}
+
+func (h *HealthCheck) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, h)
+}
@@ -0,0 +1,62 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Limits of hook and one-off command run times.
+const (
+	DefaultHookTimeoutSeconds = 600
+	MaxHookTimeoutSeconds     = 3600
+)
+
+// DeployHooks are release-phase commands a deployment runs in the new image
+// with the application's environment, each in a throwaway container or
+// Kubernetes Job and with sh -c. A hook that exits non-zero fails the
+// deployment.
+type DeployHooks struct {
+	PreDeploy      string `json:"pre_deploy,omitempty"`  // before the new version starts, e.g. database migrations
+	PostDeploy     string `json:"post_deploy,omitempty"` // once the new version is up and healthy
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"`
+}
+
+// Timeout returns how long each hook may run.
+func (h DeployHooks) Timeout() time.Duration {
+	if h.TimeoutSeconds <= 0 {
+		return DefaultHookTimeoutSeconds * time.Second
+	}
+	return time.Duration(h.TimeoutSeconds) * time.Second
+}
+
+// Validate checks the hooks' settings.
+func (h DeployHooks) Validate() error {
+	for name, cmd := range map[string]string{"pre_deploy": h.PreDeploy, "post_deploy": h.PostDeploy} {
+		if strings.ContainsRune(cmd, 0) {
+			return fmt.Errorf("%s must not contain NUL bytes", name)
+		}
+	}
+	if h.TimeoutSeconds < 0 || h.TimeoutSeconds > MaxHookTimeoutSeconds {
+		return fmt.Errorf("timeout_seconds must be between 0 and %d", MaxHookTimeoutSeconds)
+	}
+	return nil
+}
+
+func (h DeployHooks) Value() (driver.Value, error) {
+	return json.Marshal(h)
+}
+
+func (h *DeployHooks) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, h)
+}
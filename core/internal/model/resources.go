@@ -0,0 +1,82 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// MinMemoryLimitMB is the smallest memory limit Docker accepts.
+const MinMemoryLimitMB = 6
+
+// Resources are the CPU and memory each instance of an application asks
+// for and may use. CPU is in millicores (1000 = one core) and memory in MiB;
+// zero leaves the setting unset. Requests are what the instance is
+// guaranteed and are counted against cluster capacity; limits cap it.
+type Resources struct {
+	CPURequestMillicores int `json:"cpu_request_millicores,omitempty"`
+	CPULimitMillicores   int `json:"cpu_limit_millicores,omitempty"`
+	MemoryRequestMB      int `json:"memory_request_mb,omitempty"`
+	MemoryLimitMB        int `json:"memory_limit_mb,omitempty"`
+}
+
+// IsZero reports whether no request or limit is set.
+func (r Resources) IsZero() bool {
+	return r == Resources{}
+}
+
+// Reserved returns what one instance reserves: its requests, or its limits
+// where no request is set, as Kubernetes does.
+func (r Resources) Reserved() (cpuMillicores, memoryMB int) {
+	cpuMillicores, memoryMB = r.CPURequestMillicores, r.MemoryRequestMB
+	if cpuMillicores == 0 {
+		cpuMillicores = r.CPULimitMillicores
+	}
+	if memoryMB == 0 {
+		memoryMB = r.MemoryLimitMB
+	}
+	return cpuMillicores, memoryMB
+}
+
+// Validate checks the requests and limits.
+func (r Resources) Validate() error {
+	for name, v := range map[string]int{
+		"cpu_request_millicores": r.CPURequestMillicores,
+		"cpu_limit_millicores":   r.CPULimitMillicores,
+		"memory_request_mb":      r.MemoryRequestMB,
+		"memory_limit_mb":        r.MemoryLimitMB,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	if r.CPULimitMillicores > 0 && r.CPULimitMillicores < 10 {
+		return fmt.Errorf("cpu_limit_millicores must be at least 10")
+	}
+	if r.MemoryLimitMB > 0 && r.MemoryLimitMB < MinMemoryLimitMB {
+		return fmt.Errorf("memory_limit_mb must be at least %d", MinMemoryLimitMB)
+	}
+	if r.CPULimitMillicores > 0 && r.CPURequestMillicores > r.CPULimitMillicores {
+		return fmt.Errorf("cpu_request_millicores must not exceed cpu_limit_millicores")
+	}
+	if r.MemoryLimitMB > 0 && r.MemoryRequestMB > r.MemoryLimitMB {
+		return fmt.Errorf("memory_request_mb must not exceed memory_limit_mb")
+	}
+	return nil
+}
+
+func (r Resources) Value() (driver.Value, error) {
+	return json.Marshal(r)
+}
+
+func (r *Resources) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, r)
+}
@@ -0,0 +1,69 @@
+package model
+
+import (
+	"regexp"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MaskedValue is returned by the API in place of a secret's plaintext.
+const MaskedValue = "********"
+
+// SecretRefPattern matches a ${secret:NAME} reference inside an env value,
+// for any NAME that SecretNamePattern accepts.
+var SecretRefPattern = regexp.MustCompile(`\$\{secret:([A-Za-z_][A-Za-z0-9_.-]*)\}`)
+
+// SecretNamePattern is the set of names a secret may be stored under.
+var SecretNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// Secret is an encrypted, write-only value scoped to a cluster. Application
+// and environment variables reference it as ${secret:NAME}; the plaintext is
+// only ever decrypted by the engine when delivering it to a runtime.
+type Secret struct {
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	ClusterID       uint      `gorm:"not null;uniqueIndex:idx_cluster_secret" json:"cluster_id"`
+	Cluster         Cluster   `gorm:"foreignKey:ClusterID" json:"cluster,omitempty"`
+	Name            string    `gorm:"size:255;not null;uniqueIndex:idx_cluster_secret" json:"name"`
+	Description     string    `gorm:"type:text" json:"description,omitempty"`
+	ValueEncrypted  []byte    `gorm:"type:bytea;not null" json:"-"`
+	Value           string    `gorm:"-" json:"value"` // always MaskedValue on read
+	Version         int       `gorm:"default:1" json:"version"`
+	CreatedByUserID *uint     `json:"created_by_user_id,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// TableName overrides the table name.
+func (Secret) TableName() string {
+	return "secrets"
+}
+
+// AfterFind masks the value so the plaintext can never be serialized.
+func (s *Secret) AfterFind(tx *gorm.DB) error {
+	s.Value = MaskedValue
+	return nil
+}
+
+// AfterSave masks the value after a create or update.
+func (s *Secret) AfterSave(tx *gorm.DB) error {
+	s.Value = MaskedValue
+	return nil
+}
+
+// SecretRefs returns the sorted, de-duplicated secret names referenced by vars.
+func SecretRefs(vars map[string]string) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, v := range vars {
+		for _, m := range SecretRefPattern.FindAllStringSubmatch(v, -1) {
+			if !seen[m[1]] {
+				seen[m[1]] = true
+				names = append(names, m[1])
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -3,6 +3,7 @@ package model
 import (
 	"time"
 
+	"github.com/enochcodes/orchestra/core/pkg/redact"
 	"gorm.io/gorm"
 )
 
@@ -57,6 +58,13 @@ func (Server) TableName() string {
 	return "servers"
 }
 
+// AfterFind masks secrets in error messages recorded before they were
+// redacted on write.
+func (s *Server) AfterFind(tx *gorm.DB) error {
+	s.ErrorMessage = redact.String(s.ErrorMessage)
+	return nil
+}
+
 // ServerTeam represents a team for grouping servers.
 type ServerTeam struct {
 	ID          uint           `gorm:"primaryKey" json:"id"`
@@ -0,0 +1,39 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// TeardownReport records what deleting an application removed from its
+// cluster, and what could not be removed.
+type TeardownReport struct {
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+	Removed    []string          `json:"removed"`
+	Failed     []TeardownFailure `json:"failed"`
+}
+
+// TeardownFailure is one runtime resource that teardown could not remove.
+type TeardownFailure struct {
+	Resource string `json:"resource"`         // e.g. "container web", "nginx site example.com"
+	Server   string `json:"server,omitempty"` // name of the node it lives on
+	Error    string `json:"error"`
+}
+
+func (r TeardownReport) Value() (driver.Value, error) {
+	return json.Marshal(r)
+}
+
+func (r *TeardownReport) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, r)
+}
@@ -24,6 +24,17 @@ const (
 	ServerRoleTypeViewer ServerRoleType = "viewer"
 )
 
+var serverRoleRank = map[ServerRoleType]int{
+	ServerRoleTypeViewer: 1,
+	ServerRoleTypeDevOps: 2,
+	ServerRoleTypeAdmin:  3,
+}
+
+// Allows reports whether r grants at least the access of min.
+func (r ServerRoleType) Allows(min ServerRoleType) bool {
+	return serverRoleRank[r] > 0 && serverRoleRank[r] >= serverRoleRank[min]
+}
+
 // User represents a platform user.
 type User struct {
 	ID           uint           `gorm:"primaryKey" json:"id"`
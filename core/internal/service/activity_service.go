@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 
 	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
 	"gorm.io/gorm"
 )
 
@@ -12,11 +13,11 @@ func LogActivity(db *gorm.DB, activityType model.ActivityType, message, entity s
 	var meta string
 	if metadata != nil {
 		b, _ := json.Marshal(metadata)
-		meta = string(b)
+		meta = redact.String(string(b))
 	}
 	a := model.Activity{
 		Type:     activityType,
-		Message:  message,
+		Message:  redact.String(message),
 		Entity:   entity,
 		EntityID: entityID,
 		UserID:   userID,
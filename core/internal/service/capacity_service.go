@@ -0,0 +1,108 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	tasks "github.com/enochcodes/orchestra/core/internal/engine"
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"gorm.io/gorm"
+)
+
+// ErrInsufficientCapacity means an application's resource requests do not
+// fit on the servers of its cluster.
+var ErrInsufficientCapacity = errors.New("insufficient cluster capacity")
+
+// ClusterCapacity is the CPU and memory of the servers that run a cluster's
+// applications, from the server inventory, and how much of it applications
+// reserve. Servers whose inventory was never collected count as zero.
+type ClusterCapacity struct {
+	CPUMillicores         int `json:"cpu_millicores"`
+	MemoryMB              int `json:"memory_mb"`
+	LargestCPUMillicores  int `json:"largest_cpu_millicores"` // of a single server
+	LargestMemoryMB       int `json:"largest_memory_mb"`
+	ReservedCPUMillicores int `json:"reserved_cpu_millicores"`
+	ReservedMemoryMB      int `json:"reserved_memory_mb"`
+}
+
+// GetClusterCapacity sums the inventory of the servers that run applications
+// of the cluster, all of its servers for Kubernetes and Swarm and the
+// manager otherwise, and the reservations of its applications other than
+// excludeAppID. Stopped applications and ones being deleted reserve nothing.
+func GetClusterCapacity(db *gorm.DB, clusterID, excludeAppID uint) (*ClusterCapacity, error) {
+	var cluster model.Cluster
+	if err := db.Preload("ManagerServer").First(&cluster, clusterID).Error; err != nil {
+		return nil, fmt.Errorf("cluster not found: %w", err)
+	}
+	var servers []model.Server
+	switch cluster.Type {
+	case model.ClusterTypeK8s, model.ClusterTypeDockerSwarm:
+		if err := db.Where("cluster_id = ?", clusterID).Find(&servers).Error; err != nil {
+			return nil, fmt.Errorf("list cluster servers: %w", err)
+		}
+	default:
+		servers = []model.Server{cluster.ManagerServer}
+	}
+
+	capacity := &ClusterCapacity{}
+	for _, s := range servers {
+		cpu, memory := s.CPUCores*1000, int(s.RAMBytes>>20)
+		capacity.CPUMillicores += cpu
+		capacity.MemoryMB += memory
+		capacity.LargestCPUMillicores = max(capacity.LargestCPUMillicores, cpu)
+		capacity.LargestMemoryMB = max(capacity.LargestMemoryMB, memory)
+	}
+
+	var apps []model.Application
+	if err := db.Select("id", "replicas", "resources").
+		Where("cluster_id = ? AND id <> ? AND status NOT IN ?", clusterID, excludeAppID,
+			[]string{tasks.AppStatusStopped, tasks.AppStatusDeleting, tasks.AppStatusTeardownFailed}).
+		Find(&apps).Error; err != nil {
+		return nil, fmt.Errorf("list cluster applications: %w", err)
+	}
+	for _, app := range apps {
+		cpu, memory := app.Resources.Reserved()
+		capacity.ReservedCPUMillicores += cpu * app.Replicas
+		capacity.ReservedMemoryMB += memory * app.Replicas
+	}
+	return capacity, nil
+}
+
+// CheckCapacity checks that replicas instances of app, with its resources,
+// fit on its cluster: each instance on a single server, and all of them in
+// what the cluster's other applications leave unreserved. Checks against
+// an inventory that was never collected are skipped. A failed check wraps
+// ErrInsufficientCapacity.
+func CheckCapacity(db *gorm.DB, app *model.Application, replicas int) error {
+	if app.Resources.IsZero() {
+		return nil
+	}
+	capacity, err := GetClusterCapacity(db, app.ClusterID, app.ID)
+	if err != nil {
+		return err
+	}
+
+	r := app.Resources
+	cpu, memory := r.Reserved()
+	if capacity.CPUMillicores > 0 {
+		if each := max(cpu, r.CPULimitMillicores); each > capacity.LargestCPUMillicores {
+			return fmt.Errorf("%w: each instance needs %dm CPU but the largest server has %dm",
+				ErrInsufficientCapacity, each, capacity.LargestCPUMillicores)
+		}
+		if free := capacity.CPUMillicores - capacity.ReservedCPUMillicores; cpu*replicas > free {
+			return fmt.Errorf("%w: %d instance(s) request %dm CPU but only %dm of %dm is unreserved",
+				ErrInsufficientCapacity, replicas, cpu*replicas, max(free, 0), capacity.CPUMillicores)
+		}
+	}
+	if capacity.MemoryMB > 0 {
+		if each := max(memory, r.MemoryLimitMB); each > capacity.LargestMemoryMB {
+			return fmt.Errorf("%w: each instance needs %d MiB of memory but the largest server has %d MiB",
+				ErrInsufficientCapacity, each, capacity.LargestMemoryMB)
+		}
+		if free := capacity.MemoryMB - capacity.ReservedMemoryMB; memory*replicas > free {
+			return fmt.Errorf("%w: %d instance(s) request %d MiB of memory but only %d of %d MiB is unreserved",
+				ErrInsufficientCapacity, replicas, memory*replicas, max(free, 0), capacity.MemoryMB)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+)
+
+// SpecChange is one field that differs between two deployment specs.
+type SpecChange struct {
+	Field    string `json:"field"`
+	OldValue string `json:"old_value"`
+	NewValue string `json:"new_value"`
+}
+
+// specFields lists the comparable fields of a spec, in display order. Env is
+// compared separately, key by key.
+func specFields(s model.DeploymentSpec) [][2]string {
+	envID := ""
+	if s.EnvironmentID != nil {
+		envID = fmt.Sprint(*s.EnvironmentID)
+	}
+	policy := ""
+	if s.UpdatePolicy != nil {
+		policy = fmt.Sprintf("%+v", *s.UpdatePolicy)
+	}
+	health := ""
+	if s.HealthCheck != nil {
+		health = fmt.Sprintf("%+v", *s.HealthCheck)
+	}
+	resources := ""
+	if s.Resources != nil {
+		resources = fmt.Sprintf("%+v", *s.Resources)
+	}
+	var volumes []string
+	for _, v := range s.Volumes {
+		volumes = append(volumes, fmt.Sprintf("%s:%s (%d GB)", v.Name, v.MountPath, v.SizeGB))
+	}
+	var preDeploy, postDeploy string
+	if s.Hooks != nil {
+		preDeploy, postDeploy = s.Hooks.PreDeploy, s.Hooks.PostDeploy
+	}
+	return [][2]string{
+		{"app_name", s.AppName},
+		{"source_type", string(s.SourceType)},
+		{"repo_url", s.RepoURL},
+		{"branch", s.Branch},
+		{"docker_image", s.DockerImage},
+		{"manual_path", s.ManualPath},
+		{"build_type", s.BuildType},
+		{"build_cmd", s.BuildCmd},
+		{"start_cmd", s.StartCmd},
+		{"cluster_type", string(s.ClusterType)},
+		{"image", s.Image},
+		{"namespace", s.Namespace},
+		{"replicas", fmt.Sprint(s.Replicas)},
+		{"port", fmt.Sprint(s.Port)},
+		{"domain", s.Domain},
+		{"strategy", string(s.Strategy)},
+		{"update_policy", policy},
+		{"health_check", health},
+		{"pre_deploy_hook", preDeploy},
+		{"post_deploy_hook", postDeploy},
+		{"resources", resources},
+		{"volumes", strings.Join(volumes, ", ")},
+		{"environment_id", envID},
+	}
+}
+
+// DiffDeploymentSpecs returns the fields and env vars that changed from one
+// deployment spec to another. Env values are masked like env revisions.
+func DiffDeploymentSpecs(from, to model.DeploymentSpec) ([]SpecChange, model.EnvChanges) {
+	changes := []SpecChange{}
+	oldFields, newFields := specFields(from), specFields(to)
+	for i := range oldFields {
+		if oldFields[i][1] != newFields[i][1] {
+			changes = append(changes, SpecChange{
+				Field:    oldFields[i][0],
+				OldValue: oldFields[i][1],
+				NewValue: newFields[i][1],
+			})
+		}
+	}
+	return changes, DiffEnvVars(from.Env, to.Env)
+}
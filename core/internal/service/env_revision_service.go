@@ -0,0 +1,125 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/enochcodes/orchestra/core/internal/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// sensitiveKeyPattern matches variable names whose values are masked in
+// change lists even when they are not secret references.
+var sensitiveKeyPattern = regexp.MustCompile(`(?i)(pass(word|wd)?|secret|token|api_?key|private|credential|auth)`)
+
+// MaskEnvValue returns the value as it may be shown in revision history.
+// Secret references are shown as-is since they carry no plaintext; values of
+// sensitive-looking keys are masked.
+func MaskEnvValue(key, value string) string {
+	if model.SecretRefPattern.MatchString(value) {
+		return value
+	}
+	if sensitiveKeyPattern.MatchString(key) {
+		return model.MaskedValue
+	}
+	return value
+}
+
+// MaskEnvVars applies MaskEnvValue to every variable.
+func MaskEnvVars(vars map[string]string) map[string]string {
+	out := make(map[string]string, len(vars))
+	for k, v := range vars {
+		out[k] = MaskEnvValue(k, v)
+	}
+	return out
+}
+
+// DiffEnvVars returns the masked, key-sorted changes needed to turn from into to.
+func DiffEnvVars(from, to map[string]string) model.EnvChanges {
+	changes := model.EnvChanges{}
+	for k, newValue := range to {
+		oldValue, existed := from[k]
+		switch {
+		case !existed:
+			changes = append(changes, model.EnvChange{Key: k, Action: model.EnvChangeAdded, NewValue: MaskEnvValue(k, newValue)})
+		case oldValue != newValue:
+			changes = append(changes, model.EnvChange{
+				Key:      k,
+				Action:   model.EnvChangeChanged,
+				OldValue: MaskEnvValue(k, oldValue),
+				NewValue: MaskEnvValue(k, newValue),
+			})
+		}
+	}
+	for k, oldValue := range from {
+		if _, ok := to[k]; !ok {
+			changes = append(changes, model.EnvChange{Key: k, Action: model.EnvChangeRemoved, OldValue: MaskEnvValue(k, oldValue)})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// RecordEnvRevision appends a revision to rev.Target's history if vars differ
+// from previous. rev carries the target, owner IDs, author and message; the
+// revision number, snapshot and change list are filled in here. It returns
+// nil without error when nothing changed.
+//
+// The number is taken while holding a lock on the Environment or
+// Application row that owns the history, so concurrent changes cannot take
+// the same one. Pass the transaction that saved the change as db, so the
+// change and its revision are committed together.
+func RecordEnvRevision(db *gorm.DB, rev model.EnvRevision, previous, vars map[string]string) (*model.EnvRevision, error) {
+	changes := DiffEnvVars(previous, vars)
+	if len(changes) == 0 && rev.RolledBackFrom == nil {
+		return nil, nil
+	}
+
+	snapshot := model.EnvVarMap{}
+	for k, v := range vars {
+		snapshot[k] = v
+	}
+	rev.Variables = snapshot
+	rev.Changes = changes
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := lockRevisionOwner(tx, rev); err != nil {
+			return err
+		}
+		var last int
+		if err := tx.Model(&model.EnvRevision{}).Where("target = ?", rev.Target).
+			Select("COALESCE(MAX(revision), 0)").Scan(&last).Error; err != nil {
+			return err
+		}
+		rev.Revision = last + 1
+		return tx.Create(&rev).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("record env revision: %w", err)
+	}
+	return &rev, nil
+}
+
+// lockRevisionOwner locks the row whose history rev belongs to until the
+// transaction ends.
+func lockRevisionOwner(tx *gorm.DB, rev model.EnvRevision) error {
+	locked := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id")
+	switch {
+	case rev.EnvironmentID != nil:
+		return locked.First(&model.Environment{}, *rev.EnvironmentID).Error
+	case rev.ApplicationID != nil:
+		return locked.First(&model.Application{}, *rev.ApplicationID).Error
+	}
+	return fmt.Errorf("revision of %s has no owner", rev.Target)
+}
+
+// GetEnvRevision loads one revision of a target's history.
+func GetEnvRevision(db *gorm.DB, target string, revision int) (*model.EnvRevision, error) {
+	var rev model.EnvRevision
+	if err := db.Preload("Author").Where("target = ? AND revision = ?", target, revision).First(&rev).Error; err != nil {
+		return nil, fmt.Errorf("revision %d not found: %w", revision, err)
+	}
+	return &rev, nil
+}
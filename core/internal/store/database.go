@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"github.com/enochcodes/orchestra/core/internal/model"
+	"github.com/enochcodes/orchestra/core/pkg/redact"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -15,13 +17,21 @@ import (
 const maxRetries = 15
 const retryDelay = 3 * time.Second
 
+// sqlLogger logs every statement with its values, so secrets in them are
+// masked.
+var sqlLogger = logger.New(log.New(redact.Writer(os.Stdout), "\r\n", log.LstdFlags), logger.Config{
+	SlowThreshold: 200 * time.Millisecond,
+	LogLevel:      logger.Info,
+	Colorful:      true,
+})
+
 // Connect establishes a connection to PostgreSQL and runs auto-migrations.
 func Connect(databaseURL string) (*gorm.DB, error) {
 	var db *gorm.DB
 	var err error
 	for i := 0; i < maxRetries; i++ {
 		db, err = gorm.Open(postgres.Open(databaseURL), &gorm.Config{
-			Logger:                                   logger.Default.LogMode(logger.Info),
+			Logger:                                   sqlLogger,
 			DisableForeignKeyConstraintWhenMigrating: true,
 		})
 		if err != nil {
@@ -74,10 +84,19 @@ func Connect(databaseURL string) (*gorm.DB, error) {
 		&model.Cluster{},
 		&model.Application{},
 		&model.ApplicationMembership{},
+		&model.AppVolume{},
 		&model.Deployment{},
+		&model.DeploymentStep{},
+		&model.DeploymentLogLine{},
+		&model.DeploymentLogArchive{},
 		&model.Activity{},
 		&model.Environment{},
 		&model.NginxConfig{},
+		&model.Secret{},
+		&model.EnvRevision{},
+		&model.EnvPushResult{},
+		&model.ExecSession{},
+		&model.AppCommandRun{},
 	}
 	for _, m := range modelsToMigrate {
 		if err := db.AutoMigrate(m); err != nil {
@@ -85,6 +104,16 @@ func Connect(databaseURL string) (*gorm.DB, error) {
 		}
 	}
 
+	// Indexes AutoMigrate cannot express.
+	indexes := []string{
+		`CREATE INDEX IF NOT EXISTS idx_deployment_log_lines_text ON deployment_log_lines USING GIN (to_tsvector('simple', text))`,
+	}
+	for _, idx := range indexes {
+		if err := db.Exec(idx).Error; err != nil {
+			log.Printf("Index warning: %v", err)
+		}
+	}
+
 	log.Println("Database migrations completed")
 	return db, nil
 }
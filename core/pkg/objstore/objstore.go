@@ -0,0 +1,59 @@
+// Package objstore stores blobs by key in a local directory or an
+// S3-compatible bucket.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrNotFound is returned by Get for a key that does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// Store puts, gets and deletes blobs by key. Keys use "/" as a separator.
+type Store interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// S3Credentials configure access to an S3-compatible store.
+type S3Credentials struct {
+	Endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// Open returns the store addressed by rawURL:
+//
+//	file:///var/lib/orchestra/logs  or  /var/lib/orchestra/logs
+//	s3://bucket/optional/prefix
+//
+// An empty rawURL means no store; Open returns nil.
+func Open(rawURL string, creds S3Credentials) (Store, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(rawURL, "/") {
+		return NewLocal(rawURL)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store URL: %w", err)
+	}
+	switch u.Scheme {
+	case "file":
+		return NewLocal(u.Path)
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("s3 store URL needs a bucket: s3://bucket/prefix")
+		}
+		return NewS3(u.Host, strings.Trim(u.Path, "/"), creds)
+	default:
+		return nil, fmt.Errorf("unsupported store URL scheme %q (want file or s3)", u.Scheme)
+	}
+}
@@ -0,0 +1,169 @@
+// Package redact masks secrets in text before it is stored, logged or
+// returned by the API.
+//
+// Two things are masked: values registered with Track while a task that
+// handles them runs, and anything matching a known credential pattern
+// (join tokens, access tokens, private keys, passwords in URLs and
+// KEY=VALUE assignments with a secret-looking name).
+package redact
+
+import (
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask replaces every redacted secret.
+const Mask = "[REDACTED]"
+
+// minTrackedLength is the shortest value Track masks. Shorter values such
+// as "true" or "3000" would mask ordinary output far more often than they
+// hide a secret.
+const minTrackedLength = 6
+
+// patterns match credentials by shape. Each match is replaced with repl,
+// which keeps the name of the credential readable where there is one.
+var patterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`), Mask},
+	{regexp.MustCompile(`K10[0-9a-f]{20,}::[^\s"'@]+`), Mask},                                   // K3s node token
+	{regexp.MustCompile(`SWMTKN-1-[0-9a-z]+-[0-9a-z]+`), Mask},                                  // Docker Swarm join token
+	{regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{30,}|github_pat_[A-Za-z0-9_]{30,})`), Mask}, // GitHub tokens
+	{regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}`), Mask},                                    // GitLab tokens
+	{regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), Mask},                                 // AWS access key IDs
+	{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]+`), Mask},  // JWTs
+	{regexp.MustCompile(`(?i)(\bbearer\s+)[A-Za-z0-9._~+/=-]{8,}`), "${1}" + Mask},
+	{regexp.MustCompile(`([a-z][a-z0-9+.-]*://[^:/@\s"']+:)[^@\s"'/]+@`), "${1}" + Mask + "@"}, // user:password@ in URLs
+	{regexp.MustCompile(`(https?://)[^:/@\s"']+@`), "${1}" + Mask + "@"},                       // token@ in HTTP URLs
+	{regexp.MustCompile(`(?i)(\b[A-Z0-9_]*(?:PASSWORD|PASSWD|SECRET|TOKEN|API_?KEY|ACCESS_?KEY|PRIVATE_?KEY|CREDENTIALS?)[A-Z0-9_]*=)[^\s"']+`), "${1}" + Mask},
+	{regexp.MustCompile(`(?i)(\b(?:client-key-data|password):[ \t]+)[^\s"']+`), "${1}" + Mask}, // kubeconfig and similar YAML
+}
+
+var (
+	mu      sync.RWMutex
+	tracked = map[string]int{} // value -> number of Track calls holding it
+	ordered []string           // tracked values, longest first
+)
+
+// Track registers secret values to mask until the returned release
+// function is called. Tasks track the secrets they handle for as long as
+// they run; tracking the same value twice is fine.
+func Track(values ...string) (release func()) {
+	var added []string
+	mu.Lock()
+	for _, v := range values {
+		for _, form := range forms(v) {
+			tracked[form]++
+			added = append(added, form)
+		}
+	}
+	reorder()
+	mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			mu.Lock()
+			for _, v := range added {
+				if tracked[v]--; tracked[v] <= 0 {
+					delete(tracked, v)
+				}
+			}
+			reorder()
+			mu.Unlock()
+		})
+	}
+}
+
+// forms returns the ways v may appear in output: as is, and URL-encoded.
+func forms(v string) []string {
+	v = strings.TrimSpace(v)
+	if len(v) < minTrackedLength {
+		return nil
+	}
+	out := []string{v}
+	if esc := url.QueryEscape(v); esc != v {
+		out = append(out, esc)
+	}
+	return out
+}
+
+// reorder rebuilds the longest-first list of tracked values, so a secret
+// that contains another is masked whole. mu must be held.
+func reorder() {
+	ordered = ordered[:0]
+	for v := range tracked {
+		ordered = append(ordered, v)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return len(ordered[i]) > len(ordered[j]) })
+}
+
+// String masks secrets in s.
+func String(s string) string {
+	if s == "" {
+		return s
+	}
+	mu.RLock()
+	for _, v := range ordered {
+		if strings.Contains(s, v) {
+			s = strings.ReplaceAll(s, v, Mask)
+		}
+	}
+	mu.RUnlock()
+	for _, p := range patterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// Error returns err with secrets masked from its message. The result still
+// wraps err, so errors.Is and errors.As see through it.
+func Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if masked := String(msg); masked != msg {
+		return &redactedError{msg: masked, err: err}
+	}
+	return err
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// Writer returns a writer that masks secrets in everything written to w.
+// It is meant for line-oriented output such as a log.Logger's, where each
+// Write is a whole message.
+func Writer(w io.Writer) io.Writer {
+	return writer{w}
+}
+
+type writer struct {
+	w io.Writer
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+var sensitiveName = regexp.MustCompile(`(?i)(PASSWORD|PASSWD|SECRET|TOKEN|API_?KEY|ACCESS_?KEY|PRIVATE_?KEY|CREDENTIAL|DSN|DATABASE_URL)`)
+
+// SensitiveName reports whether a variable called name likely holds a
+// credential.
+func SensitiveName(name string) bool {
+	return sensitiveName.MatchString(name)
+}
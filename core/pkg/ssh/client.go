@@ -2,9 +2,13 @@ package ssh
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -23,6 +27,7 @@ type Client struct {
 	port   int
 	user   string
 	client *ssh.Client
+	ctx    context.Context // aborts running commands when done; may be nil
 }
 
 // NormalizePEMKey fixes common PEM key formatting issues (extra line breaks, wrong wraps).
@@ -135,6 +140,52 @@ func NewClientWithPassword(host string, port int, user, password string) (*Clien
 
 // ExecuteCommand runs a command on the remote server and returns the result.
 func (c *Client) ExecuteCommand(cmd string) (*CommandResult, error) {
+	return c.run(cmd, nil, nil, true)
+}
+
+// Stream identifies which output of a remote command a line came from.
+type Stream string
+
+const (
+	Stdout Stream = "stdout"
+	Stderr Stream = "stderr"
+)
+
+// ExecuteCommandStream runs a command like ExecuteCommand, and also calls
+// onLine with each line of stdout and stderr as soon as it arrives. Calls
+// are never concurrent. The full output is still returned in the result.
+func (c *Client) ExecuteCommandStream(cmd string, onLine func(stream Stream, line string)) (*CommandResult, error) {
+	return c.run(cmd, nil, onLine, true)
+}
+
+// ExecuteCommandFollow runs a command like ExecuteCommandStream but keeps
+// none of its output: the result carries only the exit code. Use it for
+// commands that may run until cancelled, such as following a log.
+func (c *Client) ExecuteCommandFollow(cmd string, onLine func(stream Stream, line string)) (*CommandResult, error) {
+	return c.run(cmd, nil, onLine, false)
+}
+
+// ExecuteCommandWithInput runs a command with input streamed to its stdin.
+// Use it to hand sensitive data to a remote process without placing it on
+// the command line, where it would be visible in the process list.
+func (c *Client) ExecuteCommandWithInput(cmd string, input []byte) (*CommandResult, error) {
+	return c.run(cmd, bytes.NewReader(input), nil, true)
+}
+
+// WithContext returns a client sharing c's connection whose commands are
+// aborted when ctx is done: the running remote command is sent SIGTERM, its
+// session is closed, and it and every later command fail with ctx's error.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	bound := *c
+	bound.ctx = ctx
+	return &bound
+}
+
+func (c *Client) run(cmd string, stdin io.Reader, onLine func(Stream, string), keep bool) (*CommandResult, error) {
+	if c.ctx != nil && c.ctx.Err() != nil {
+		return &CommandResult{}, fmt.Errorf("command aborted: %w", c.ctx.Err())
+	}
+
 	session, err := c.client.NewSession()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create session: %w", err)
@@ -142,14 +193,43 @@ func (c *Client) ExecuteCommand(cmd string) (*CommandResult, error) {
 	defer session.Close()
 
 	var stdout, stderr bytes.Buffer
+	session.Stdin = stdin
 	session.Stdout = &stdout
 	session.Stderr = &stderr
+	if onLine != nil {
+		var mu sync.Mutex
+		outLines := &lineWriter{mu: &mu, stream: Stdout, onLine: onLine}
+		errLines := &lineWriter{mu: &mu, stream: Stderr, onLine: onLine}
+		defer outLines.flush()
+		defer errLines.flush()
+		session.Stdout = io.MultiWriter(&stdout, outLines)
+		session.Stderr = io.MultiWriter(&stderr, errLines)
+		if !keep {
+			session.Stdout, session.Stderr = outLines, errLines
+		}
+	}
+
+	if c.ctx != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-c.ctx.Done():
+				session.Signal(ssh.SIGTERM)
+				session.Close()
+			case <-done:
+			}
+		}()
+	}
 
 	err = session.Run(cmd)
 	result := &CommandResult{
 		Stdout: stdout.String(),
 		Stderr: stderr.String(),
 	}
+	if c.ctx != nil && c.ctx.Err() != nil {
+		return result, fmt.Errorf("command aborted: %w", c.ctx.Err())
+	}
 
 	if err != nil {
 		if exitErr, ok := err.(*ssh.ExitError); ok {
@@ -162,6 +242,59 @@ func (c *Client) ExecuteCommand(cmd string) (*CommandResult, error) {
 	return result, nil
 }
 
+// lineWriter splits what is written to it into lines and passes each
+// complete line to onLine. Writers sharing mu never call onLine at once.
+type lineWriter struct {
+	mu      *sync.Mutex
+	stream  Stream
+	onLine  func(Stream, string)
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexAny(w.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		// Progress output rewrites a line with \r; each rewrite is a line.
+		if line := string(w.partial[:i]); line != "" {
+			w.onLine(w.stream, line)
+		}
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush passes on a final line that had no newline.
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.onLine(w.stream, string(w.partial))
+		w.partial = nil
+	}
+}
+
+// WriteFile writes data to path on the remote server with the given mode,
+// creating the parent directory if needed. The file is created under a
+// restrictive umask so it is never readable by others, even briefly.
+func (c *Client) WriteFile(path string, data []byte, mode os.FileMode) error {
+	cmd := Shellf("umask 077 && mkdir -p -- \"$(dirname -- %s)\" && cat > %s && chmod %o -- %s",
+		path, path, mode.Perm(), path)
+	result, err := c.ExecuteCommandWithInput(cmd, data)
+	if err != nil {
+		return err
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("write %s: exit %d: %s", path, result.ExitCode, strings.TrimSpace(result.Stderr))
+	}
+	return nil
+}
+
 // Close terminates the SSH connection.
 func (c *Client) Close() error {
 	if c.client != nil {
@@ -0,0 +1,117 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Remote commands are run by the login shell, so every value placed in one
+// must be quoted. Build commands with Cmd, or with Shellf when they need
+// shell syntax such as pipes, redirections or &&; both quote every value
+// they are given. Only text wrapped in Raw is passed to the shell as is.
+
+// Raw is trusted shell text that Cmd and Shellf insert without quoting:
+// operators, redirections, or a command built and quoted elsewhere.
+type Raw string
+
+// Quote returns s as a single shell word that the shell passes on
+// literally. Words made only of characters with no special meaning are
+// left bare for readability; everything else is single-quoted.
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if isSafeWord(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func isSafeWord(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("_-+=.,/:@%", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Shellf formats a command line like fmt.Sprintf, quoting every string,
+// fmt.Stringer and error argument with Quote so it is one inert word.
+// Integers and other values are formatted as usual. The format itself is
+// trusted shell text; arguments of type Raw and *Command are inserted as is.
+func Shellf(format string, args ...interface{}) string {
+	quoted := make([]interface{}, len(args))
+	for i, a := range args {
+		quoted[i] = shellArg(a)
+	}
+	return fmt.Sprintf(format, quoted...)
+}
+
+func shellArg(a interface{}) interface{} {
+	switch v := a.(type) {
+	case Raw:
+		return string(v)
+	case *Command:
+		return v.String()
+	case string:
+		return Quote(v)
+	case []string:
+		words := make([]string, len(v))
+		for i, s := range v {
+			words[i] = Quote(s)
+		}
+		return strings.Join(words, " ")
+	case fmt.Stringer:
+		return Quote(v.String())
+	case error:
+		return Quote(v.Error())
+	default:
+		return a
+	}
+}
+
+// Command is a command line built one word at a time.
+type Command struct {
+	words []string
+}
+
+// Cmd starts a command line running name with args, each quoted.
+func Cmd(name string, args ...string) *Command {
+	c := &Command{}
+	return c.Arg(name).Arg(args...)
+}
+
+// Arg appends args, each quoted as one word.
+func (c *Command) Arg(args ...string) *Command {
+	for _, a := range args {
+		c.words = append(c.words, Quote(a))
+	}
+	return c
+}
+
+// Flag appends a flag and its value as two words, as in --name value. It
+// appends nothing when value is empty.
+func (c *Command) Flag(name, value string) *Command {
+	if value == "" {
+		return c
+	}
+	return c.Arg(name, value)
+}
+
+// Raw appends trusted shell text without quoting it.
+func (c *Command) Raw(text string) *Command {
+	if text != "" {
+		c.words = append(c.words, text)
+	}
+	return c
+}
+
+// String returns the command line.
+func (c *Command) String() string {
+	return strings.Join(c.words, " ")
+}
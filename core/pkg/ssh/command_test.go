@@ -0,0 +1,156 @@
+package ssh
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hostile are values an attacker might put in a branch, image, path, domain
+// or variable, each trying to run `touch pwned` in the working directory.
+var hostile = []string{
+	"main; touch pwned",
+	"main && touch pwned",
+	"main || touch pwned",
+	"main | touch pwned",
+	"$(touch pwned)",
+	"`touch pwned`",
+	"${IFS}touch${IFS}pwned",
+	"'; touch pwned; '",
+	`"; touch pwned; "`,
+	`\'; touch pwned #`,
+	"main\ntouch pwned",
+	"main\rtouch pwned",
+	"-o ProxyCommand=touch pwned",
+	"--upload-pack=touch pwned",
+	"main > pwned",
+	"main < /etc/passwd",
+	"* ?",
+	"~root",
+	"!!",
+	"'''",
+	"",
+	"x'y\"z`$\\",
+}
+
+// run runs cmd with sh in a fresh directory and returns its stdout. It fails
+// the test if the command created anything in the directory.
+func run(t *testing.T, cmd string) string {
+	t.Helper()
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not available")
+	}
+	dir := t.TempDir()
+	c := exec.Command(sh, "-c", cmd)
+	c.Dir = dir
+	out, err := c.Output()
+	if err != nil {
+		t.Fatalf("%q: %v", cmd, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("%q created %s", cmd, filepath.Join(dir, e.Name()))
+	}
+	return string(out)
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", "''"},
+		{"main", "main"},
+		{"feature/x-1.2", "feature/x-1.2"},
+		{"user@host:repo.git", "user@host:repo.git"},
+		{"a b", "'a b'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+		{"a\nb", "'a\nb'"},
+	}
+	for _, tt := range tests {
+		if got := Quote(tt.in); got != tt.want {
+			t.Errorf("Quote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteIsInert(t *testing.T) {
+	for _, s := range hostile {
+		if got := run(t, "printf %s "+Quote(s)); got != s {
+			t.Errorf("printf %%s Quote(%q) printed %q", s, got)
+		}
+	}
+}
+
+func TestShellfIsInert(t *testing.T) {
+	for _, s := range hostile {
+		got := run(t, Shellf("printf '%%s|' %s %s && printf done", s, []string{s, "x"}))
+		if want := s + "|" + s + "|x|done"; got != want {
+			t.Errorf("Shellf with %q printed %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestShellfArgs(t *testing.T) {
+	err := errors.New("it's bad")
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"int", Shellf("sleep %d", 5), "sleep 5"},
+		{"error", Shellf("echo %s", err), `echo 'it'\''s bad'`},
+		{"raw", Shellf("ls %s", Raw("| wc -l")), "ls | wc -l"},
+		{"command", Shellf("%s || true", Cmd("rm", "a b")), "rm 'a b' || true"},
+		{"indexed", Shellf("docker stop %[1]s; docker rm %[1]s", "a;b"), "docker stop 'a;b'; docker rm 'a;b'"},
+		{"empty slice", Shellf("echo %s", []string{}), "echo "},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestCommandIsInert(t *testing.T) {
+	for _, s := range hostile {
+		cmd := Cmd("printf", "%s|").Arg(s).Flag("--flag", s).Raw("&& printf done")
+		got := run(t, cmd.String())
+		want := s + "|done"
+		if s != "" {
+			want = s + "|--flag|" + s + "|done"
+		}
+		if got != want {
+			t.Errorf("Cmd with %q printed %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestCommandString(t *testing.T) {
+	got := Cmd("docker", "run", "--name", "web").
+		Flag("--env-file", "").
+		Flag("--label", "orchestra.app=web").
+		Arg("nginx:1.27").
+		Raw("2>&1").
+		String()
+	want := "docker run --name web --label orchestra.app=web nginx:1.27 2>&1"
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestQuoteHasNoUnquotedMetacharacters(t *testing.T) {
+	for _, s := range hostile {
+		q := Quote(s)
+		if q == s && strings.ContainsAny(s, " \t\n;&|<>()$`\\\"'*?[]#~!{}") {
+			t.Errorf("Quote(%q) left it bare", s)
+		}
+	}
+}
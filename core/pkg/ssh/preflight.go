@@ -103,7 +103,7 @@ func RunPreflightCheck(client *Client) (*PreflightReport, error) {
 	// 8. Check essential kernel modules
 	requiredModules := []string{"overlay", "br_netfilter"}
 	for _, mod := range requiredModules {
-		cmd := fmt.Sprintf("lsmod | grep -q %s && echo 'loaded' || echo 'not_loaded'", mod)
+		cmd := Shellf("lsmod | grep -q %s && echo 'loaded' || echo 'not_loaded'", mod)
 		result, err = client.ExecuteCommand(cmd)
 		if err != nil || strings.TrimSpace(result.Stdout) != "loaded" {
 			errors = append(errors, fmt.Sprintf("kernel module %s is not loaded", mod))
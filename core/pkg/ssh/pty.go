@@ -0,0 +1,88 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PTY is an interactive command attached to a remote pseudo-terminal. Read
+// returns what the terminal displays, stdout and stderr alike; Write types.
+type PTY struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+}
+
+// StartPTY starts cmd on a remote pseudo-terminal of cols by rows
+// characters, or the user's login shell when cmd is empty.
+func (c *Client) StartPTY(cmd string, cols, rows int) (*PTY, error) {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty("xterm-256color", rows, cols, modes); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("request pty: %w", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if cmd == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(cmd)
+	}
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("start %s: %w", cmd, err)
+	}
+	return &PTY{session: session, stdin: stdin, stdout: stdout}, nil
+}
+
+// Read reads terminal output.
+func (p *PTY) Read(b []byte) (int, error) { return p.stdout.Read(b) }
+
+// Write sends keystrokes to the terminal.
+func (p *PTY) Write(b []byte) (int, error) { return p.stdin.Write(b) }
+
+// Resize tells the remote side the terminal is now cols by rows.
+func (p *PTY) Resize(cols, rows int) error {
+	return p.session.WindowChange(rows, cols)
+}
+
+// Wait waits for the command to exit and returns its exit code. The code
+// is -1 when the command did not exit normally, e.g. it was killed or the
+// connection dropped.
+func (p *PTY) Wait() (int, error) {
+	err := p.session.Wait()
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.As(err, &exitErr):
+		return exitErr.ExitStatus(), nil
+	default:
+		return -1, err
+	}
+}
+
+// Close hangs up the terminal, ending the command.
+func (p *PTY) Close() error {
+	p.session.Signal(ssh.SIGHUP)
+	return p.session.Close()
+}